@@ -1,22 +1,64 @@
 package cli
 
 import (
+	"io"
 	"os"
+	"time"
 
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/capture"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client/sinks/stdout"
 	stui "github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client/sinks/tui"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/cover"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/service"
 	"github.com/spf13/cobra"
 )
 
 var (
-	logLevel  string
+	logLevel     string
+	logFormat    string
+	logFile      = logger.DefaultFileConfig()
+	logMaxSizeMB int64
+
 	onionPath string
 	dest      string
 	payload   string
 
 	tui bool
 
+	mixClass   uint8
+	redundancy uint8
+
+	useSphinx bool
+	pqHybrid  bool
+
+	erasureK int
+	erasureN int
+
+	coverRate float64
+	coverHops int
+
+	ackListen  string
+	ackTimeout time.Duration
+	ackRetries int
+
+	hsdir string
+
+	unixDir string
+
+	pcapPath string
+
+	serviceDir     string
+	serviceListen  string
+	serviceGuard   string
+	serviceIntro   string
+	serviceRefresh time.Duration
+
 	rootCommand = &cobra.Command{
 		Use:   "dorc",
 		Short: "Dynamic Onion Routing client",
@@ -42,6 +84,49 @@ func init() {
 		"info",
 		"Set log level [debug, info, warn, error, off]",
 	)
+
+	rootCommand.Flags().StringVar(
+		&logFormat,
+		"log-format",
+		"text",
+		"Set log format [text, json]",
+	)
+
+	rootCommand.Flags().StringVar(&logFile.Path,
+		"log-file",
+		"",
+		"Also write the logs, without colors, to this file",
+	)
+
+	rootCommand.Flags().Int64Var(&logMaxSizeMB,
+		"log-max-size",
+		logFile.MaxSize>>20,
+		"Rotate the log file past this size in MiB (0 = no size rotation)",
+	)
+
+	rootCommand.Flags().DurationVar(&logFile.RotateEvery,
+		"log-rotate-every",
+		logFile.RotateEvery,
+		"Rotate the log file on this period, 24h rotating at midnight UTC (0 = no time rotation)",
+	)
+
+	rootCommand.Flags().IntVar(&logFile.MaxBackups,
+		"log-max-backups",
+		logFile.MaxBackups,
+		"Number of rotated log files kept (0 = all)",
+	)
+
+	rootCommand.Flags().DurationVar(&logFile.MaxAge,
+		"log-max-age",
+		logFile.MaxAge,
+		"Delete rotated log files older than this (0 = never)",
+	)
+
+	rootCommand.Flags().BoolVar(&logFile.Compress,
+		"log-compress",
+		logFile.Compress,
+		"Gzip rotated log files",
+	)
 	rootCommand.Flags().StringVar(&onionPath,
 		"onion-path",
 		"",
@@ -50,7 +135,7 @@ func init() {
 	rootCommand.Flags().StringVar(&dest,
 		"dest",
 		"",
-		"Final IP. e.g. 8.8.8.8:63",
+		"Final destination, resolved by the exit if a domain. e.g. 8.8.8.8:63 or example.com:443",
 	)
 	rootCommand.Flags().StringVar(&payload,
 		"payload",
@@ -63,16 +148,241 @@ func init() {
 		false,
 		"Enable TUI mode",
 	)
+
+	rootCommand.Flags().Uint8Var(&mixClass,
+		"mix-class",
+		0,
+		"Delay class requested from mixing relays (0-15, 0 = relay default)",
+	)
+
+	rootCommand.Flags().Uint8Var(&redundancy,
+		"redundancy",
+		1,
+		"Relays of each group getting the packet in parallel (1-3, 1 = failover only)",
+	)
+
+	rootCommand.Flags().BoolVar(&useSphinx,
+		"sphinx",
+		false,
+		"Send constant-size Sphinx packets through the first relay of each group instead of onions",
+	)
+
+	rootCommand.Flags().BoolVar(&pqHybrid,
+		"pq-hybrid",
+		false,
+		"Derive layer keys from both X25519 and ML-KEM-768 (every relay needs an ML-KEM key)",
+	)
+
+	rootCommand.Flags().IntVar(&erasureN,
+		"erasure-n",
+		0,
+		"Split the payload into n Reed-Solomon shares sent through different relays (0 = disabled)",
+	)
+	rootCommand.Flags().IntVar(&erasureK,
+		"erasure-k",
+		2,
+		"Number of shares needed by the exit relay to rebuild the payload",
+	)
+
+	rootCommand.Flags().Float64Var(&coverRate,
+		"cover-rate",
+		0,
+		"Cover onions per second sent through the known relays in TUI mode (0 = none)",
+	)
+	rootCommand.Flags().IntVar(&coverHops,
+		"cover-hops",
+		cover.DefaultHops,
+		"Number of relays crossed by cover onions",
+	)
+
+	rootCommand.Flags().StringVar(&ackListen,
+		"ack-listen",
+		"",
+		"Endpoint receiving delivery acks from the reply onions, e.g. 127.0.0.1:62600 (empty = no acks)",
+	)
+	rootCommand.Flags().DurationVar(&ackTimeout,
+		"ack-timeout",
+		client.DefaultAckTimeout,
+		"Time to wait for the delivery ack of a message before retrying",
+	)
+	rootCommand.Flags().IntVar(&ackRetries,
+		"ack-retries",
+		client.DefaultAckRetries,
+		"Retries over a fresh path for messages not acknowledged in time",
+	)
+
+	rootCommand.Flags().StringVar(&hsdir,
+		"hsdir",
+		"",
+		"Relay storing hidden service descriptors, needed to reach or host a .dor service",
+	)
+
+	rootCommand.Flags().StringVar(&unixDir,
+		"unix-dir",
+		"",
+		"Reach relays, and listen, over Unix sockets in this directory instead of TCP",
+	)
+
+	rootCommand.Flags().StringVar(&pcapPath,
+		"pcap",
+		"",
+		"Write every DOR packet sent and received to this pcapng file, for Wireshark",
+	)
+
+	rootCommand.Flags().StringVar(&serviceDir,
+		"service-dir",
+		"",
+		"Host the hidden service whose keys are in this directory instead of sending a payload",
+	)
+	rootCommand.Flags().StringVar(&serviceListen,
+		"service-listen",
+		"",
+		"Endpoint where the guard relay hands data to the hosted service, e.g. 127.0.0.1:62700",
+	)
+	rootCommand.Flags().StringVar(&serviceGuard,
+		"service-guard",
+		"",
+		"Guard relay of the hosted service, the only relay learning its address",
+	)
+	rootCommand.Flags().StringVar(&serviceIntro,
+		"service-intro",
+		"",
+		"Comma-separated introduction relays of the hosted service",
+	)
+	rootCommand.Flags().DurationVar(&serviceRefresh,
+		"service-refresh",
+		service.DefaultRefresh,
+		"Interval between renewals of the hosted service registrations",
+	)
 }
 
 func Run(cmd *cobra.Command, args []string) {
+	logger.SetLevel(logger.ParseLevel(logLevel))
+	logger.SetFormat(logger.ParseFormat(logFormat))
+	if tui {
+		// The TUI owns the terminal: only --log-file gets the logs.
+		logger.SetOutput(io.Discard)
+	}
+	if logFile.Path != "" {
+		logFile.MaxSize = logMaxSizeMB << 20
+		f, err := logger.OpenFile(logFile)
+		if err != nil {
+			cmd.PrintErrf("Err: cannot open --log-file: %v\n", err)
+			os.Exit(1)
+		}
+		logger.AddOutput(f, false)
+		defer func() {
+			if err := f.Close(); err != nil {
+				cmd.PrintErrln("Log file:", err)
+			}
+		}()
+	}
+
 	ic := client.InputConfig{
 		OnionPath: onionPath,
 		Dest:      dest,
 		Payload:   payload,
 	}
 
-	c := client.New()
+	if mixClass > onion.MaxMixDelayClass {
+		cmd.PrintErrf("Err: --mix-class must be between 0 and %d.\n", onion.MaxMixDelayClass)
+		os.Exit(1)
+	}
+
+	if redundancy < 1 || redundancy > onion.MaxWrappedKey {
+		cmd.PrintErrf("Err: --redundancy must be between 1 and %d.\n", onion.MaxWrappedKey)
+		os.Exit(1)
+	}
+
+	if erasureN != 0 && (erasureK < 1 || erasureK > erasureN || erasureN > onion.MaxWrappedKey) {
+		cmd.PrintErrf("Err: erasure coding needs 1 <= --erasure-k <= --erasure-n <= %d.\n", onion.MaxWrappedKey)
+		os.Exit(1)
+	}
+
+	if useSphinx && (redundancy > 1 || erasureN != 0 || ackListen != "") {
+		cmd.PrintErrln("Err: --sphinx cannot be combined with --redundancy, --erasure-n or --ack-listen.")
+		os.Exit(1)
+	}
+
+	if coverRate > 0 && useSphinx {
+		cmd.PrintErrln("Err: --cover-rate cannot be combined with --sphinx: cover onions would not look like Sphinx packets.")
+		os.Exit(1)
+	}
+
+	if pqHybrid && useSphinx {
+		cmd.PrintErrln("Err: --pq-hybrid cannot be combined with --sphinx.")
+		os.Exit(1)
+	}
+
+	if coverRate > 0 && !tui {
+		cmd.PrintErrln("Err: --cover-rate needs --tui: the stdout client exits once its message is sent.")
+		os.Exit(1)
+	}
+
+	var acks client.AckConfig
+	if ackListen != "" {
+		ep, err := identity.ParseEpFromString(ackListen)
+		if err != nil {
+			cmd.PrintErrf("Err: invalid --ack-listen: %v\n", err)
+			os.Exit(1)
+		}
+		acks = client.AckConfig{Listen: ep, Timeout: ackTimeout, Retries: ackRetries}
+	}
+
+	var opts []client.Option
+	if hsdir != "" {
+		ep, err := identity.ParseEpFromString(hsdir)
+		if err != nil {
+			cmd.PrintErrf("Err: invalid --hsdir: %v\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, client.WithHSDir(ep))
+	}
+	if useSphinx {
+		opts = append(opts, client.WithSphinx())
+	}
+	if pqHybrid {
+		opts = append(opts, client.WithHybridKEM())
+	}
+	if unixDir != "" {
+		unix := transport.Unix{Dir: unixDir}
+		opts = append(opts, client.WithDialer(unix), client.WithListener(unix))
+	}
+
+	if pcapPath != "" {
+		var capOpts []capture.Option
+		if acks.Listen.IP != nil {
+			capOpts = append(capOpts, capture.WithLocal(acks.Listen))
+		}
+		w, err := capture.Create(pcapPath, capOpts...)
+		if err != nil {
+			cmd.PrintErrf("Err: cannot create --pcap file: %v\n", err)
+			os.Exit(1)
+		}
+		packet.SetTap(w.Frame)
+		defer func() {
+			packet.SetTap(nil)
+			if err := w.Close(); err != nil {
+				cmd.PrintErrln("Packet capture incomplete:", err)
+			}
+		}()
+	}
+
+	c := client.New(append([]client.Option{
+		client.WithMixDelay(mixClass),
+		client.WithRedundancy(redundancy),
+		client.WithErasure(erasureK, erasureN),
+		client.WithCover(client.CoverConfig{Rate: coverRate, Hops: coverHops}),
+		client.WithAcks(acks),
+	}, opts...)...)
+
+	if serviceDir != "" {
+		if err := runService(c); err != nil {
+			cmd.PrintErrln("Error running service:", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	type Sinker interface {
 		Start() error
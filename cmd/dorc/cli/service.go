@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/service"
+)
+
+func parseRelay(flag, raw string) (identity.Relay, error) {
+	ep, err := identity.ParseEpFromString(strings.TrimSpace(raw))
+	if err != nil {
+		return identity.Relay{}, fmt.Errorf("invalid --%s: %w", flag, err)
+	}
+	return identity.Relay{Ep: ep}, nil
+}
+
+// runService hosts the hidden service of --service-dir until interrupted,
+// printing the messages it receives.
+func runService(c *client.Client) error {
+	si, err := identity.LoadServiceIdentity(serviceDir)
+	if err != nil {
+		return err
+	}
+
+	cfg := service.Config{Identity: si, Refresh: serviceRefresh}
+
+	if cfg.Listen, err = identity.ParseEpFromString(serviceListen); err != nil {
+		return fmt.Errorf("invalid --service-listen: %w", err)
+	}
+	if cfg.Guard, err = parseRelay("service-guard", serviceGuard); err != nil {
+		return err
+	}
+	if cfg.HSDir, err = parseRelay("hsdir", hsdir); err != nil {
+		return err
+	}
+	for raw := range strings.SplitSeq(serviceIntro, ",") {
+		r, err := parseRelay("service-intro", raw)
+		if err != nil {
+			return err
+		}
+		cfg.Intro = append(cfg.Intro, r)
+	}
+	if onionPath != "" {
+		if cfg.Path, err = identity.ParseRelayPath(onionPath); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for ev := range c.Events() {
+			switch ev.Type {
+			case client.EvLog:
+				logger.Infof("%v", ev.Payload)
+			case client.EvErr:
+				logger.Errorf("%v", ev.Payload)
+			}
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	svc := service.New(c, cfg, func(msg []byte) {
+		fmt.Printf("[MSG] %q\n", msg)
+	})
+	logger.Infof("Hosting %s", svc.Address())
+
+	err = svc.Run(ctx)
+	c.Close()
+	return err
+}
@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/inspect"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+var (
+	format string
+	idDirs []string
+
+	decodeCommand = &cobra.Command{
+		Use:   "decode [file]",
+		Short: "Peel captured onion cells",
+		Long: `Peel captured onion cells with the keys of relays.
+
+The capture is a 4096-byte cell or OnionPacket frame, in binary or hex, or a
+pcap capture whose TCP streams are searched for OnionPackets. It is read from
+file, or from stdin when file is "-" or missing.
+
+Each --id-dir adds the identity of a relay, as written by dord. The layers
+these relays can open are decrypted, and the first one none of them opens is
+printed as is.
+`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: runDecode,
+	}
+)
+
+func init() {
+	decodeCommand.Flags().StringVar(&format,
+		"format",
+		inspect.FormatAuto,
+		"Capture format [auto, hex, bin, pcap]",
+	)
+	decodeCommand.Flags().StringArrayVar(&idDirs,
+		"id-dir",
+		nil,
+		"Identity directory of a relay whose layers to peel (repeatable)",
+	)
+}
+
+func runDecode(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+
+	data, err := readInput(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	var ids []*identity.PrivateIdentity
+	for _, dir := range idDirs {
+		pi, err := identity.ReadPrivateIdentity(dir)
+		if err != nil {
+			return fmt.Errorf("identity %s: %w", dir, err)
+		}
+		ids = append(ids, pi)
+	}
+
+	cells, err := inspect.ReadCells(data, format)
+	if err != nil {
+		return err
+	}
+	if len(cells) == 0 {
+		return fmt.Errorf("no onion cell found")
+	}
+
+	out := cmd.OutOrStdout()
+	for i, c := range cells {
+		if i > 0 {
+			_, _ = fmt.Fprintln(out)
+		}
+		if c.Source != "" {
+			_, _ = fmt.Fprintf(out, "=== %s\n", c.Source)
+		}
+
+		var layers []inspect.Layer
+		if c.Envelope != nil {
+			layers, err = inspect.PeelHybrid(c.Data, *c.Envelope, ids)
+		} else {
+			layers, err = inspect.Peel(c.Data, ids)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "%v\n", err)
+			continue
+		}
+		if err := inspect.Fprint(out, layers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readInput(cmd *cobra.Command, args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return io.ReadAll(cmd.InOrStdin())
+	}
+	return os.ReadFile(args[0])
+}
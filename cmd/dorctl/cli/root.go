@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var rootCommand = &cobra.Command{
+	Use:   "dorctl",
+	Short: "Dynamic Onion Routing tooling",
+	Long: `Dynamic Onion Routing Control (dorctl)
+
+Offline tools to debug the Dynamic Onion Routing protocol.
+`,
+}
+
+func Execute() {
+	if err := rootCommand.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	rootCommand.AddCommand(decodeCommand)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/cmd/dorctl/cli"
+
+func main() {
+	cli.Execute()
+}
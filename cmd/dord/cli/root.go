@@ -2,15 +2,22 @@ package cli
 
 import (
 	"context"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/capture"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/server"
 )
 
@@ -19,7 +26,37 @@ var (
 	port  uint16
 	idDir string
 
-	logLevel string
+	logLevel      string
+	logFormat     string
+	unsafeLogging bool
+
+	logFile      = logger.DefaultFileConfig()
+	logMaxSizeMB int64
+
+	limits      = server.DefaultLimits()
+	limitExempt []string
+
+	workers   int
+	queueSize int
+
+	mix     = server.DefaultMixConfig()
+	mixMode string
+
+	coverCfg   = server.DefaultCoverConfig()
+	coverPeers []string
+
+	dedupSize int
+	dedupTTL  time.Duration
+
+	unixDir string
+
+	pcapPath string
+
+	exitPolicy       string
+	exitAllowPrivate bool
+	exitResolver     string
+
+	untaggedSlots bool
 
 	rootCommand = &cobra.Command{
 		Use:   "dord",
@@ -70,11 +107,284 @@ func init() {
 		"info",
 		"Log level (debug, info, warn, error, off)",
 	)
+
+	rootCommand.Flags().StringVar(
+		&logFormat,
+		"log-format",
+		"text",
+		"Log format (text, json); json writes one object per line with the correlation fields",
+	)
+
+	rootCommand.Flags().BoolVar(
+		&unsafeLogging,
+		"unsafe-logging",
+		false,
+		"Log addresses, keys and next hops in clear instead of daily-keyed hashes (de-anonymizes users)",
+	)
+
+	rootCommand.Flags().StringVar(
+		&logFile.Path,
+		"log-file",
+		"",
+		"Also write the logs, without colors, to this file",
+	)
+
+	rootCommand.Flags().Int64Var(
+		&logMaxSizeMB,
+		"log-max-size",
+		logFile.MaxSize>>20,
+		"Rotate the log file past this size in MiB (0 = no size rotation)",
+	)
+
+	rootCommand.Flags().DurationVar(
+		&logFile.RotateEvery,
+		"log-rotate-every",
+		logFile.RotateEvery,
+		"Rotate the log file on this period, 24h rotating at midnight UTC (0 = no time rotation)",
+	)
+
+	rootCommand.Flags().IntVar(
+		&logFile.MaxBackups,
+		"log-max-backups",
+		logFile.MaxBackups,
+		"Number of rotated log files kept (0 = all)",
+	)
+
+	rootCommand.Flags().DurationVar(
+		&logFile.MaxAge,
+		"log-max-age",
+		logFile.MaxAge,
+		"Delete rotated log files older than this (0 = never)",
+	)
+
+	rootCommand.Flags().BoolVar(
+		&logFile.Compress,
+		"log-compress",
+		logFile.Compress,
+		"Gzip rotated log files",
+	)
+
+	rootCommand.Flags().IntVar(
+		&limits.MaxConns,
+		"max-conns",
+		limits.MaxConns,
+		"Maximum concurrent connections (0 = unlimited)",
+	)
+
+	rootCommand.Flags().IntVar(
+		&limits.MaxConnsPerSource,
+		"max-conns-per-source",
+		limits.MaxConnsPerSource,
+		"Maximum concurrent connections per source prefix (0 = unlimited)",
+	)
+
+	rootCommand.Flags().IntVar(
+		&limits.SourcePrefixV4,
+		"source-prefix-v4",
+		limits.SourcePrefixV4,
+		"IPv4 prefix length grouping sources for per-source limits",
+	)
+
+	rootCommand.Flags().IntVar(
+		&limits.SourcePrefixV6,
+		"source-prefix-v6",
+		limits.SourcePrefixV6,
+		"IPv6 prefix length grouping sources for per-source limits",
+	)
+
+	rootCommand.Flags().Float64Var(
+		&limits.PacketRate,
+		"packet-rate",
+		limits.PacketRate,
+		"Sustained packets per second allowed per source (0 = unlimited)",
+	)
+
+	rootCommand.Flags().IntVar(
+		&limits.PacketBurst,
+		"packet-burst",
+		limits.PacketBurst,
+		"Packet burst allowed per source above the sustained rate",
+	)
+
+	rootCommand.Flags().IntVar(
+		&limits.MaxInFlight,
+		"max-inflight",
+		limits.MaxInFlight,
+		"Maximum packets processed at once across all connections (0 = unlimited)",
+	)
+
+	rootCommand.Flags().StringSliceVar(
+		&limitExempt,
+		"limit-exempt",
+		nil,
+		"Addresses or prefixes, such as upstream relays, exempt from the per-source limits. e.g. 203.0.113.7,2001:db8::/32",
+	)
+
+	rootCommand.Flags().IntVar(
+		&workers,
+		"workers",
+		server.DefaultWorkers(),
+		"Number of workers processing onion packets",
+	)
+
+	rootCommand.Flags().IntVar(
+		&queueSize,
+		"queue-size",
+		4*server.DefaultWorkers(),
+		"Onion packets queued for the workers before reads are paused",
+	)
+
+	rootCommand.Flags().IntVar(
+		&dedupSize,
+		"dedup-size",
+		server.DefaultDedupSize,
+		"Onion layers remembered to drop parallel copies (0 = disabled)",
+	)
+
+	rootCommand.Flags().DurationVar(
+		&dedupTTL,
+		"dedup-ttl",
+		server.DefaultDedupTTL,
+		"How long an onion layer is remembered",
+	)
+
+	rootCommand.Flags().StringVar(
+		&mixMode,
+		"mix",
+		mix.Mode.String(),
+		"Mix strategy for relayed packets (none, poisson, timed)",
+	)
+
+	rootCommand.Flags().DurationVar(
+		&mix.MeanDelay,
+		"mix-delay",
+		mix.MeanDelay,
+		"Poisson mix: mean delay of packets requesting no delay class",
+	)
+
+	rootCommand.Flags().DurationVar(
+		&mix.ClassUnit,
+		"mix-class-unit",
+		mix.ClassUnit,
+		"Poisson mix: mean delay per delay class requested by a packet",
+	)
+
+	rootCommand.Flags().DurationVar(
+		&mix.MaxDelay,
+		"mix-max-delay",
+		mix.MaxDelay,
+		"Poisson mix: upper bound of any delay (0 = none)",
+	)
+
+	rootCommand.Flags().IntVar(
+		&mix.Threshold,
+		"mix-threshold",
+		mix.Threshold,
+		"Timed mix: pooled packets triggering an early flush (0 = timer only)",
+	)
+
+	rootCommand.Flags().DurationVar(
+		&mix.Interval,
+		"mix-interval",
+		mix.Interval,
+		"Timed mix: flush period",
+	)
+
+	rootCommand.Flags().Float64Var(
+		&coverCfg.LoopRate,
+		"cover-loop-rate",
+		coverCfg.LoopRate,
+		"Loop cover onions per second, coming back to this relay (0 = none)",
+	)
+
+	rootCommand.Flags().Float64Var(
+		&coverCfg.DropRate,
+		"cover-drop-rate",
+		coverCfg.DropRate,
+		"Drop cover onions per second, discarded by a peer (0 = none)",
+	)
+
+	rootCommand.Flags().IntVar(
+		&coverCfg.Hops,
+		"cover-hops",
+		coverCfg.Hops,
+		"Number of relays crossed by cover onions",
+	)
+
+	rootCommand.Flags().StringSliceVar(
+		&coverPeers,
+		"cover-peers",
+		nil,
+		"Relays used to route cover onions. e.g. [::1]:62504,127.0.0.1:62505",
+	)
+
+	rootCommand.Flags().StringVar(
+		&unixDir,
+		"unix-dir",
+		"",
+		"Listen, and reach other relays, over Unix sockets in this directory instead of TCP",
+	)
+
+	rootCommand.Flags().StringVar(
+		&pcapPath,
+		"pcap",
+		"",
+		"Write every DOR packet sent and received to this pcapng file, for Wireshark (needs --unsafe-logging)",
+	)
+
+	rootCommand.Flags().StringVar(
+		&exitPolicy,
+		"exit-policy",
+		"accept *:*",
+		"Comma separated rules for the destinations delivered to as exit, first match wins. e.g. \"reject *:25, accept 203.0.113.0/24:80-443, reject6 *:*\"",
+	)
+
+	rootCommand.Flags().BoolVar(
+		&exitAllowPrivate,
+		"exit-allow-private",
+		false,
+		"Deliver to loopback, private and link-local destinations as exit",
+	)
+
+	rootCommand.Flags().StringVar(
+		&exitResolver,
+		"exit-resolver",
+		"",
+		"DNS server resolving the domain destinations delivered to as exit, instead of the system one. e.g. 9.9.9.9:53",
+	)
+
+	rootCommand.Flags().BoolVar(
+		&untaggedSlots,
+		"untagged-slots",
+		false,
+		"Also accept onions from clients predating wrapped key tags, trying every key slot of the layers (slower)",
+	)
 }
 
 func Run(cmd *cobra.Command, args []string) {
 	lvl := logger.ParseLevel(logLevel)
 	logger.SetLevel(lvl)
+	logger.SetFormat(logger.ParseFormat(logFormat))
+	if logFile.Path != "" {
+		logFile.MaxSize = logMaxSizeMB << 20
+		f, err := logger.OpenFile(logFile)
+		if err != nil {
+			logger.Fatalf("Cannot open --log-file: %v", err)
+		}
+		logger.AddOutput(f, false)
+		defer func() {
+			if err := f.Close(); err != nil {
+				logger.Warnf("Log file incomplete: %v", err)
+			}
+		}()
+	}
+	if unsafeLogging {
+		logger.SetPrivacy(logger.Unsafe)
+		logger.Warnf("Unsafe logging enabled: addresses, keys and next hops are logged in clear")
+	}
+	if pcapPath != "" && !unsafeLogging {
+		logger.Fatalf("--pcap records peer addresses, ports and timings in clear: it needs --unsafe-logging")
+	}
 
 	if strings.HasPrefix(idDir, "~") {
 		home, err := os.UserHomeDir()
@@ -85,7 +395,74 @@ func Run(cmd *cobra.Command, args []string) {
 	}
 	logger.Infof("Initializing DORD (Level: %s)", logLevel)
 
-	s, err := server.New(addr, idDir, port)
+	mode, err := server.ParseMixMode(mixMode)
+	if err != nil {
+		logger.Fatalf("Invalid --mix: %v", err)
+	}
+	mix.Mode = mode
+
+	for _, raw := range coverPeers {
+		ep, err := identity.ParseEpFromString(raw)
+		if err != nil {
+			logger.Fatalf("Invalid --cover-peers: %v", err)
+		}
+		if ep.IsDomain() {
+			logger.Fatalf("Invalid --cover-peers: relays are given by IP address")
+		}
+		coverCfg.Peers = append(coverCfg.Peers, ep)
+	}
+
+	for _, raw := range limitExempt {
+		p, err := parsePrefix(raw)
+		if err != nil {
+			logger.Fatalf("Invalid --limit-exempt: %v", err)
+		}
+		limits.Exempt = append(limits.Exempt, p)
+	}
+
+	exit, err := identity.ParseExitPolicy(exitPolicy, exitAllowPrivate)
+	if err != nil {
+		logger.Fatalf("Invalid --exit-policy: %v", err)
+	}
+	logger.Infof("Exit policy: %s", exit)
+
+	opts := []server.Option{
+		server.WithExitPolicy(exit),
+		server.WithResolver(newResolver(exitResolver)),
+		server.WithLimits(limits),
+		server.WithWorkers(workers, queueSize),
+		server.WithMix(mix),
+		server.WithCover(coverCfg),
+		server.WithDedup(dedupSize, dedupTTL),
+	}
+	if unixDir != "" {
+		unix := transport.Unix{Dir: unixDir}
+		opts = append(opts, server.WithListener(unix), server.WithDialer(unix))
+	}
+	if untaggedSlots {
+		opts = append(opts, server.WithUntaggedSlots())
+	}
+
+	if pcapPath != "" {
+		ep, err := identity.NewEndpoint(addr, port)
+		if err != nil {
+			logger.Fatalf("Invalid listen address: %v", err)
+		}
+		w, err := capture.Create(pcapPath, capture.WithLocal(ep))
+		if err != nil {
+			logger.Fatalf("Cannot create --pcap file: %v", err)
+		}
+		packet.SetTap(w.Frame)
+		defer func() {
+			packet.SetTap(nil)
+			if err := w.Close(); err != nil {
+				logger.Warnf("Packet capture incomplete: %v", err)
+			}
+		}()
+		logger.Infof("Capturing packets to %s", pcapPath)
+	}
+
+	s, err := server.New(addr, idDir, port, opts...)
 	if err != nil {
 		logger.Fatalf("Error initializing server: %v", err)
 	}
@@ -99,3 +476,39 @@ func Run(cmd *cobra.Command, args []string) {
 	}
 	logger.Infof("Sutdown complete.")
 }
+
+// newResolver returns a resolver querying the DNS server at addr, or the
+// system one when addr is empty.
+func newResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	if _, err := identity.ParseEpFromString(addr); err != nil {
+		logger.Fatalf("Invalid --exit-resolver: %v", err)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// parsePrefix parses a CIDR prefix, or a single address as a full-length one.
+func parsePrefix(raw string) (netip.Prefix, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "/") {
+		p, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
@@ -0,0 +1,320 @@
+// Package capture records the DOR frames of a process in a pcapng file, for
+// Wireshark and its DOR plugin. Frames are wrapped in synthesized TCP/IP
+// headers carrying the addresses of their connection, so no privileged
+// capture of the interfaces is needed.
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+const (
+	// maxSegment bounds the TCP payload of a synthesized segment, so that it
+	// fits an IP packet.
+	maxSegment = 65000
+
+	// flowIdle is how long a flow stays known without traffic. Frames of a
+	// forgotten flow start a new connection in the capture.
+	flowIdle = 2 * time.Minute
+
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// Writer writes frames to a pcapng file. It is safe for concurrent use.
+type Writer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	c     io.Closer
+	local identity.Endpoint
+	now   func() time.Time
+
+	flows    map[flowKey]*flow
+	lastScan time.Time
+	err      error
+}
+
+type Option func(*Writer)
+
+// WithLocal sets the endpoint standing for the process on connections whose
+// local address is not an IP one, such as Unix sockets. It defaults to
+// 127.0.0.1 with port 0; peers without an IP address are given loopback
+// addresses and ports derived from their address.
+func WithLocal(ep identity.Endpoint) Option {
+	return func(w *Writer) {
+		w.local = ep
+	}
+}
+
+// withClock sets the source of the timestamps, for tests.
+func withClock(now func() time.Time) Option {
+	return func(w *Writer) {
+		w.now = now
+	}
+}
+
+// NewWriter writes the header of a capture to w and returns a Writer adding
+// frames to it.
+func NewWriter(w io.Writer, opts ...Option) (*Writer, error) {
+	cw := &Writer{
+		w:     w,
+		local: identity.Endpoint{IP: net.IPv4(127, 0, 0, 1)},
+		now:   time.Now,
+		flows: make(map[flowKey]*flow),
+	}
+	for _, opt := range opts {
+		opt(cw)
+	}
+
+	if err := cw.writeHeader(); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Create creates the capture file at path, replacing any existing one.
+func Create(path string, opts ...Option) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := NewWriter(f, opts...)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	w.c = f
+	return w, nil
+}
+
+// Frame records a frame sent or received on conn. Its signature matches
+// packet.Tap. Write errors are kept for Close, the capture never failing the
+// connection.
+func (w *Writer) Frame(conn net.Conn, sent bool, frame []byte) {
+	src, dst := w.addr(conn.LocalAddr(), true), w.addr(conn.RemoteAddr(), false)
+	if !sent {
+		src, dst = dst, src
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return
+	}
+
+	now := w.now()
+	w.expire(now)
+
+	f, fwd := w.flow(src, dst, now)
+	out, in := &f.a, &f.b
+	if !fwd {
+		out, in = in, out
+	}
+
+	for len(frame) > 0 {
+		n := min(len(frame), maxSegment)
+		w.segment(now, src, dst, out.seq, in.seq, tcpPSH|tcpACK, frame[:n])
+		out.seq += uint32(n)
+		frame = frame[n:]
+	}
+	f.last = now
+}
+
+// Close flushes the capture and closes the file opened by Create. It returns
+// the first error met while writing.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.err
+	if w.c != nil {
+		err = errors.Join(err, w.c.Close())
+		w.c = nil
+	}
+	if w.err == nil {
+		w.err = errors.New("capture closed")
+	}
+	return err
+}
+
+// addr returns the IP endpoint standing for a connection address.
+func (w *Writer) addr(a net.Addr, local bool) identity.Endpoint {
+	if tcp, ok := a.(*net.TCPAddr); ok && tcp.IP != nil {
+		return identity.Endpoint{IP: tcp.IP, Port: uint16(tcp.Port)}
+	}
+	if local {
+		return w.local
+	}
+
+	var name string
+	if a != nil {
+		name = a.String()
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	sum := h.Sum32()
+
+	ip := net.IPv4(127, 0, 1, byte(sum>>16))
+	if w.local.IP.To4() == nil {
+		ip = net.ParseIP("::1")
+	}
+	return identity.Endpoint{IP: ip, Port: 49152 + uint16(sum%16384)}
+}
+
+// flowKey identifies a connection, its endpoints in a fixed order.
+type flowKey [2]string
+
+type flowSide struct {
+	seq uint32
+}
+
+// flow is a connection seen in the capture. a is the side of the endpoint
+// sorting first in its key.
+type flow struct {
+	a, b flowSide
+	last time.Time
+}
+
+// flow returns the flow from src to dst, and whether src is its a side. A new
+// flow starts with a synthesized handshake from src.
+func (w *Writer) flow(src, dst identity.Endpoint, now time.Time) (*flow, bool) {
+	ks, kd := src.String(), dst.String()
+	fwd := ks <= kd
+	key := flowKey{ks, kd}
+	if !fwd {
+		key = flowKey{kd, ks}
+	}
+
+	if f, ok := w.flows[key]; ok {
+		return f, fwd
+	}
+
+	f := &flow{}
+	out, in := &f.a, &f.b
+	if !fwd {
+		out, in = in, out
+	}
+	out.seq, in.seq = isn(ks, kd), isn(kd, ks)
+
+	w.segment(now, src, dst, out.seq, 0, tcpSYN, nil)
+	w.segment(now, dst, src, in.seq, out.seq+1, tcpSYN|tcpACK, nil)
+	out.seq++
+	in.seq++
+	w.segment(now, src, dst, out.seq, in.seq, tcpACK, nil)
+
+	w.flows[key] = f
+	return f, fwd
+}
+
+// expire forgets the flows idle for flowIdle, at most once per flowIdle.
+func (w *Writer) expire(now time.Time) {
+	if now.Sub(w.lastScan) < flowIdle {
+		return
+	}
+	w.lastScan = now
+
+	for key, f := range w.flows {
+		if now.Sub(f.last) >= flowIdle {
+			delete(w.flows, key)
+		}
+	}
+}
+
+func isn(src, dst string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(src + ">" + dst))
+	return h.Sum32()
+}
+
+// segment writes a TCP segment from src to dst.
+func (w *Writer) segment(now time.Time, src, dst identity.Endpoint, seq, ack uint32, flags uint8, payload []byte) {
+	if w.err != nil {
+		return
+	}
+	w.err = w.writePacket(now, ipPacket(src, dst, tcpSegment(src, dst, seq, ack, flags, payload)))
+}
+
+// tcpSegment returns a TCP segment with a valid checksum.
+func tcpSegment(src, dst identity.Endpoint, seq, ack uint32, flags uint8, payload []byte) []byte {
+	seg := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], src.Port)
+	binary.BigEndian.PutUint16(seg[2:4], dst.Port)
+	binary.BigEndian.PutUint32(seg[4:8], seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(seg[8:12], ack)
+	}
+	seg[12] = 5 << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:16], 65535)
+	seg = append(seg, payload...)
+
+	var pseudo []byte
+	if s4, d4 := src.IP.To4(), dst.IP.To4(); s4 != nil && d4 != nil {
+		pseudo = append(append(pseudo, s4...), d4...)
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(seg)))
+	} else {
+		pseudo = append(append(pseudo, src.IP.To16()...), dst.IP.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(seg)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(seg[16:18], checksum(pseudo, seg))
+	return seg
+}
+
+// ipPacket wraps seg in an IPv4 header, or an IPv6 one when either endpoint
+// is IPv6.
+func ipPacket(src, dst identity.Endpoint, seg []byte) []byte {
+	if s4, d4 := src.IP.To4(), dst.IP.To4(); s4 != nil && d4 != nil {
+		hdr := make([]byte, 20, 20+len(seg))
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(20+len(seg)))
+		hdr[6] = 0x40 // don't fragment
+		hdr[8] = 64
+		hdr[9] = 6
+		copy(hdr[12:16], s4)
+		copy(hdr[16:20], d4)
+		binary.BigEndian.PutUint16(hdr[10:12], checksum(hdr))
+		return append(hdr, seg...)
+	}
+
+	hdr := make([]byte, 40, 40+len(seg))
+	hdr[0] = 0x60
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(len(seg)))
+	hdr[6] = 6
+	hdr[7] = 64
+	copy(hdr[8:24], src.IP.To16())
+	copy(hdr[24:40], dst.IP.To16())
+	return append(hdr, seg...)
+}
+
+// checksum returns the Internet checksum of the concatenation of parts, each
+// but the last of even length.
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range parts {
+		for len(b) >= 2 {
+			sum += uint32(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		}
+		if len(b) == 1 {
+			sum += uint32(b[0]) << 8
+		}
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
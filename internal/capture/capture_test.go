@@ -0,0 +1,234 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/inspect"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+type fakeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *fakeConn) LocalAddr() net.Addr  { return c.local }
+func (c *fakeConn) RemoteAddr() net.Addr { return c.remote }
+
+func tcpConn(local, remote string) *fakeConn {
+	l, _ := net.ResolveTCPAddr("tcp", local)
+	r, _ := net.ResolveTCPAddr("tcp", remote)
+	return &fakeConn{local: l, remote: r}
+}
+
+func onionFrame(t *testing.T, fill byte) []byte {
+	t.Helper()
+
+	var p packet.OnionPacket
+	copy(p.Data[:], bytes.Repeat([]byte{fill}, onion.PacketSize))
+	var buf bytes.Buffer
+	if err := packet.WritePacket(nil, &buf, &p); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// blocks splits a little-endian pcapng capture into its blocks.
+func blocks(t *testing.T, data []byte) map[uint32][][]byte {
+	t.Helper()
+
+	out := make(map[uint32][][]byte)
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %d bytes left", len(data))
+		}
+		typ, total := binary.LittleEndian.Uint32(data), int(binary.LittleEndian.Uint32(data[4:]))
+		if total%4 != 0 || total > len(data) || binary.LittleEndian.Uint32(data[total-4:]) != uint32(total) {
+			t.Fatalf("invalid block length %d", total)
+		}
+		out[typ] = append(out[typ], data[8:total-4])
+		data = data[total:]
+	}
+	return out
+}
+
+func TestWriter_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		conn *fakeConn
+		src  string // address sending the first frame
+	}{
+		{"ipv4", tcpConn("10.0.0.1:40000", "10.0.0.2:62503"), "10.0.0.1:40000"},
+		{"ipv6", tcpConn("[fd00::1]:40000", "[fd00::2]:62503"), "[fd00::1]:40000"},
+		{
+			"unix socket",
+			&fakeConn{local: &net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, remote: &net.UnixAddr{Net: "unix"}},
+			"127.0.0.1:62503",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			local, err := identity.NewEndpoint("127.0.0.1", 62503)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, WithLocal(local))
+			if err != nil {
+				t.Fatalf("NewWriter() failed: %v", err)
+			}
+
+			first, reply, second := onionFrame(t, 1), onionFrame(t, 9), onionFrame(t, 2)
+			w.Frame(tt.conn, true, first)
+			w.Frame(tt.conn, false, reply)
+			w.Frame(tt.conn, true, second)
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() failed: %v", err)
+			}
+
+			bs := blocks(t, buf.Bytes())
+			if len(bs[blockSectionHeader]) != 1 || len(bs[blockInterface]) != 1 {
+				t.Fatalf("want one section and one interface, got %d and %d",
+					len(bs[blockSectionHeader]), len(bs[blockInterface]))
+			}
+			if got := len(bs[blockEnhancedPacket]); got != 6 {
+				t.Errorf("packet count mismatch:\n\tgot:  %d\n\twant: 6 (handshake and 3 frames)", got)
+			}
+			for i, epb := range bs[blockEnhancedPacket] {
+				pkt := epb[20 : 20+binary.LittleEndian.Uint32(epb[12:16])]
+				if !validChecksums(pkt) {
+					t.Errorf("packet %d: invalid checksum", i)
+				}
+			}
+
+			cells, err := inspect.ReadPcap(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("ReadPcap() failed: %v", err)
+			}
+			if len(cells) != 3 {
+				t.Fatalf("cell count mismatch:\n\tgot:  %d\n\twant: 3", len(cells))
+			}
+			want := []byte{1, 2} // fill of the cells sent from src, in order
+			for _, c := range cells {
+				if !strings.HasPrefix(c.Source, tt.src+" -> ") {
+					if !bytes.Equal(c.Data, reply[packet.HeaderSize:]) {
+						t.Errorf("%s: cell mismatch", c.Source)
+					}
+					continue
+				}
+				if len(want) == 0 || c.Data[0] != want[0] {
+					t.Errorf("%s: unexpected cell", c.Source)
+					continue
+				}
+				want = want[1:]
+			}
+			if len(want) != 0 {
+				t.Errorf("%d cells sent from %s missing", len(want), tt.src)
+			}
+		})
+	}
+}
+
+// validChecksums checks the IPv4 header and TCP checksums of pkt.
+func validChecksums(pkt []byte) bool {
+	var pseudo, seg []byte
+	if pkt[0]>>4 == 4 {
+		if checksum(pkt[:20]) != 0 {
+			return false
+		}
+		seg = pkt[20:]
+		pseudo = append(append(pseudo, pkt[12:20]...), 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(seg)))
+	} else {
+		seg = pkt[40:]
+		pseudo = append(pseudo, pkt[8:40]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(seg)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	return checksum(pseudo, seg) == 0
+}
+
+func TestWriter_LargeFrame(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, maxSegment+10)
+	w.Frame(tcpConn("10.0.0.1:1", "10.0.0.2:2"), true, frame)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(blocks(t, buf.Bytes())[blockEnhancedPacket]); got != 5 {
+		t.Errorf("packet count mismatch:\n\tgot:  %d\n\twant: 5 (handshake and 2 segments)", got)
+	}
+}
+
+func TestWriter_Expire(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, withClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := tcpConn("10.0.0.1:1", "10.0.0.2:2")
+	w.Frame(conn, true, []byte{1})
+	w.Frame(tcpConn("10.0.0.1:3", "10.0.0.2:2"), true, []byte{1})
+
+	now = now.Add(flowIdle / 2)
+	w.Frame(conn, true, []byte{2})
+
+	// The second flow is idle for longer than flowIdle, the first is not.
+	now = now.Add(flowIdle * 3 / 4)
+	w.Frame(conn, true, []byte{3})
+
+	w.mu.Lock()
+	if len(w.flows) != 1 {
+		t.Errorf("flow count mismatch:\n\tgot:  %d\n\twant: 1", len(w.flows))
+	}
+	w.mu.Unlock()
+
+	// A forgotten active flow would have started again with a handshake.
+	if got := len(blocks(t, buf.Bytes())[blockEnhancedPacket]); got != 10 {
+		t.Errorf("packet count mismatch:\n\tgot:  %d\n\twant: 10", got)
+	}
+}
+
+func TestWriter_Closed(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n := buf.Len()
+	w.Frame(tcpConn("10.0.0.1:1", "10.0.0.2:2"), true, []byte{1})
+	if buf.Len() != n {
+		t.Error("frame written after Close")
+	}
+}
@@ -0,0 +1,82 @@
+package capture
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// pcapng block types, see draft-ietf-opsawg-pcapng.
+const (
+	blockSectionHeader    = 0x0A0D0D0A
+	blockInterface        = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1A2B3C4D
+	linkTypeRaw           = 101 // IPv4 or IPv6 packets without link layer
+	snapLen               = 0   // no limit
+	optionEnd             = 0
+	optionInterfaceName   = 2
+	optionInterfaceTSResl = 9
+)
+
+// writeHeader writes the section header and the single interface of the
+// capture.
+func (w *Writer) writeHeader() error {
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	if err := w.writeBlock(blockSectionHeader, shb); err != nil {
+		return err
+	}
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, snapLen)
+	idb = appendOption(idb, optionInterfaceName, []byte("dor"))
+	idb = appendOption(idb, optionInterfaceTSResl, []byte{9}) // nanoseconds
+	idb = appendOption(idb, optionEnd, nil)
+	return w.writeBlock(blockInterface, idb)
+}
+
+// writePacket writes an IP packet captured at t.
+func (w *Writer) writePacket(t time.Time, pkt []byte) error {
+	ts := uint64(t.UnixNano())
+
+	epb := make([]byte, 0, 20+len(pkt)+3)
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // interface
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = append(epb, pkt...)
+	return w.writeBlock(blockEnhancedPacket, pad(epb))
+}
+
+func (w *Writer) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+
+	block := make([]byte, 0, total)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, total)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, total)
+
+	_, err := w.w.Write(block)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return pad(append(b, value...))
+}
+
+// pad pads b with zeros to a multiple of 4 bytes.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
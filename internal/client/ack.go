@@ -0,0 +1,323 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+const (
+	DefaultAckTimeout = 10 * time.Second
+	DefaultAckRetries = 2
+)
+
+// AckConfig configures delivery acknowledgements. The exit relay of every
+// message sends back a reply onion, through the forward path in reverse,
+// whose last relay hands an authenticated token to Listen.
+type AckConfig struct {
+	Listen  identity.Endpoint // disabled when the port is zero
+	Timeout time.Duration
+	Retries int // extra attempts over a fresh path
+}
+
+func (cfg AckConfig) enabled() bool {
+	return cfg.Listen.Port != 0
+}
+
+// WithAcks makes SendMessage wait for a delivery acknowledgement of every
+// message, and retry the undelivered ones.
+func WithAcks(cfg AckConfig) Option {
+	return func(c *Client) {
+		c.acks = cfg
+	}
+}
+
+type DeliveryStatus int
+
+const (
+	// StatusSent means the message left the client, acks being disabled.
+	StatusSent DeliveryStatus = iota
+	StatusDelivered
+	StatusTimedOut
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case StatusSent:
+		return "sent"
+	case StatusDelivered:
+		return "delivered"
+	case StatusTimedOut:
+		return "timed out"
+	default:
+		return fmt.Sprintf("DeliveryStatus(%d)", int(s))
+	}
+}
+
+// Delivery is the outcome of SendMessage.
+type Delivery struct {
+	ID       [16]byte // of the last attempt
+	Status   DeliveryStatus
+	RTT      time.Duration // of the acknowledged attempt
+	Attempts int
+}
+
+func (d Delivery) String() string {
+	if d.Status == StatusDelivered {
+		return fmt.Sprintf("message %x %s in %s (%d attempt(s))", d.ID[:4], d.Status, d.RTT.Round(time.Millisecond), d.Attempts)
+	}
+	return fmt.Sprintf("message %x %s (%d attempt(s))", d.ID[:4], d.Status, d.Attempts)
+}
+
+// ackState holds the acknowledgements awaited by the client.
+type ackState struct {
+	key [32]byte // authenticates the tokens carried by reply onions
+
+	once sync.Once
+	err  error // of the listener start
+
+	mu      sync.Mutex
+	pending map[[16]byte]chan time.Time
+}
+
+// SendMessage sends payload to dest through path, in a Sphinx packet if the
+// client was created with WithSphinx. With acks enabled it waits for the
+// acknowledgement of the exit relay and retries over a fresh path, rotating
+// the relays of every group and renewing the crypto material, until the
+// message is delivered or the retries run out.
+func (c *Client) SendMessage(dest identity.Endpoint, path []identity.CryptoGroup, payload []byte) (Delivery, error) {
+	if c.sphinx {
+		if err := c.SendSphinx(dest, path, payload); err != nil {
+			return Delivery{}, err
+		}
+		return Delivery{Status: StatusSent, Attempts: 1}, nil
+	}
+
+	if !c.acks.enabled() {
+		outs, err := c.BuildOnions(dest, path, payload)
+		if err != nil {
+			return Delivery{}, err
+		}
+		if err := c.SendOnions(outs); err != nil {
+			return Delivery{}, err
+		}
+		return Delivery{Status: StatusSent, Attempts: 1}, nil
+	}
+
+	if err := c.startAckListener(); err != nil {
+		return Delivery{}, err
+	}
+
+	timeout := c.acks.Timeout
+	if timeout <= 0 {
+		timeout = DefaultAckTimeout
+	}
+
+	var d Delivery
+	for attempt := 0; attempt <= max(0, c.acks.Retries); attempt++ {
+		d.Attempts++
+
+		attemptPath := path
+		if attempt > 0 {
+			var err error
+			if attemptPath, err = freshPath(path, attempt); err != nil {
+				return d, err
+			}
+			c.EmitLog(fmt.Sprintf("retrying message %x over a fresh path (attempt %d)", d.ID[:4], d.Attempts))
+		}
+
+		id, exts, err := c.ackRequest(attemptPath)
+		if err != nil {
+			return d, err
+		}
+		d.ID = id
+
+		outs, err := c.buildOnions(dest, attemptPath, payload, onion.WithExtensions(exts...))
+		if err != nil {
+			return d, err
+		}
+
+		acked := c.awaitAck(id)
+		start := time.Now()
+		if err := c.SendOnions(outs); err != nil {
+			c.cancelAck(id)
+			c.EmitLog(err.Error())
+			continue
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case at := <-acked:
+			timer.Stop()
+			d.Status, d.RTT = StatusDelivered, at.Sub(start)
+			return d, nil
+		case <-timer.C:
+			c.cancelAck(id)
+		case <-c.ctx.Done():
+			timer.Stop()
+			c.cancelAck(id)
+			return d, c.ctx.Err()
+		}
+	}
+
+	d.Status = StatusTimedOut
+	return d, nil
+}
+
+// ackRequest picks the id of a new message and builds its ack request: a
+// reply onion through the groups of path in reverse. A hybrid reply onion
+// comes with the hybrid secret of its entry group, for the exit to seal.
+func (c *Client) ackRequest(path []identity.CryptoGroup) ([16]byte, []onion.Extension, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, nil, fmt.Errorf("failed to generate message id: %w", err)
+	}
+	tag := c.ackTag(id)
+	token := append(id[:], tag[:]...)
+
+	replyPath := make([]identity.CryptoGroup, len(path))
+	for i, g := range path {
+		replyPath[len(path)-1-i].Group = g.Group
+	}
+	for i := range replyPath {
+		if err := replyPath[i].GenerateCryptoMaterial(); err != nil {
+			return id, nil, err
+		}
+	}
+
+	req, err := onion.BuildAckRequest(c.acks.Listen, replyPath, token, c.buildOpts...)
+	if err != nil {
+		return id, nil, err
+	}
+	ext, err := req.Extension()
+	if err != nil || !c.hybrid {
+		return id, []onion.Extension{ext}, err
+	}
+
+	secret, err := onion.HybridSecret(replyPath[0].CipherKey)
+	if err != nil {
+		return id, nil, err
+	}
+	return id, []onion.Extension{ext, onion.HybridSecretExtension(secret)}, nil
+}
+
+func (c *Client) ackTag(id [16]byte) [16]byte {
+	mac := hmac.New(sha256.New, c.ack.key[:])
+	mac.Write(id[:])
+
+	var tag [16]byte
+	copy(tag[:], mac.Sum(nil))
+	return tag
+}
+
+// freshPath copies path with the relays of every group rotated by attempt,
+// so that the first relay tried changes, and new crypto material.
+func freshPath(path []identity.CryptoGroup, attempt int) ([]identity.CryptoGroup, error) {
+	out := make([]identity.CryptoGroup, len(path))
+	for i, g := range path {
+		relays := g.Group.Relays
+		rotated := make([]identity.Relay, len(relays))
+		for j := range relays {
+			rotated[j] = relays[(j+attempt)%len(relays)]
+		}
+		out[i].Group.Relays = rotated
+		if err := out[i].GenerateCryptoMaterial(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (c *Client) awaitAck(id [16]byte) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+
+	c.ack.mu.Lock()
+	c.ack.pending[id] = ch
+	c.ack.mu.Unlock()
+	return ch
+}
+
+func (c *Client) cancelAck(id [16]byte) {
+	c.ack.mu.Lock()
+	delete(c.ack.pending, id)
+	c.ack.mu.Unlock()
+}
+
+// handleAck resolves the message acknowledged by ack. Acks with a bad tag,
+// or for messages no longer awaited, are ignored.
+func (c *Client) handleAck(ack *packet.DeliveryAck) bool {
+	tag := c.ackTag(ack.ID)
+	if !hmac.Equal(tag[:], ack.Tag[:]) {
+		return false
+	}
+
+	c.ack.mu.Lock()
+	ch, ok := c.ack.pending[ack.ID]
+	delete(c.ack.pending, ack.ID)
+	c.ack.mu.Unlock()
+
+	if ok {
+		ch <- time.Now()
+	}
+	return ok
+}
+
+// startAckListener listens for acks on the configured endpoint, until the
+// client is closed.
+func (c *Client) startAckListener() error {
+	c.ack.once.Do(func() {
+		ln, err := c.Listen(c.acks.Listen)
+		if err != nil {
+			c.ack.err = fmt.Errorf("failed to listen for acks: %w", err)
+			return
+		}
+		c.EmitLog(fmt.Sprintf("listening for delivery acks on %s", ln.Addr()))
+
+		go func() {
+			<-c.ctx.Done()
+			_ = ln.Close()
+		}()
+		go c.serveAcks(ln)
+	})
+	return c.ack.err
+}
+
+func (c *Client) serveAcks(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.readAck(conn)
+	}
+}
+
+func (c *Client) readAck(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	cfg := handshake.DefaultConfig()
+	_, p, err := handshake.Accept(conn, packet.DefaultRegistry, cfg)
+	if err != nil {
+		return
+	}
+	if p == nil {
+		if err := conn.SetReadDeadline(time.Now().Add(cfg.Timeout)); err != nil {
+			return
+		}
+		if p, err = packet.ReadPacket(packet.DefaultRegistry, conn); err != nil {
+			return
+		}
+	}
+	if ack, ok := p.(*packet.DeliveryAck); ok {
+		c.handleAck(ack)
+	}
+}
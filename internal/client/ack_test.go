@@ -0,0 +1,81 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func TestClient_handleAck(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	defer c.Close()
+
+	id := [16]byte{1, 2, 3}
+	acked := c.awaitAck(id)
+
+	forged := &packet.DeliveryAck{ID: id}
+	if c.handleAck(forged) {
+		t.Fatal("ack with a bad tag accepted")
+	}
+
+	ack := &packet.DeliveryAck{ID: id, Tag: c.ackTag(id)}
+	if !c.handleAck(ack) {
+		t.Fatal("valid ack rejected")
+	}
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatal("pending message not resolved")
+	}
+
+	if c.handleAck(ack) {
+		t.Fatal("ack accepted twice")
+	}
+}
+
+func TestClient_ackTag_PerClient(t *testing.T) {
+	t.Parallel()
+
+	a, b := New(), New()
+	defer a.Close()
+	defer b.Close()
+
+	id := [16]byte{9}
+	if a.ackTag(id) == b.ackTag(id) {
+		t.Fatal("two clients produced the same tag")
+	}
+}
+
+func TestFreshPath(t *testing.T) {
+	t.Parallel()
+
+	relays := make([]identity.Relay, 3)
+	for i := range relays {
+		relays[i].Ep = identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: uint16(7000 + i)}
+	}
+	path := []identity.CryptoGroup{{Group: identity.RelayGroup{Relays: relays}}}
+	if err := path[0].GenerateCryptoMaterial(); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, err := freshPath(path, 1)
+	if err != nil {
+		t.Fatalf("freshPath() failed: %v", err)
+	}
+
+	got := fresh[0].Group.Relays
+	if got[0].Ep.Port != 7001 || got[1].Ep.Port != 7002 || got[2].Ep.Port != 7000 {
+		t.Errorf("relays not rotated: %v", fresh[0].Group)
+	}
+	if fresh[0].CipherKey == path[0].CipherKey || fresh[0].EPK == path[0].EPK {
+		t.Error("crypto material reused")
+	}
+	if relays[0].Ep.Port != 7000 {
+		t.Error("original path modified")
+	}
+}
@@ -2,8 +2,12 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
+	"net"
+	"time"
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
 )
@@ -13,18 +17,101 @@ type Client struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	tx *transport.Transport
+	tx       *transport.Transport
+	txOpts   []transport.Option
+	listener transport.Listener
+
+	buildOpts     []onion.BuildOption
+	mixDelayClass uint8
+	redundancy    int
+
+	sphinx bool
+	hybrid bool
+
+	// Erasure coding of payloads, disabled when shareN is zero.
+	shareK, shareN int
+
+	cover    CoverConfig
+	coverRun *coverState
+
+	acks AckConfig
+	ack  *ackState
+
+	hsdir identity.Endpoint
 }
 
-func New() *Client {
+type Option func(*Client)
+
+// WithMixDelay requests the given delay class from every mixing relay of the
+// onions built by the client.
+func WithMixDelay(class uint8) Option {
+	return func(c *Client) {
+		c.mixDelayClass = class
+		c.buildOpts = append(c.buildOpts, onion.WithMixDelay(class))
+	}
+}
+
+// WithRedundancy sends onions to k entry relays in parallel, and asks every
+// relay of the path to do the same with the next group.
+func WithRedundancy(k uint8) Option {
+	return func(c *Client) {
+		c.redundancy = int(k)
+		c.buildOpts = append(c.buildOpts, onion.WithRedundancy(k))
+	}
+}
+
+// WithErasure splits every payload into n Reed-Solomon shares sent through
+// different relays, any k of which rebuild it at the exit. n = 0 disables it.
+func WithErasure(k, n int) Option {
+	return func(c *Client) {
+		c.shareK, c.shareN = k, n
+	}
+}
+
+// WithHybridKEM builds hybrid onions, their layer keys depending on both
+// X25519 and ML-KEM-768, and sends them to the entry group in
+// HybridOnionPackets. Every relay of the path must hold an ML-KEM key, sent
+// along with its identity.
+func WithHybridKEM() Option {
+	return func(c *Client) {
+		c.hybrid = true
+		c.buildOpts = append(c.buildOpts, onion.WithHybridKEM())
+	}
+}
+
+// WithDialer sets how the client connects to relays. Defaults to TCP.
+func WithDialer(d transport.Dialer) Option {
+	return func(c *Client) {
+		c.txOpts = append(c.txOpts, transport.WithDialer(d))
+	}
+}
+
+// WithListener sets how the client listens for delivery acks. Defaults to
+// TCP.
+func WithListener(l transport.Listener) Option {
+	return func(c *Client) {
+		c.listener = l
+	}
+}
+
+func New(opts ...Option) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Client{
+	c := &Client{
 		events: make(chan Event, 10),
 		ctx:    ctx,
 		cancel: cancel,
 
-		tx: transport.NewTransport(),
+		listener: transport.TCP{},
+
+		coverRun: &coverState{},
+		ack:      &ackState{pending: make(map[[16]byte]chan time.Time)},
 	}
+	_, _ = rand.Read(c.ack.key[:]) // never fails since Go 1.24
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.tx = transport.NewTransport(c.txOpts...)
+	return c
 }
 
 func (c *Client) SendPacket(ep identity.Endpoint, p packet.Packet) error {
@@ -35,6 +122,12 @@ func (c *Client) RequestPacket(ep identity.Endpoint, req packet.Packet) (packet.
 	return c.tx.Request(ep, req)
 }
 
+// Listen listens on ep for the connections of relays, with the listener of
+// the client.
+func (c *Client) Listen(ep identity.Endpoint) (net.Listener, error) {
+	return c.listener.Listen(ep)
+}
+
 func (c *Client) EmitLog(payload string) {
 	c.events <- Event{
 		Type:    EvLog,
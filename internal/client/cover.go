@@ -0,0 +1,126 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/cover"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// CoverConfig configures the dummy onions emitted by the client. They are
+// dropped by the last relay of a random path over the known relays.
+type CoverConfig struct {
+	Rate float64 // onions per second (0 = none)
+	Hops int
+}
+
+// coverState tracks the cover loop of a client.
+type coverState struct {
+	once sync.Once
+	sent atomic.Uint64
+}
+
+// WithCover makes the client emit cover onions once StartCover is called.
+func WithCover(cfg CoverConfig) Option {
+	return func(c *Client) {
+		c.cover = cfg
+	}
+}
+
+// StartCover starts emitting cover onions through the relays of path, until
+// the client is closed. It does nothing if cover traffic is disabled or
+// already running, nor for a Sphinx client, whose cover onions would stand
+// out among its Sphinx packets.
+func (c *Client) StartCover(path []identity.CryptoGroup) {
+	if c.cover.Rate <= 0 {
+		return
+	}
+	if c.sphinx {
+		c.EmitLog("cover traffic is not available with Sphinx packets")
+		return
+	}
+
+	var relays []identity.Relay
+	for _, g := range path {
+		relays = append(relays, g.Group.Relays...)
+	}
+	if len(relays) == 0 {
+		return
+	}
+
+	c.coverRun.once.Do(func() {
+		c.EmitLog("cover traffic started")
+		go c.runCover(relays)
+	})
+}
+
+// CoverSent returns the number of cover onions sent so far.
+func (c *Client) CoverSent() uint64 {
+	return c.coverRun.sent.Load()
+}
+
+func (c *Client) runCover(relays []identity.Relay) {
+	hops := c.cover.Hops
+	if hops <= 0 {
+		hops = cover.DefaultHops
+	}
+
+	timer := time.NewTimer(cover.Interval(c.cover.Rate))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		// Failures are not reported: cover traffic is best effort and the
+		// event channel may be closed under our feet.
+		if c.sendCover(relays, hops) == nil {
+			c.coverRun.sent.Add(1)
+		}
+		timer.Reset(cover.Interval(c.cover.Rate))
+	}
+}
+
+func (c *Client) sendCover(relays []identity.Relay, hops int) error {
+	path, err := cover.RandomPath(relays, hops)
+	if err != nil {
+		return err
+	}
+
+	layer, groups, err := cover.BuildGroups(path, len(path)-1, c.buildOpts...)
+	if err != nil {
+		return err
+	}
+	o, err := c.outbound(layer, groups)
+	if err != nil {
+		return err
+	}
+
+	raw, err := layer.BytesPadded()
+	if err != nil {
+		return err
+	}
+
+	// Cover onions travel in the same packets as the real ones.
+	if o.Hybrid != nil {
+		env, err := onion.SealHybridEnvelope(path[0].KEMKey, *o.Hybrid)
+		if err != nil {
+			return err
+		}
+		pkt := packet.HybridOnionPacket{Envelope: env}
+		copy(pkt.Data[:], raw)
+		return c.SendPacket(path[0].Ep, &pkt)
+	}
+
+	var pkt packet.OnionPacket
+	copy(pkt.Data[:], raw)
+
+	return c.SendPacket(path[0].Ep, &pkt)
+}
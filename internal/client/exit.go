@@ -0,0 +1,60 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// RetrieveExitPolicy fetches the exit policy summary advertised by r.
+func (c *Client) RetrieveExitPolicy(r *identity.Relay) error {
+	resp, err := c.tx.Request(r.Ep, &packet.GetExitPolicyRequest{})
+	if err != nil {
+		return err
+	}
+
+	p, ok := resp.(*packet.GetExitPolicyResponse)
+	if !ok {
+		return fmt.Errorf("unexpected packet type %T", resp)
+	}
+
+	var summary identity.ExitSummary
+	if err := summary.Parse(p.Summary); err != nil {
+		return err
+	}
+	r.ExitPolicy = &summary
+
+	c.EmitLog(fmt.Sprintf("exit policy received from %s => %s", r.Ep.String(), summary))
+	return nil
+}
+
+// SelectExits keeps the relays of the last group of path that accept dest,
+// according to the policies they advertise. Relays advertising none, such as
+// older ones, are kept. It fails when no relay is left.
+func (c *Client) SelectExits(dest identity.Endpoint, path []identity.CryptoGroup) error {
+	if len(path) == 0 {
+		return nil
+	}
+	exit := &path[len(path)-1]
+
+	relays := exit.Group.Relays[:0]
+	for _, r := range exit.Group.Relays {
+		if r.ExitPolicy == nil {
+			if err := c.RetrieveExitPolicy(&r); err != nil {
+				c.EmitLog(fmt.Sprintf("no exit policy from %s (%v), keeping it", r.Ep.String(), err))
+			}
+		}
+		if r.ExitPolicy != nil && !r.ExitPolicy.Allows(dest) {
+			c.EmitLog(fmt.Sprintf("exit %s rejects %s, skipping", r.Ep.String(), dest.String()))
+			continue
+		}
+		relays = append(relays, r)
+	}
+	exit.Group.Relays = relays
+
+	if len(relays) == 0 {
+		return fmt.Errorf("no exit relay accepts %s", dest.String())
+	}
+	return nil
+}
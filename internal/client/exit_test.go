@@ -0,0 +1,99 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+func TestClient_SelectExits(t *testing.T) {
+	t.Parallel()
+
+	// Nothing listens on this port, so the relay advertises no policy.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	silent := uint16(ln.Addr().(*net.TCPAddr).Port)
+	_ = ln.Close()
+
+	web := &identity.ExitSummary{IPv4: []identity.PortRange{{Min: 80, Max: 80}, {Min: 443, Max: 443}}}
+	mail := &identity.ExitSummary{IPv4: []identity.PortRange{{Min: 25, Max: 25}}}
+	relay := func(port uint16, policy *identity.ExitSummary) identity.Relay {
+		return identity.Relay{
+			Ep:         identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: port},
+			ExitPolicy: policy,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		dest        uint16
+		relays      []identity.Relay
+		expected    []uint16
+		errContains string
+	}{
+		{
+			name:     "compatible exits kept",
+			dest:     443,
+			relays:   []identity.Relay{relay(7000, web), relay(7001, mail), relay(7002, web)},
+			expected: []uint16{7000, 7002},
+		},
+		{
+			name:     "unknown policy kept",
+			dest:     25,
+			relays:   []identity.Relay{relay(7000, web), relay(silent, nil)},
+			expected: []uint16{silent},
+		},
+		{
+			name:        "no compatible exit",
+			dest:        22,
+			relays:      []identity.Relay{relay(7000, web), relay(7001, mail)},
+			errContains: "no exit relay accepts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := New()
+			defer c.Close()
+			go func() {
+				for range c.Events() {
+				}
+			}()
+
+			entry := identity.CryptoGroup{Group: identity.RelayGroup{Relays: []identity.Relay{relay(6000, mail)}}}
+			exit := identity.CryptoGroup{Group: identity.RelayGroup{Relays: tt.relays}}
+			path := []identity.CryptoGroup{entry, exit}
+
+			dest := identity.Endpoint{IP: net.ParseIP("93.184.216.34"), Port: tt.dest}
+			err := c.SelectExits(dest, path)
+			if tt.errContains != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+					t.Fatalf("error mismatch:\n\tgot:  %v\n\twant: %q", err, tt.errContains)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SelectExits() failed: %v", err)
+			}
+
+			got := path[1].Group.Relays
+			if len(got) != len(tt.expected) {
+				t.Fatalf("exit count mismatch:\n\tgot:  %v\n\twant: %v", got, tt.expected)
+			}
+			for i, port := range tt.expected {
+				if got[i].Ep.Port != port {
+					t.Errorf("exit %d mismatch:\n\tgot:  %d\n\twant: %d", i, got[i].Ep.Port, port)
+				}
+			}
+			if len(path[0].Group.Relays) != 1 {
+				t.Error("entry group modified")
+			}
+		})
+	}
+}
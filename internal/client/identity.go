@@ -27,5 +27,11 @@ func (c *Client) RetrieveRelayIdentity(r *identity.Relay) error {
 		id.PublicKey[:4],
 	))
 
+	// Relays holding an ML-KEM key send it to peers negotiating hybrid
+	// onions.
+	r.KEMKey = id.KEMKey
+	if c.hybrid && len(r.KEMKey) == 0 {
+		return fmt.Errorf("relay %s has no KEM key", r.Ep.String())
+	}
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 
 type Message struct {
 	Dest    identity.Endpoint
+	Service string // .dor address replacing Dest
 	Path    []identity.CryptoGroup
 	Payload []byte
 }
@@ -22,8 +23,17 @@ func (m Message) String() string {
 }
 
 func BuildFromInputConfig(ic client.InputConfig) (Message, error) {
-	dest, err := identity.ParseEpFromString(ic.Dest)
-	if err != nil {
+	var (
+		dest    identity.Endpoint
+		service string
+		err     error
+	)
+	if identity.IsServiceAddress(ic.Dest) {
+		if _, err = identity.ParseServiceAddress(ic.Dest); err != nil {
+			return Message{}, err
+		}
+		service = ic.Dest
+	} else if dest, err = identity.ParseEpFromString(ic.Dest); err != nil {
 		return Message{}, err
 	}
 
@@ -41,6 +51,7 @@ func BuildFromInputConfig(ic client.InputConfig) (Message, error) {
 
 	return Message{
 		Dest:    dest,
+		Service: service,
 		Path:    path,
 		Payload: []byte(ic.Payload),
 	}, nil
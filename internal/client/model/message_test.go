@@ -265,6 +265,40 @@ func TestMessage_BuildFromInputConfig(t *testing.T) {
 			wantErr:  true,
 			err:      nil,
 		},
+		{
+			name: "hidden service destination",
+			ic: client.InputConfig{
+				OnionPath: "[::1]:9000",
+				Dest:      "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.dor",
+				Payload:   "psst",
+			},
+			expected: model.Message{
+				Service: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.dor",
+				Path: []identity.CryptoGroup{
+					{
+						Group: identity.RelayGroup{
+							Relays: []identity.Relay{
+								{Ep: identity.Endpoint{IP: net.ParseIP("::1"), Port: 9000}},
+							},
+						},
+					},
+				},
+				Payload: []byte("psst"),
+			},
+			wantErr: false,
+			err:     nil,
+		},
+		{
+			name: "invalid hidden service destination",
+			ic: client.InputConfig{
+				OnionPath: "[::1]:9000",
+				Dest:      "short.dor",
+				Payload:   "psst",
+			},
+			expected: model.Message{},
+			wantErr:  true,
+			err:      nil,
+		},
 		{
 			name: "large payload",
 			ic: client.InputConfig{
@@ -6,8 +6,83 @@ import (
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
 )
 
+// BuildOnion builds an onion for dest through path with the options the
+// client was created with, followed by extra.
+func (c *Client) BuildOnion(dest identity.Endpoint, path []identity.CryptoGroup, payload []byte, extra ...onion.BuildOption) (*onion.OnionLayer, error) {
+	opts := append(c.buildOpts[:len(c.buildOpts):len(c.buildOpts)], extra...)
+	return onion.BuildOnion(dest, path, payload, opts...)
+}
+
+// Outbound is an onion ready to be sent to a relay of its entry group.
+type Outbound struct {
+	Layer *onion.OnionLayer
+	Entry identity.RelayGroup
+	// Redundancy is how many entry relays get the onion in parallel: the
+	// client redundancy, or 1 when the entry group is also the exit one,
+	// which would otherwise deliver as many copies.
+	Redundancy int
+	// Hybrid is the hybrid secret of the entry group of a hybrid onion, nil
+	// for classic ones.
+	Hybrid *[32]byte
+}
+
+// outbound pairs layer with the entry group of path, and with the hybrid
+// secret of the group when the client builds hybrid onions.
+func (c *Client) outbound(layer *onion.OnionLayer, path []identity.CryptoGroup) (Outbound, error) {
+	entry := path[0]
+	o := Outbound{Layer: layer, Entry: entry.Group, Redundancy: c.redundancy}
+	if len(path) == 1 {
+		o.Redundancy = 1
+	}
+	if !c.hybrid {
+		return o, nil
+	}
+
+	secret, err := onion.HybridSecret(entry.CipherKey)
+	if err != nil {
+		return Outbound{}, err
+	}
+	o.Hybrid = &secret
+	return o, nil
+}
+
+// BuildOnions builds the onions carrying payload: a single one, or one per
+// share when the client uses erasure coding.
+func (c *Client) BuildOnions(dest identity.Endpoint, path []identity.CryptoGroup, payload []byte) ([]Outbound, error) {
+	return c.buildOnions(dest, path, payload)
+}
+
+func (c *Client) buildOnions(dest identity.Endpoint, path []identity.CryptoGroup, payload []byte, extra ...onion.BuildOption) ([]Outbound, error) {
+	if c.shareN == 0 {
+		layer, err := c.BuildOnion(dest, path, payload, extra...)
+		if err != nil {
+			return nil, err
+		}
+		o, err := c.outbound(layer, path)
+		if err != nil {
+			return nil, err
+		}
+		return []Outbound{o}, nil
+	}
+
+	opts := append(c.buildOpts[:len(c.buildOpts):len(c.buildOpts)], extra...)
+	shares, err := onion.BuildOnionShares(dest, path, payload, c.shareK, c.shareN, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Outbound, len(shares))
+	for i, so := range shares {
+		if out[i], err = c.outbound(so.Layer, so.Path); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
 func (c *Client) SendOnionPacket(ep identity.Endpoint, raw []byte) error {
 	if len(raw) != onion.PacketSize {
 		return fmt.Errorf("invalid onion packet size: got %d, want %d", len(raw), onion.PacketSize)
@@ -18,3 +93,111 @@ func (c *Client) SendOnionPacket(ep identity.Endpoint, raw []byte) error {
 
 	return c.SendPacket(ep, &pkt)
 }
+
+// DispatchOnionPacket sends raw to the first reachable relay of the entry
+// group, or to k of them in parallel. It returns how many relays got the
+// packet.
+func (c *Client) DispatchOnionPacket(entry identity.RelayGroup, k int, raw []byte) (int, error) {
+	if len(raw) != onion.PacketSize {
+		return 0, fmt.Errorf("invalid onion packet size: got %d, want %d", len(raw), onion.PacketSize)
+	}
+
+	var pkt packet.OnionPacket
+	copy(pkt.Data[:], raw)
+
+	results := c.tx.SendRedundant(entryEndpoints(entry), k, &pkt)
+	return c.dispatched(results)
+}
+
+// DispatchHybridOnionPacket is DispatchOnionPacket for a hybrid onion: every
+// entry relay tried gets raw with secret, the hybrid secret of the group,
+// sealed with its ML-KEM key.
+func (c *Client) DispatchHybridOnionPacket(entry identity.RelayGroup, k int, raw []byte, secret [32]byte) (int, error) {
+	if len(raw) != onion.PacketSize {
+		return 0, fmt.Errorf("invalid onion packet size: got %d, want %d", len(raw), onion.PacketSize)
+	}
+
+	var data [onion.PacketSize]byte
+	copy(data[:], raw)
+
+	kemKeys := make(map[string][]byte, len(entry.Relays))
+	for _, relay := range entry.Relays {
+		kemKeys[relay.Ep.String()] = relay.KEMKey
+	}
+
+	results := c.tx.SendRedundantFunc(entryEndpoints(entry), k, func(ep identity.Endpoint) (packet.Packet, error) {
+		env, err := onion.SealHybridEnvelope(kemKeys[ep.String()], secret)
+		if err != nil {
+			return nil, err
+		}
+		return &packet.HybridOnionPacket{Envelope: env, Data: data}, nil
+	})
+	return c.dispatched(results)
+}
+
+func entryEndpoints(entry identity.RelayGroup) []identity.Endpoint {
+	eps := make([]identity.Endpoint, len(entry.Relays))
+	for i, relay := range entry.Relays {
+		eps[i] = relay.Ep
+	}
+	return eps
+}
+
+// dispatched logs the results of a dispatch and counts the relays reached.
+func (c *Client) dispatched(results []transport.SendResult) (int, error) {
+	for _, r := range results {
+		if r.Err != nil {
+			c.EmitLog(fmt.Sprintf("failed to send onion packet to %s: %v", r.Ep.String(), r.Err))
+			continue
+		}
+		c.EmitLog(fmt.Sprintf("onion packet sent to %s", r.Ep.String()))
+	}
+
+	n := transport.Delivered(results)
+	if n == 0 {
+		return 0, fmt.Errorf("failed to send onion packet to any entry relay")
+	}
+	return n, nil
+}
+
+// dispatch sends raw, the padded layer of o, to its entry group.
+func (c *Client) dispatch(o Outbound, raw []byte) error {
+	var err error
+	if o.Hybrid != nil {
+		_, err = c.DispatchHybridOnionPacket(o.Entry, o.Redundancy, raw, *o.Hybrid)
+	} else {
+		_, err = c.DispatchOnionPacket(o.Entry, o.Redundancy, raw)
+	}
+	return err
+}
+
+// SendOnions pads and dispatches outs. It fails unless enough of them reached
+// an entry relay to deliver the payload: all of them, or k with erasure
+// coding.
+func (c *Client) SendOnions(outs []Outbound) error {
+	sent := 0
+	for _, o := range outs {
+		raw, err := o.Layer.BytesPadded()
+		if err != nil {
+			return err
+		}
+
+		c.EmitLog(fmt.Sprintf("Sending a %d bytes packet", len(raw)))
+		c.EmitLog(fmt.Sprintf("Packet prefix=%x", raw[:24]))
+
+		if err := c.dispatch(o, raw); err != nil {
+			c.EmitLog(err.Error())
+			continue
+		}
+		sent++
+	}
+
+	needed := len(outs)
+	if c.shareN > 0 {
+		needed = c.shareK
+	}
+	if sent < needed {
+		return fmt.Errorf("only %d of %d onion packets sent, %d needed", sent, len(outs), needed)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// WithHSDir sets the relay asked for the descriptors of hidden services.
+func WithHSDir(ep identity.Endpoint) Option {
+	return func(c *Client) {
+		c.hsdir = ep
+	}
+}
+
+// LookupService fetches and checks the descriptor of the hidden service
+// named by a .dor address.
+func (c *Client) LookupService(addr string) (identity.ServiceDescriptor, error) {
+	key, err := identity.ParseServiceAddress(addr)
+	if err != nil {
+		return identity.ServiceDescriptor{}, err
+	}
+	if c.hsdir.Port == 0 {
+		return identity.ServiceDescriptor{}, fmt.Errorf("no descriptor directory configured")
+	}
+
+	req := &packet.ServiceLookupRequest{}
+	copy(req.Key[:], key)
+
+	resp, err := c.tx.Request(c.hsdir, req)
+	if err != nil {
+		return identity.ServiceDescriptor{}, err
+	}
+	lookup, ok := resp.(*packet.ServiceLookupResponse)
+	if !ok {
+		return identity.ServiceDescriptor{}, fmt.Errorf("unexpected packet type %T", resp)
+	}
+	if len(lookup.Descriptor) == 0 {
+		return identity.ServiceDescriptor{}, fmt.Errorf("no descriptor found for %s", addr)
+	}
+
+	desc, err := identity.ParseServiceDescriptor(lookup.Descriptor)
+	if err != nil {
+		return identity.ServiceDescriptor{}, err
+	}
+	if !bytes.Equal(desc.Key, key) {
+		return identity.ServiceDescriptor{}, fmt.Errorf("descriptor of another service returned for %s", addr)
+	}
+	if err := desc.Verify(time.Now()); err != nil {
+		return identity.ServiceDescriptor{}, err
+	}
+
+	c.EmitLog(fmt.Sprintf("descriptor of %s found with %d introduction relay(s)", addr, len(desc.Intro)))
+	return desc, nil
+}
+
+// PathTo returns a path through via ending at target alone, with fresh crypto
+// material. Relays of via must know their identity.
+func PathTo(via []identity.RelayGroup, target identity.Relay) ([]identity.CryptoGroup, error) {
+	path := make([]identity.CryptoGroup, len(via)+1)
+	for i, g := range via {
+		path[i].Group = g
+	}
+	path[len(via)].Group = identity.RelayGroup{Relays: []identity.Relay{target}}
+
+	for i := range path {
+		if err := path[i].GenerateCryptoMaterial(); err != nil {
+			return nil, err
+		}
+	}
+	return path, nil
+}
+
+// SendExtension sends an onion through path whose last relay runs ext on
+// payload.
+func (c *Client) SendExtension(path []identity.CryptoGroup, payload []byte, ext onion.Extension) error {
+	last := path[len(path)-1].Group.Relays[0]
+
+	layer, err := c.BuildOnion(last.Ep, path, payload, onion.WithExtensions(ext))
+	if err != nil {
+		return err
+	}
+	o, err := c.outbound(layer, path)
+	if err != nil {
+		return err
+	}
+	raw, err := layer.BytesPadded()
+	if err != nil {
+		return err
+	}
+
+	return c.dispatch(o, raw)
+}
+
+// SendToService sends payload to the hidden service named by addr. The first
+// relay of the last group of path is the rendezvous relay, and the other
+// groups lead to it and to the introduction relay. Neither the client nor the
+// service learns the address of the other.
+func (c *Client) SendToService(addr string, path []identity.CryptoGroup, payload []byte) error {
+	if len(path) == 0 || len(path[len(path)-1].Group.Relays) == 0 {
+		return fmt.Errorf("path cannot be empty")
+	}
+
+	desc, err := c.LookupService(addr)
+	if err != nil {
+		return err
+	}
+
+	via := make([]identity.RelayGroup, len(path)-1)
+	for i, g := range path[:len(path)-1] {
+		via[i] = g.Group
+	}
+	rdv := path[len(path)-1].Group.Relays[0]
+
+	in := onion.Introduction{Rendezvous: rdv}
+	if _, err := rand.Read(in.Cookie[:]); err != nil {
+		return fmt.Errorf("failed to generate cookie: %w", err)
+	}
+
+	// The message waits at the rendezvous relay, sealed for the service.
+	sealed, err := onion.Seal(desc.EncKey, payload)
+	if err != nil {
+		return err
+	}
+	rdvPath, err := PathTo(via, rdv)
+	if err != nil {
+		return err
+	}
+	if err := c.SendExtension(rdvPath, sealed, onion.RendezvousExtension(in.Cookie)); err != nil {
+		return fmt.Errorf("failed to reach rendezvous relay %s: %w", rdv.Ep.String(), err)
+	}
+	c.EmitLog(fmt.Sprintf("message left at rendezvous relay %s", rdv.Ep.String()))
+
+	raw, err := in.Bytes()
+	if err != nil {
+		return err
+	}
+	intro, err := onion.Seal(desc.EncKey, raw)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range desc.Intro {
+		introPath, err := PathTo(via, ip)
+		if err != nil {
+			return err
+		}
+		if err := c.SendExtension(introPath, intro, onion.IntroduceExtension(desc.Key)); err != nil {
+			c.EmitLog(fmt.Sprintf("introduction relay %s unreachable: %v", ip.Ep.String(), err))
+			continue
+		}
+		c.EmitLog(fmt.Sprintf("introduction sent through %s", ip.Ep.String()))
+		return nil
+	}
+	return fmt.Errorf("no introduction relay of %s reachable", addr)
+}
@@ -6,7 +6,7 @@ import (
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client/model"
-	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
 )
 
 type Sink struct {
@@ -33,9 +33,9 @@ func (s *Sink) Start() error {
 		for ev := range s.client.Events() {
 			switch ev.Type {
 			case client.EvLog:
-				fmt.Println("[LOG]", ev.Payload)
+				logger.Infof("%v", ev.Payload)
 			case client.EvErr:
-				fmt.Printf("[ERR] %v\n", ev.Payload)
+				logger.Errorf("%v", ev.Payload)
 			}
 		}
 		close(done)
@@ -70,32 +70,19 @@ func (s *Sink) Start() error {
 		}
 	}
 
-	layer, err := onion.BuildOnion(msg.Dest, msg.Path, msg.Payload)
-	if err != nil {
-		return err
-	}
-
-	packet, err := layer.BytesPadded()
-	if err != nil {
-		return err
-	}
-
-	s.client.EmitLog(fmt.Sprintf("Sending a %d bytes packet", len(packet)))
-	s.client.EmitLog(fmt.Sprintf("Packet prefix=%x", packet[:64]))
-
-	sent := false
-	for _, relay := range msg.Path[0].Group.Relays {
-		entry := relay.Ep
-		if err := s.client.SendOnionPacket(entry, packet); err != nil {
-			s.client.EmitLog(fmt.Sprintf("failed to send onion packet to %s: %v", entry.String(), err))
-			continue
+	if msg.Service != "" {
+		if err := s.client.SendToService(msg.Service, msg.Path, msg.Payload); err != nil {
+			return err
 		}
-		s.client.EmitLog(fmt.Sprintf("onion packet sent to %s", entry.String()))
-		sent = true
-		break
-	}
-	if !sent {
-		return fmt.Errorf("failed to send onion packet to any entry relay")
+	} else {
+		if err := s.client.SelectExits(msg.Dest, msg.Path); err != nil {
+			return err
+		}
+		d, err := s.client.SendMessage(msg.Dest, msg.Path, msg.Payload)
+		if err != nil {
+			return err
+		}
+		s.client.EmitLog(d.String())
 	}
 
 	s.client.Close()
@@ -6,7 +6,7 @@ import (
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client/model"
-	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -167,7 +167,14 @@ func (m tuiModel) startProcessing() tea.Cmd {
 				}
 			}
 
+			if msg.Service == "" {
+				if err := m.sink.client.SelectExits(msg.Dest, msg.Path); err != nil {
+					return errorMsg{err: err}
+				}
+			}
+
 			cachedMessage = &msg
+			m.sink.client.StartCover(msg.Path)
 			lastConfig = sinkConfig
 		} else if payloadChanged {
 			msg = *cachedMessage
@@ -179,33 +186,16 @@ func (m tuiModel) startProcessing() tea.Cmd {
 			m.sink.client.EmitLog("Reusing cached relay identities and crypto material")
 		}
 
-		layer, err := onion.BuildOnion(msg.Dest, msg.Path, msg.Payload)
-		if err != nil {
-			return errorMsg{err: err}
-		}
-
-		packet, err := layer.BytesPadded()
-		if err != nil {
-			return errorMsg{err: err}
-		}
-
-		m.sink.client.EmitLog(fmt.Sprintf("Sending a %d bytes packet", len(packet)))
-		m.sink.client.EmitLog(fmt.Sprintf("Packet prefix=%x", packet[:24]))
-
-		sent := false
-		for _, relay := range msg.Path[0].Group.Relays {
-			entry := relay.Ep
-			if err := m.sink.client.SendOnionPacket(entry, packet); err != nil {
-				m.sink.client.EmitLog(fmt.Sprintf("failed to send onion packet to %s: %v", entry.String(), err))
-				continue
+		if msg.Service != "" {
+			if err := m.sink.client.SendToService(msg.Service, msg.Path, msg.Payload); err != nil {
+				return errorMsg{err: err}
 			}
-			m.sink.client.EmitLog(fmt.Sprintf("onion packet sent to %s", entry.String()))
-			sent = true
-			break
-		}
-
-		if !sent {
-			return errorMsg{err: fmt.Errorf("failed to send onion packet to any entry relay")}
+		} else {
+			d, err := m.sink.client.SendMessage(msg.Dest, msg.Path, msg.Payload)
+			if err != nil {
+				return errorMsg{err: err}
+			}
+			m.sink.client.EmitLog(d.String())
 		}
 
 		return tea.Batch(
@@ -227,8 +217,10 @@ func (s *Sink) Start() error {
 		for ev := range s.client.Events() {
 			switch ev.Type {
 			case client.EvLog:
+				logger.Infof("%v", ev.Payload)
 				eventChan <- logMsg{message: fmt.Sprintf("%v", ev.Payload)}
 			case client.EvErr:
+				logger.Errorf("%v", ev.Payload)
 				eventChan <- logMsg{message: fmt.Sprintf("[ERR] %v", ev.Payload)}
 			}
 		}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/sphinx"
+)
+
+// WithSphinx makes SendMessage send constant-size Sphinx packets instead of
+// onions. Sphinx hops are single relays: the first relay of every group is
+// used. Acks, redundancy and erasure coding are not available with it.
+func WithSphinx() Option {
+	return func(c *Client) {
+		c.sphinx = true
+	}
+}
+
+// SendSphinx sends payload to dest in a Sphinx packet through the first relay
+// of every group of path.
+func (c *Client) SendSphinx(dest identity.Endpoint, path []identity.CryptoGroup, payload []byte) error {
+	relays := make([]identity.Relay, len(path))
+	for i, g := range path {
+		if len(g.Group.Relays) == 0 {
+			return fmt.Errorf("group %d of path is empty", i)
+		}
+		relays[i] = g.Group.Relays[0]
+	}
+
+	p, err := sphinx.Build(dest, relays, payload, sphinx.WithMixDelay(c.mixDelayClass))
+	if err != nil {
+		return err
+	}
+
+	pkt := packet.SphinxPacket{Data: p.Bytes()}
+	c.EmitLog(fmt.Sprintf("Sending a %d bytes sphinx packet", len(pkt.Data)))
+	if err := c.SendPacket(relays[0].Ep, &pkt); err != nil {
+		return fmt.Errorf("failed to send sphinx packet to %s: %w", relays[0].Ep.String(), err)
+	}
+	c.EmitLog(fmt.Sprintf("sphinx packet sent to %s", relays[0].Ep.String()))
+	return nil
+}
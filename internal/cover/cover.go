@@ -0,0 +1,91 @@
+// Package cover builds the dummy onions sent as cover traffic by clients and
+// relays.
+//
+// A cover onion is built exactly like a real one and padded to the same size;
+// the only difference is the drop flag set inside the layer of its drop hop,
+// which only that relay can read.
+package cover
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand/v2"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+// DefaultHops is the default number of relays crossed by a cover onion.
+const DefaultHops = 3
+
+// payloadSize is the size of the random payload carried by cover onions.
+// Padding makes every onion PacketSize bytes long whatever its payload.
+const payloadSize = 64
+
+// Interval draws the wait before the next event of a Poisson process of the
+// given rate, in events per second. A non-positive rate never fires.
+func Interval(rate float64) time.Duration {
+	if rate <= 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration(mrand.ExpFloat64() / rate * float64(time.Second))
+}
+
+// RandomPath picks hops relays at random, never the same one twice in a row
+// when there is a choice.
+func RandomPath(relays []identity.Relay, hops int) ([]identity.Relay, error) {
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no relay to build a cover path")
+	}
+	if hops < 1 || hops > onion.MaxJump {
+		return nil, fmt.Errorf("cover hops must be in [1, %d], got %d", onion.MaxJump, hops)
+	}
+
+	path := make([]identity.Relay, hops)
+	prev := -1
+	for i := range path {
+		j := mrand.IntN(len(relays))
+		if j == prev && len(relays) > 1 {
+			j = (j + 1 + mrand.IntN(len(relays)-1)) % len(relays)
+		}
+		path[i] = relays[j]
+		prev = j
+	}
+	return path, nil
+}
+
+// Build builds a cover onion through path, one relay per hop, dropped by the
+// relay at index dropAt. The onion is addressed to the last relay of path.
+func Build(path []identity.Relay, dropAt int, opts ...onion.BuildOption) (*onion.OnionLayer, error) {
+	layer, _, err := BuildGroups(path, dropAt, opts...)
+	return layer, err
+}
+
+// BuildGroups is Build also returning the groups the onion was built for,
+// whose first one hybrid cover onions are sent with the secret of.
+func BuildGroups(path []identity.Relay, dropAt int, opts ...onion.BuildOption) (*onion.OnionLayer, []identity.CryptoGroup, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cover path cannot be empty")
+	}
+
+	groups := make([]identity.CryptoGroup, len(path))
+	for i, r := range path {
+		groups[i].Group.Relays = []identity.Relay{r}
+		if err := groups[i].GenerateCryptoMaterial(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	payload := make([]byte, payloadSize)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate cover payload: %w", err)
+	}
+
+	opts = append(opts[:len(opts):len(opts)], onion.WithDropAt(dropAt))
+	layer, err := onion.BuildOnion(path[len(path)-1].Ep, groups, payload, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return layer, groups, nil
+}
@@ -0,0 +1,115 @@
+package cover_test
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/cover"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"golang.org/x/crypto/curve25519"
+)
+
+func testRelays(t *testing.T, n int) []identity.Relay {
+	t.Helper()
+
+	relays := make([]identity.Relay, n)
+	for i := range relays {
+		var priv [32]byte
+		if _, err := rand.Read(priv[:]); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		relays[i].Ep = identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: uint16(62500 + i)}
+		relays[i].UUID[0] = byte(i)
+		copy(relays[i].PubKey[:], pub)
+	}
+	return relays
+}
+
+func TestInterval(t *testing.T) {
+	t.Parallel()
+
+	if got := cover.Interval(0); got < 100*365*24*time.Hour {
+		t.Fatalf("Interval(0) = %s, want practically infinite", got)
+	}
+
+	var total time.Duration
+	const n = 2000
+	for range n {
+		d := cover.Interval(10)
+		if d < 0 {
+			t.Fatalf("negative interval %s", d)
+		}
+		total += d
+	}
+	if mean := total / n; mean < 70*time.Millisecond || mean > 130*time.Millisecond {
+		t.Fatalf("mean interval = %s, want about 100ms", mean)
+	}
+}
+
+func TestRandomPath(t *testing.T) {
+	t.Parallel()
+
+	relays := testRelays(t, 3)
+
+	for range 100 {
+		path, err := cover.RandomPath(relays, onion.MaxJump)
+		if err != nil {
+			t.Fatalf("RandomPath() failed: %v", err)
+		}
+		if len(path) != onion.MaxJump {
+			t.Fatalf("path length = %d, want %d", len(path), onion.MaxJump)
+		}
+		for i := 1; i < len(path); i++ {
+			if path[i].UUID == path[i-1].UUID {
+				t.Fatalf("same relay twice in a row at hop %d", i)
+			}
+		}
+	}
+
+	if _, err := cover.RandomPath(nil, 2); err == nil {
+		t.Error("expected error without relays")
+	}
+	if _, err := cover.RandomPath(relays, 0); err == nil {
+		t.Error("expected error for zero hops")
+	}
+	if _, err := cover.RandomPath(relays, onion.MaxJump+1); err == nil {
+		t.Error("expected error for too many hops")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+
+	relays := testRelays(t, 3)
+
+	layer, err := cover.Build(relays, len(relays)-1, onion.WithMixDelay(2))
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	raw, err := layer.BytesPadded()
+	if err != nil {
+		t.Fatalf("BytesPadded() failed: %v", err)
+	}
+	if len(raw) != onion.PacketSize {
+		t.Fatalf("cover size = %d, want %d", len(raw), onion.PacketSize)
+	}
+	if layer.Flags != 0 {
+		t.Fatalf("mix delay class leaked in the cleartext flags: 0x%02x", layer.Flags)
+	}
+
+	if _, err := cover.Build(nil, 0); err == nil {
+		t.Error("expected error for empty path")
+	}
+	if _, err := cover.Build(relays, len(relays)); err == nil {
+		t.Error("expected error for drop hop out of range")
+	}
+}
@@ -0,0 +1,166 @@
+// Package erasure implements a systematic Reed-Solomon code over GF(2^8):
+// data is split into k shards, extended to n, and any k of them rebuild it.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the largest n supported by the code.
+const MaxShards = 255
+
+var ErrTooFewShards = errors.New("not enough shards to reconstruct")
+
+func checkParams(k, n int) error {
+	if k < 1 || n < k || n > MaxShards {
+		return fmt.Errorf("invalid erasure parameters k=%d n=%d (want 1 <= k <= n <= %d)", k, n, MaxShards)
+	}
+	return nil
+}
+
+// ShardSize returns the size of each shard when splitting size bytes into k
+// data shards.
+func ShardSize(size, k int) int {
+	if size == 0 {
+		return 1
+	}
+	return (size + k - 1) / k
+}
+
+// row returns the coefficients producing shard i from the k data shards.
+// The first k rows form the identity, the other ones a Cauchy matrix, so any
+// k rows are linearly independent.
+func row(i, k int) []byte {
+	r := make([]byte, k)
+	if i < k {
+		r[i] = 1
+		return r
+	}
+	for j := range k {
+		r[j] = gfInv(byte(i) ^ byte(j))
+	}
+	return r
+}
+
+// Split splits data into k equally sized data shards and n-k parity shards.
+func Split(data []byte, k, n int) ([][]byte, error) {
+	if err := checkParams(k, n); err != nil {
+		return nil, err
+	}
+
+	size := ShardSize(len(data), k)
+	padded := make([]byte, size*k)
+	copy(padded, data)
+
+	shards := make([][]byte, n)
+	for i := range k {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	for i := k; i < n; i++ {
+		shards[i] = make([]byte, size)
+		for j, c := range row(i, k) {
+			mulAdd(shards[i], shards[j], c)
+		}
+	}
+	return shards, nil
+}
+
+// Join rebuilds the original size bytes from shards, indexed by shard
+// number, in which missing shards are nil. At least k must be present.
+func Join(shards [][]byte, k, size int) ([]byte, error) {
+	n := len(shards)
+	if err := checkParams(k, n); err != nil {
+		return nil, err
+	}
+
+	shardSize := ShardSize(size, k)
+	var (
+		idx  []int
+		rows [][]byte
+	)
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		if len(s) != shardSize {
+			return nil, fmt.Errorf("shard %d has %d bytes, want %d", i, len(s), shardSize)
+		}
+		idx = append(idx, i)
+		rows = append(rows, row(i, k))
+		if len(idx) == k {
+			break
+		}
+	}
+	if len(idx) < k {
+		return nil, ErrTooFewShards
+	}
+
+	dec, err := invert(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, shardSize*k)
+	for i := range k {
+		dst := out[i*shardSize : (i+1)*shardSize]
+		for j, c := range dec[i] {
+			mulAdd(dst, shards[idx[j]], c)
+		}
+	}
+	return out[:size], nil
+}
+
+// mulAdd computes dst += c*src.
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(c, b)
+	}
+}
+
+// invert returns the inverse of the square matrix m by Gauss-Jordan
+// elimination. m is modified.
+func invert(m [][]byte) ([][]byte, error) {
+	k := len(m)
+	inv := make([][]byte, k)
+	for i := range inv {
+		inv[i] = make([]byte, k)
+		inv[i][i] = 1
+	}
+
+	for col := range k {
+		pivot := -1
+		for r := col; r < k; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("singular decoding matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(m[col][col])
+		for j := range k {
+			m[col][j] = gfMul(m[col][j], scale)
+			inv[col][j] = gfMul(inv[col][j], scale)
+		}
+
+		for r := range k {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			f := m[r][col]
+			for j := range k {
+				m[r][j] ^= gfMul(f, m[col][j])
+				inv[r][j] ^= gfMul(f, inv[col][j])
+			}
+		}
+	}
+	return inv, nil
+}
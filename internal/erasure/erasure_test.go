@@ -0,0 +1,127 @@
+package erasure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestGF256(t *testing.T) {
+	t.Parallel()
+
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInv(byte(a))); got != 1 {
+			t.Fatalf("%d * inv(%d) = %d, want 1", a, a, got)
+		}
+	}
+	if gfMul(0, 42) != 0 || gfMul(42, 0) != 0 {
+		t.Fatal("multiplication by zero should be zero")
+	}
+}
+
+// subsets returns every subset of {0..n-1} of size k.
+func subsets(n, k int) [][]int {
+	var out [][]int
+	var rec func(start int, cur []int)
+	rec = func(start int, cur []int) {
+		if len(cur) == k {
+			out = append(out, append([]int(nil), cur...))
+			return
+		}
+		for i := start; i < n; i++ {
+			rec(i+1, append(cur, i))
+		}
+	}
+	rec(0, nil)
+	return out
+}
+
+func TestSplitJoin_AnyKShards(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		k, n, size int
+	}{
+		{1, 1, 10},
+		{1, 3, 10},
+		{2, 3, 1000},
+		{3, 3, 7},
+		{2, 3, 0},
+		{4, 10, 333},
+	}
+
+	for _, tt := range tests {
+		data := make([]byte, tt.size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+
+		shards, err := Split(data, tt.k, tt.n)
+		if err != nil {
+			t.Fatalf("Split(k=%d, n=%d) failed: %v", tt.k, tt.n, err)
+		}
+		if len(shards) != tt.n {
+			t.Fatalf("got %d shards, want %d", len(shards), tt.n)
+		}
+
+		for _, keep := range subsets(tt.n, tt.k) {
+			partial := make([][]byte, tt.n)
+			for _, i := range keep {
+				partial[i] = shards[i]
+			}
+
+			got, err := Join(partial, tt.k, tt.size)
+			if err != nil {
+				t.Fatalf("Join(k=%d, n=%d, keep=%v) failed: %v", tt.k, tt.n, keep, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Join(k=%d, n=%d, keep=%v) mismatch", tt.k, tt.n, keep)
+			}
+		}
+	}
+}
+
+func TestSplit_Systematic(t *testing.T) {
+	t.Parallel()
+
+	shards, err := Split([]byte("abcdef"), 2, 3)
+	if err != nil {
+		t.Fatalf("Split() failed: %v", err)
+	}
+	if string(shards[0]) != "abc" || string(shards[1]) != "def" {
+		t.Fatalf("data shards = %q %q, want the data itself", shards[0], shards[1])
+	}
+}
+
+func TestJoin_TooFewShards(t *testing.T) {
+	t.Parallel()
+
+	shards, err := Split([]byte("payload"), 2, 3)
+	if err != nil {
+		t.Fatalf("Split() failed: %v", err)
+	}
+
+	_, err = Join([][]byte{nil, shards[1], nil}, 2, 7)
+	if !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("Join() error = %v, want ErrTooFewShards", err)
+	}
+}
+
+func TestSplit_InvalidParams(t *testing.T) {
+	t.Parallel()
+
+	for _, p := range [][2]int{{0, 1}, {3, 2}, {1, 256}} {
+		if _, err := Split([]byte("x"), p[0], p[1]); err == nil {
+			t.Errorf("Split(k=%d, n=%d) should fail", p[0], p[1])
+		}
+	}
+}
+
+func TestJoin_WrongShardSize(t *testing.T) {
+	t.Parallel()
+
+	if _, err := Join([][]byte{{1, 2}, {3}}, 2, 4); err == nil {
+		t.Fatal("expected error for mismatched shard size")
+	}
+}
@@ -0,0 +1,107 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// Cell is a captured onion cell.
+type Cell struct {
+	Source string // where the cell was found, empty for a lone cell
+	Data   []byte
+
+	// Envelope is the hybrid envelope the cell travelled with, nil unless
+	// it was captured in a HybridOnionPacket.
+	Envelope *onion.HybridEnvelope
+}
+
+// hybridFrameSize is the size of a whole HybridOnionPacket frame.
+const hybridFrameSize = packet.HeaderSize + onion.HybridEnvelopeSize + onion.PacketSize
+
+// Formats of the captures read by ReadCells.
+const (
+	FormatAuto = "auto"
+	FormatHex  = "hex"
+	FormatBin  = "bin"
+	FormatPcap = "pcap"
+)
+
+// ReadCells reads the cells of a capture. Hex and binary captures hold a
+// single cell, bare or as a whole OnionPacket or HybridOnionPacket frame; hex
+// ones may be spread over lines and spaced. FormatAuto tells the formats apart from the content.
+func ReadCells(data []byte, format string) ([]Cell, error) {
+	if format == FormatAuto {
+		format = detectFormat(data)
+	}
+
+	switch format {
+	case FormatPcap:
+		return ReadPcap(bytes.NewReader(data))
+	case FormatHex:
+		raw, err := hex.DecodeString(strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) || r == ':' {
+				return -1
+			}
+			return r
+		}, string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex capture: %w", err)
+		}
+		return readCell(raw)
+	case FormatBin:
+		return readCell(data)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func detectFormat(data []byte) string {
+	switch {
+	case IsPcap(data):
+		return FormatPcap
+	case len(data) == onion.PacketSize || len(data) == packet.HeaderSize+onion.PacketSize || len(data) == hybridFrameSize:
+		return FormatBin
+	default:
+		return FormatHex
+	}
+}
+
+// readCell reads a lone cell, stripping the frame header of an OnionPacket
+// or HybridOnionPacket.
+func readCell(raw []byte) ([]Cell, error) {
+	switch len(raw) {
+	case onion.PacketSize:
+		return []Cell{{Data: raw}}, nil
+	case packet.HeaderSize + onion.PacketSize, hybridFrameSize:
+		p, err := packet.ReadPacket(nil, bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		c, ok := frameCell(p)
+		if !ok {
+			return nil, fmt.Errorf("frame of type 0x%02x is not an onion packet", p.Type())
+		}
+		return []Cell{c}, nil
+	default:
+		return nil, fmt.Errorf("cell is %d bytes, want %d", len(raw), onion.PacketSize)
+	}
+}
+
+// frameCell returns the cell carried by p, if it is an onion packet.
+func frameCell(p packet.Packet) (Cell, bool) {
+	switch op := p.(type) {
+	case *packet.OnionPacket:
+		return Cell{Data: bytes.Clone(op.Data[:])}, true
+	case *packet.HybridOnionPacket:
+		env := op.Envelope
+		return Cell{Data: bytes.Clone(op.Data[:]), Envelope: &env}, true
+	default:
+		return Cell{}, false
+	}
+}
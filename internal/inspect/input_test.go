@@ -0,0 +1,290 @@
+package inspect_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/inspect"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func testCell(b byte) []byte {
+	return bytes.Repeat([]byte{b}, onion.PacketSize)
+}
+
+func onionFrame(t *testing.T, cell []byte) []byte {
+	t.Helper()
+
+	var p packet.OnionPacket
+	copy(p.Data[:], cell)
+	var buf bytes.Buffer
+	if err := packet.WritePacket(nil, &buf, &p); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func hybridFrame(t *testing.T, cell []byte) []byte {
+	t.Helper()
+
+	p := packet.HybridOnionPacket{Envelope: onion.HybridEnvelope{0x01}}
+	copy(p.Data[:], cell)
+	var buf bytes.Buffer
+	if err := packet.WritePacket(nil, &buf, &p); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadCells(t *testing.T) {
+	t.Parallel()
+
+	cell := testCell(0xab)
+	frame := onionFrame(t, cell)
+	hybrid := hybridFrame(t, cell)
+
+	spaced := hex.EncodeToString(cell)
+	spaced = spaced[:100] + "\n  " + spaced[100:] + "\n"
+
+	tests := []struct {
+		name       string
+		data       []byte
+		format     string
+		wantHybrid bool
+		wantErr    bool
+	}{
+		{"bin cell", cell, inspect.FormatBin, false, false},
+		{"bin frame", frame, inspect.FormatBin, false, false},
+		{"hex cell", []byte(hex.EncodeToString(cell)), inspect.FormatHex, false, false},
+		{"hex frame", []byte(hex.EncodeToString(frame)), inspect.FormatHex, false, false},
+		{"auto bin", cell, inspect.FormatAuto, false, false},
+		{"auto spaced hex", []byte(spaced), inspect.FormatAuto, false, false},
+		{"auto pcap", writePcap(t, linkEthernet, []testSegment{{data: frame}}), inspect.FormatAuto, false, false},
+		{"auto hybrid frame", hybrid, inspect.FormatAuto, true, false},
+		{"auto hybrid pcap", writePcap(t, linkEthernet, []testSegment{{data: hybrid}}), inspect.FormatAuto, true, false},
+		{"short cell", cell[:100], inspect.FormatBin, false, true},
+		{"invalid hex", []byte("zz"), inspect.FormatHex, false, true},
+		{"unknown format", cell, "json", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cells, err := inspect.ReadCells(tt.data, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadCells() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(cells) != 1 || !bytes.Equal(cells[0].Data, cell) {
+				t.Fatalf("cells mismatch: got %d cells", len(cells))
+			}
+			if hybrid := cells[0].Envelope != nil; hybrid != tt.wantHybrid {
+				t.Errorf("envelope mismatch: got %t, want %t", hybrid, tt.wantHybrid)
+			}
+		})
+	}
+}
+
+const (
+	linkEthernet = 1
+	linkRaw      = 101
+	linkSLL      = 113
+)
+
+type testSegment struct {
+	src, dst net.IP
+	seq      uint32
+	syn      bool
+	data     []byte
+}
+
+// writePcap writes a little-endian capture of segments sent from port 40000
+// to port 62503.
+func writePcap(t *testing.T, linkType uint32, segs []testSegment) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.Write(le.AppendUint32(nil, 0xa1b2c3d4))
+	buf.Write(le.AppendUint16(nil, 2))
+	buf.Write(le.AppendUint16(nil, 4))
+	buf.Write(make([]byte, 8))
+	buf.Write(le.AppendUint32(nil, 65535))
+	buf.Write(le.AppendUint32(nil, linkType))
+
+	for _, s := range segs {
+		if s.src == nil {
+			s.src, s.dst = net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+		}
+
+		tcp := make([]byte, 20)
+		binary.BigEndian.PutUint16(tcp[0:2], 40000)
+		binary.BigEndian.PutUint16(tcp[2:4], 62503)
+		binary.BigEndian.PutUint32(tcp[4:8], s.seq)
+		tcp[12] = 5 << 4
+		if s.syn {
+			tcp[13] = 0x02
+		}
+		tcp = append(tcp, s.data...)
+
+		var ip []byte
+		etherType := uint16(0x0800)
+		if v4 := s.src.To4(); v4 != nil {
+			ip = make([]byte, 20)
+			ip[0] = 0x45
+			binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+			ip[9] = 6
+			copy(ip[12:16], v4)
+			copy(ip[16:20], s.dst.To4())
+		} else {
+			etherType = 0x86dd
+			ip = make([]byte, 40)
+			ip[0] = 0x60
+			binary.BigEndian.PutUint16(ip[4:6], uint16(len(tcp)))
+			ip[6] = 6
+			copy(ip[8:24], s.src)
+			copy(ip[24:40], s.dst)
+		}
+		ip = append(ip, tcp...)
+
+		var frame []byte
+		switch linkType {
+		case linkEthernet:
+			frame = make([]byte, 12)
+			frame = binary.BigEndian.AppendUint16(frame, etherType)
+		case linkSLL:
+			frame = make([]byte, 14)
+			frame = binary.BigEndian.AppendUint16(frame, etherType)
+		}
+		frame = append(frame, ip...)
+
+		buf.Write(make([]byte, 8))
+		buf.Write(le.AppendUint32(nil, uint32(len(frame))))
+		buf.Write(le.AppendUint32(nil, uint32(len(frame))))
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func TestReadPcap(t *testing.T) {
+	t.Parallel()
+
+	var hello bytes.Buffer
+	if err := packet.WritePacket(nil, &hello, &packet.Hello{}); err != nil {
+		t.Fatal(err)
+	}
+	first, second := onionFrame(t, testCell(1)), onionFrame(t, testCell(2))
+	stream := append(append(hello.Bytes(), first...), second...)
+
+	const isn = 1000
+	split := 1500
+	v6src, v6dst := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+
+	tests := []struct {
+		name     string
+		linkType uint32
+		segs     []testSegment
+		want     int
+	}{
+		{
+			name:     "in order",
+			linkType: linkEthernet,
+			segs: []testSegment{
+				{seq: isn, syn: true},
+				{seq: isn + 1, data: stream[:split]},
+				{seq: isn + 1 + uint32(split), data: stream[split:]},
+			},
+			want: 2,
+		},
+		{
+			name:     "reordered and retransmitted",
+			linkType: linkSLL,
+			segs: []testSegment{
+				{seq: isn, syn: true},
+				{seq: isn + 1 + uint32(split), data: stream[split:]},
+				{seq: isn + 1, data: stream[:split]},
+				{seq: isn + 1, data: stream[:split+10]},
+			},
+			want: 2,
+		},
+		{
+			name:     "without handshake",
+			linkType: linkRaw,
+			segs: []testSegment{
+				{seq: 7, data: stream[:split]},
+				{seq: 7 + uint32(split), data: stream[split:]},
+			},
+			want: 2,
+		},
+		{
+			name:     "hole",
+			linkType: linkEthernet,
+			segs: []testSegment{
+				{seq: isn, syn: true},
+				{seq: isn + 1, data: stream[:len(hello.Bytes())+len(first)]},
+				{seq: isn + 1 + uint32(len(stream)-10), data: stream[len(stream)-10:]},
+			},
+			want: 1,
+		},
+		{
+			name:     "ipv6",
+			linkType: linkEthernet,
+			segs:     []testSegment{{src: v6src, dst: v6dst, seq: 1, data: stream}},
+			want:     2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cells, err := inspect.ReadPcap(bytes.NewReader(writePcap(t, tt.linkType, tt.segs)))
+			if err != nil {
+				t.Fatalf("ReadPcap() failed: %v", err)
+			}
+			if len(cells) != tt.want {
+				t.Fatalf("cell count mismatch:\n\tgot:  %d\n\twant: %d", len(cells), tt.want)
+			}
+			for i, c := range cells {
+				if !bytes.Equal(c.Data, testCell(byte(i+1))) {
+					t.Errorf("cell %d mismatch", i)
+				}
+				if !strings.Contains(c.Source, ":40000 -> ") {
+					t.Errorf("cell %d source %q misses the flow", i, c.Source)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPcap_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a capture", make([]byte, 24)},
+		{"unsupported link type", writePcap(t, 228, nil)},
+		{"truncated record", writePcap(t, linkEthernet, []testSegment{{seq: 1, data: []byte("x")}})[:30]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := inspect.ReadPcap(bytes.NewReader(tt.data)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
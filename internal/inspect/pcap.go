@@ -0,0 +1,330 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// Link types of the captures ReadPcap understands.
+const (
+	linkTypeNull     = 0   // BSD loopback
+	linkTypeEthernet = 1   // Ethernet II
+	linkTypeRaw      = 101 // raw IPv4 or IPv6
+	linkTypeLinuxSLL = 113 // Linux cooked capture, as tcpdump -i any writes
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+
+	pcapHeaderSize = 24
+	pcapRecordSize = 16
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+
+	protoTCP = 6
+	tcpSYN   = 0x02
+)
+
+// IsPcap reports whether data starts like a pcap or pcapng capture.
+func IsPcap(data []byte) bool {
+	return isClassicPcap(data) || isPcapNG(data)
+}
+
+func isClassicPcap(data []byte) bool {
+	_, ok := classicOrder(data)
+	return ok
+}
+
+func classicOrder(data []byte) (binary.ByteOrder, bool) {
+	if len(data) < 4 {
+		return nil, false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if m := order.Uint32(data); m == pcapMagicMicro || m == pcapMagicNano {
+			return order, true
+		}
+	}
+	return nil, false
+}
+
+// ReadPcap extracts the onion cells of the TCP streams of a pcap or pcapng
+// capture. Each direction of a connection is reassembled in sequence order,
+// up to its first hole, and read as a series of DOR frames. Cells are
+// returned in the order their streams start in the capture.
+func ReadPcap(r io.Reader) ([]Cell, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var flows tcpFlows
+	if isPcapNG(data) {
+		err = readPcapNG(data, flows.add)
+	} else {
+		err = readClassicPcap(data, flows.add)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return flows.cells(), nil
+}
+
+// frameFunc receives the frames of a capture, with their link type and the
+// byte order of the capture.
+type frameFunc func(linkType uint32, order binary.ByteOrder, frame []byte)
+
+func supportedLinkType(linkType uint32) bool {
+	switch linkType {
+	case linkTypeNull, linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL:
+		return true
+	}
+	return false
+}
+
+func readClassicPcap(data []byte, fn frameFunc) error {
+	if len(data) < pcapHeaderSize {
+		return errors.New("failed to read pcap header: capture too short")
+	}
+	order, ok := classicOrder(data)
+	if !ok {
+		return errors.New("not a pcap or pcapng capture")
+	}
+
+	linkType := order.Uint32(data[20:24]) & 0x0FFFFFFF
+	if !supportedLinkType(linkType) {
+		return fmt.Errorf("unsupported link type %d", linkType)
+	}
+
+	data = data[pcapHeaderSize:]
+	for len(data) > 0 {
+		if len(data) < pcapRecordSize {
+			return fmt.Errorf("failed to read pcap record: %w", io.ErrUnexpectedEOF)
+		}
+		n := int(order.Uint32(data[8:12]))
+		if n > len(data)-pcapRecordSize {
+			return fmt.Errorf("failed to read pcap record: %w", io.ErrUnexpectedEOF)
+		}
+		fn(linkType, order, data[pcapRecordSize:pcapRecordSize+n])
+		data = data[pcapRecordSize+n:]
+	}
+	return nil
+}
+
+// tcpSegment is the payload of a TCP segment, with the flow it belongs to.
+type tcpSegment struct {
+	key  string // "src -> dst"
+	seq  uint32
+	syn  bool
+	data []byte
+}
+
+// decodeFrame returns the TCP segment carried by a captured frame.
+func decodeFrame(linkType uint32, order binary.ByteOrder, frame []byte) (tcpSegment, bool) {
+	var etherType uint16
+
+	switch linkType {
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return tcpSegment{}, false
+		}
+		// The address family is written in the byte order of the capturing
+		// host, and AF_INET6 differs between systems.
+		if order.Uint32(frame) == 2 {
+			etherType = etherTypeIPv4
+		} else {
+			etherType = etherTypeIPv6
+		}
+		frame = frame[4:]
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return tcpSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+		if etherType == etherTypeVLAN {
+			if len(frame) < 4 {
+				return tcpSegment{}, false
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return tcpSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(frame[14:16])
+		frame = frame[16:]
+	case linkTypeRaw:
+		if len(frame) < 1 {
+			return tcpSegment{}, false
+		}
+		if frame[0]>>4 == 4 {
+			etherType = etherTypeIPv4
+		} else {
+			etherType = etherTypeIPv6
+		}
+	}
+
+	var src, dst net.IP
+	var tcp []byte
+
+	switch etherType {
+	case etherTypeIPv4:
+		if len(frame) < 20 || frame[0]>>4 != 4 || frame[9] != protoTCP {
+			return tcpSegment{}, false
+		}
+		ihl := int(frame[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(frame[2:4]))
+		if ihl < 20 || total < ihl || total > len(frame) {
+			return tcpSegment{}, false
+		}
+		src, dst = net.IP(frame[12:16]), net.IP(frame[16:20])
+		tcp = frame[ihl:total]
+	case etherTypeIPv6:
+		if len(frame) < 40 || frame[0]>>4 != 6 || frame[6] != protoTCP {
+			return tcpSegment{}, false
+		}
+		end := 40 + int(binary.BigEndian.Uint16(frame[4:6]))
+		if end > len(frame) {
+			return tcpSegment{}, false
+		}
+		src, dst = net.IP(frame[8:24]), net.IP(frame[24:40])
+		tcp = frame[40:end]
+	default:
+		return tcpSegment{}, false
+	}
+
+	if len(tcp) < 20 {
+		return tcpSegment{}, false
+	}
+	off := int(tcp[12]>>4) * 4
+	if off < 20 || off > len(tcp) {
+		return tcpSegment{}, false
+	}
+
+	srcPort := binary.BigEndian.Uint16(tcp[0:2])
+	dstPort := binary.BigEndian.Uint16(tcp[2:4])
+	return tcpSegment{
+		key: fmt.Sprintf("%s -> %s",
+			net.JoinHostPort(src.String(), fmt.Sprint(srcPort)),
+			net.JoinHostPort(dst.String(), fmt.Sprint(dstPort)),
+		),
+		seq:  binary.BigEndian.Uint32(tcp[4:8]),
+		syn:  tcp[13]&tcpSYN != 0,
+		data: tcp[off:],
+	}, true
+}
+
+// tcpFlows gathers the segments of a capture by flow.
+type tcpFlows struct {
+	flows []*tcpFlow
+	byKey map[string]*tcpFlow
+}
+
+func (fs *tcpFlows) add(linkType uint32, order binary.ByteOrder, frame []byte) {
+	seg, ok := decodeFrame(linkType, order, frame)
+	if !ok {
+		return
+	}
+
+	f, ok := fs.byKey[seg.key]
+	if !ok {
+		if fs.byKey == nil {
+			fs.byKey = make(map[string]*tcpFlow)
+		}
+		f = &tcpFlow{key: seg.key}
+		fs.byKey[seg.key] = f
+		fs.flows = append(fs.flows, f)
+	}
+	f.add(seg)
+}
+
+func (fs *tcpFlows) cells() []Cell {
+	var cells []Cell
+	for _, f := range fs.flows {
+		cells = append(cells, f.cells()...)
+	}
+	return cells
+}
+
+// tcpFlow is one direction of a TCP connection.
+type tcpFlow struct {
+	key      string
+	isn      uint32
+	synSeen  bool
+	segments []tcpSegment
+}
+
+func (f *tcpFlow) add(seg tcpSegment) {
+	if seg.syn {
+		f.isn, f.synSeen = seg.seq, true
+	}
+	if len(seg.data) > 0 {
+		f.segments = append(f.segments, seg)
+	}
+}
+
+// stream returns the bytes of the flow up to its first hole. Without its SYN,
+// the flow starts at its lowest sequence number.
+func (f *tcpFlow) stream() []byte {
+	if len(f.segments) == 0 {
+		return nil
+	}
+
+	base := f.isn + 1
+	if !f.synSeen {
+		base = f.segments[0].seq
+		for _, s := range f.segments[1:] {
+			if int32(s.seq-base) < 0 {
+				base = s.seq
+			}
+		}
+	}
+
+	segs := slices.Clone(f.segments)
+	slices.SortStableFunc(segs, func(a, b tcpSegment) int {
+		return int(int64(a.seq-base) - int64(b.seq-base))
+	})
+
+	var out []byte
+	for _, s := range segs {
+		off := int(s.seq - base)
+		end := off + len(s.data)
+		switch {
+		case off > len(out):
+			return out
+		case end > len(out):
+			out = append(out, s.data[len(out)-off:]...)
+		}
+	}
+	return out
+}
+
+// cells reads the stream of the flow as DOR frames, keeping the onion
+// packets, hybrid ones included. Reading stops at the first frame that does not decode.
+func (f *tcpFlow) cells() []Cell {
+	r := bytes.NewReader(f.stream())
+
+	var cells []Cell
+	for r.Len() > 0 {
+		p, err := packet.ReadPacket(nil, r)
+		if err != nil {
+			break
+		}
+		if c, ok := frameCell(p); ok {
+			c.Source = fmt.Sprintf("%s #%d", f.key, len(cells))
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
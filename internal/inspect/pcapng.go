@@ -0,0 +1,81 @@
+package inspect
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// pcapng block types, see draft-ietf-opsawg-pcapng.
+const (
+	blockSectionHeader  = 0x0A0D0D0A
+	blockInterface      = 0x00000001
+	blockSimplePacket   = 0x00000003
+	blockEnhancedPacket = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+)
+
+func isPcapNG(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == blockSectionHeader
+}
+
+// readPcapNG hands the packets of the interfaces with a supported link type
+// to fn. Other blocks are skipped.
+func readPcapNG(data []byte, fn frameFunc) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var linkTypes []uint32
+
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return errors.New("truncated pcapng block")
+		}
+
+		if binary.LittleEndian.Uint32(data) == blockSectionHeader {
+			switch uint32(byteOrderMagic) {
+			case binary.LittleEndian.Uint32(data[8:12]):
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(data[8:12]):
+				order = binary.BigEndian
+			default:
+				return errors.New("invalid pcapng byte-order magic")
+			}
+			linkTypes = nil
+		}
+
+		blockType, total := order.Uint32(data[0:4]), int(order.Uint32(data[4:8]))
+		if total < 12 || total%4 != 0 || total > len(data) {
+			return fmt.Errorf("invalid pcapng block length %d", total)
+		}
+		body := data[8 : total-4]
+		data = data[total:]
+
+		switch blockType {
+		case blockInterface:
+			if len(body) < 8 {
+				return errors.New("truncated pcapng interface block")
+			}
+			linkTypes = append(linkTypes, uint32(order.Uint16(body[0:2])))
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return errors.New("truncated pcapng packet block")
+			}
+			iface, n := int(order.Uint32(body[0:4])), int(order.Uint32(body[12:16]))
+			if iface >= len(linkTypes) || n > len(body)-20 {
+				return errors.New("invalid pcapng packet block")
+			}
+			if supportedLinkType(linkTypes[iface]) {
+				fn(linkTypes[iface], order, body[20:20+n])
+			}
+		case blockSimplePacket:
+			if len(body) < 4 || len(linkTypes) == 0 {
+				return errors.New("invalid pcapng simple packet block")
+			}
+			n := min(int(order.Uint32(body[0:4])), len(body)-4)
+			if supportedLinkType(linkTypes[0]) {
+				fn(linkTypes[0], order, body[4:4+n])
+			}
+		}
+	}
+	return nil
+}
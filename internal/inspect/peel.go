@@ -0,0 +1,143 @@
+// Package inspect looks inside captured onion cells offline. Given the
+// private identities of some relays, it peels the layers they can open, as
+// the relays themselves would, for protocol debugging.
+package inspect
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+// ErrNoKey is set on the last layer of a peel when none of the supplied
+// identities can unwrap its session key.
+var ErrNoKey = errors.New("no supplied identity opens this layer")
+
+// Layer is one layer of a peeled cell.
+type Layer struct {
+	// Outer is the layer as read from the wire. Once peeled, its CipherText
+	// is trimmed of the padding.
+	Outer *onion.OnionLayer
+
+	// Relay is the identity that opened the layer and Slot the wrapped key
+	// slot its session key was found in. Relay is nil and Slot -1 when no
+	// identity opens the layer.
+	Relay *identity.PrivateIdentity
+	Slot  int
+
+	// Hybrid is set on the layers of a hybrid onion.
+	Hybrid bool
+
+	// Inner is the decrypted content of the layer, nil when it was not
+	// peeled.
+	Inner *onion.OnionLayerCiphered
+
+	// Err tells why peeling stopped at this layer, nil when the layer is the
+	// last one of the path.
+	Err error
+}
+
+// Peeled reports whether the layer was decrypted.
+func (l *Layer) Peeled() bool {
+	return l.Inner != nil
+}
+
+// Peel peels cell with ids, layer by layer, until a layer cannot be opened
+// or the last relay of the path is reached. The layers are returned in path
+// order; only the last one may carry an Err. An error is returned when cell
+// is not an onion layer at all.
+func Peel(cell []byte, ids []*identity.PrivateIdentity) ([]Layer, error) {
+	return peel(cell, nil, ids)
+}
+
+// PeelHybrid is Peel for a hybrid onion cell captured with env, the
+// envelope sealed for its entry relay. The identity opening the first layer
+// must hold the ML-KEM key of that relay; the hybrid secrets of the next
+// layers are read from the layers before them.
+func PeelHybrid(cell []byte, env onion.HybridEnvelope, ids []*identity.PrivateIdentity) ([]Layer, error) {
+	return peel(cell, &env, ids)
+}
+
+func peel(cell []byte, env *onion.HybridEnvelope, ids []*identity.PrivateIdentity) ([]Layer, error) {
+	outer := &onion.OnionLayer{}
+	if err := outer.Parse(cell); err != nil {
+		return nil, fmt.Errorf("not an onion layer: %w", err)
+	}
+
+	h := hybrid{env: env}
+	var layers []Layer
+	for {
+		l := peelLayer(outer, h, ids)
+		layers = append(layers, l)
+		if l.Err != nil || l.Inner.LastServer || l.Inner.Drop {
+			return layers, nil
+		}
+
+		if l.Hybrid {
+			secret, ok := onion.NextHybridSecret(l.Inner.Extensions)
+			if !ok {
+				layers[len(layers)-1].Err = errors.New("hybrid layer without the hybrid secret of the next group")
+				return layers, nil
+			}
+			h = hybrid{secret: &secret}
+		}
+
+		next := &onion.OnionLayer{}
+		if err := next.Parse(l.Inner.Payload); err != nil {
+			layers[len(layers)-1].Err = fmt.Errorf("payload is not an onion layer: %w", err)
+			return layers, nil
+		}
+		outer = next
+	}
+}
+
+// hybrid holds what opens the hybrid secret of a layer: the envelope it was
+// captured with for the first one, the secret read from the previous layer
+// for the others. Both are nil for classic onions.
+type hybrid struct {
+	env    *onion.HybridEnvelope
+	secret *[32]byte
+}
+
+func (h hybrid) enabled() bool {
+	return h.env != nil || h.secret != nil
+}
+
+// peelLayer opens outer with the first identity of ids holding one of its
+// wrapped keys.
+func peelLayer(outer *onion.OnionLayer, h hybrid, ids []*identity.PrivateIdentity) Layer {
+	l := Layer{Outer: outer, Slot: -1, Hybrid: h.enabled(), Err: ErrNoKey}
+
+	for _, pi := range ids {
+		sessionKey, slot, err := unwrap(outer, h, pi)
+		if err != nil {
+			continue
+		}
+
+		l.Relay, l.Slot = pi, slot
+		l.Inner, l.Err = outer.Decrypt(sessionKey)
+		return l
+	}
+	return l
+}
+
+func unwrap(outer *onion.OnionLayer, h hybrid, pi *identity.PrivateIdentity) ([32]byte, int, error) {
+	if !h.enabled() {
+		return onion.UnwrapSessionKeySlot(pi.PrivKey, pi.UUID, outer.EPK, outer.WrappedKeys)
+	}
+
+	secret := h.secret
+	if secret == nil {
+		if pi.KEM == nil {
+			return [32]byte{}, -1, errors.New("no KEM key to open the hybrid envelope")
+		}
+		opened, err := onion.OpenHybridEnvelope(pi.KEM, *h.env)
+		if err != nil {
+			return [32]byte{}, -1, err
+		}
+		secret = &opened
+	}
+	return onion.UnwrapHybridSessionKeySlot(pi.PrivKey, pi.UUID, outer.EPK, *secret, outer.WrappedKeys)
+}
@@ -0,0 +1,254 @@
+package inspect_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/inspect"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+type testRelay struct {
+	pi    *identity.PrivateIdentity
+	relay identity.Relay
+}
+
+func newTestRelays(t *testing.T, n int) []testRelay {
+	t.Helper()
+
+	relays := make([]testRelay, n)
+	for i := range relays {
+		pi, err := identity.LoadPrivateIdentity(t.TempDir())
+		if err != nil {
+			t.Fatalf("LoadPrivateIdentity() failed: %v", err)
+		}
+		relays[i] = testRelay{
+			pi: pi,
+			relay: identity.Relay{
+				Ep:     identity.Endpoint{IP: net.ParseIP(fmt.Sprintf("10.0.0.%d", i+1)), Port: 62503},
+				UUID:   pi.UUID,
+				PubKey: pi.PubKey,
+				KEMKey: pi.KEMKey(),
+			},
+		}
+	}
+	return relays
+}
+
+// buildCell builds a cell through groups of relays, given by index.
+func buildCell(t *testing.T, relays []testRelay, groups [][]int, payload []byte, opts ...onion.BuildOption) []byte {
+	t.Helper()
+
+	cell, _ := buildPathCell(t, relays, groups, payload, opts...)
+	return cell
+}
+
+// buildPathCell is buildCell also returning the path of the cell.
+func buildPathCell(t *testing.T, relays []testRelay, groups [][]int, payload []byte, opts ...onion.BuildOption) ([]byte, []identity.CryptoGroup) {
+	t.Helper()
+
+	path := make([]identity.CryptoGroup, len(groups))
+	for i, idx := range groups {
+		for _, j := range idx {
+			path[i].Group.Relays = append(path[i].Group.Relays, relays[j].relay)
+		}
+		if err := path[i].GenerateCryptoMaterial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest := identity.Endpoint{IP: net.ParseIP("192.0.2.1"), Port: 8080}
+	layer, err := onion.BuildOnion(dest, path, payload, opts...)
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+	cell, err := layer.BytesPadded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cell, path
+}
+
+func TestPeel(t *testing.T) {
+	t.Parallel()
+
+	relays := newTestRelays(t, 4)
+	payload := []byte("peeled offline")
+
+	tests := []struct {
+		name    string
+		groups  [][]int
+		ids     []int
+		opts    []onion.BuildOption
+		peeled  int
+		wantErr error
+	}{
+		{"all keys", [][]int{{0}, {1, 2}, {3}}, []int{3, 2, 1, 0}, nil, 3, nil},
+		{"missing middle key", [][]int{{0}, {1}, {2}}, []int{0, 2}, nil, 1, inspect.ErrNoKey},
+		{"no keys", [][]int{{0}, {1}}, nil, nil, 0, inspect.ErrNoKey},
+		{"cover", [][]int{{0}, {1}, {2}}, []int{0, 1, 2}, []onion.BuildOption{onion.WithDropAt(1)}, 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cell := buildCell(t, relays, tt.groups, payload, tt.opts...)
+			var ids []*identity.PrivateIdentity
+			for _, i := range tt.ids {
+				ids = append(ids, relays[i].pi)
+			}
+
+			layers, err := inspect.Peel(cell, ids)
+			if err != nil {
+				t.Fatalf("Peel() failed: %v", err)
+			}
+
+			peeled := 0
+			for i, l := range layers {
+				if !l.Peeled() {
+					continue
+				}
+				peeled++
+
+				inGroup := false
+				for _, j := range tt.groups[i] {
+					inGroup = inGroup || l.Relay == relays[j].pi
+				}
+				if !inGroup {
+					t.Errorf("layer %d opened by a relay outside its group", i)
+				}
+				if l.Slot < 0 || l.Slot >= onion.MaxWrappedKey {
+					t.Errorf("layer %d: slot %d out of range", i, l.Slot)
+				}
+			}
+			if peeled != tt.peeled {
+				t.Fatalf("peeled layers mismatch:\n\tgot:  %d\n\twant: %d", peeled, tt.peeled)
+			}
+
+			last := layers[len(layers)-1]
+			if !errors.Is(last.Err, tt.wantErr) {
+				t.Errorf("last layer error mismatch:\n\tgot:  %v\n\twant: %v", last.Err, tt.wantErr)
+			}
+			if tt.wantErr == nil && len(tt.opts) == 0 {
+				if !last.Inner.LastServer || !bytes.Equal(last.Inner.Payload, payload) {
+					t.Errorf("exit layer mismatch: last=%t payload=%q", last.Inner.LastServer, last.Inner.Payload)
+				}
+			}
+		})
+	}
+}
+
+func TestPeelHybrid(t *testing.T) {
+	t.Parallel()
+
+	relays := newTestRelays(t, 4)
+	payload := []byte("peeled offline")
+	groups := [][]int{{0, 1}, {2}, {3}}
+
+	cell, path := buildPathCell(t, relays, groups, payload, onion.WithHybridKEM())
+	secret, err := onion.HybridSecret(path[0].CipherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := onion.SealHybridEnvelope(relays[1].relay.KEMKey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ids     []int
+		peeled  int
+		wantErr error
+	}{
+		{"all keys", []int{3, 2, 1}, 3, nil},
+		// Only the relay the envelope is sealed for opens the first layer.
+		{"other entry relay", []int{0, 2, 3}, 0, inspect.ErrNoKey},
+		{"missing middle key", []int{1, 3}, 1, inspect.ErrNoKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var ids []*identity.PrivateIdentity
+			for _, i := range tt.ids {
+				ids = append(ids, relays[i].pi)
+			}
+
+			if layers, err := inspect.Peel(cell, ids); err != nil || layers[0].Peeled() {
+				t.Fatalf("Peel() of a hybrid cell without its envelope opened it (err %v)", err)
+			}
+
+			layers, err := inspect.PeelHybrid(cell, env, ids)
+			if err != nil {
+				t.Fatalf("PeelHybrid() failed: %v", err)
+			}
+
+			peeled := 0
+			for _, l := range layers {
+				if !l.Hybrid {
+					t.Error("layer of a hybrid cell not marked hybrid")
+				}
+				if l.Peeled() {
+					peeled++
+				}
+			}
+			if peeled != tt.peeled {
+				t.Fatalf("peeled layers mismatch:\n\tgot:  %d\n\twant: %d", peeled, tt.peeled)
+			}
+
+			last := layers[len(layers)-1]
+			if !errors.Is(last.Err, tt.wantErr) {
+				t.Errorf("last layer error mismatch:\n\tgot:  %v\n\twant: %v", last.Err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !bytes.Equal(last.Inner.Payload, payload) {
+				t.Errorf("exit payload mismatch: got %q, want %q", last.Inner.Payload, payload)
+			}
+		})
+	}
+}
+
+func TestPeel_NotALayer(t *testing.T) {
+	t.Parallel()
+
+	if _, err := inspect.Peel(make([]byte, 10), nil); err == nil {
+		t.Fatal("expected an error for a truncated cell")
+	}
+}
+
+func TestFprint(t *testing.T) {
+	t.Parallel()
+
+	relays := newTestRelays(t, 2)
+	cell := buildCell(t, relays, [][]int{{0}, {1}}, []byte("hi"))
+
+	layers, err := inspect.Peel(cell, []*identity.PrivateIdentity{relays[0].pi})
+	if err != nil {
+		t.Fatalf("Peel() failed: %v", err)
+	}
+
+	var out strings.Builder
+	if err := inspect.Fprint(&out, layers); err != nil {
+		t.Fatalf("Fprint() failed: %v", err)
+	}
+
+	for _, want := range []string{
+		"Layer 0",
+		"Layer 1",
+		fmt.Sprintf("EPK:          %x", layers[0].Outer.EPK),
+		"<- relay",
+		"Next hops:  10.0.0.2:62503",
+		"Stopped:      " + inspect.ErrNoKey.Error(),
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package inspect
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/google/uuid"
+)
+
+// maxDump bounds the bytes of a payload printed in hex.
+const maxDump = 64
+
+var extensionNames = map[uint8]string{
+	onion.ExtShare:          "share",
+	onion.ExtMixDelay:       "mix-delay",
+	onion.ExtAckRequest:     "ack-request",
+	onion.ExtAckDeliver:     "ack-deliver",
+	onion.ExtServicePublish: "service-publish",
+	onion.ExtIntroRegister:  "intro-register",
+	onion.ExtIntroduce:      "introduce",
+	onion.ExtRendezvous:     "rendezvous",
+	onion.ExtRendezvousJoin: "rendezvous-join",
+	onion.ExtGuardDeliver:   "guard-deliver",
+	onion.ExtHybridSecret:   "hybrid-secret",
+}
+
+// Fprint writes a human readable dump of layers to w.
+func Fprint(w io.Writer, layers []Layer) error {
+	p := &printer{w: w}
+	for i, l := range layers {
+		if i > 0 {
+			p.line("")
+		}
+		p.layer(i, &l)
+	}
+	return p.err
+}
+
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) line(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, format+"\n", args...)
+}
+
+func (p *printer) layer(i int, l *Layer) {
+	out := l.Outer
+	p.line("Layer %d", i)
+	p.line("  EPK:          %x", out.EPK)
+
+	p.line("  Flags:        0x%02x", out.Flags)
+	p.line("  Nonce:        %x", out.PayloadNonce)
+	if l.Hybrid {
+		p.line("  Hybrid:       yes")
+	}
+
+	p.line("  Wrapped keys:")
+	for s, wk := range out.WrappedKeys {
+		mark := ""
+		if s == l.Slot && l.Relay != nil {
+			mark = fmt.Sprintf("  <- relay %s", uuid.UUID(l.Relay.UUID))
+		}
+		p.line("    [%d] nonce %x  cipher %x...%s", s, wk.Nonce, wk.CipherText[:8], mark)
+	}
+
+	if l.Peeled() {
+		p.line("  CipherText:   %d bytes", len(out.CipherText))
+		p.inner(l.Inner)
+	} else {
+		p.line("  CipherText:   %d bytes (encrypted)", len(out.CipherText))
+	}
+
+	if l.Err != nil {
+		p.line("  Stopped:      %v", l.Err)
+	}
+}
+
+func (p *printer) inner(olc *onion.OnionLayerCiphered) {
+	p.line("  Inner:")
+	p.line("    Flags:      extensions=%t redundancy=%d drop=%t last=%t next-hops=%d",
+		len(olc.Extensions) > 0, olc.Redundancy, olc.Drop, olc.LastServer, len(olc.NextHops),
+	)
+
+	hops := make([]string, len(olc.NextHops))
+	for i, ep := range olc.NextHops {
+		hops[i] = ep.String()
+	}
+	if len(hops) > 0 {
+		p.line("    Next hops:  %s", strings.Join(hops, ", "))
+	}
+
+	for _, ext := range olc.Extensions {
+		name, ok := extensionNames[ext.Type]
+		if !ok {
+			name = "unknown"
+		}
+		p.line("    Extension:  0x%02x %s (%d bytes)", ext.Type, name, len(ext.Value))
+	}
+
+	p.line("    Payload:    %d bytes (length field %d)", len(olc.Payload), olc.UtilPayloadLength)
+	if olc.LastServer {
+		data := olc.Payload
+		suffix := ""
+		if len(data) > maxDump {
+			data, suffix = data[:maxDump], "..."
+		}
+		p.line("    Data:       %x%s", data, suffix)
+	}
+}
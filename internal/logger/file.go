@@ -0,0 +1,322 @@
+package logger
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names the rotated files, sorting them by age.
+const backupTimeFormat = "20060102T150405Z"
+
+// FileConfig configures a log file and its rotation.
+type FileConfig struct {
+	Path string
+
+	// MaxSize is the size in bytes past which the file is rotated, 0
+	// disabling size-based rotation.
+	MaxSize int64
+	// RotateEvery rotates the file on the multiples of this period since
+	// the Unix epoch, so 24h rotates at midnight UTC. 0 disables it.
+	RotateEvery time.Duration
+
+	// MaxBackups is the number of rotated files kept, 0 keeping them all.
+	MaxBackups int
+	// MaxAge is how long rotated files are kept, 0 keeping them forever.
+	MaxAge time.Duration
+	// Compress gzips the rotated files.
+	Compress bool
+}
+
+// DefaultFileConfig returns the rotation used by the relays: 100 MiB files,
+// the last seven kept compressed.
+func DefaultFileConfig() FileConfig {
+	return FileConfig{
+		MaxSize:    100 << 20,
+		MaxBackups: 7,
+		Compress:   true,
+	}
+}
+
+// File is a log file rotated by size and time. Rotated files are renamed
+// with the time of their rotation, then compressed and pruned in the
+// background. It is safe for concurrent use.
+type File struct {
+	mu     sync.Mutex
+	cfg    FileConfig
+	f      *os.File
+	size   int64
+	period time.Time // start of the rotation period of f
+	now    func() time.Time
+
+	bg    sync.WaitGroup // compression and pruning
+	bgMu  sync.Mutex     // runs them one at a time
+	bgErr error
+}
+
+// OpenFile opens the log file of cfg, appending to it when it exists.
+func OpenFile(cfg FileConfig) (*File, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("empty log file path")
+	}
+	if cfg.MaxSize < 0 || cfg.RotateEvery < 0 || cfg.MaxBackups < 0 || cfg.MaxAge < 0 {
+		return nil, errors.New("negative log rotation limit")
+	}
+
+	lf := &File{cfg: cfg, now: time.Now}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(lf.cfg.Path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(lf.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	lf.f = f
+	lf.size = info.Size()
+	// An existing file belongs to the period it was last written in, so a
+	// restart past the end of that period rotates it.
+	start := lf.now()
+	if lf.size > 0 {
+		start = info.ModTime()
+	}
+	lf.period = lf.periodStart(start)
+	return nil
+}
+
+func (lf *File) periodStart(t time.Time) time.Time {
+	if lf.cfg.RotateEvery <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(lf.cfg.RotateEvery)
+}
+
+// Write writes p to the file, rotating it first when p would take it past
+// MaxSize or when its rotation period is over.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	now := lf.now()
+	overSize := lf.cfg.MaxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.cfg.MaxSize
+	overTime := lf.cfg.RotateEvery > 0 && !lf.periodStart(now).Equal(lf.period)
+	if overSize || overTime {
+		if err := lf.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now.
+func (lf *File) Rotate() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		return os.ErrClosed
+	}
+	return lf.rotate(lf.now())
+}
+
+func (lf *File) rotate(now time.Time) error {
+	backup, err := lf.backupName(now)
+	if err != nil {
+		return err // keep writing to the current file
+	}
+
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	lf.f = nil
+	if err := os.Rename(lf.cfg.Path, backup); err != nil {
+		return errors.Join(err, lf.open()) // keep writing to the current file
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	lf.period = lf.periodStart(now)
+
+	lf.bg.Add(1)
+	go func() {
+		defer lf.bg.Done()
+
+		lf.bgMu.Lock()
+		defer lf.bgMu.Unlock()
+
+		var err error
+		if lf.cfg.Compress {
+			err = compress(backup)
+		}
+		err = errors.Join(err, lf.prune(now))
+		if err != nil {
+			lf.mu.Lock()
+			lf.bgErr = errors.Join(lf.bgErr, err)
+			lf.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// backupName returns a free name for the file rotated at now.
+func (lf *File) backupName(now time.Time) (string, error) {
+	base := lf.cfg.Path + "." + now.UTC().Format(backupTimeFormat)
+	for i := 0; i < 100; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		_, err := os.Stat(name)
+		_, gzErr := os.Stat(name + ".gz")
+		if errors.Is(err, os.ErrNotExist) && errors.Is(gzErr, os.ErrNotExist) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free name to rotate %s", lf.cfg.Path)
+}
+
+// compress gzips path into path.gz and removes it. A file pruned in the
+// meantime is skipped.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	err = errors.Join(err, zw.Close(), out.Close())
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the rotated files beyond MaxBackups or older than MaxAge.
+func (lf *File) prune(now time.Time) error {
+	if lf.cfg.MaxBackups == 0 && lf.cfg.MaxAge == 0 {
+		return nil
+	}
+
+	backups, err := lf.backups()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, b := range backups {
+		tooMany := lf.cfg.MaxBackups > 0 && i >= lf.cfg.MaxBackups
+		tooOld := lf.cfg.MaxAge > 0 && now.Sub(b.rotated) > lf.cfg.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		for _, name := range b.names {
+			if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type backup struct {
+	rotated time.Time
+	names   []string // the file and its compressed copy, while compressing
+}
+
+// backups lists the rotated files of the log file, newest first.
+func (lf *File) backups() ([]backup, error) {
+	dir, base := filepath.Split(lf.cfg.Path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*backup)
+	var keys []string
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), base+".")
+		if !ok || e.IsDir() {
+			continue
+		}
+		key := strings.TrimSuffix(name, ".gz")
+		stamp, _, _ := strings.Cut(key, "-")
+		rotated, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+
+		b, ok := byName[key]
+		if !ok {
+			b = &backup{rotated: rotated}
+			byName[key] = b
+			keys = append(keys, key)
+		}
+		b.names = append(b.names, filepath.Join(dir, e.Name()))
+	}
+
+	slices.SortFunc(keys, func(a, b string) int { return strings.Compare(b, a) })
+	out := make([]backup, len(keys))
+	for i, k := range keys {
+		out[i] = *byName[k]
+	}
+	return out, nil
+}
+
+// Close closes the file once the background compression and pruning are
+// done, and returns their errors.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	var err error
+	if lf.f != nil {
+		err = lf.f.Close()
+		lf.f = nil
+	}
+	lf.mu.Unlock()
+
+	lf.bg.Wait()
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return errors.Join(err, lf.bgErr)
+}
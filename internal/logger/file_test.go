@@ -0,0 +1,260 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rotated returns the names of the rotated files of path, oldest first.
+func rotated(t *testing.T, path string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range matches {
+		matches[i] = filepath.Base(m)
+	}
+	slices.Sort(matches)
+	return matches
+}
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFile_SizeRotation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		compress   bool
+		maxBackups int
+		wantFiles  int
+	}{
+		{name: "keep all", wantFiles: 4},
+		{name: "compressed", compress: true, wantFiles: 4},
+		{name: "two backups", compress: true, maxBackups: 2, wantFiles: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "logs", "dord.log")
+			lf, err := OpenFile(FileConfig{
+				Path:       path,
+				MaxSize:    10,
+				MaxBackups: tt.maxBackups,
+				Compress:   tt.compress,
+			})
+			if err != nil {
+				t.Fatalf("OpenFile() failed: %v", err)
+			}
+			now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+			lf.now = func() time.Time { return now }
+
+			for _, line := range []string{"line 0\n", "line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+				if _, err := lf.Write([]byte(line)); err != nil {
+					t.Fatalf("Write() failed: %v", err)
+				}
+				now = now.Add(time.Second)
+			}
+			if err := lf.Close(); err != nil {
+				t.Fatalf("Close() failed: %v", err)
+			}
+
+			if got := readLog(t, path); got != "line 4\n" {
+				t.Errorf("current file mismatch:\n\tgot:  %q\n\twant: %q", got, "line 4\n")
+			}
+
+			files := rotated(t, path)
+			if len(files) != tt.wantFiles {
+				t.Fatalf("rotated file count mismatch:\n\tgot:  %v\n\twant: %d files", files, tt.wantFiles)
+			}
+			for i, name := range files {
+				if strings.HasSuffix(name, ".gz") != tt.compress {
+					t.Errorf("%s: compression mismatch, want %v", name, tt.compress)
+				}
+				// The newest files are kept.
+				want := "line " + string(rune('0'+4-len(files)+i)) + "\n"
+				if got := readLog(t, filepath.Join(filepath.Dir(path), name)); got != want {
+					t.Errorf("%s mismatch:\n\tgot:  %q\n\twant: %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFile_TimeRotation(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "dord.log")
+	lf, err := OpenFile(FileConfig{Path: path, RotateEvery: 24 * time.Hour, MaxAge: 36 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC)
+	lf.now = func() time.Time { return now }
+	lf.period = lf.periodStart(now)
+
+	write := func(s string) {
+		t.Helper()
+		if _, err := lf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("day 1\n")
+	now = now.Add(30 * time.Second)
+	write("day 1 again\n")
+	now = now.Add(time.Minute) // past midnight
+	write("day 2\n")
+	now = now.Add(24 * time.Hour)
+	write("day 3\n")
+	now = now.Add(24 * time.Hour)
+	write("day 4\n")
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"dord.log.20261020T000030Z", "dord.log.20261021T000030Z"}
+	if got := rotated(t, path); !slices.Equal(got, want) {
+		t.Errorf("rotated files mismatch (day 1 is past MaxAge):\n\tgot:  %v\n\twant: %v", got, want)
+	}
+	if got := readLog(t, path); got != "day 4\n" {
+		t.Errorf("current file mismatch:\n\tgot:  %q\n\twant: %q", got, "day 4\n")
+	}
+}
+
+func TestFile_NoBackupName(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "dord.log")
+	lf, err := OpenFile(FileConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	lf.now = func() time.Time { return now }
+
+	// Every name a rotation at now could take is in use.
+	base := path + "." + now.Format(backupTimeFormat)
+	for i := 0; i < 100; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := lf.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.Rotate(); err == nil {
+		t.Fatal("Rotate() succeeded without a free name")
+	}
+	if _, err := lf.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write() after a failed rotation: %v", err)
+	}
+
+	if got := readLog(t, path); got != "before\nafter\n" {
+		t.Errorf("current file mismatch:\n\tgot:  %q\n\twant: %q", got, "before\nafter\n")
+	}
+}
+
+func TestFile_Reopen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "dord.log")
+	for _, line := range []string{"first\n", "second\n"} {
+		lf, err := OpenFile(FileConfig{Path: path, MaxSize: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := lf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		if err := lf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := readLog(t, path); got != "first\nsecond\n" {
+		t.Errorf("file mismatch:\n\tgot:  %q\n\twant: %q", got, "first\nsecond\n")
+	}
+}
+
+func TestOpenFile_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		cfg  FileConfig
+	}{
+		{"empty path", FileConfig{}},
+		{"negative size", FileConfig{Path: filepath.Join(t.TempDir(), "a.log"), MaxSize: -1}},
+		{"negative backups", FileConfig{Path: filepath.Join(t.TempDir(), "a.log"), MaxBackups: -1}},
+	}
+
+	for _, tt := range tests {
+		if _, err := OpenFile(tt.cfg); err == nil {
+			t.Errorf("%s: OpenFile() succeeded", tt.name)
+		}
+	}
+}
+
+func TestAddOutput(t *testing.T) {
+	var console, file bytes.Buffer
+	withStd(t, New(&console, Info, true))
+	AddOutput(&file, false)
+
+	Warnf("disk almost full")
+
+	if !strings.Contains(console.String(), "\033[33m") {
+		t.Errorf("console line not colored: %q", console.String())
+	}
+	if strings.Contains(file.String(), "\033[") || !strings.HasSuffix(file.String(), "[WARN ] disk almost full\n") {
+		t.Errorf("file line mismatch: %q", file.String())
+	}
+
+	console.Reset()
+	file.Reset()
+	SetFormat(FormatJSON)
+	Infof("json")
+	if console.String() != file.String() || !strings.Contains(file.String(), `"msg":"json"`) {
+		t.Errorf("JSON lines differ:\n\tconsole: %q\n\tfile:    %q", console.String(), file.String())
+	}
+}
@@ -1,9 +1,12 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,6 +23,22 @@ const (
 	Off
 )
 
+// Format is the encoding of the lines written by a Logger.
+type Format uint32
+
+const (
+	// FormatText writes a line per entry, its fields as key=value pairs.
+	FormatText Format = iota
+	// FormatJSON writes a JSON object per entry, as slog.JSONHandler does.
+	FormatJSON
+)
+
+// output is a writer added with AddOutput.
+type output struct {
+	w     io.Writer
+	color bool
+}
+
 type Logger struct {
 	mu          sync.Mutex
 	out         io.Writer
@@ -27,6 +46,12 @@ type Logger struct {
 	enableColor bool
 	timeFormat  string
 	useUTC      bool
+	format      Format
+	handler     slog.Handler // replaces out when set
+	json        slog.Handler // writes to out and extra in FormatJSON
+	extra       []output     // written to along with out
+	privacy     atomic.Uint32
+	scrub       *scrubber
 }
 
 var std = New(os.Stdout, Info, true)
@@ -37,6 +62,7 @@ func New(out io.Writer, lvl Level, color bool) *Logger {
 		enableColor: color,
 		timeFormat:  time.RFC3339,
 		useUTC:      true,
+		scrub:       newScrubber(),
 	}
 	l.level.Store(uint32(lvl))
 	return l
@@ -46,6 +72,17 @@ func SetOutput(w io.Writer) {
 	std.mu.Lock()
 	defer std.mu.Unlock()
 	std.out = w
+	std.setJSON()
+}
+
+// AddOutput adds w to the outputs of the default logger, next to the one set
+// with SetOutput, so that a colored console and a plain file get the same
+// lines.
+func AddOutput(w io.Writer, color bool) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.extra = append(std.extra, output{w: w, color: color})
+	std.setJSON()
 }
 
 func SetLevel(l Level) {
@@ -58,6 +95,49 @@ func DisableColor() {
 	std.enableColor = false
 }
 
+// SetFormat sets the encoding of the lines of the default logger.
+func SetFormat(f Format) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.format = f
+	std.setJSON()
+}
+
+// setJSON builds the handler writing the JSON lines to the outputs, once
+// for all entries. Callers hold l.mu.
+func (l *Logger) setJSON() {
+	if l.format != FormatJSON {
+		l.json = nil
+		return
+	}
+
+	w := l.out
+	if len(l.extra) > 0 {
+		ws := []io.Writer{l.out}
+		for _, o := range l.extra {
+			ws = append(ws, o.w)
+		}
+		w = io.MultiWriter(ws...)
+	}
+	l.json = slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       slog.LevelDebug,
+		ReplaceAttr: replaceFatal,
+	})
+}
+
+// SetHandler hands the entries of the default logger to h instead of writing
+// them to its output. The level set with SetLevel still applies first. A nil
+// handler restores the output.
+func SetHandler(h slog.Handler) {
+	if sh, ok := h.(*handler); ok && sh.l == std {
+		h = nil // would loop back into std
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.handler = h
+}
+
 func (l Level) String() string {
 	switch l {
 	case Debug:
@@ -92,27 +172,126 @@ func ParseLevel(s string) Level {
 	}
 }
 
+// ParseFormat returns the format named s, "text" or "json", defaulting to
+// FormatText.
+func ParseFormat(s string) Format {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "json":
+		return FormatJSON
+	default:
+		return FormatText
+	}
+}
+
 func (l *Logger) output(lvl Level, colorCode, label, msg string) {
+	l.outputAttrs(lvl, colorCode, label, msg, nil)
+}
+
+func (l *Logger) outputAttrs(lvl Level, colorCode, label, msg string, attrs []slog.Attr) {
 	if lvl < Level(l.level.Load()) {
 		return
 	}
 
+	if Privacy(l.privacy.Load()) == Safe {
+		msg = l.scrub.message(msg)
+		attrs = l.scrub.attrs(attrs)
+	}
+
 	now := time.Now()
 	if l.useUTC {
 		now = now.UTC()
 	}
-	ts := now.Format(l.timeFormat)
 
-	var line string
-	if l.enableColor {
-		line = fmt.Sprintf("\033[%sm%s [%-5s]\033[0m %s\n", colorCode, ts, label, msg)
-	} else {
-		line = fmt.Sprintf("%s [%-5s] %s\n", ts, label, msg)
+	l.mu.Lock()
+	h := l.handler
+	if h == nil {
+		h = l.json
 	}
+	if h != nil {
+		// The handler may log in turn, and serializes its own writes.
+		l.mu.Unlock()
 
-	l.mu.Lock()
+		r := slog.NewRecord(now, slogLevel(lvl, label), msg, 0)
+		r.AddAttrs(attrs...)
+		if h.Enabled(context.Background(), r.Level) {
+			_ = h.Handle(context.Background(), r)
+		}
+		return
+	}
 	defer l.mu.Unlock()
-	_, _ = l.out.Write([]byte(line))
+
+	var lines [2][]byte // plain, colored
+	line := func(color bool) []byte {
+		i := 0
+		if color {
+			i = 1
+		}
+		if lines[i] == nil {
+			lines[i] = textLine(now.Format(l.timeFormat), color, colorCode, label, msg, attrs)
+		}
+		return lines[i]
+	}
+
+	_, _ = l.out.Write(line(l.enableColor))
+	for _, o := range l.extra {
+		_, _ = o.w.Write(line(o.color))
+	}
+}
+
+func textLine(ts string, color bool, colorCode, label, msg string, attrs []slog.Attr) []byte {
+	var b strings.Builder
+	if color {
+		fmt.Fprintf(&b, "\033[%sm%s [%-5s]\033[0m %s", colorCode, ts, label, msg)
+	} else {
+		fmt.Fprintf(&b, "%s [%-5s] %s", ts, label, msg)
+	}
+
+	var flat []slog.Attr
+	for _, a := range attrs {
+		flat = appendFlat(flat, "", a)
+	}
+	for _, a := range flat {
+		b.WriteByte(' ')
+		b.WriteString(a.Key)
+		b.WriteByte('=')
+		b.WriteString(quoteValue(a.Value.Resolve().String()))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// levelFatal is the slog level of the entries written by Fatalf.
+const levelFatal = slog.LevelError + 4
+
+func slogLevel(lvl Level, label string) slog.Level {
+	switch {
+	case label == "FATAL":
+		return levelFatal
+	case lvl == Debug:
+		return slog.LevelDebug
+	case lvl == Warn:
+		return slog.LevelWarn
+	case lvl == Error:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func replaceFatal(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.LevelKey && a.Value.Any() == levelFatal {
+		a.Value = slog.StringValue("FATAL")
+	}
+	return a
+}
+
+// quoteValue quotes a text field value when it would not read back as one
+// token.
+func quoteValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") || !strconv.CanBackquote(s) {
+		return strconv.Quote(s)
+	}
+	return s
 }
 
 func Debugf(format string, a ...any) {
@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Privacy is how much of the identifying data of the traffic a Logger lets
+// through.
+type Privacy uint32
+
+const (
+	// Safe replaces addresses, keys, next hops and the other fields of
+	// sensitiveKeys with keyed hashes, whatever the level. The hash key
+	// changes every UTC day, so the lines of a day can be correlated but
+	// not those of different days.
+	Safe Privacy = iota
+	// Unsafe writes every field and message as it is.
+	Unsafe
+)
+
+// sensitiveKeys are the fields hashed in Safe mode. Their values identify a
+// peer, a route or a circuit.
+var sensitiveKeys = map[string]bool{
+	"remote":   true,
+	"next_hop": true,
+	"epk":      true,
+	"nonce":    true,
+	"layer":    true,
+	"service":  true,
+	"token":    true,
+	"cookie":   true,
+}
+
+// SetPrivacy sets the privacy mode of the default logger, Safe by default.
+func SetPrivacy(p Privacy) {
+	std.privacy.Store(uint32(p))
+}
+
+var (
+	// addrCandidate matches the words of a message that may be an IP
+	// address, with or without a port.
+	addrCandidate = regexp.MustCompile(`\[[0-9A-Fa-f:.%\w]+\](?::\d+)?|[0-9A-Fa-f:.]*[:.][0-9A-Fa-f:.]*[0-9A-Fa-f]`)
+	// longHex matches the hex dumps of keys and nonces in a message.
+	longHex = regexp.MustCompile(`\b[0-9A-Fa-f]{16,}\b`)
+)
+
+// scrubber hashes sensitive values with a key drawn at random every UTC day.
+type scrubber struct {
+	mu  sync.Mutex
+	day int64
+	key [32]byte
+	now func() time.Time
+}
+
+func newScrubber() *scrubber {
+	return &scrubber{day: -1, now: time.Now}
+}
+
+// hash returns the keyed hash standing for v in the logs of the day.
+func (s *scrubber) hash(v string) string {
+	s.mu.Lock()
+	if day := s.now().UTC().Unix() / 86400; day != s.day {
+		_, _ = rand.Read(s.key[:])
+		s.day = day
+	}
+	mac := hmac.New(sha256.New, s.key[:])
+	s.mu.Unlock()
+
+	mac.Write([]byte(v))
+	return "anon:" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// message replaces the IP addresses and long hex strings of msg, such as the
+// ones wrapped errors carry.
+func (s *scrubber) message(msg string) string {
+	msg = addrCandidate.ReplaceAllStringFunc(msg, func(w string) string {
+		if !isAddr(w) {
+			return w
+		}
+		return s.hash(w)
+	})
+	return longHex.ReplaceAllStringFunc(msg, s.hash)
+}
+
+// attrs returns attrs with the values of sensitive keys hashed, groups
+// included, and the other string values scrubbed as messages are.
+func (s *scrubber) attrs(attrs []slog.Attr) []slog.Attr {
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = s.attr(a)
+	}
+	return out
+}
+
+func (s *scrubber) attr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		a.Value = slog.GroupValue(s.attrs(a.Value.Group())...)
+	case sensitiveKeys[a.Key[strings.LastIndexByte(a.Key, '.')+1:]]:
+		a.Value = slog.StringValue(s.hash(a.Value.String()))
+	case a.Value.Kind() == slog.KindString, a.Value.Kind() == slog.KindAny:
+		a.Value = slog.StringValue(s.message(a.Value.String()))
+	}
+	return a
+}
+
+// isAddr reports whether w is an IP address, with or without a port.
+func isAddr(w string) bool {
+	if host, _, err := net.SplitHostPort(w); err == nil {
+		w = host
+	}
+	w = strings.Trim(w, "[]")
+	if i := strings.IndexByte(w, '%'); i >= 0 {
+		w = w[:i] // zone
+	}
+	return net.ParseIP(w) != nil
+}
@@ -0,0 +1,144 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// secrets are the values that must never reach the output in Safe mode.
+var secrets = []string{
+	"10.0.0.2",
+	"fd00::2",
+	"/tmp/dor/relay.sock",
+	"8e1f6c0a52b4d7e93c2a1f0e6d5b4a39",
+	"a1b2c3d4e5f60718",
+	"3f2a9c1d",
+	"dorabcdefghijk.dor",
+}
+
+func logSensitive() {
+	log := With(
+		"remote", "10.0.0.2:62503",
+		"next_hop", "[fd00::2]:62504",
+		"epk", "8e1f6c0a52b4d7e93c2a1f0e6d5b4a39",
+		"nonce", "a1b2c3d4e5f60718",
+		"layer", "3f2a9c1d",
+		slog.Group("peer", "remote", "/tmp/dor/relay.sock"),
+	)
+	log.Debugf("Onion layer parsed")
+	log.With("service", "dorabcdefghijk.dor").Infof("Descriptor stored")
+	log.With("err", errors.New("dial tcp 10.0.0.2:62503: connection refused")).Warnf("relay failed")
+	log.Errorf("Failed to relay packet to [fd00::2]:62504: %v", errors.New("write unix /tmp/x: broken pipe"))
+	Warnf("read 10.0.0.2:62503: epk %s rejected", "8e1f6c0a52b4d7e93c2a1f0e6d5b4a39")
+	Infof("no route to fd00::2")
+	slog.New(Handler()).WithGroup("req").Error("slog", "next_hop", "10.0.0.2:1", "remote", "fd00::2")
+}
+
+func TestSafe_NoSensitiveOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		handler bool
+	}{
+		{name: "text"},
+		{name: "json", format: FormatJSON},
+		{name: "slog handler", handler: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := New(&buf, Debug, false)
+			old := std
+			std = l
+			defer func() { std = old }()
+
+			SetFormat(tt.format)
+			if tt.handler {
+				SetHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			}
+
+			logSensitive()
+
+			out := buf.String()
+			if strings.Count(out, "\n") < 7 {
+				t.Fatalf("lines missing from the output:\n%s", out)
+			}
+			for _, s := range secrets {
+				if strings.Contains(out, s) {
+					t.Errorf("%q reached the output:\n%s", s, out)
+				}
+			}
+			if !strings.Contains(out, "anon:") {
+				t.Errorf("no hashed value in the output:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestUnsafe(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Debug, false)
+	old := std
+	std = l
+	defer func() { std = old }()
+
+	SetPrivacy(Unsafe)
+	logSensitive()
+
+	for _, s := range secrets {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("%q missing from the output:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestScrubber_hash(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	s := newScrubber()
+	s.now = func() time.Time { return now }
+
+	a := s.hash("10.0.0.2:62503")
+	if s.hash("10.0.0.2:62503") != a {
+		t.Error("hash changed within a day")
+	}
+	if s.hash("10.0.0.3:62503") == a {
+		t.Error("distinct values share a hash")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if s.hash("10.0.0.2:62503") == a {
+		t.Error("hash key not rotated on a new day")
+	}
+}
+
+func TestIsAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"10.0.0.2", true},
+		{"10.0.0.2:62503", true},
+		{"[fd00::2]:62504", true},
+		{"fd00::2", true},
+		{"[fe80::1%eth0]:1", true},
+		{"::1", true},
+		{"12:30:45", false},
+		{"1.5", false},
+		{"0x02", false},
+	}
+
+	for _, tt := range tests {
+		if got := isAddr(tt.input); got != tt.expected {
+			t.Errorf("isAddr(%q) mismatch:\n\tgot:  %v\n\twant: %v", tt.input, got, tt.expected)
+		}
+	}
+}
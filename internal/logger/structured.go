@@ -0,0 +1,163 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Entry is a set of fields added to every line logged through it, such as
+// the remote address and correlation ID of a connection. A nil *Entry logs
+// without fields.
+type Entry struct {
+	attrs []slog.Attr
+}
+
+// With returns an Entry of the default logger carrying the given fields, as
+// key/value pairs or slog.Attr values in the manner of slog.Logger.With.
+func With(args ...any) *Entry {
+	return (*Entry)(nil).With(args...)
+}
+
+// With returns a copy of e with more fields.
+func (e *Entry) With(args ...any) *Entry {
+	var attrs []slog.Attr
+	if e != nil {
+		attrs = e.attrs
+	}
+
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(args...)
+
+	out := make([]slog.Attr, len(attrs), len(attrs)+r.NumAttrs())
+	copy(out, attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		out = append(out, a)
+		return true
+	})
+	return &Entry{attrs: out}
+}
+
+func (e *Entry) fields() []slog.Attr {
+	if e == nil {
+		return nil
+	}
+	return e.attrs
+}
+
+func (e *Entry) Debugf(format string, a ...any) {
+	std.outputAttrs(Debug, "34", "DEBUG", fmt.Sprintf(format, a...), e.fields())
+}
+
+func (e *Entry) Infof(format string, a ...any) {
+	std.outputAttrs(Info, "32", "INFO", fmt.Sprintf(format, a...), e.fields())
+}
+
+func (e *Entry) Warnf(format string, a ...any) {
+	std.outputAttrs(Warn, "33", "WARN", fmt.Sprintf(format, a...), e.fields())
+}
+
+func (e *Entry) Errorf(format string, a ...any) {
+	std.outputAttrs(Error, "31", "ERROR", fmt.Sprintf(format, a...), e.fields())
+}
+
+// NewID returns a random correlation ID, 8 hex digits, to tie together the
+// lines of a connection or a packet.
+func NewID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Handler returns a slog.Handler writing through the default logger, in its
+// format and honoring its level, so that embedders can log with slog next to
+// DOR.
+func Handler() slog.Handler {
+	return &handler{l: std}
+}
+
+type handler struct {
+	l      *Logger
+	attrs  []slog.Attr
+	prefix string // of the keys, from WithGroup
+}
+
+func (h *handler) Enabled(_ context.Context, lvl slog.Level) bool {
+	return levelOf(lvl) >= Level(h.l.level.Load())
+}
+
+func (h *handler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make([]slog.Attr, len(h.attrs), len(h.attrs)+r.NumAttrs())
+	copy(attrs, h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = appendFlat(attrs, h.prefix, a)
+		return true
+	})
+
+	lvl := levelOf(r.Level)
+	color, label := "32", lvl.String()
+	switch {
+	case r.Level >= levelFatal:
+		color, label = "31", "FATAL"
+	case lvl == Debug:
+		color = "34"
+	case lvl == Warn:
+		color = "33"
+	case lvl == Error:
+		color = "31"
+	}
+	h.l.outputAttrs(lvl, color, label, r.Message, attrs)
+	return nil
+}
+
+func (h *handler) WithAttrs(as []slog.Attr) slog.Handler {
+	attrs := make([]slog.Attr, len(h.attrs), len(h.attrs)+len(as))
+	copy(attrs, h.attrs)
+	for _, a := range as {
+		attrs = appendFlat(attrs, h.prefix, a)
+	}
+	return &handler{l: h.l, attrs: attrs, prefix: h.prefix}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &handler{l: h.l, attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// appendFlat appends a to attrs, groups flattened into dotted keys.
+func appendFlat(attrs []slog.Attr, prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup {
+		if a.Key == "" {
+			return attrs
+		}
+		a.Key = prefix + a.Key
+		return append(attrs, a)
+	}
+
+	if a.Key != "" {
+		prefix += a.Key + "."
+	}
+	for _, ga := range a.Value.Group() {
+		attrs = appendFlat(attrs, prefix, ga)
+	}
+	return attrs
+}
+
+func levelOf(lvl slog.Level) Level {
+	switch {
+	case lvl < slog.LevelInfo:
+		return Debug
+	case lvl < slog.LevelWarn:
+		return Info
+	case lvl < slog.LevelError:
+		return Warn
+	default:
+		return Error
+	}
+}
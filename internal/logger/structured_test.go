@@ -0,0 +1,235 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withStd replaces the default logger for the duration of a test.
+func withStd(t *testing.T, l *Logger) {
+	t.Helper()
+
+	l.privacy.Store(uint32(Unsafe))
+	old := std
+	std = l
+	t.Cleanup(func() { std = old })
+}
+
+func TestEntry_Text(t *testing.T) {
+	var buf bytes.Buffer
+	withStd(t, New(&buf, Debug, false))
+
+	conn := With("conn", "0a1b2c3d", "remote", "10.0.0.1:4000")
+	conn.With("packet", "ffee0011", slog.Int("type", 2)).Infof("packet %s", "handled")
+	conn.Warnf("closed")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		"[INFO ] packet handled conn=0a1b2c3d remote=10.0.0.1:4000 packet=ffee0011 type=2",
+		"[WARN ] closed conn=0a1b2c3d remote=10.0.0.1:4000",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("line count mismatch:\n\tgot:  %q\n\twant: %q", lines, want)
+	}
+	for i := range want {
+		if !strings.HasSuffix(lines[i], want[i]) {
+			t.Errorf("line %d mismatch:\n\tgot:  %q\n\twant: %q", i, lines[i], "... "+want[i])
+		}
+	}
+}
+
+func TestEntry_Nil(t *testing.T) {
+	var buf bytes.Buffer
+	withStd(t, New(&buf, Debug, false))
+
+	var e *Entry
+	e.Debugf("no fields")
+	if !strings.HasSuffix(buf.String(), "[DEBUG] no fields\n") {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		log   func()
+		level string
+		msg   string
+		attrs map[string]any
+	}{
+		{
+			name:  "entry fields",
+			log:   func() { With("remote", "[::1]:62503", "hops", 2).Debugf("relayed to %d hops", 2) },
+			level: "DEBUG",
+			msg:   "relayed to 2 hops",
+			attrs: map[string]any{"remote": "[::1]:62503", "hops": float64(2)},
+		},
+		{
+			name:  "multi-line message",
+			log:   func() { Warnf("first\nsecond") },
+			level: "WARN",
+			msg:   "first\nsecond",
+		},
+		{
+			name:  "fatal",
+			log:   func() { std.output(Error, "31", "FATAL", "giving up") },
+			level: "FATAL",
+			msg:   "giving up",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			withStd(t, New(&buf, Debug, true))
+			SetFormat(FormatJSON)
+
+			tt.log()
+
+			var got map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("output is not one JSON object: %v\n%s", err, buf.String())
+			}
+			if got["level"] != tt.level || got["msg"] != tt.msg {
+				t.Errorf("level/msg mismatch:\n\tgot:  %v %q\n\twant: %v %q", got["level"], got["msg"], tt.level, tt.msg)
+			}
+			if _, ok := got["time"]; !ok {
+				t.Error("missing time")
+			}
+			for k, v := range tt.attrs {
+				if got[k] != v {
+					t.Errorf("field %s mismatch:\n\tgot:  %v\n\twant: %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+type recordingHandler struct {
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestSetHandler(t *testing.T) {
+	var buf bytes.Buffer
+	withStd(t, New(&buf, Info, false))
+
+	h := &recordingHandler{}
+	SetHandler(h)
+	Debugf("below the level")
+	With("conn", "0a1b2c3d").Errorf("failed")
+
+	if buf.Len() != 0 {
+		t.Errorf("output written with a handler set: %q", buf.String())
+	}
+	if len(h.records) != 1 {
+		t.Fatalf("record count mismatch:\n\tgot:  %d\n\twant: 1", len(h.records))
+	}
+	r := h.records[0]
+	if r.Level != slog.LevelError || r.Message != "failed" || r.NumAttrs() != 1 {
+		t.Errorf("unexpected record: %v %q with %d fields", r.Level, r.Message, r.NumAttrs())
+	}
+
+	SetHandler(Handler()) // loops back into the logger: same as nil
+	Infof("restored")
+	if !strings.Contains(buf.String(), "restored") {
+		t.Errorf("output not restored: %q", buf.String())
+	}
+}
+
+// reentrantHandler logs through the default logger while handling a record,
+// as a handler reporting its own failures would.
+type reentrantHandler struct{ recordingHandler }
+
+func (h *reentrantHandler) Handle(ctx context.Context, r slog.Record) error {
+	SetHandler(nil)
+	Warnf("handler failed")
+	return h.recordingHandler.Handle(ctx, r)
+}
+
+func TestSetHandler_Reentrant(t *testing.T) {
+	var buf bytes.Buffer
+	withStd(t, New(&buf, Info, false))
+	SetHandler(&reentrantHandler{})
+
+	done := make(chan struct{})
+	go func() {
+		Infof("handled")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("logging from the handler deadlocked")
+	}
+	if !strings.Contains(buf.String(), "handler failed") {
+		t.Errorf("output mismatch: %q", buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	withStd(t, New(&buf, Info, false))
+
+	sl := slog.New(Handler()).With("app", "embedder").WithGroup("req")
+	sl.Debug("hidden")
+	sl.Warn("slow", "id", 7, slog.Group("peer", "addr", "10.0.0.2:1"))
+
+	want := "[WARN ] slow app=embedder req.id=7 req.peer.addr=10.0.0.2:1\n"
+	if !strings.HasSuffix(buf.String(), want) || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("output mismatch:\n\tgot:  %q\n\twant: %q", buf.String(), "... "+want)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected Format
+	}{
+		{"json", FormatJSON},
+		{" JSON ", FormatJSON},
+		{"text", FormatText},
+		{"invalid", FormatText},
+	}
+
+	for _, tt := range tests {
+		if got := ParseFormat(tt.input); got != tt.expected {
+			t.Errorf("ParseFormat(%q) mismatch:\n\tgot:  %v\n\twant: %v", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestQuoteValue(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input, expected string
+	}{
+		{"10.0.0.1:4000", "10.0.0.1:4000"},
+		{"", `""`},
+		{"two words", `"two words"`},
+		{`a="b"`, `"a=\"b\""`},
+		{"line\nbreak", `"line\nbreak"`},
+	}
+
+	for _, tt := range tests {
+		if got := quoteValue(tt.input); got != tt.expected {
+			t.Errorf("quoteValue(%q) mismatch:\n\tgot:  %s\n\twant: %s", tt.input, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package handshake
+
+import (
+	"strings"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// Capability is the bitmap of optional protocol features exchanged in the
+// Hello/HelloAck packets.
+type Capability uint32
+
+const (
+	CapLinkEncryption Capability = 1 << iota
+	CapCircuits
+	CapFragmentation
+	CapPaddingConstant
+	CapPaddingRandom
+	// CapSphinx marks a peer that accepts fixed-size Sphinx packets.
+	CapSphinx
+	// CapHybrid marks a peer that holds an ML-KEM key and accepts hybrid
+	// onion packets.
+	CapHybrid
+)
+
+// Supported is the set of capabilities this implementation speaks.
+const Supported = CapSphinx | CapHybrid
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapLinkEncryption, "link-encryption"},
+	{CapCircuits, "circuits"},
+	{CapFragmentation, "fragmentation"},
+	{CapPaddingConstant, "padding-constant"},
+	{CapPaddingRandom, "padding-random"},
+	{CapSphinx, "sphinx"},
+	{CapHybrid, "hybrid"},
+}
+
+func (c Capability) Has(other Capability) bool {
+	return c&other == other
+}
+
+// Required returns the capability a peer must have negotiated before it may
+// be sent a packet of type t.
+func Required(t uint8) Capability {
+	switch t {
+	case packet.TypeSphinxPacket:
+		return CapSphinx
+	case packet.TypeHybridOnionPacket:
+		return CapHybrid
+	}
+	return 0
+}
+
+func (c Capability) String() string {
+	if c == 0 {
+		return "none"
+	}
+
+	var names []string
+	rest := c
+	for _, cn := range capabilityNames {
+		if c.Has(cn.c) {
+			names = append(names, cn.name)
+			rest &^= cn.c
+		}
+	}
+	if rest != 0 {
+		names = append(names, "unknown")
+	}
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,64 @@
+package handshake_test
+
+import (
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+)
+
+func TestCapability_String(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		c        handshake.Capability
+		expected string
+	}{
+		{
+			name:     "none",
+			c:        0,
+			expected: "none",
+		},
+		{
+			name:     "single",
+			c:        handshake.CapCircuits,
+			expected: "circuits",
+		},
+		{
+			name:     "multiple",
+			c:        handshake.CapLinkEncryption | handshake.CapPaddingConstant,
+			expected: "link-encryption|padding-constant",
+		},
+		{
+			name:     "unknown bits",
+			c:        handshake.CapFragmentation | 1<<31,
+			expected: "fragmentation|unknown",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := tt.c.String(); got != tt.expected {
+				t.Fatalf("String() mismatch: \ngot: %s\nwant: %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCapability_Has(t *testing.T) {
+	t.Parallel()
+
+	c := handshake.CapLinkEncryption | handshake.CapFragmentation
+
+	if !c.Has(handshake.CapLinkEncryption) {
+		t.Error("Has(CapLinkEncryption) = false, want true")
+	}
+	if !c.Has(handshake.CapLinkEncryption | handshake.CapFragmentation) {
+		t.Error("Has(CapLinkEncryption|CapFragmentation) = false, want true")
+	}
+	if c.Has(handshake.CapCircuits) {
+		t.Error("Has(CapCircuits) = true, want false")
+	}
+}
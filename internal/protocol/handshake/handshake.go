@@ -0,0 +1,171 @@
+// Package handshake implements the Hello/HelloAck exchange that opens every
+// DOR connection and negotiates the protocol version and capabilities.
+package handshake
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+const (
+	// VersionLegacy is the session version of a peer that predates the
+	// handshake and sends its first packet without a Hello.
+	VersionLegacy uint8 = 0
+
+	// Version1 is the original wire format, keyed by the "DORv1" HKDF labels.
+	Version1 uint8 = 1
+
+	MinVersion = Version1
+	MaxVersion = Version1
+
+	DefaultTimeout = 5 * time.Second
+)
+
+var (
+	ErrVersionMismatch  = errors.New("no common protocol version")
+	ErrUnexpectedPacket = errors.New("unexpected packet during handshake")
+	ErrPeerClosed       = errors.New("peer closed the connection during handshake")
+)
+
+type Config struct {
+	MinVersion   uint8
+	MaxVersion   uint8
+	Capabilities Capability
+	Timeout      time.Duration
+	// AllowLegacy accepts peers that do not speak the handshake as
+	// VersionLegacy sessions without capabilities.
+	AllowLegacy bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MinVersion:   MinVersion,
+		MaxVersion:   MaxVersion,
+		Capabilities: Supported,
+		Timeout:      DefaultTimeout,
+		AllowLegacy:  true,
+	}
+}
+
+// Session is the outcome of a successful handshake.
+type Session struct {
+	Version      uint8
+	Capabilities Capability
+}
+
+func (s Session) String() string {
+	return fmt.Sprintf("{version=%d caps=%s}", s.Version, s.Capabilities)
+}
+
+// Negotiate picks the highest version both ranges share and the intersection
+// of both capability sets. A zero Version means there is no common version.
+func Negotiate(local Config, hello *packet.Hello) Session {
+	lo := max(local.MinVersion, hello.MinVersion)
+	hi := min(local.MaxVersion, hello.MaxVersion)
+	if lo == 0 || lo > hi {
+		return Session{}
+	}
+
+	return Session{
+		Version:      hi,
+		Capabilities: local.Capabilities & Capability(hello.Capabilities),
+	}
+}
+
+// Initiate runs the client side of the handshake on a freshly dialed conn.
+func Initiate(conn net.Conn, reg *packet.Registry, cfg Config) (Session, error) {
+	if err := setDeadline(conn, cfg.Timeout); err != nil {
+		return Session{}, err
+	}
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	hello := &packet.Hello{
+		MinVersion:   cfg.MinVersion,
+		MaxVersion:   cfg.MaxVersion,
+		Capabilities: uint32(cfg.Capabilities),
+	}
+	if err := packet.WritePacket(reg, conn, hello); err != nil {
+		return Session{}, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	p, err := packet.ReadPacket(reg, conn)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Session{}, fmt.Errorf("%w: %w", ErrPeerClosed, err)
+	}
+	if err != nil {
+		return Session{}, fmt.Errorf("failed to read hello ack: %w", err)
+	}
+
+	ack, ok := p.(*packet.HelloAck)
+	if !ok {
+		return Session{}, fmt.Errorf("%w: got 0x%02x, want hello ack", ErrUnexpectedPacket, p.Type())
+	}
+
+	if ack.Version == 0 {
+		return Session{}, fmt.Errorf("%w: peer rejected versions %d-%d",
+			ErrVersionMismatch, cfg.MinVersion, cfg.MaxVersion)
+	}
+	if ack.Version < cfg.MinVersion || ack.Version > cfg.MaxVersion {
+		return Session{}, fmt.Errorf("%w: peer chose version %d outside %d-%d",
+			ErrVersionMismatch, ack.Version, cfg.MinVersion, cfg.MaxVersion)
+	}
+
+	return Session{
+		Version:      ack.Version,
+		Capabilities: cfg.Capabilities & Capability(ack.Capabilities),
+	}, nil
+}
+
+// Accept runs the server side of the handshake. A HelloAck is always sent
+// back when a Hello was read, with a zero version when the peer is rejected.
+// When the first packet is not a Hello and cfg.AllowLegacy is set, the peer
+// gets a VersionLegacy session and that packet is returned for the caller to
+// handle; the returned packet is nil otherwise.
+func Accept(conn net.Conn, reg *packet.Registry, cfg Config) (Session, packet.Packet, error) {
+	if err := setDeadline(conn, cfg.Timeout); err != nil {
+		return Session{}, nil, err
+	}
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	p, err := packet.ReadPacket(reg, conn)
+	if err != nil {
+		return Session{}, nil, err
+	}
+
+	hello, ok := p.(*packet.Hello)
+	if !ok {
+		if cfg.AllowLegacy {
+			return Session{Version: VersionLegacy}, p, nil
+		}
+		return Session{}, nil, fmt.Errorf("%w: got 0x%02x, want hello", ErrUnexpectedPacket, p.Type())
+	}
+
+	sess := Negotiate(cfg, hello)
+
+	ack := &packet.HelloAck{
+		Version:      sess.Version,
+		Capabilities: uint32(sess.Capabilities),
+	}
+	if err := packet.WritePacket(reg, conn, ack); err != nil {
+		return Session{}, nil, fmt.Errorf("failed to send hello ack: %w", err)
+	}
+
+	if sess.Version == 0 {
+		return Session{}, nil, fmt.Errorf("%w: local %d-%d, peer %d-%d", ErrVersionMismatch,
+			cfg.MinVersion, cfg.MaxVersion, hello.MinVersion, hello.MaxVersion)
+	}
+
+	return sess, nil, nil
+}
+
+func setDeadline(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	return conn.SetDeadline(time.Now().Add(timeout))
+}
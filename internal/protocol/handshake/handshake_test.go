@@ -0,0 +1,246 @@
+package handshake_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		local    handshake.Config
+		hello    packet.Hello
+		expected handshake.Session
+	}{
+		{
+			name:     "same single version",
+			local:    handshake.Config{MinVersion: 1, MaxVersion: 1},
+			hello:    packet.Hello{MinVersion: 1, MaxVersion: 1},
+			expected: handshake.Session{Version: 1},
+		},
+		{
+			name:     "overlapping ranges pick highest common",
+			local:    handshake.Config{MinVersion: 1, MaxVersion: 3},
+			hello:    packet.Hello{MinVersion: 2, MaxVersion: 5},
+			expected: handshake.Session{Version: 3},
+		},
+		{
+			name:     "disjoint ranges",
+			local:    handshake.Config{MinVersion: 1, MaxVersion: 1},
+			hello:    packet.Hello{MinVersion: 2, MaxVersion: 4},
+			expected: handshake.Session{},
+		},
+		{
+			name:     "zero version is never negotiated",
+			local:    handshake.Config{MinVersion: 0, MaxVersion: 0},
+			hello:    packet.Hello{MinVersion: 0, MaxVersion: 0},
+			expected: handshake.Session{},
+		},
+		{
+			name: "capabilities are intersected",
+			local: handshake.Config{
+				MinVersion:   1,
+				MaxVersion:   1,
+				Capabilities: handshake.CapLinkEncryption | handshake.CapPaddingRandom,
+			},
+			hello: packet.Hello{
+				MinVersion:   1,
+				MaxVersion:   1,
+				Capabilities: uint32(handshake.CapPaddingRandom | handshake.CapCircuits),
+			},
+			expected: handshake.Session{Version: 1, Capabilities: handshake.CapPaddingRandom},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := handshake.Negotiate(tt.local, &tt.hello)
+			if got != tt.expected {
+				t.Fatalf("Negotiate() mismatch:\n\tgot:  %s\n\twant: %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestInitiateAccept(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		client   handshake.Config
+		server   handshake.Config
+		expected handshake.Session
+		wantErr  error
+	}{
+		{
+			name:     "default configs",
+			client:   handshake.DefaultConfig(),
+			server:   handshake.DefaultConfig(),
+			expected: handshake.Session{Version: handshake.Version1, Capabilities: handshake.Supported},
+		},
+		{
+			name: "shared capabilities",
+			client: handshake.Config{
+				MinVersion:   1,
+				MaxVersion:   2,
+				Capabilities: handshake.CapFragmentation | handshake.CapCircuits,
+			},
+			server: handshake.Config{
+				MinVersion:   1,
+				MaxVersion:   1,
+				Capabilities: handshake.CapFragmentation,
+			},
+			expected: handshake.Session{Version: 1, Capabilities: handshake.CapFragmentation},
+		},
+		{
+			name:    "version mismatch",
+			client:  handshake.Config{MinVersion: 2, MaxVersion: 2},
+			server:  handshake.Config{MinVersion: 1, MaxVersion: 1},
+			wantErr: handshake.ErrVersionMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, s := net.Pipe()
+			t.Cleanup(func() {
+				_ = c.Close()
+				_ = s.Close()
+			})
+
+			type result struct {
+				sess handshake.Session
+				err  error
+			}
+			srvCh := make(chan result, 1)
+			go func() {
+				sess, _, err := handshake.Accept(s, nil, tt.server)
+				srvCh <- result{sess, err}
+			}()
+
+			got, err := handshake.Initiate(c, nil, tt.client)
+			srv := <-srvCh
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Initiate() error mismatch:\n\tgot:  %v\n\twant: %v", err, tt.wantErr)
+				}
+				if !errors.Is(srv.err, tt.wantErr) {
+					t.Fatalf("Accept() error mismatch:\n\tgot:  %v\n\twant: %v", srv.err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Initiate() unexpected error: %v", err)
+			}
+			if srv.err != nil {
+				t.Fatalf("Accept() unexpected error: %v", srv.err)
+			}
+			if got != tt.expected || srv.sess != tt.expected {
+				t.Fatalf("session mismatch:\n\tclient: %s\n\tserver: %s\n\twant:   %s", got, srv.sess, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAccept_NotHello(t *testing.T) {
+	t.Parallel()
+
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+
+	go func() {
+		_ = packet.WritePacket(nil, c, &packet.GetIdentityRequest{})
+	}()
+
+	cfg := handshake.DefaultConfig()
+	cfg.AllowLegacy = false
+
+	_, _, err := handshake.Accept(s, nil, cfg)
+	if !errors.Is(err, handshake.ErrUnexpectedPacket) {
+		t.Fatalf("Accept() error mismatch:\n\tgot:  %v\n\twant: %v", err, handshake.ErrUnexpectedPacket)
+	}
+}
+
+func TestAccept_Legacy(t *testing.T) {
+	t.Parallel()
+
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+
+	go func() {
+		_ = packet.WritePacket(nil, c, &packet.GetIdentityRequest{})
+	}()
+
+	sess, first, err := handshake.Accept(s, nil, handshake.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Accept() unexpected error: %v", err)
+	}
+	if want := (handshake.Session{Version: handshake.VersionLegacy}); sess != want {
+		t.Fatalf("session mismatch:\n\tgot:  %s\n\twant: %s", sess, want)
+	}
+	if _, ok := first.(*packet.GetIdentityRequest); !ok {
+		t.Fatalf("first packet mismatch: got %T, want *packet.GetIdentityRequest", first)
+	}
+}
+
+func TestInitiate_PeerClosed(t *testing.T) {
+	t.Parallel()
+
+	c, s := net.Pipe()
+	t.Cleanup(func() { _ = c.Close() })
+
+	// A peer that predates the handshake drops the unknown Hello packet.
+	go func() {
+		buf := make([]byte, 64)
+		_, _ = s.Read(buf)
+		_ = s.Close()
+	}()
+
+	_, err := handshake.Initiate(c, nil, handshake.DefaultConfig())
+	if !errors.Is(err, handshake.ErrPeerClosed) {
+		t.Fatalf("Initiate() error mismatch:\n\tgot:  %v\n\twant: %v", err, handshake.ErrPeerClosed)
+	}
+}
+
+func TestRequired(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		typ      uint8
+		expected handshake.Capability
+	}{
+		{"sphinx", packet.TypeSphinxPacket, handshake.CapSphinx},
+		{"hybrid onion", packet.TypeHybridOnionPacket, handshake.CapHybrid},
+		{"onion", packet.TypeOnionPacket, 0},
+		{"identity", packet.TypeGetIdentityRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := handshake.Required(tt.typ); got != tt.expected {
+				t.Fatalf("Required(0x%02x) = %s, want %s", tt.typ, got, tt.expected)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package identity
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 
 	"golang.org/x/crypto/curve25519"
 )
@@ -25,11 +26,17 @@ func (g CryptoGroup) String() string {
 }
 
 func (g *CryptoGroup) GenerateCryptoMaterial() error {
-	if _, err := rand.Read(g.CipherKey[:]); err != nil {
+	return g.GenerateCryptoMaterialFrom(rand.Reader)
+}
+
+// GenerateCryptoMaterialFrom is GenerateCryptoMaterial drawing the cipher key
+// and the ephemeral key, in that order, from r.
+func (g *CryptoGroup) GenerateCryptoMaterialFrom(r io.Reader) error {
+	if _, err := io.ReadFull(r, g.CipherKey[:]); err != nil {
 		return fmt.Errorf("cipher key generation failed: %w", err)
 	}
 
-	if _, err := rand.Read(g.ESK[:]); err != nil {
+	if _, err := io.ReadFull(r, g.ESK[:]); err != nil {
 		return fmt.Errorf("esk generation failed: %w", err)
 	}
 
@@ -5,19 +5,41 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
+// Endpoint is an IP address and port or, when Host is set, a domain name and
+// port resolved by the exit relay only, so that the client does not leak it
+// to its own resolver.
 type Endpoint struct {
 	IP   net.IP
+	Host string
 	Port uint16
 }
 
 const (
-	EndpointIPv4 = 0x04
-	EndpointIPv6 = 0x06
+	EndpointDomain = 0x03
+	EndpointIPv4   = 0x04
+	EndpointIPv6   = 0x06
+
+	// MaxHostLen is the longest domain name an endpoint carries, as in DNS.
+	MaxHostLen = 253
 )
 
+// Bytes encodes the endpoint as its type, its port then its IP address or,
+// for a domain, the 1-byte length of the name followed by the name.
 func (e Endpoint) Bytes() ([]byte, error) {
+	if e.Host != "" {
+		if err := validHost(e.Host); err != nil {
+			return nil, err
+		}
+		out := make([]byte, 4, 4+len(e.Host))
+		out[0] = EndpointDomain
+		binary.BigEndian.PutUint16(out[1:3], e.Port)
+		out[3] = byte(len(e.Host))
+		return append(out, e.Host...), nil
+	}
+
 	var ipBytes []byte
 	var ipType byte
 
@@ -40,6 +62,9 @@ func (e Endpoint) Bytes() ([]byte, error) {
 }
 
 func (e Endpoint) BytesLen() int {
+	if e.Host != "" {
+		return 4 + len(e.Host)
+	}
 	if ip4 := e.IP.To4(); ip4 != nil {
 		return 7
 	}
@@ -57,8 +82,20 @@ func (e *Endpoint) Parse(data []byte) (int, error) {
 	ipType := data[0]
 	e.Port = binary.BigEndian.Uint16(data[1:3])
 
+	e.IP, e.Host = nil, ""
+
 	var n int
 	switch ipType {
+	case EndpointDomain:
+		if len(data) < 4 || len(data) < 4+int(data[3]) {
+			return 0, fmt.Errorf("buffer too short for domain")
+		}
+		n = 4 + int(data[3])
+		host := string(data[4:n])
+		if err := validHost(host); err != nil {
+			return 0, err
+		}
+		e.Host = host
 	case EndpointIPv4:
 		n = 7
 		if len(data) < n {
@@ -71,6 +108,11 @@ func (e *Endpoint) Parse(data []byte) (int, error) {
 		if len(data) < n {
 			return 0, fmt.Errorf("buffer too short for IPv6")
 		}
+		// An IPv4-mapped address would come back as IPv4 from Bytes, and
+		// be seen as another endpoint than the one encoded.
+		if net.IP(data[3:19]).To4() != nil {
+			return 0, fmt.Errorf("IPv4-mapped address encoded as IPv6")
+		}
 		e.IP = make(net.IP, net.IPv6len)
 		copy(e.IP, data[3:19])
 	default:
@@ -113,7 +155,10 @@ func ParseEpFromString(ep string) (Endpoint, error) {
 
 	ip := net.ParseIP(host)
 	if ip == nil {
-		return Endpoint{}, fmt.Errorf("invalid IP address: %s", host)
+		if err := validHost(host); err != nil {
+			return Endpoint{}, fmt.Errorf("invalid IP address or domain %q: %w", host, err)
+		}
+		return Endpoint{Host: host, Port: uint16(port64)}, nil
 	}
 
 	return Endpoint{
@@ -122,7 +167,31 @@ func ParseEpFromString(ep string) (Endpoint, error) {
 	}, nil
 }
 
+// validHost reports why host is not a domain name an endpoint can carry.
+func validHost(host string) error {
+	if len(host) == 0 || len(host) > MaxHostLen {
+		return fmt.Errorf("invalid domain length: %d", len(host))
+	}
+	for label := range strings.SplitSeq(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("invalid domain %q: empty or too long label", host)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid domain %q: label starting or ending with '-'", host)
+		}
+		for _, c := range []byte(label) {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid domain %q: character %q", host, c)
+			}
+		}
+	}
+	return nil
+}
+
 func (e Endpoint) String() string {
+	if e.Host != "" {
+		return net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port)))
+	}
 	if e.IP.To4() != nil {
 		return fmt.Sprintf("%s:%d", e.IP.String(), e.Port)
 	}
@@ -130,15 +199,23 @@ func (e Endpoint) String() string {
 }
 
 func (e Endpoint) IsIPv4() bool {
-	return e.IP.To4() != nil
+	return e.Host == "" && e.IP.To4() != nil
 }
 
 func (e Endpoint) IsIPv6() bool {
-	return e.IP.To16() != nil && e.IP.To4() == nil
+	return e.Host == "" && e.IP.To16() != nil && e.IP.To4() == nil
+}
+
+// IsDomain reports whether the endpoint is a domain name to resolve.
+func (e Endpoint) IsDomain() bool {
+	return e.Host != ""
 }
 
 func (e Endpoint) Network() string {
-	if e.IsIPv4() {
+	switch {
+	case e.IsDomain():
+		return "tcp"
+	case e.IsIPv4():
 		return "tcp4"
 	}
 	return "tcp6"
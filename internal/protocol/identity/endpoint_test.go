@@ -54,6 +54,27 @@ func TestEndpoint_Bytes(t *testing.T) {
 			wantErr:     true,
 			errContains: "invalid IP address",
 		},
+		{
+			name:        "domain",
+			ep:          identity.Endpoint{Host: "example.com", Port: 443},
+			expected:    append([]byte{0x03, 0x01, 0xbb, 0x0b}, "example.com"...),
+			wantErr:     false,
+			errContains: "",
+		},
+		{
+			name:        "invalid domain",
+			ep:          identity.Endpoint{Host: "exa mple.com", Port: 443},
+			expected:    nil,
+			wantErr:     true,
+			errContains: "invalid domain",
+		},
+		{
+			name:        "domain too long",
+			ep:          identity.Endpoint{Host: strings.Repeat("a.", 127) + "a", Port: 443},
+			expected:    nil,
+			wantErr:     true,
+			errContains: "invalid domain length",
+		},
 		{
 			name:        "IPv4 with port 0",
 			ep:          identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 0},
@@ -134,6 +155,11 @@ func TestEndpoint_BytesLen(t *testing.T) {
 			ep:       identity.Endpoint{IP: net.ParseIP("2003:2506::1"), Port: 62503},
 			expected: 19,
 		},
+		{
+			name:     "domain",
+			ep:       identity.Endpoint{Host: "example.com", Port: 443},
+			expected: 15,
+		},
 		{
 			name:     "IPv6 loopback",
 			ep:       identity.Endpoint{IP: net.ParseIP("::1"), Port: 62503},
@@ -196,6 +222,35 @@ func TestEndpoint_Parse(t *testing.T) {
 			wantErr:     false,
 			errContains: "",
 		},
+		{
+			name:     "valid domain with trailing data",
+			b:        append([]byte{0x03, 0x00, 0x50, 0x07}, "dor.net extra"...),
+			expected: 11,
+			expectedEp: identity.Endpoint{
+				Host: "dor.net",
+				Port: 80,
+			},
+			wantErr:     false,
+			errContains: "",
+		},
+		{
+			name:        "truncated domain",
+			b:           append([]byte{0x03, 0x00, 0x50, 0x08}, "dor.net"...),
+			wantErr:     true,
+			errContains: "buffer too short for domain",
+		},
+		{
+			name:        "missing domain length",
+			b:           []byte{0x03, 0x00, 0x50},
+			wantErr:     true,
+			errContains: "buffer too short for domain",
+		},
+		{
+			name:        "invalid domain",
+			b:           append([]byte{0x03, 0x00, 0x50, 0x07}, "dor/net"...),
+			wantErr:     true,
+			errContains: "invalid domain",
+		},
 		{
 			name:     "valid IPv6",
 			b:        []byte{0x06, 0xf4, 0x27, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01},
@@ -319,6 +374,10 @@ func TestEndpoint_Parse(t *testing.T) {
 				t.Fatalf("IP mismatch:\n\tgot:  %v\n\twant: %v", ep.IP, tt.expectedEp.IP)
 			}
 
+			if ep.Host != tt.expectedEp.Host {
+				t.Fatalf("Host mismatch:\n\tgot:  %q\n\twant: %q", ep.Host, tt.expectedEp.Host)
+			}
+
 			if ep.Port != tt.expectedEp.Port {
 				t.Fatalf("Port mismatch:\n\tgot:  %v\n\twant: %v", ep.Port, tt.expectedEp.Port)
 			}
@@ -341,6 +400,8 @@ func TestEndpoint_RoundTrip(t *testing.T) {
 		{IP: net.ParseIP("127.0.0.1"), Port: 0},
 		{IP: net.ParseIP("fe80::1"), Port: 65535},
 		{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 9000},
+		{Host: "example.com", Port: 443},
+		{Host: "localhost", Port: 8080},
 	}
 
 	for _, original := range testCases {
@@ -366,6 +427,10 @@ func TestEndpoint_RoundTrip(t *testing.T) {
 				t.Fatalf("IP mismatch:\n\toriginal: %v\n\tparsed:   %v", original.IP, parsed.IP)
 			}
 
+			if parsed.Host != original.Host {
+				t.Fatalf("Host mismatch:\n\toriginal: %q\n\tparsed:   %q", original.Host, parsed.Host)
+			}
+
 			if parsed.Port != original.Port {
 				t.Fatalf("Port mismatch:\n\toriginal: %v\n\tparsed:   %v", original.Port, parsed.Port)
 			}
@@ -489,6 +554,10 @@ func TestNewEndpoint(t *testing.T) {
 				t.Fatalf("IP mismatch:\n\tgot:  %v\n\twant: %v", got.IP, tt.expected.IP)
 			}
 
+			if got.Host != tt.expected.Host {
+				t.Fatalf("Host mismatch:\n\tgot:  %q\n\twant: %q", got.Host, tt.expected.Host)
+			}
+
 			if got.Port != tt.expected.Port {
 				t.Fatalf("Port mismatch:\n\tgot:  %v\n\twant: %v", got.Port, tt.expected.Port)
 			}
@@ -562,10 +631,27 @@ func TestParseEpFromString(t *testing.T) {
 		},
 		{
 			name:        "invalid IP",
-			ep:          "invalid:8080",
+			ep:          "inv@lid:8080",
 			expected:    identity.Endpoint{},
 			wantErr:     true,
-			errContains: "invalid IP address",
+			errContains: "invalid IP address or domain",
+		},
+		{
+			name: "domain",
+			ep:   "example.com:443",
+			expected: identity.Endpoint{
+				Host: "example.com",
+				Port: 443,
+			},
+			wantErr:     false,
+			errContains: "",
+		},
+		{
+			name:        "domain with empty label",
+			ep:          "example..com:443",
+			expected:    identity.Endpoint{},
+			wantErr:     true,
+			errContains: "empty or too long label",
 		},
 		{
 			name:        "port 0",
@@ -698,6 +784,11 @@ func TestEndpoint_String(t *testing.T) {
 			ep:       identity.Endpoint{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 8080},
 			expected: "192.0.2.1:8080",
 		},
+		{
+			name:     "domain",
+			ep:       identity.Endpoint{Host: "example.com", Port: 443},
+			expected: "example.com:443",
+		},
 	}
 
 	for _, tt := range tests {
@@ -852,6 +943,11 @@ func TestEndpoint_Network(t *testing.T) {
 			ep:       identity.Endpoint{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 8080},
 			expected: "tcp4",
 		},
+		{
+			name:     "domain",
+			ep:       identity.Endpoint{Host: "example.com", Port: 443},
+			expected: "tcp",
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,426 @@
+package identity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return r.Min <= port && port <= r.Max
+}
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(int(r.Min))
+	}
+	if r.Min == 0 && r.Max == 65535 {
+		return "*"
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// ExitRule accepts or rejects the destinations of an address prefix and a
+// port range. An invalid Prefix matches every address of Family, or every
+// address when Family is 0.
+type ExitRule struct {
+	Accept bool
+	Family uint8 // 0, EndpointIPv4 or EndpointIPv6
+	Prefix netip.Prefix
+	Ports  PortRange
+}
+
+func (r ExitRule) matches(addr netip.Addr, port uint16) bool {
+	if !r.Ports.contains(port) {
+		return false
+	}
+	if r.Family != 0 && r.Family != addrFamily(addr) {
+		return false
+	}
+	return !r.Prefix.IsValid() || r.Prefix.Contains(addr)
+}
+
+// wildcard reports whether the rule matches every address of its family.
+func (r ExitRule) wildcard() bool {
+	return !r.Prefix.IsValid()
+}
+
+// String writes the rule the way ParseExitRule reads it.
+func (r ExitRule) String() string {
+	action := "reject"
+	if r.Accept {
+		action = "accept"
+	}
+	switch r.Family {
+	case EndpointIPv4:
+		action += "4"
+	case EndpointIPv6:
+		action += "6"
+	}
+
+	addr := "*"
+	if r.Prefix.IsValid() {
+		addr = r.Prefix.String()
+		if r.Prefix.Addr().Is6() {
+			addr = "[" + r.Prefix.Addr().String() + "]/" + strconv.Itoa(r.Prefix.Bits())
+		}
+	}
+	return action + " " + addr + ":" + r.Ports.String()
+}
+
+// ParseExitRule reads a rule such as "accept 10.0.0.0/8:80-443",
+// "reject [2001:db8::]/32:*" or "reject6 *:25". The action takes a 4 or 6
+// suffix to apply to one IP family only.
+func ParseExitRule(s string) (ExitRule, error) {
+	action, target, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok {
+		return ExitRule{}, fmt.Errorf("exit rule %q: want \"accept|reject ADDR:PORTS\"", s)
+	}
+
+	var r ExitRule
+	switch action {
+	case "accept", "accept4", "accept6":
+		r.Accept = true
+	case "reject", "reject4", "reject6":
+	default:
+		return ExitRule{}, fmt.Errorf("exit rule %q: unknown action %q", s, action)
+	}
+	switch action[len(action)-1] {
+	case '4':
+		r.Family = EndpointIPv4
+	case '6':
+		r.Family = EndpointIPv6
+	}
+
+	target = strings.TrimSpace(target)
+	i := strings.LastIndexByte(target, ':')
+	if i < 0 {
+		return ExitRule{}, fmt.Errorf("exit rule %q: missing ports", s)
+	}
+	addr, ports := target[:i], target[i+1:]
+
+	if addr != "*" {
+		p, err := parsePrefix(addr)
+		if err != nil {
+			return ExitRule{}, fmt.Errorf("exit rule %q: %w", s, err)
+		}
+		fam := addrFamily(p.Addr())
+		if r.Family != 0 && r.Family != fam {
+			return ExitRule{}, fmt.Errorf("exit rule %q: address of the other family", s)
+		}
+		r.Prefix = p
+	}
+
+	pr, err := parsePortRange(ports)
+	if err != nil {
+		return ExitRule{}, fmt.Errorf("exit rule %q: %w", s, err)
+	}
+	r.Ports = pr
+	return r, nil
+}
+
+// parsePrefix reads an address or a prefix, IPv6 ones possibly in brackets.
+func parsePrefix(s string) (netip.Prefix, error) {
+	addr, bits, hasBits := strings.Cut(s, "/")
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	a = a.Unmap()
+
+	n := a.BitLen()
+	if hasBits {
+		n, err = strconv.Atoi(bits)
+		if err != nil || n < 0 || n > a.BitLen() {
+			return netip.Prefix{}, fmt.Errorf("invalid prefix length %q", bits)
+		}
+	}
+	return a.Prefix(n)
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	if s == "*" {
+		return PortRange{0, 65535}, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", first)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.ParseUint(last, 10, 16); err != nil {
+			return PortRange{}, fmt.Errorf("invalid port %q", last)
+		}
+	}
+	if lo > hi {
+		return PortRange{}, fmt.Errorf("empty port range %q", s)
+	}
+	return PortRange{uint16(lo), uint16(hi)}, nil
+}
+
+// ExitPolicy decides which destinations an exit relay delivers payloads to.
+// Private addresses are rejected first when RejectPrivate is set, then the
+// first matching rule applies. Destinations no rule matches are rejected.
+type ExitPolicy struct {
+	RejectPrivate bool
+	Rules         []ExitRule
+}
+
+// DefaultExitPolicy accepts every destination but private addresses.
+func DefaultExitPolicy() ExitPolicy {
+	return ExitPolicy{
+		RejectPrivate: true,
+		Rules:         []ExitRule{{Accept: true, Ports: PortRange{0, 65535}}},
+	}
+}
+
+// ParseExitPolicy reads a comma separated list of rules, see ParseExitRule.
+// Private addresses are rejected unless allowPrivate is set.
+func ParseExitPolicy(s string, allowPrivate bool) (ExitPolicy, error) {
+	p := ExitPolicy{RejectPrivate: !allowPrivate}
+	for _, rule := range strings.Split(s, ",") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r, err := ParseExitRule(rule)
+		if err != nil {
+			return ExitPolicy{}, err
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	return p, nil
+}
+
+// Allows reports whether the policy accepts payloads for dest. Domains are
+// rejected: the exit resolves them and checks the addresses it gets.
+func (p ExitPolicy) Allows(dest Endpoint) bool {
+	addr, ok := netip.AddrFromSlice(dest.IP)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if p.RejectPrivate && IsPrivateAddr(addr) {
+		return false
+	}
+	for _, r := range p.Rules {
+		if r.matches(addr, dest.Port) {
+			return r.Accept
+		}
+	}
+	return false
+}
+
+func (p ExitPolicy) String() string {
+	rules := make([]string, 0, len(p.Rules)+1)
+	if p.RejectPrivate {
+		rules = append(rules, "reject private:*")
+	}
+	for _, r := range p.Rules {
+		rules = append(rules, r.String())
+	}
+	return strings.Join(rules, ", ")
+}
+
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// IsPrivateAddr reports whether addr is a loopback, link-local, private,
+// shared, multicast or unspecified address, none of which an exit reaches
+// by default.
+func IsPrivateAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsMulticast() ||
+		addr.IsUnspecified() || addr.IsPrivate() {
+		return true
+	}
+	for _, p := range privatePrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrFamily(addr netip.Addr) uint8 {
+	if addr.Is4() {
+		return EndpointIPv4
+	}
+	return EndpointIPv6
+}
+
+// ExitSummary is the part of an exit policy advertised to clients: the ports
+// it accepts for most public addresses of each family, and whether it
+// rejects private addresses. Rules about some addresses only are left out,
+// so a summary may accept a destination its policy rejects.
+type ExitSummary struct {
+	RejectPrivate bool
+	IPv4, IPv6    []PortRange
+}
+
+// Summary returns the summary of the policy advertised to clients.
+func (p ExitPolicy) Summary() ExitSummary {
+	return ExitSummary{
+		RejectPrivate: p.RejectPrivate,
+		IPv4:          p.acceptedPorts(EndpointIPv4),
+		IPv6:          p.acceptedPorts(EndpointIPv6),
+	}
+}
+
+// acceptedPorts returns the ports the wildcard rules of the policy accept
+// for family, as sorted disjoint ranges.
+func (p ExitPolicy) acceptedPorts(family uint8) []PortRange {
+	// Ranges start at the bounds of the rules, where the verdict changes.
+	bounds := []int{0}
+	for _, r := range p.Rules {
+		bounds = append(bounds, int(r.Ports.Min), int(r.Ports.Max)+1)
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	var out []PortRange
+	for i, lo := range bounds {
+		if lo > 65535 {
+			break
+		}
+		hi := 65535
+		if i+1 < len(bounds) {
+			hi = min(bounds[i+1]-1, 65535)
+		}
+		if !p.wildcardAccepts(family, uint16(lo)) {
+			continue
+		}
+		if n := len(out); n > 0 && int(out[n-1].Max)+1 == lo {
+			out[n-1].Max = uint16(hi)
+			continue
+		}
+		out = append(out, PortRange{uint16(lo), uint16(hi)})
+	}
+	return out
+}
+
+func (p ExitPolicy) wildcardAccepts(family uint8, port uint16) bool {
+	for _, r := range p.Rules {
+		if !r.wildcard() || (r.Family != 0 && r.Family != family) || !r.Ports.contains(port) {
+			continue
+		}
+		return r.Accept
+	}
+	return false
+}
+
+// Allows reports whether the summary accepts dest. A domain is accepted when
+// its port is, for either family, since only the exit resolves it.
+func (s ExitSummary) Allows(dest Endpoint) bool {
+	if dest.IsDomain() {
+		return slices.ContainsFunc(slices.Concat(s.IPv4, s.IPv6), func(r PortRange) bool {
+			return r.contains(dest.Port)
+		})
+	}
+
+	addr, ok := netip.AddrFromSlice(dest.IP)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if s.RejectPrivate && IsPrivateAddr(addr) {
+		return false
+	}
+
+	ranges := s.IPv6
+	if addr.Is4() {
+		ranges = s.IPv4
+	}
+	for _, r := range ranges {
+		if r.contains(dest.Port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s ExitSummary) String() string {
+	ports := func(rs []PortRange) string {
+		if len(rs) == 0 {
+			return "none"
+		}
+		out := make([]string, len(rs))
+		for i, r := range rs {
+			out[i] = r.String()
+		}
+		return strings.Join(out, ",")
+	}
+	return fmt.Sprintf("{ipv4=%s ipv6=%s private=%t}", ports(s.IPv4), ports(s.IPv6), !s.RejectPrivate)
+}
+
+// Bytes encodes the summary as a flags byte, bit 0 set when private
+// addresses are rejected, then for IPv4 and IPv6 a 2-byte count of ranges
+// followed by their bounds, big-endian.
+func (s ExitSummary) Bytes() []byte {
+	out := make([]byte, 1, 5+4*(len(s.IPv4)+len(s.IPv6)))
+	if s.RejectPrivate {
+		out[0] = 1
+	}
+	for _, rs := range [][]PortRange{s.IPv4, s.IPv6} {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(rs)))
+		for _, r := range rs {
+			out = binary.BigEndian.AppendUint16(out, r.Min)
+			out = binary.BigEndian.AppendUint16(out, r.Max)
+		}
+	}
+	return out
+}
+
+// Parse decodes a summary written by Bytes.
+func (s *ExitSummary) Parse(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("exit summary too short")
+	}
+	if data[0]&^1 != 0 {
+		return fmt.Errorf("unknown exit summary flags 0x%02x", data[0])
+	}
+	s.RejectPrivate = data[0]&1 != 0
+	data = data[1:]
+
+	for _, rs := range []*[]PortRange{&s.IPv4, &s.IPv6} {
+		if len(data) < 2 {
+			return fmt.Errorf("exit summary too short")
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < 4*n {
+			return fmt.Errorf("exit summary too short")
+		}
+
+		*rs = nil
+		for i := range n {
+			r := PortRange{binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])}
+			if r.Min > r.Max || (i > 0 && r.Min <= (*rs)[i-1].Max) {
+				return fmt.Errorf("exit summary ranges not sorted and disjoint")
+			}
+			*rs = append(*rs, r)
+			data = data[4:]
+		}
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("%d trailing bytes after exit summary", len(data))
+	}
+	return nil
+}
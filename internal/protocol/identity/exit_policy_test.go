@@ -0,0 +1,247 @@
+package identity_test
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+func TestParseExitRule(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input       string
+		expected    identity.ExitRule
+		errContains string
+	}{
+		{
+			input:    "accept *:*",
+			expected: identity.ExitRule{Accept: true, Ports: identity.PortRange{Min: 0, Max: 65535}},
+		},
+		{
+			input: "reject 10.0.0.0/8:80-443",
+			expected: identity.ExitRule{
+				Prefix: netip.MustParsePrefix("10.0.0.0/8"),
+				Ports:  identity.PortRange{Min: 80, Max: 443},
+			},
+		},
+		{
+			input: "accept6 [2001:db8::]/32:22",
+			expected: identity.ExitRule{
+				Accept: true,
+				Family: identity.EndpointIPv6,
+				Prefix: netip.MustParsePrefix("2001:db8::/32"),
+				Ports:  identity.PortRange{Min: 22, Max: 22},
+			},
+		},
+		{
+			input: "reject4 1.2.3.4:*",
+			expected: identity.ExitRule{
+				Family: identity.EndpointIPv4,
+				Prefix: netip.MustParsePrefix("1.2.3.4/32"),
+				Ports:  identity.PortRange{Min: 0, Max: 65535},
+			},
+		},
+		{input: "accept", errContains: "want"},
+		{input: "allow *:*", errContains: "unknown action"},
+		{input: "accept *", errContains: "missing ports"},
+		{input: "accept 10.0.0.0/33:80", errContains: "invalid prefix length"},
+		{input: "accept host:80", errContains: "ParseAddr"},
+		{input: "accept *:70000", errContains: "invalid port"},
+		{input: "accept *:443-80", errContains: "empty port range"},
+		{input: "accept4 [::1]:80", errContains: "other family"},
+	}
+
+	for _, tt := range tests {
+		got, err := identity.ParseExitRule(tt.input)
+		if tt.errContains != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("ParseExitRule(%q) error mismatch:\n\tgot:  %v\n\twant: %q", tt.input, err, tt.errContains)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseExitRule(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("ParseExitRule(%q) mismatch:\n\tgot:  %+v\n\twant: %+v", tt.input, got, tt.expected)
+		}
+
+		again, err := identity.ParseExitRule(got.String())
+		if err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("ParseExitRule(%q) does not read back %q: %+v, %v", tt.input, got.String(), again, err)
+		}
+	}
+}
+
+func TestExitPolicy_Allows(t *testing.T) {
+	t.Parallel()
+
+	ep := func(s string, port uint16) identity.Endpoint {
+		return identity.Endpoint{IP: net.ParseIP(s), Port: port}
+	}
+
+	tests := []struct {
+		name         string
+		rules        string
+		allowPrivate bool
+		dest         identity.Endpoint
+		expected     bool
+	}{
+		{"default public", "accept *:*", false, ep("8.8.8.8", 53), true},
+		{"default loopback", "accept *:*", false, ep("127.0.0.1", 8080), false},
+		{"default IPv6 loopback", "accept *:*", false, ep("::1", 8080), false},
+		{"default private", "accept *:*", false, ep("192.168.1.10", 80), false},
+		{"default unique local", "accept *:*", false, ep("fd00::1", 80), false},
+		{"default mapped private", "accept *:*", false, ep("::ffff:10.0.0.1", 80), false},
+		{"private allowed", "accept *:*", true, ep("127.0.0.1", 8080), true},
+		{"no rules", "", false, ep("8.8.8.8", 53), false},
+		{"first match wins", "reject *:25, accept *:*", false, ep("8.8.8.8", 25), false},
+		{"port range", "accept *:80-443, reject *:*", false, ep("8.8.8.8", 443), true},
+		{"outside port range", "accept *:80-443, reject *:*", false, ep("8.8.8.8", 444), false},
+		{"CIDR", "reject 8.8.0.0/16:*, accept *:*", false, ep("8.8.8.8", 53), false},
+		{"outside CIDR", "reject 8.8.0.0/16:*, accept *:*", false, ep("1.1.1.1", 53), true},
+		{"IPv4 only", "accept4 *:*", false, ep("2001:4860::8888", 53), false},
+		{"IPv6 only", "accept6 *:*", false, ep("2001:4860::8888", 53), true},
+		{"invalid IP", "accept *:*", true, identity.Endpoint{Port: 80}, false},
+		{"unresolved domain", "accept *:*", true, identity.Endpoint{Host: "example.com", Port: 80}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := identity.ParseExitPolicy(tt.rules, tt.allowPrivate)
+			if err != nil {
+				t.Fatalf("ParseExitPolicy() failed: %v", err)
+			}
+			if got := p.Allows(tt.dest); got != tt.expected {
+				t.Errorf("Allows(%s) mismatch with %q:\n\tgot:  %t\n\twant: %t", tt.dest, p, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExitPolicy_Summary(t *testing.T) {
+	t.Parallel()
+
+	all := []identity.PortRange{{Min: 0, Max: 65535}}
+
+	tests := []struct {
+		name     string
+		rules    string
+		expected identity.ExitSummary
+	}{
+		{
+			name:     "accept all",
+			rules:    "accept *:*",
+			expected: identity.ExitSummary{RejectPrivate: true, IPv4: all, IPv6: all},
+		},
+		{
+			name:  "reject SMTP",
+			rules: "reject *:25, accept *:*",
+			expected: identity.ExitSummary{
+				RejectPrivate: true,
+				IPv4:          []identity.PortRange{{Min: 0, Max: 24}, {Min: 26, Max: 65535}},
+				IPv6:          []identity.PortRange{{Min: 0, Max: 24}, {Min: 26, Max: 65535}},
+			},
+		},
+		{
+			name:  "web over IPv4",
+			rules: "accept4 *:80, accept4 *:443, accept4 *:444-500",
+			expected: identity.ExitSummary{
+				RejectPrivate: true,
+				IPv4:          []identity.PortRange{{Min: 80, Max: 80}, {Min: 443, Max: 500}},
+			},
+		},
+		{
+			name:     "address rules left out",
+			rules:    "reject 1.2.3.0/24:*, accept 5.6.7.8:22, accept *:*",
+			expected: identity.ExitSummary{RejectPrivate: true, IPv4: all, IPv6: all},
+		},
+		{
+			name:     "reject all",
+			rules:    "reject *:*",
+			expected: identity.ExitSummary{RejectPrivate: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := identity.ParseExitPolicy(tt.rules, false)
+			if err != nil {
+				t.Fatalf("ParseExitPolicy() failed: %v", err)
+			}
+			got := p.Summary()
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("Summary() mismatch:\n\tgot:  %s\n\twant: %s", got, tt.expected)
+			}
+
+			var parsed identity.ExitSummary
+			if err := parsed.Parse(got.Bytes()); err != nil {
+				t.Fatalf("Parse() failed: %v", err)
+			}
+			if !reflect.DeepEqual(parsed, got) {
+				t.Errorf("round trip mismatch:\n\tgot:  %s\n\twant: %s", parsed, got)
+			}
+		})
+	}
+}
+
+func TestExitSummary_Allows(t *testing.T) {
+	t.Parallel()
+
+	s := identity.ExitSummary{
+		RejectPrivate: true,
+		IPv4:          []identity.PortRange{{Min: 80, Max: 80}, {Min: 443, Max: 443}},
+	}
+
+	tests := []struct {
+		dest     identity.Endpoint
+		expected bool
+	}{
+		{identity.Endpoint{IP: net.ParseIP("8.8.8.8"), Port: 443}, true},
+		{identity.Endpoint{IP: net.ParseIP("8.8.8.8"), Port: 22}, false},
+		{identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 80}, false},
+		{identity.Endpoint{IP: net.ParseIP("2001:4860::8888"), Port: 80}, false},
+		{identity.Endpoint{Host: "example.com", Port: 443}, true},
+		{identity.Endpoint{Host: "example.com", Port: 22}, false},
+	}
+
+	for _, tt := range tests {
+		if got := s.Allows(tt.dest); got != tt.expected {
+			t.Errorf("Allows(%s) mismatch:\n\tgot:  %t\n\twant: %t", tt.dest, got, tt.expected)
+		}
+	}
+}
+
+func TestExitSummary_Parse_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown flags", []byte{0x02, 0, 0, 0, 0}},
+		{"missing IPv6 count", []byte{0x01, 0, 0}},
+		{"truncated range", []byte{0x01, 0, 1, 0, 80}},
+		{"inverted range", []byte{0x01, 0, 1, 0, 81, 0, 80, 0, 0}},
+		{"overlapping ranges", []byte{0x01, 0, 2, 0, 80, 0, 90, 0, 85, 0, 95, 0, 0}},
+		{"trailing bytes", []byte{0x01, 0, 0, 0, 0, 0xff}},
+	}
+
+	for _, tt := range tests {
+		var s identity.ExitSummary
+		if err := s.Parse(tt.data); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
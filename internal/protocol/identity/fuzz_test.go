@@ -0,0 +1,71 @@
+package identity_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+func FuzzEndpoint_Parse(f *testing.F) {
+	f.Add([]byte{0x04, 0xf4, 0x27, 0xc0, 0xa8, 0x01, 0x01})
+	f.Add([]byte{0x06, 0xf4, 0x27, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	f.Add([]byte{0x04, 0xf4})
+	f.Add([]byte{0x05, 0x00, 0x50, 0x7f, 0x00, 0x00, 0x01})
+	f.Add(append([]byte{0x03, 0x01, 0xbb, 0x0b}, "example.com"...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var ep identity.Endpoint
+		n, err := ep.Parse(data)
+		if err != nil {
+			return
+		}
+
+		if n > len(data) || n != ep.BytesLen() {
+			t.Fatalf("Parse() read %d bytes of %d, BytesLen() = %d", n, len(data), ep.BytesLen())
+		}
+		out, err := ep.Bytes()
+		if err != nil {
+			t.Fatalf("Bytes() of a parsed endpoint failed: %v", err)
+		}
+		if !bytes.Equal(out, data[:n]) {
+			t.Fatalf("round trip mismatch:\n\tgot:  %x\n\twant: %x", out, data[:n])
+		}
+	})
+}
+
+func FuzzParseServiceDescriptor(f *testing.F) {
+	d := identity.ServiceDescriptor{
+		Key:     make(ed25519.PublicKey, ed25519.PublicKeySize),
+		EncKey:  [32]byte{0xcc},
+		Expires: time.Unix(1700000000, 0),
+		Intro: []identity.Relay{
+			{Ep: identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 62503}, UUID: [16]byte{0xaa}, PubKey: [32]byte{0xbb}},
+			{Ep: identity.Endpoint{IP: net.ParseIP("2001:db8::1"), Port: 62504}},
+		},
+	}
+	raw, err := d.Bytes()
+	if err != nil {
+		f.Fatalf("Bytes() failed: %v", err)
+	}
+	f.Add(raw)
+	f.Add(raw[:len(raw)-1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := identity.ParseServiceDescriptor(data)
+		if err != nil {
+			return
+		}
+
+		out, err := d.Bytes()
+		if err != nil {
+			t.Fatalf("Bytes() of a parsed descriptor failed: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("round trip mismatch:\n\tgot:  %x\n\twant: %x", out, data)
+		}
+	})
+}
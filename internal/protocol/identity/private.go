@@ -1,6 +1,7 @@
 package identity
 
 import (
+	"crypto/mlkem"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -16,6 +17,19 @@ type PrivateIdentity struct {
 	UUID    [16]byte
 	PrivKey [32]byte
 	PubKey  [32]byte
+
+	// KEM decapsulates the ML-KEM-768 half of hybrid layers. Nil disables
+	// them.
+	KEM *mlkem.DecapsulationKey768
+}
+
+// KEMKey returns the ML-KEM-768 encapsulation key advertised by the relay,
+// nil if it has none.
+func (pi *PrivateIdentity) KEMKey() []byte {
+	if pi.KEM == nil {
+		return nil
+	}
+	return pi.KEM.EncapsulationKey().Bytes()
 }
 
 type identityStore struct {
@@ -23,6 +37,7 @@ type identityStore struct {
 	uuidPath string
 	privPath string
 	pubPath  string
+	kemPath  string
 }
 
 func newIdentityStore(dir string) identityStore {
@@ -31,6 +46,7 @@ func newIdentityStore(dir string) identityStore {
 		uuidPath: filepath.Join(dir, "relay.uuid"),
 		privPath: filepath.Join(dir, "relay.priv"),
 		pubPath:  filepath.Join(dir, "relay.pub"),
+		kemPath:  filepath.Join(dir, "relay.kem"),
 	}
 }
 
@@ -91,6 +107,28 @@ func generatePrivKey(path string) ([32]byte, error) {
 	return priv, nil
 }
 
+func loadKEM(path string) (*mlkem.DecapsulationKey768, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != mlkem.SeedSize {
+		return nil, fmt.Errorf("invalid KEM seed size: expected %d bytes", mlkem.SeedSize)
+	}
+	return mlkem.NewDecapsulationKey768(raw)
+}
+
+func generateKEM(path string) (*mlkem.DecapsulationKey768, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, dk.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
 func LoadPrivateIdentity(dir string) (*PrivateIdentity, error) {
 	store := newIdentityStore(dir)
 	pi := &PrivateIdentity{}
@@ -155,5 +193,45 @@ func LoadPrivateIdentity(dir string) (*PrivateIdentity, error) {
 		logger.Infof("Public key derived and saved (PK: %X...)", pi.PubKey[:6])
 	}
 
+	if fileExists(store.kemPath) {
+		pi.KEM, err = loadKEM(store.kemPath)
+		logger.Debugf("ML-KEM key loaded from disk")
+	} else {
+		pi.KEM, err = generateKEM(store.kemPath)
+		logger.Infof("New ML-KEM key generated")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ML-KEM key error: %w", err)
+	}
+
+	return pi, nil
+}
+
+// ReadPrivateIdentity reads the identity stored in dir without creating or
+// repairing any file, for tools inspecting the traffic of a relay. The
+// ML-KEM key is optional: KEM stays nil when dir holds none.
+func ReadPrivateIdentity(dir string) (*PrivateIdentity, error) {
+	store := newIdentityStore(dir)
+	pi := &PrivateIdentity{}
+
+	var err error
+	if pi.UUID, err = loadUUID(store.uuidPath); err != nil {
+		return nil, fmt.Errorf("UUID error: %w", err)
+	}
+	if pi.PrivKey, err = loadKey32(store.privPath); err != nil {
+		return nil, fmt.Errorf("private key error: %w", err)
+	}
+
+	pub, err := curve25519.X25519(pi.PrivKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive public key: %w", err)
+	}
+	copy(pi.PubKey[:], pub)
+
+	if fileExists(store.kemPath) {
+		if pi.KEM, err = loadKEM(store.kemPath); err != nil {
+			return nil, fmt.Errorf("ML-KEM key error: %w", err)
+		}
+	}
 	return pi, nil
 }
@@ -1,6 +1,8 @@
 package identity_test
 
 import (
+	"bytes"
+	"crypto/mlkem"
 	"os"
 	"path/filepath"
 	"testing"
@@ -388,14 +390,15 @@ func TestLoadPrivateIdentity_EmptyDirectory(t *testing.T) {
 		t.Fatalf("failed to read dir: %v", err)
 	}
 
-	if len(entries) != 3 {
-		t.Fatalf("expected 3 files, got %d", len(entries))
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 files, got %d", len(entries))
 	}
 
 	expectedFiles := map[string]bool{
 		"relay.uuid": false,
 		"relay.priv": false,
 		"relay.pub":  false,
+		"relay.kem":  false,
 	}
 
 	for _, entry := range entries {
@@ -503,3 +506,90 @@ func TestLoadPrivateIdentity_PartialFiles(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadPrivateIdentity_KEMKey(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	pi1, err := identity.LoadPrivateIdentity(dir)
+	if err != nil {
+		t.Fatalf("first load failed: %v", err)
+	}
+	if len(pi1.KEMKey()) != mlkem.EncapsulationKeySize768 {
+		t.Fatalf("KEMKey() length = %d, want %d", len(pi1.KEMKey()), mlkem.EncapsulationKeySize768)
+	}
+
+	pi2, err := identity.LoadPrivateIdentity(dir)
+	if err != nil {
+		t.Fatalf("second load failed: %v", err)
+	}
+	if !bytes.Equal(pi1.KEMKey(), pi2.KEMKey()) {
+		t.Fatal("KEM key should be the same across loads")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "relay.kem"), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := identity.LoadPrivateIdentity(dir); err == nil {
+		t.Fatal("expected error for invalid KEM seed")
+	}
+}
+
+func TestPrivateIdentity_KEMKey_Nil(t *testing.T) {
+	t.Parallel()
+
+	var pi identity.PrivateIdentity
+	if pi.KEMKey() != nil {
+		t.Fatal("KEMKey() should be nil without a KEM key")
+	}
+}
+
+func TestReadPrivateIdentity(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	want, err := identity.LoadPrivateIdentity(dir)
+	if err != nil {
+		t.Fatalf("LoadPrivateIdentity() failed: %v", err)
+	}
+
+	got, err := identity.ReadPrivateIdentity(dir)
+	if err != nil {
+		t.Fatalf("ReadPrivateIdentity() failed: %v", err)
+	}
+	if got.UUID != want.UUID || got.PrivKey != want.PrivKey || got.PubKey != want.PubKey {
+		t.Error("identity mismatch")
+	}
+	if !bytes.Equal(got.KEMKey(), want.KEMKey()) {
+		t.Error("ML-KEM key mismatch")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "relay.kem")); err != nil {
+		t.Fatal(err)
+	}
+	got, err = identity.ReadPrivateIdentity(dir)
+	if err != nil {
+		t.Fatalf("ReadPrivateIdentity() without ML-KEM key failed: %v", err)
+	}
+	if got.KEM != nil {
+		t.Error("expected no ML-KEM key")
+	}
+}
+
+func TestReadPrivateIdentity_Missing(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if _, err := identity.ReadPrivateIdentity(dir); err == nil {
+		t.Fatal("expected an error for an empty directory")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("ReadPrivateIdentity() created %d files", len(entries))
+	}
+}
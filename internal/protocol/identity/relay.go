@@ -9,6 +9,14 @@ type Relay struct {
 
 	UUID   [16]byte
 	PubKey [32]byte
+
+	// KEMKey is the ML-KEM-768 encapsulation key of the relay, nil if it does
+	// not advertise one.
+	KEMKey []byte
+
+	// ExitPolicy is the exit policy summary advertised by the relay, nil
+	// until retrieved or if it does not advertise one.
+	ExitPolicy *ExitSummary
 }
 
 func (r Relay) String() string {
@@ -24,3 +32,34 @@ func (r *Relay) HydrateIdentity(uuid [16]byte, pubKey [32]byte) {
 	r.UUID = uuid
 	r.PubKey = pubKey
 }
+
+// Bytes encodes the relay as its endpoint followed by its UUID and public
+// key.
+func (r Relay) Bytes() ([]byte, error) {
+	ep, err := r.Ep.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(ep)+16+32)
+	out = append(out, ep...)
+	out = append(out, r.UUID[:]...)
+	out = append(out, r.PubKey[:]...)
+	return out, nil
+}
+
+// Parse decodes a relay written by Bytes and returns the number of bytes
+// read.
+func (r *Relay) Parse(data []byte) (int, error) {
+	n, err := r.Ep.Parse(data)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < n+16+32 {
+		return 0, fmt.Errorf("relay identity too short")
+	}
+
+	copy(r.UUID[:], data[n:n+16])
+	copy(r.PubKey[:], data[n+16:n+48])
+	return n + 48, nil
+}
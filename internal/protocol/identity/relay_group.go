@@ -68,6 +68,12 @@ func ParseRelayPath(raw string) ([]RelayGroup, error) {
 					relayStr, gi, err,
 				)
 			}
+			if ep.IsDomain() {
+				return nil, fmt.Errorf(
+					"invalid relay %q in group %d: relays are given by IP address",
+					relayStr, gi,
+				)
+			}
 
 			relays = append(relays, Relay{
 				Ep: ep,
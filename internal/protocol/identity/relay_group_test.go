@@ -164,6 +164,13 @@ func TestParseRelayPath(t *testing.T) {
 			errContains: "invalid relay",
 			wantErr:     true,
 		},
+		{
+			name:        "relay given by domain",
+			raw:         "[::1]:3103|relay.example.com:3103",
+			expected:    nil,
+			errContains: "relays are given by IP address",
+			wantErr:     true,
+		},
 	}
 
 	for _, tt := range tests {
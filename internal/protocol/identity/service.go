@@ -0,0 +1,233 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"golang.org/x/crypto/curve25519"
+)
+
+// ServiceAddressSuffix ends the addresses of hidden services.
+const ServiceAddressSuffix = ".dor"
+
+// MaxIntroPoints bounds the introduction relays of a service descriptor.
+const MaxIntroPoints = 8
+
+var serviceEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ServiceIdentity is the long-term identity of a hidden service. Its address
+// is derived from the signing key, which authenticates the descriptors and
+// introduction registrations of the service. Introductions are encrypted to
+// the X25519 key.
+type ServiceIdentity struct {
+	SignKey ed25519.PrivateKey
+	EncPriv [32]byte
+	EncPub  [32]byte
+}
+
+// LoadServiceIdentity loads the service identity stored in dir, generating
+// the missing keys.
+func LoadServiceIdentity(dir string) (*ServiceIdentity, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create service dir: %w", err)
+	}
+
+	seedPath := filepath.Join(dir, "service.sign")
+	encPath := filepath.Join(dir, "service.enc")
+
+	var (
+		seed [32]byte
+		err  error
+	)
+	if fileExists(seedPath) {
+		seed, err = loadKey32(seedPath)
+	} else {
+		seed, err = generateSignSeed(seedPath)
+		logger.Infof("New service signing key generated")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing key error: %w", err)
+	}
+
+	si := &ServiceIdentity{SignKey: ed25519.NewKeyFromSeed(seed[:])}
+
+	if fileExists(encPath) {
+		si.EncPriv, err = loadKey32(encPath)
+	} else {
+		si.EncPriv, err = generatePrivKey(encPath)
+		logger.Infof("New service encryption key generated")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encryption key error: %w", err)
+	}
+
+	pub, err := curve25519.X25519(si.EncPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive encryption key: %w", err)
+	}
+	copy(si.EncPub[:], pub)
+
+	return si, nil
+}
+
+// generateSignSeed stores a fresh ed25519 seed at path. Unlike X25519 keys,
+// the seed is used as drawn.
+func generateSignSeed(path string) ([32]byte, error) {
+	var seed [ed25519.SeedSize]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return seed, err
+	}
+	if err := os.WriteFile(path, seed[:], 0600); err != nil {
+		return seed, err
+	}
+	return seed, nil
+}
+
+func (si *ServiceIdentity) PublicKey() ed25519.PublicKey {
+	return si.SignKey.Public().(ed25519.PublicKey)
+}
+
+func (si *ServiceIdentity) Address() string {
+	return ServiceAddress(si.PublicKey())
+}
+
+// ServiceAddress returns the .dor address of the service with the given
+// signing key.
+func ServiceAddress(key ed25519.PublicKey) string {
+	return strings.ToLower(serviceEncoding.EncodeToString(key)) + ServiceAddressSuffix
+}
+
+func IsServiceAddress(addr string) bool {
+	return strings.HasSuffix(addr, ServiceAddressSuffix)
+}
+
+// ParseServiceAddress returns the signing key named by a .dor address.
+func ParseServiceAddress(addr string) (ed25519.PublicKey, error) {
+	if !IsServiceAddress(addr) {
+		return nil, fmt.Errorf("not a service address: %q", addr)
+	}
+
+	raw, err := serviceEncoding.DecodeString(strings.ToUpper(strings.TrimSuffix(addr, ServiceAddressSuffix)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid service address %q: %w", addr, err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid service address %q: wrong key size", addr)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// ServiceDescriptor is published by a hidden service to tell clients how to
+// introduce themselves to it.
+//
+// +--------+--------+--------+--------+--------+--------+
+// | Key (32) | EncKey (32) | Expires (8) | n | Intro (n relays) | Sig (64) |
+// +--------+--------+--------+--------+--------+--------+
+type ServiceDescriptor struct {
+	Key     ed25519.PublicKey
+	EncKey  [32]byte
+	Expires time.Time // second precision
+	Intro   []Relay
+	Sig     [ed25519.SignatureSize]byte
+}
+
+var errDescriptorSignature = errors.New("invalid descriptor signature")
+
+func (d ServiceDescriptor) signedBytes() ([]byte, error) {
+	if len(d.Key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid descriptor key size: %d", len(d.Key))
+	}
+	if len(d.Intro) == 0 || len(d.Intro) > MaxIntroPoints {
+		return nil, fmt.Errorf("descriptor needs 1 to %d introduction relays, got %d", MaxIntroPoints, len(d.Intro))
+	}
+
+	out := make([]byte, 0, 32+32+8+1+len(d.Intro)*67)
+	out = append(out, d.Key...)
+	out = append(out, d.EncKey[:]...)
+	out = binary.BigEndian.AppendUint64(out, uint64(d.Expires.Unix()))
+	out = append(out, uint8(len(d.Intro)))
+	for _, r := range d.Intro {
+		b, err := r.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+func (d ServiceDescriptor) Bytes() ([]byte, error) {
+	out, err := d.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	return append(out, d.Sig[:]...), nil
+}
+
+// Sign fills Key and Sig from the service identity.
+func (d *ServiceDescriptor) Sign(si *ServiceIdentity) error {
+	d.Key = si.PublicKey()
+	msg, err := d.signedBytes()
+	if err != nil {
+		return err
+	}
+	copy(d.Sig[:], ed25519.Sign(si.SignKey, msg))
+	return nil
+}
+
+// Verify checks the signature of the descriptor and that it has not expired
+// at now.
+func (d ServiceDescriptor) Verify(now time.Time) error {
+	msg, err := d.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(d.Key, msg, d.Sig[:]) {
+		return errDescriptorSignature
+	}
+	if !now.Before(d.Expires) {
+		return fmt.Errorf("descriptor expired at %s", d.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func ParseServiceDescriptor(data []byte) (ServiceDescriptor, error) {
+	if len(data) < 32+32+8+1 {
+		return ServiceDescriptor{}, fmt.Errorf("descriptor too short: %d bytes", len(data))
+	}
+
+	var d ServiceDescriptor
+	d.Key = ed25519.PublicKey(append([]byte(nil), data[:32]...))
+	copy(d.EncKey[:], data[32:64])
+	d.Expires = time.Unix(int64(binary.BigEndian.Uint64(data[64:72])), 0)
+
+	n := int(data[72])
+	if n == 0 || n > MaxIntroPoints {
+		return ServiceDescriptor{}, fmt.Errorf("invalid introduction relay count: %d", n)
+	}
+
+	offset := 73
+	d.Intro = make([]Relay, n)
+	for i := range d.Intro {
+		m, err := d.Intro[i].Parse(data[offset:])
+		if err != nil {
+			return ServiceDescriptor{}, fmt.Errorf("introduction relay %d: %w", i, err)
+		}
+		offset += m
+	}
+
+	if len(data)-offset != ed25519.SignatureSize {
+		return ServiceDescriptor{}, fmt.Errorf("invalid descriptor signature size: %d", len(data)-offset)
+	}
+	copy(d.Sig[:], data[offset:])
+	return d, nil
+}
@@ -0,0 +1,160 @@
+package identity_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+func TestLoadServiceIdentity_Persistent(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	first, err := identity.LoadServiceIdentity(dir)
+	if err != nil {
+		t.Fatalf("LoadServiceIdentity() failed: %v", err)
+	}
+	second, err := identity.LoadServiceIdentity(dir)
+	if err != nil {
+		t.Fatalf("LoadServiceIdentity() reload failed: %v", err)
+	}
+
+	if first.Address() != second.Address() || first.EncPub != second.EncPub {
+		t.Fatal("service identity changed on reload")
+	}
+
+	seed, err := os.ReadFile(filepath.Join(dir, "service.sign"))
+	if err != nil {
+		t.Fatalf("failed to read signing seed: %v", err)
+	}
+	if !bytes.Equal(seed, first.SignKey.Seed()) {
+		t.Fatal("signing key not derived from the stored seed")
+	}
+}
+
+func TestServiceAddress_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	si, err := identity.LoadServiceIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadServiceIdentity() failed: %v", err)
+	}
+
+	addr := si.Address()
+	if !strings.HasSuffix(addr, identity.ServiceAddressSuffix) || addr != strings.ToLower(addr) {
+		t.Fatalf("unexpected address %q", addr)
+	}
+
+	key, err := identity.ParseServiceAddress(addr)
+	if err != nil {
+		t.Fatalf("ParseServiceAddress() failed: %v", err)
+	}
+	if !bytes.Equal(key, si.PublicKey()) {
+		t.Fatal("address does not name the service key")
+	}
+}
+
+func TestParseServiceAddress_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, addr := range []string{"127.0.0.1:80", "abc.dor", "!!!!.dor", ".dor"} {
+		if _, err := identity.ParseServiceAddress(addr); err == nil {
+			t.Errorf("ParseServiceAddress(%q): expected error", addr)
+		}
+	}
+}
+
+func TestServiceDescriptor_SignVerify(t *testing.T) {
+	t.Parallel()
+
+	si, err := identity.LoadServiceIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadServiceIdentity() failed: %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	d := identity.ServiceDescriptor{
+		EncKey:  si.EncPub,
+		Expires: now.Add(time.Hour),
+		Intro: []identity.Relay{
+			{Ep: identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 62503}, UUID: [16]byte{1}, PubKey: [32]byte{2}},
+			{Ep: identity.Endpoint{IP: net.ParseIP("::1"), Port: 62504}, UUID: [16]byte{3}, PubKey: [32]byte{4}},
+		},
+	}
+	if err := d.Sign(si); err != nil {
+		t.Fatalf("Sign() failed: %v", err)
+	}
+
+	raw, err := d.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() failed: %v", err)
+	}
+	got, err := identity.ParseServiceDescriptor(raw)
+	if err != nil {
+		t.Fatalf("ParseServiceDescriptor() failed: %v", err)
+	}
+	if err := got.Verify(now); err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+	if len(got.Intro) != 2 || got.Intro[1].Ep.Port != 62504 || got.Intro[1].UUID != [16]byte{3} {
+		t.Fatalf("introduction relays mismatch: %v", got.Intro)
+	}
+
+	if err := got.Verify(now.Add(time.Hour)); err == nil {
+		t.Error("expired descriptor accepted")
+	}
+
+	got.Intro[0].Ep.Port++
+	if err := got.Verify(now); err == nil {
+		t.Error("tampered descriptor accepted")
+	}
+}
+
+func TestParseServiceDescriptor_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string][]byte{
+		"empty":     nil,
+		"no intro":  make([]byte, 73),
+		"truncated": append(make([]byte, 72), 1, identity.EndpointIPv4, 0x1f),
+	}
+	for name, raw := range tests {
+		if _, err := identity.ParseServiceDescriptor(raw); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestRelay_BytesParse(t *testing.T) {
+	t.Parallel()
+
+	want := identity.Relay{
+		Ep:     identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 62503},
+		UUID:   [16]byte{0xaa},
+		PubKey: [32]byte{0xbb},
+	}
+	raw, err := want.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() failed: %v", err)
+	}
+
+	var got identity.Relay
+	n, err := got.Parse(append(raw, 0xff))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	if n != len(raw) || !got.Ep.IP.Equal(want.Ep.IP) || got.Ep.Port != want.Ep.Port ||
+		got.UUID != want.UUID || got.PubKey != want.PubKey {
+		t.Fatalf("round trip mismatch: %v (%d bytes)", got, n)
+	}
+
+	if _, err := got.Parse(raw[:len(raw)-1]); err == nil {
+		t.Fatal("expected error for truncated relay")
+	}
+}
@@ -0,0 +1,109 @@
+package onion
+
+import (
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+// Extension types used by delivery acknowledgements.
+const (
+	// ExtAckRequest asks the exit to send back the reply onion it carries
+	// once the payload is delivered.
+	ExtAckRequest = 0x02
+	// ExtAckDeliver marks the last layer of a reply onion: its payload is
+	// sent to the destination as a DeliveryAck packet.
+	ExtAckDeliver = 0x03
+)
+
+// AckRequest carries a reply onion prepared by the client, with the relays of
+// its first group.
+//
+// 0        7
+// +--------+--------+--------+
+// |   n    |  Entry (n endpoints)
+// +--------+--------+--------+
+// ~  Reply onion (unpadded)  ~
+// +--------+--------+--------+
+type AckRequest struct {
+	Entry []identity.Endpoint
+	Reply []byte // OnionLayer bytes, padded by the exit
+}
+
+func (a AckRequest) Extension() (Extension, error) {
+	if len(a.Entry) == 0 || len(a.Entry) > MaxWrappedKey {
+		return Extension{}, fmt.Errorf("ack request needs 1 to %d entry relays, got %d", MaxWrappedKey, len(a.Entry))
+	}
+
+	v := []byte{uint8(len(a.Entry))}
+	for _, ep := range a.Entry {
+		b, err := ep.Bytes()
+		if err != nil {
+			return Extension{}, err
+		}
+		v = append(v, b...)
+	}
+	v = append(v, a.Reply...)
+
+	return Extension{Type: ExtAckRequest, Value: v}, nil
+}
+
+func ParseAckRequest(e Extension) (AckRequest, error) {
+	if e.Type != ExtAckRequest {
+		return AckRequest{}, fmt.Errorf("not an ack request extension: 0x%02x", e.Type)
+	}
+	if len(e.Value) < 1 {
+		return AckRequest{}, fmt.Errorf("empty ack request")
+	}
+
+	n := int(e.Value[0])
+	if n == 0 || n > MaxWrappedKey {
+		return AckRequest{}, fmt.Errorf("invalid ack request entry count: %d", n)
+	}
+
+	a := AckRequest{Entry: make([]identity.Endpoint, n)}
+	offset := 1
+	for i := range a.Entry {
+		if offset >= len(e.Value) {
+			return AckRequest{}, fmt.Errorf("truncated ack request entry %d", i)
+		}
+		m, err := a.Entry[i].Parse(e.Value[offset:])
+		if err != nil {
+			return AckRequest{}, fmt.Errorf("failed to parse ack request entry %d: %w", i, err)
+		}
+		offset += m
+	}
+
+	a.Reply = e.Value[offset:]
+	if len(a.Reply) < FixedHeaderSize {
+		return AckRequest{}, fmt.Errorf("reply onion too short: %d bytes", len(a.Reply))
+	}
+	return a, nil
+}
+
+// BuildAckRequest builds a reply onion through path whose last relay sends
+// token to dest as a DeliveryAck, and wraps it in an AckRequest for the exit
+// of the forward onion.
+func BuildAckRequest(dest identity.Endpoint, path []identity.CryptoGroup, token []byte, opts ...BuildOption) (AckRequest, error) {
+	if len(path) == 0 {
+		return AckRequest{}, fmt.Errorf("reply path cannot be empty")
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithExtensions(Extension{Type: ExtAckDeliver}))
+	layer, err := BuildOnion(dest, path, token, opts...)
+	if err != nil {
+		return AckRequest{}, fmt.Errorf("failed to build reply onion: %w", err)
+	}
+
+	reply, err := layer.Bytes()
+	if err != nil {
+		return AckRequest{}, err
+	}
+
+	entry := make([]identity.Endpoint, len(path[0].Group.Relays))
+	for i, r := range path[0].Group.Relays {
+		entry[i] = r.Ep
+	}
+
+	return AckRequest{Entry: entry, Reply: reply}, nil
+}
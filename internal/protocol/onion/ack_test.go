@@ -0,0 +1,85 @@
+package onion
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+func TestAckRequest_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("::1"), Port: 62600}
+	path := []identity.CryptoGroup{
+		{Group: relayGroup(3000, 2)},
+		{Group: relayGroup(4000, 1)},
+	}
+	for i := range path {
+		if err := path[i].GenerateCryptoMaterial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := bytes.Repeat([]byte{0x42}, 32)
+
+	req, err := BuildAckRequest(dest, path, token)
+	if err != nil {
+		t.Fatalf("BuildAckRequest() failed: %v", err)
+	}
+	if len(req.Entry) != 2 {
+		t.Fatalf("got %d entry relays, want 2", len(req.Entry))
+	}
+
+	ext, err := req.Extension()
+	if err != nil {
+		t.Fatalf("Extension() failed: %v", err)
+	}
+	got, err := ParseAckRequest(ext)
+	if err != nil {
+		t.Fatalf("ParseAckRequest() failed: %v", err)
+	}
+	if !bytes.Equal(got.Reply, req.Reply) || len(got.Entry) != 2 || got.Entry[1].Port != 3001 {
+		t.Fatalf("round trip mismatch: %+v", got)
+	}
+
+	// Peel the reply onion as its relays would.
+	layer := &OnionLayer{}
+	if err := layer.Parse(got.Reply); err != nil {
+		t.Fatalf("reply Parse() failed: %v", err)
+	}
+	olc := peel(t, layer, path[0].CipherKey)
+	next := &OnionLayer{}
+	if err := next.Parse(olc.Payload); err != nil {
+		t.Fatalf("next layer Parse() failed: %v", err)
+	}
+	last := peel(t, next, path[1].CipherKey)
+
+	if _, ok := FindExtension(last.Extensions, ExtAckDeliver); !ok {
+		t.Fatal("missing ack deliver extension on the last reply layer")
+	}
+	if !last.LastServer || !last.NextHops[0].IP.Equal(dest.IP) || !bytes.Equal(last.Payload, token) {
+		t.Fatalf("unexpected last reply layer: %+v", last)
+	}
+}
+
+func TestParseAckRequest_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]Extension{
+		"wrong type":  {Type: ExtShare, Value: []byte{1}},
+		"empty":       {Type: ExtAckRequest},
+		"no entry":    {Type: ExtAckRequest, Value: []byte{0}},
+		"truncated":   {Type: ExtAckRequest, Value: []byte{2}},
+		"short reply": {Type: ExtAckRequest, Value: []byte{1, 4, 0x1f, 0x90, 127, 0, 0, 1, 0xaa}},
+	}
+	for name, e := range tests {
+		if _, err := ParseAckRequest(e); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if _, err := (AckRequest{}).Extension(); err == nil {
+		t.Error("expected error for ack request without entry relays")
+	}
+}
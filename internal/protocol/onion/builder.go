@@ -3,6 +3,7 @@ package onion
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
@@ -13,19 +14,109 @@ const (
 	MaxJump    = 5
 )
 
+type buildConfig struct {
+	mixDelayClass uint8
+	dropAt        int // index in path of the relay discarding the onion, -1 if none
+	redundancy    uint8
+	extensions    []Extension // for the last relay of the path
+	hybrid        bool
+	rand          io.Reader
+}
+
+type BuildOption func(*buildConfig)
+
+// WithMixDelay asks every relay of the path to hold the packet for the given
+// delay class before forwarding it. The class travels in an ExtMixDelay
+// extension of each layer. Relays not running in mix mode ignore it.
+func WithMixDelay(class uint8) BuildOption {
+	return func(c *buildConfig) {
+		c.mixDelayClass = class
+	}
+}
+
+// WithDropAt marks the onion as cover traffic: the relay group at index hop of
+// the path silently discards it instead of forwarding it.
+func WithDropAt(hop int) BuildOption {
+	return func(c *buildConfig) {
+		c.dropAt = hop
+	}
+}
+
+// WithRedundancy asks every relay of the path to send the onion to k relays
+// of the next group in parallel instead of the first reachable one. Relays
+// receiving several copies keep a single one. The exit group still gets a
+// single copy, as each of its relays would deliver the payload.
+func WithRedundancy(k uint8) BuildOption {
+	return func(c *buildConfig) {
+		c.redundancy = k
+	}
+}
+
+// WithExtensions adds extensions to the layer read by the last relay of the
+// path.
+func WithExtensions(exts ...Extension) BuildOption {
+	return func(c *buildConfig) {
+		c.extensions = append(c.extensions, exts...)
+	}
+}
+
+// WithHybridKEM mixes a hybrid secret into the wrapping key of every layer,
+// so that recorded onions stay confidential against a quantum adversary.
+// Each group gets its secret in a HybridEnvelope sealed with the ML-KEM-768
+// key of the relay the onion is sent to, by the client for the entry group
+// and by the previous hop for the others. The layers only carry the secret
+// of the next group, which keeps the full path budget. The onion must be
+// sent as a HybridOnionPacket.
+func WithHybridKEM() BuildOption {
+	return func(c *buildConfig) {
+		c.hybrid = true
+	}
+}
+
+// WithRand draws the nonces, dummy wrapped keys and slot order of every
+// layer from r instead of crypto/rand, making the onion reproducible from
+// the crypto material of its groups, as test vectors need.
+func WithRand(r io.Reader) BuildOption {
+	return func(c *buildConfig) {
+		c.rand = r
+	}
+}
+
 func BuildOnion(
 	dest identity.Endpoint,
 	path []identity.CryptoGroup,
 	payload []byte,
+	opts ...BuildOption,
 ) (*OnionLayer, error) {
+	cfg := buildConfig{dropAt: -1, rand: rand.Reader}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.mixDelayClass > MaxMixDelayClass {
+		return nil, fmt.Errorf("mix delay class %d out of range (max %d)", cfg.mixDelayClass, MaxMixDelayClass)
+	}
+	if cfg.redundancy > MaxWrappedKey {
+		return nil, fmt.Errorf("redundancy %d out of range (max %d)", cfg.redundancy, MaxWrappedKey)
+	}
 	if len(path) == 0 {
 		return nil, fmt.Errorf("path cannot be empty")
 	}
 	if len(path) > MaxJump {
 		return nil, fmt.Errorf("max jump value is %d", MaxJump)
 	}
+	if cfg.dropAt < -1 || cfg.dropAt >= len(path) {
+		return nil, fmt.Errorf("drop hop %d out of path range [0, %d)", cfg.dropAt, len(path))
+	}
 
 	overhead := computePathOverhead(path, dest)
+	for i := range path {
+		exts, err := cfg.layerExtensions(path, i)
+		if err != nil {
+			return nil, err
+		}
+		overhead += extensionsLen(exts)
+	}
 	totalSize := overhead + len(payload)
 	if totalSize > PacketSize {
 		return nil, fmt.Errorf("payload too large: %d bytes (max allowed with this path: %d)", len(payload), PacketSize-overhead)
@@ -39,7 +130,21 @@ func BuildOnion(
 
 	for i := len(path) - 1; i >= 0; i-- {
 		group := &path[i]
+
+		exts, err := cfg.layerExtensions(path, i)
+		if err != nil {
+			return nil, err
+		}
+
+		redundancy := cfg.redundancy
+		if i >= len(path)-2 && redundancy > 1 {
+			redundancy = 1
+		}
+
 		ciphered := OnionLayerCiphered{
+			Redundancy:        redundancy,
+			Drop:              i == cfg.dropAt,
+			Extensions:        exts,
 			LastServer:        isLast,
 			NextHops:          nextHops,
 			UtilPayloadLength: uint16(len(currentPayload)),
@@ -52,11 +157,20 @@ func BuildOnion(
 		}
 
 		var payloadNonce [12]byte
-		if _, err = rand.Read(payloadNonce[:]); err != nil {
+		if _, err = io.ReadFull(cfg.rand, payloadNonce[:]); err != nil {
 			return nil, fmt.Errorf("failed to generate payload nonce: %v", err)
 		}
 
-		wrappedKeys, err := NewWrappedKeys(group)
+		var hybridSecret []byte
+		if cfg.hybrid {
+			secret, err := HybridSecret(group.CipherKey)
+			if err != nil {
+				return nil, err
+			}
+			hybridSecret = secret[:]
+		}
+
+		wrappedKeys, err := newWrappedKeys(group, true, hybridSecret, cfg.rand)
 		if err != nil {
 			return nil, err
 		}
@@ -115,6 +229,26 @@ func BuildOnion(
 	return layer, nil
 }
 
+// layerExtensions returns the extensions of the layer of path[i], the last
+// one of the path also carrying those given with WithExtensions.
+func (c *buildConfig) layerExtensions(path []identity.CryptoGroup, i int) ([]Extension, error) {
+	var exts []Extension
+	if c.mixDelayClass > 0 {
+		exts = append(exts, MixDelayExtension(c.mixDelayClass))
+	}
+	if i == len(path)-1 {
+		return append(exts, c.extensions...), nil
+	}
+	if c.hybrid {
+		secret, err := HybridSecret(path[i+1].CipherKey)
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, HybridSecretExtension(secret))
+	}
+	return exts, nil
+}
+
 func computePathOverhead(path []identity.CryptoGroup, dest identity.Endpoint) int {
 	overhead := 0
 
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"golang.org/x/crypto/curve25519"
 )
@@ -47,6 +48,20 @@ func TestComputePathOverhead(t *testing.T) {
 			dest:     identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000},
 			expected: 311,
 		},
+		{
+			name: "domain destination",
+			path: []identity.CryptoGroup{
+				{
+					Group: identity.RelayGroup{
+						Relays: []identity.Relay{
+							{Ep: identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 8080}},
+						},
+					},
+				},
+			},
+			dest:     identity.Endpoint{Host: "example.com", Port: 443},
+			expected: 319,
+		},
 		{
 			name: "two hop path",
 			path: []identity.CryptoGroup{
@@ -146,6 +161,25 @@ func TestBuildOnion(t *testing.T) {
 			payload: []byte("test payload"),
 			wantErr: false,
 		},
+		{
+			name: "valid domain destination",
+			dest: identity.Endpoint{Host: "example.com", Port: 443},
+			path: []identity.CryptoGroup{
+				{
+					Group: identity.RelayGroup{
+						Relays: []identity.Relay{
+							{
+								Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+								PubKey: generateValidX25519Key(),
+							},
+						},
+					},
+					EPK: generateValidX25519Key(),
+				},
+			},
+			payload: []byte("test payload"),
+			wantErr: false,
+		},
 		{
 			name: "valid two hops",
 			dest: identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000},
@@ -375,6 +409,139 @@ func TestBuildOnion_OutputSize(t *testing.T) {
 	}
 }
 
+func TestBuildOnion_WithMixDelay(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000}
+	path := []identity.CryptoGroup{
+		{
+			Group: identity.RelayGroup{
+				Relays: []identity.Relay{
+					{
+						Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+						PubKey: generateValidX25519Key(),
+					},
+				},
+			},
+			EPK:       generateValidX25519Key(),
+			CipherKey: [32]byte{0xbb},
+		},
+	}
+
+	layer, err := BuildOnion(dest, path, []byte("test payload"), WithMixDelay(5))
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+	if layer.Flags != 0 {
+		t.Fatalf("mix delay class leaked in the cleartext flags: 0x%02x", layer.Flags)
+	}
+	olc := peel(t, layer, path[0].CipherKey)
+	if got := MixDelayClass(olc.Extensions); got != 5 {
+		t.Fatalf("mix delay class mismatch:\n\tgot:  %d\n\twant: %d", got, 5)
+	}
+	if string(olc.Payload) != "test payload" {
+		t.Fatalf("payload mismatch: got %q", olc.Payload)
+	}
+
+	_, err = BuildOnion(dest, path, []byte("test payload"), WithMixDelay(MaxMixDelayClass+1))
+	if err == nil {
+		t.Fatal("expected error for out of range mix delay class")
+	}
+}
+
+func TestBuildOnion_WithDropAt(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000}
+	path := []identity.CryptoGroup{
+		{
+			Group: identity.RelayGroup{
+				Relays: []identity.Relay{
+					{
+						Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 8080},
+						PubKey: generateValidX25519Key(),
+					},
+				},
+			},
+			EPK:       generateValidX25519Key(),
+			CipherKey: [32]byte{0xbb},
+		},
+	}
+
+	layer, err := BuildOnion(dest, path, []byte("cover"), WithDropAt(0))
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+
+	if err := layer.TrimCipherText(path[0].CipherKey); err != nil {
+		t.Fatalf("TrimCipherText() failed: %v", err)
+	}
+	header, err := layer.HeaderBytes()
+	if err != nil {
+		t.Fatalf("HeaderBytes() failed: %v", err)
+	}
+	plaintext, err := crypto.ChachaDecrypt(path[0].CipherKey, layer.PayloadNonce, layer.CipherText, header)
+	if err != nil {
+		t.Fatalf("ChachaDecrypt() failed: %v", err)
+	}
+
+	var olc OnionLayerCiphered
+	if err := olc.Parse(plaintext); err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	if !olc.Drop {
+		t.Fatal("expected the drop flag on the designated hop")
+	}
+
+	for _, hop := range []int{-2, 1} {
+		if _, err := BuildOnion(dest, path, []byte("cover"), WithDropAt(hop)); err == nil {
+			t.Fatalf("expected error for drop hop %d", hop)
+		}
+	}
+}
+
+func TestBuildOnion_WithRedundancy(t *testing.T) {
+	t.Parallel()
+
+	group := func(ports ...int) identity.CryptoGroup {
+		g := identity.CryptoGroup{EPK: generateValidX25519Key(), CipherKey: generateValidX25519Key()}
+		for _, port := range ports {
+			g.Group.Relays = append(g.Group.Relays, identity.Relay{
+				Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: uint16(port)},
+				PubKey: generateValidX25519Key(),
+			})
+		}
+		return g
+	}
+
+	dest := identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000}
+	path := []identity.CryptoGroup{group(8080, 8081), group(8082, 8083), group(8084, 8085)}
+
+	layer, err := BuildOnion(dest, path, []byte("redundant"), WithRedundancy(2))
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+
+	// The exit group must get a single copy, each of its relays delivering.
+	want := []uint8{2, 1, 1}
+	for i := range path {
+		olc, err := layer.Decrypt(path[i].CipherKey)
+		if err != nil {
+			t.Fatalf("Decrypt() of layer %d failed: %v", i, err)
+		}
+		if olc.Redundancy != want[i] {
+			t.Fatalf("layer %d redundancy mismatch:\n\tgot:  %d\n\twant: %d", i, olc.Redundancy, want[i])
+		}
+		if olc.LastServer {
+			break
+		}
+		layer = &OnionLayer{}
+		if err := layer.Parse(olc.Payload); err != nil {
+			t.Fatalf("Parse() of layer %d failed: %v", i+1, err)
+		}
+	}
+}
+
 func BenchmarkBuildOnion(b *testing.B) {
 	dest := identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000}
 	path := []identity.CryptoGroup{
@@ -0,0 +1,120 @@
+package onion
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Extension types carried ahead of the payload of an OnionLayerCiphered.
+const (
+	ExtEnd      = 0x00
+	ExtShare    = 0x01
+	ExtMixDelay = 0x0A // delay class asked to the relay reading the layer
+)
+
+// Type (1) + Length (2)
+const extensionHeaderSize = 1 + 2
+
+// Extension is a TLV read by the relay decrypting the layer it belongs to.
+//
+// 0        7        15       23
+// +--------+--------+--------+
+// |  Type  |     Length      |
+// +--------+--------+--------+
+// ~      Value (Length)      ~
+// +--------+--------+--------+
+//
+// The list is terminated by an ExtEnd type byte.
+type Extension struct {
+	Type  uint8
+	Value []byte
+}
+
+func extensionsLen(exts []Extension) int {
+	if len(exts) == 0 {
+		return 0
+	}
+	n := 1 // ExtEnd
+	for _, e := range exts {
+		n += extensionHeaderSize + len(e.Value)
+	}
+	return n
+}
+
+func appendExtensions(out []byte, exts []Extension) ([]byte, error) {
+	for _, e := range exts {
+		if e.Type == ExtEnd {
+			return nil, fmt.Errorf("extension type 0x%02x is reserved", ExtEnd)
+		}
+		if len(e.Value) > 0xFFFF {
+			return nil, fmt.Errorf("extension 0x%02x too large: %d bytes", e.Type, len(e.Value))
+		}
+
+		out = append(out, e.Type)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(e.Value)))
+		out = append(out, e.Value...)
+	}
+	return append(out, ExtEnd), nil
+}
+
+// parseExtensions reads an extension list and returns it with the number of
+// bytes consumed.
+func parseExtensions(data []byte) ([]Extension, int, error) {
+	var exts []Extension
+	offset := 0
+	for {
+		if offset >= len(data) {
+			return nil, 0, fmt.Errorf("unterminated extension list")
+		}
+
+		t := data[offset]
+		if t == ExtEnd {
+			// An empty list is never written: the extensions flag is
+			// cleared instead.
+			if len(exts) == 0 {
+				return nil, 0, fmt.Errorf("empty extension list")
+			}
+			return exts, offset + 1, nil
+		}
+		if offset+extensionHeaderSize > len(data) {
+			return nil, 0, fmt.Errorf("truncated extension header")
+		}
+
+		l := int(binary.BigEndian.Uint16(data[offset+1 : offset+3]))
+		offset += extensionHeaderSize
+		if offset+l > len(data) {
+			return nil, 0, fmt.Errorf("truncated extension 0x%02x: want %d bytes, have %d", t, l, len(data)-offset)
+		}
+
+		value := make([]byte, l)
+		copy(value, data[offset:offset+l])
+		exts = append(exts, Extension{Type: t, Value: value})
+		offset += l
+	}
+}
+
+// FindExtension returns the first extension of the given type.
+func FindExtension(exts []Extension, t uint8) (Extension, bool) {
+	for _, e := range exts {
+		if e.Type == t {
+			return e, true
+		}
+	}
+	return Extension{}, false
+}
+
+// MixDelayExtension asks the relay reading the layer to hold the packet for
+// the given delay class.
+func MixDelayExtension(class uint8) Extension {
+	return Extension{Type: ExtMixDelay, Value: []byte{class}}
+}
+
+// MixDelayClass returns the delay class requested from a mixing relay in
+// exts. Zero leaves the delay to the relay configuration.
+func MixDelayClass(exts []Extension) uint8 {
+	e, ok := FindExtension(exts, ExtMixDelay)
+	if !ok || len(e.Value) != 1 {
+		return 0
+	}
+	return min(e.Value[0], MaxMixDelayClass)
+}
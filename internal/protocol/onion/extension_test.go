@@ -0,0 +1,110 @@
+package onion_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+func TestExtensions_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	in := onion.OnionLayerCiphered{
+		LastServer: true,
+		Extensions: []onion.Extension{
+			{Type: 0x42, Value: []byte("first")},
+			{Type: onion.ExtShare, Value: []byte{}},
+		},
+		UtilPayloadLength: 7,
+		Payload:           []byte("payload"),
+	}
+
+	data, err := in.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() failed: %v", err)
+	}
+	if !onion.HasExtensions(data[0]) {
+		t.Fatal("extensions flag not set")
+	}
+
+	var out onion.OnionLayerCiphered
+	if err := out.Parse(data); err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	if len(out.Extensions) != 2 {
+		t.Fatalf("got %d extensions, want 2", len(out.Extensions))
+	}
+	e, ok := onion.FindExtension(out.Extensions, 0x42)
+	if !ok || !bytes.Equal(e.Value, []byte("first")) {
+		t.Fatalf("FindExtension(0x42) = %v, %v", e, ok)
+	}
+	if !bytes.Equal(out.Payload, in.Payload) {
+		t.Fatalf("payload mismatch: got %q, want %q", out.Payload, in.Payload)
+	}
+}
+
+func TestExtensions_Invalid(t *testing.T) {
+	t.Parallel()
+
+	reserved := onion.OnionLayerCiphered{
+		Extensions: []onion.Extension{{Type: onion.ExtEnd}},
+	}
+	if _, err := reserved.Bytes(); err == nil {
+		t.Error("expected error for reserved extension type")
+	}
+
+	tests := map[string][]byte{
+		"unterminated": {onion.FlagExtensions, 0x00, 0x00, 0x42, 0x00, 0x01, 0xff},
+		"truncated":    {onion.FlagExtensions, 0x00, 0x00, 0x42, 0x00, 0x05, 0xff},
+		"no header":    {onion.FlagExtensions, 0x00, 0x00, 0x42, 0x00},
+	}
+	for name, data := range tests {
+		var olc onion.OnionLayerCiphered
+		if err := olc.Parse(data); err == nil {
+			t.Errorf("%s: expected parse error", name)
+		}
+	}
+}
+
+func TestMixDelayClass(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		exts     []onion.Extension
+		expected uint8
+	}{
+		{
+			name:     "No extension",
+			exts:     nil,
+			expected: 0,
+		},
+		{
+			name:     "Class 3 among others",
+			exts:     []onion.Extension{{Type: onion.ExtShare}, onion.MixDelayExtension(3)},
+			expected: 3,
+		},
+		{
+			name:     "Class above max",
+			exts:     []onion.Extension{onion.MixDelayExtension(0xff)},
+			expected: onion.MaxMixDelayClass,
+		},
+		{
+			name:     "Malformed value",
+			exts:     []onion.Extension{{Type: onion.ExtMixDelay, Value: []byte{1, 2}}},
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := onion.MixDelayClass(tt.exts)
+			if got != tt.expected {
+				t.Fatalf("MixDelayClass() unexpected result.\n\tgot: %d\n\twant: %d", got, tt.expected)
+			}
+		})
+	}
+}
@@ -1,14 +1,37 @@
 package onion
 
+// Flags of the decrypted OnionLayerCiphered.
 const (
+	FlagExtensions = 0x80 // 1000 0000
+	FlagRedundancy = 0x60 // 0110 0000
+	FlagDrop       = 0x10 // 0001 0000
 	FlagLastServer = 0x08 // 0000 1000
 	FlagNbNextHops = 0x07 // 0000 0111
 )
 
+// MaxMixDelayClass is the highest delay class of an ExtMixDelay extension.
+const MaxMixDelayClass = 0x0F
+
 func IsLastServer(flags uint8) bool {
 	return (flags & FlagLastServer) != 0
 }
 
+// HasExtensions reports whether the payload is preceded by an extension list.
+func HasExtensions(flags uint8) bool {
+	return (flags & FlagExtensions) != 0
+}
+
+// IsDrop reports whether the layer is cover traffic to discard at this hop.
+func IsDrop(flags uint8) bool {
+	return (flags & FlagDrop) != 0
+}
+
 func GetNbNextHops(flags uint8) uint8 {
 	return flags & FlagNbNextHops
 }
+
+// GetRedundancy returns how many next hops should get the packet in
+// parallel. Zero and one both mean a single hop, the others being fallbacks.
+func GetRedundancy(flags uint8) uint8 {
+	return (flags & FlagRedundancy) >> 5
+}
@@ -48,6 +48,48 @@ func TestFlags_IsLastServer(t *testing.T) {
 	}
 }
 
+func TestFlags_IsDrop(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		flags    uint8
+		expected bool
+	}{
+		{
+			name:     "Is drop",
+			flags:    0x10,
+			expected: true,
+		},
+		{
+			name:     "Is drop with complex flag",
+			flags:    0xff,
+			expected: true,
+		},
+		{
+			name:     "Is not drop",
+			flags:    0x00,
+			expected: false,
+		},
+		{
+			name:     "Is not drop with complex flag",
+			flags:    0xef,
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := onion.IsDrop(tt.flags)
+			if got != tt.expected {
+				t.Fatalf("IsDrop() unexpected result.\n\tgot: %v\n\twant: %v", got, tt.expected)
+			}
+		})
+	}
+}
+
 func TestFlags_GetNbNextHops(t *testing.T) {
 	t.Parallel()
 
@@ -89,3 +131,45 @@ func TestFlags_GetNbNextHops(t *testing.T) {
 		})
 	}
 }
+
+func TestFlags_GetRedundancy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		flags    uint8
+		expected uint8
+	}{
+		{
+			name:     "No redundancy",
+			flags:    0x00,
+			expected: 0,
+		},
+		{
+			name:     "No redundancy - complex flag",
+			flags:    0x9f,
+			expected: 0,
+		},
+		{
+			name:     "Redundancy 2",
+			flags:    0x40,
+			expected: 2,
+		},
+		{
+			name:     "Redundancy 3 - complex flag",
+			flags:    0xff,
+			expected: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := onion.GetRedundancy(tt.flags)
+			if got != tt.expected {
+				t.Fatalf("GetRedundancy() unexpected result.\n\tgot: %d\n\twant: %d", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package onion_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+func FuzzOnionLayer_Parse(f *testing.F) {
+	minimal := make([]byte, onion.FixedHeaderSize)
+	minimal[32+onion.MaxWrappedKey*onion.WrappedKeySize] = 0x42
+	f.Add(minimal)
+
+	full := make([]byte, onion.PacketSize)
+	for i := range full {
+		full[i] = byte(i)
+	}
+	f.Add(full)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var ol onion.OnionLayer
+		if err := ol.Parse(data); err != nil {
+			return
+		}
+
+		if len(data) > onion.PacketSize {
+			t.Fatalf("Parse() accepted %d bytes, more than a packet", len(data))
+		}
+		header, err := ol.HeaderBytes()
+		if err != nil {
+			t.Fatalf("HeaderBytes() of a parsed layer failed: %v", err)
+		}
+		if len(header) != onion.FixedHeaderSize {
+			t.Fatalf("header size mismatch:\n\tgot:  %d\n\twant: %d", len(header), onion.FixedHeaderSize)
+		}
+		out, err := ol.Bytes()
+		if err != nil {
+			t.Fatalf("Bytes() of a parsed layer failed: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("round trip mismatch:\n\tgot:  %x\n\twant: %x", out, data)
+		}
+	})
+}
+
+func FuzzOnionLayerCiphered_Parse(f *testing.F) {
+	f.Add([]byte{0x08, 0x00, 0x2A, 'D', 'O', 'R', ' ', '>', '>', '>', ' ', 'T', 'O', 'R'})
+	f.Add([]byte{2, 0, 5, 4, 121, 57, 8, 8, 8, 8, 4, 113, 175, 8, 8, 4, 4, 68, 79, 82, 73, 33})
+	f.Add([]byte{0x00})
+
+	seeds := []onion.OnionLayerCiphered{
+		{
+			Redundancy: 2,
+			Drop:       true,
+			NextHops:   []identity.Endpoint{{IP: net.ParseIP("8.8.8.8"), Port: 31033}, {IP: net.ParseIP("2001:db8::1"), Port: 29103}},
+			Payload:    []byte("DORI"),
+		},
+		{
+			LastServer: true,
+			NextHops:   []identity.Endpoint{{IP: net.ParseIP("10.0.0.1"), Port: 62503}},
+			Extensions: []onion.Extension{{Type: onion.ExtShare, Value: []byte{1, 2, 3}}, {Type: onion.ExtAckRequest}},
+			Payload:    []byte("shared"),
+		},
+	}
+	for _, olc := range seeds {
+		raw, err := olc.Bytes()
+		if err != nil {
+			f.Fatalf("Bytes() failed: %v", err)
+		}
+		f.Add(raw)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var olc onion.OnionLayerCiphered
+		if err := olc.Parse(data); err != nil {
+			return
+		}
+
+		out, err := olc.Bytes()
+		if err != nil {
+			t.Fatalf("Bytes() of a parsed layer failed: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("round trip mismatch:\n\tgot:  %x\n\twant: %x", out, data)
+		}
+	})
+}
+
+// FuzzExtensions checks that every extension parsed from a value encodes
+// back to it.
+func FuzzExtensions(f *testing.F) {
+	ep := identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 62503}
+
+	share := onion.Share{MessageID: [16]byte{1}, Index: 1, K: 2, N: 3, Size: 42}.Extension()
+	f.Add(share.Type, share.Value)
+
+	ack, err := onion.AckRequest{Entry: []identity.Endpoint{ep}, Reply: make([]byte, onion.FixedHeaderSize)}.Extension()
+	if err != nil {
+		f.Fatalf("AckRequest.Extension() failed: %v", err)
+	}
+	f.Add(ack.Type, ack.Value)
+
+	join, err := onion.RendezvousJoin{Cookie: [16]byte{2}, Token: [16]byte{3}, Guard: identity.Relay{Ep: ep}}.Extension()
+	if err != nil {
+		f.Fatalf("RendezvousJoin.Extension() failed: %v", err)
+	}
+	f.Add(join.Type, join.Value)
+
+	reg, err := onion.IntroRegistration{Key: make([]byte, 32), Guard: identity.Relay{Ep: ep}}.Extension()
+	if err != nil {
+		f.Fatalf("IntroRegistration.Extension() failed: %v", err)
+	}
+	f.Add(reg.Type, reg.Value)
+
+	f.Fuzz(func(t *testing.T, typ uint8, value []byte) {
+		e := onion.Extension{Type: typ, Value: value}
+
+		var got onion.Extension
+		switch typ {
+		case onion.ExtShare:
+			s, err := onion.ParseShare(e)
+			if err != nil {
+				return
+			}
+			got = s.Extension()
+		case onion.ExtAckRequest:
+			a, err := onion.ParseAckRequest(e)
+			if err != nil {
+				return
+			}
+			if got, err = a.Extension(); err != nil {
+				t.Fatalf("Extension() of a parsed ack request failed: %v", err)
+			}
+		case onion.ExtIntroRegister:
+			r, err := onion.ParseIntroRegistration(e)
+			if err != nil {
+				return
+			}
+			if got, err = r.Extension(); err != nil {
+				t.Fatalf("Extension() of a parsed registration failed: %v", err)
+			}
+		case onion.ExtRendezvousJoin:
+			j, err := onion.ParseRendezvousJoin(e)
+			if err != nil {
+				return
+			}
+			if got, err = j.Extension(); err != nil {
+				t.Fatalf("Extension() of a parsed rendezvous join failed: %v", err)
+			}
+		default:
+			return
+		}
+
+		if got.Type != typ || !bytes.Equal(got.Value, value) {
+			t.Fatalf("round trip mismatch:\n\tgot:  %02x %x\n\twant: %02x %x", got.Type, got.Value, typ, value)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package onion
+
+import (
+	"crypto/mlkem"
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
+)
+
+const (
+	// KEMCipherTextSize is the size of the ML-KEM-768 ciphertext of a
+	// HybridEnvelope.
+	KEMCipherTextSize = mlkem.CiphertextSize768
+
+	// KEMCipherText (1088) + sealed secret (32) + Poly1305 tag (16)
+	HybridEnvelopeSize = KEMCipherTextSize + 32 + crypto.Poly1305TagSize
+)
+
+// ExtHybridSecret carries the hybrid secret of the next group of a hybrid
+// onion or, in the last layer, that of the entry group of a hybrid reply
+// onion.
+const ExtHybridSecret = 0x0B
+
+var (
+	HKDFInfoHybridSecret   = []byte("DORv1:HybridSecret")
+	HKDFInfoHybridEnvelope = []byte("DORv1:HybridEnvelope")
+)
+
+// A hybrid onion travels with a HybridEnvelope, sealed for the relay it is
+// sent to by the previous hop (the client for the entry group). The
+// envelope carries the hybrid secret of the layer the relay opens: mixed
+// with the X25519 secret into the wrapping key, it keeps the layer safe from
+// whoever breaks X25519 alone. The hybrid secret of the next group travels
+// in an ExtHybridSecret extension of the layer, so the layers themselves
+// grow by 35 bytes per hop while the 1088 bytes of the KEM ciphertext are
+// paid once per link.
+//
+// 0        7        15       23       31
+// +--------+--------+--------+--------+
+// ~    KEM CipherText (1088 bytes)    ~
+// +--------+--------+--------+--------+
+// ~  Sealed hybrid secret (32 bytes)  ~
+// +--------+--------+--------+--------+
+// ~       Poly1305 tag (16 bytes)     ~
+// +--------+--------+--------+--------+
+type HybridEnvelope [HybridEnvelopeSize]byte
+
+// HybridSecret returns the hybrid secret of the group of the given cipher
+// key. Deriving it from the cipher key spares the path any extra material,
+// and the relay handing it over learns nothing of the key itself.
+func HybridSecret(cipherKey [32]byte) ([32]byte, error) {
+	var secret [32]byte
+
+	out, err := crypto.HKDFSha256(cipherKey[:], nil, HKDFInfoHybridSecret)
+	if err != nil {
+		return secret, err
+	}
+	if len(out) < len(secret) {
+		return secret, fmt.Errorf("hkdf output too short: %d", len(out))
+	}
+	copy(secret[:], out)
+	return secret, nil
+}
+
+// SealHybridEnvelope seals secret for the relay of ML-KEM-768 encapsulation
+// key kemKey.
+func SealHybridEnvelope(kemKey []byte, secret [32]byte) (HybridEnvelope, error) {
+	var env HybridEnvelope
+
+	ek, err := mlkem.NewEncapsulationKey768(kemKey)
+	if err != nil {
+		return env, fmt.Errorf("invalid KEM key: %w", err)
+	}
+	kemSecret, kemCipherText := ek.Encapsulate()
+
+	key, err := envelopeKey(kemSecret)
+	if err != nil {
+		return env, err
+	}
+	// The key is fresh for every envelope, so a zero nonce is safe.
+	sealed, err := crypto.ChachaEncrypt(key, [12]byte{}, secret[:], kemCipherText)
+	if err != nil {
+		return env, err
+	}
+
+	copy(env[:], kemCipherText)
+	copy(env[KEMCipherTextSize:], sealed)
+	return env, nil
+}
+
+// OpenHybridEnvelope returns the hybrid secret sealed in env, dk
+// decapsulating its KEM ciphertext.
+func OpenHybridEnvelope(dk *mlkem.DecapsulationKey768, env HybridEnvelope) ([32]byte, error) {
+	var secret [32]byte
+
+	kemCipherText := env[:KEMCipherTextSize]
+	kemSecret, err := dk.Decapsulate(kemCipherText)
+	if err != nil {
+		return secret, fmt.Errorf("failed to decapsulate KEM secret: %w", err)
+	}
+
+	key, err := envelopeKey(kemSecret)
+	if err != nil {
+		return secret, err
+	}
+	res, err := crypto.ChachaDecrypt(key, [12]byte{}, env[KEMCipherTextSize:], kemCipherText)
+	if err != nil {
+		return secret, fmt.Errorf("failed to open hybrid envelope: %w", err)
+	}
+	copy(secret[:], res)
+	return secret, nil
+}
+
+func envelopeKey(kemSecret []byte) ([32]byte, error) {
+	var key [32]byte
+
+	out, err := crypto.HKDFSha256(kemSecret, nil, HKDFInfoHybridEnvelope)
+	if err != nil {
+		return key, err
+	}
+	if len(out) < len(key) {
+		return key, fmt.Errorf("hkdf output too short: %d", len(out))
+	}
+	copy(key[:], out)
+	return key, nil
+}
+
+// HybridSecretExtension hands the hybrid secret of the next group to the
+// relay reading the layer, for it to seal in the envelope of the next hop.
+func HybridSecretExtension(secret [32]byte) Extension {
+	return Extension{Type: ExtHybridSecret, Value: secret[:]}
+}
+
+// NextHybridSecret returns the hybrid secret of the next group carried in
+// exts, and whether there is one.
+func NextHybridSecret(exts []Extension) ([32]byte, bool) {
+	var secret [32]byte
+
+	e, ok := FindExtension(exts, ExtHybridSecret)
+	if !ok || len(e.Value) != len(secret) {
+		return secret, false
+	}
+	copy(secret[:], e.Value)
+	return secret, true
+}
@@ -0,0 +1,201 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+// newHybridPath returns a path of groups of the given sizes, with the keys
+// of their relays.
+func newHybridPath(t *testing.T, sizes ...int) ([]identity.CryptoGroup, [][]testRelayKey) {
+	t.Helper()
+
+	path := make([]identity.CryptoGroup, len(sizes))
+	keys := make([][]testRelayKey, len(sizes))
+	for i, n := range sizes {
+		group, k := newTestGroup(t, n)
+		path[i], keys[i] = *group, k
+	}
+	return path, keys
+}
+
+func TestBuildOnion_Hybrid(t *testing.T) {
+	t.Parallel()
+
+	path, keys := newHybridPath(t, 3, 1, 2, 3, 1)
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	payload := []byte("post-quantum payload")
+
+	layer, err := BuildOnion(dest, path, payload, WithHybridKEM(), WithMixDelay(2))
+	if err != nil {
+		t.Fatalf("BuildOnion() error = %v", err)
+	}
+
+	secret, err := HybridSecret(path[0].CipherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, group := range keys {
+		// The last relay of each group gets the onion, as if the others
+		// were unreachable.
+		r := group[len(group)-1]
+		dk, err := mlkem.GenerateKey768()
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, err := SealHybridEnvelope(dk.EncapsulationKey().Bytes(), secret)
+		if err != nil {
+			t.Fatalf("hop %d: SealHybridEnvelope() error = %v", i, err)
+		}
+		opened, err := OpenHybridEnvelope(dk, env)
+		if err != nil {
+			t.Fatalf("hop %d: OpenHybridEnvelope() error = %v", i, err)
+		}
+
+		if _, err := UnwrapSessionKey(r.priv, r.relay.UUID, layer.EPK, layer.WrappedKeys); !errors.Is(err, ErrNoWrappedKey) {
+			t.Fatalf("hop %d: classic unwrap of a hybrid layer: error = %v, want %v", i, err, ErrNoWrappedKey)
+		}
+		key, err := UnwrapHybridSessionKey(r.priv, r.relay.UUID, layer.EPK, opened, layer.WrappedKeys)
+		if err != nil {
+			t.Fatalf("hop %d: UnwrapHybridSessionKey() error = %v", i, err)
+		}
+
+		olc := peel(t, layer, key)
+		if c := MixDelayClass(olc.Extensions); c != 2 {
+			t.Errorf("hop %d: mix delay class = %d, want 2", i, c)
+		}
+
+		next, ok := NextHybridSecret(olc.Extensions)
+		if i == len(keys)-1 {
+			if ok {
+				t.Error("last hop: unexpected hybrid secret")
+			}
+			if !bytes.Equal(olc.Payload, payload) {
+				t.Errorf("payload mismatch: got %q, want %q", olc.Payload, payload)
+			}
+			break
+		}
+		if !ok {
+			t.Fatalf("hop %d: no hybrid secret for the next group", i)
+		}
+
+		layer = &OnionLayer{}
+		if err := layer.Parse(olc.Payload); err != nil {
+			t.Fatalf("hop %d: inner Parse() error = %v", i, err)
+		}
+		secret = next
+	}
+}
+
+func TestBuildOnion_HybridBudget(t *testing.T) {
+	t.Parallel()
+
+	path, _ := newHybridPath(t, 3, 3, 3, 3, 3)
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	classic := PacketSize - computePathOverhead(path, dest)
+	// Every layer but the last carries the secret of the next group.
+	hybrid := classic - (len(path)-1)*(extensionHeaderSize+32) - (len(path) - 1)
+
+	if _, err := BuildOnion(dest, path, make([]byte, hybrid), WithHybridKEM()); err != nil {
+		t.Fatalf("BuildOnion() of the largest payload failed: %v", err)
+	}
+	if _, err := BuildOnion(dest, path, make([]byte, hybrid+1), WithHybridKEM()); err == nil {
+		t.Fatal("BuildOnion() of a payload one byte too large succeeded")
+	}
+}
+
+func TestHybridEnvelope(t *testing.T) {
+	t.Parallel()
+
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := [32]byte{1, 2, 3}
+
+	env, err := SealHybridEnvelope(dk.EncapsulationKey().Bytes(), secret)
+	if err != nil {
+		t.Fatalf("SealHybridEnvelope() error = %v", err)
+	}
+
+	tampered := env
+	tampered[0] ^= 1
+	sealed := env
+	sealed[HybridEnvelopeSize-1] ^= 1
+
+	tests := []struct {
+		name    string
+		dk      *mlkem.DecapsulationKey768
+		env     HybridEnvelope
+		wantErr bool
+	}{
+		{name: "valid", dk: dk, env: env},
+		{name: "other relay", dk: other, env: env, wantErr: true},
+		{name: "tampered KEM ciphertext", dk: dk, env: tampered, wantErr: true},
+		{name: "tampered sealed secret", dk: dk, env: sealed, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := OpenHybridEnvelope(tt.dk, tt.env)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("OpenHybridEnvelope() should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenHybridEnvelope() error = %v", err)
+			}
+			if got != secret {
+				t.Errorf("secret mismatch: got %x, want %x", got, secret)
+			}
+		})
+	}
+
+	if _, err := SealHybridEnvelope([]byte("short"), secret); err == nil {
+		t.Error("SealHybridEnvelope() should reject an invalid KEM key")
+	}
+}
+
+func TestNextHybridSecret(t *testing.T) {
+	t.Parallel()
+
+	secret := [32]byte{0xAA}
+
+	tests := []struct {
+		name   string
+		exts   []Extension
+		wantOk bool
+	}{
+		{name: "none", exts: nil},
+		{name: "present", exts: []Extension{MixDelayExtension(1), HybridSecretExtension(secret)}, wantOk: true},
+		{name: "truncated", exts: []Extension{{Type: ExtHybridSecret, Value: secret[:31]}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := NextHybridSecret(tt.exts)
+			if ok != tt.wantOk {
+				t.Fatalf("NextHybridSecret() ok = %t, want %t", ok, tt.wantOk)
+			}
+			if ok && got != secret {
+				t.Errorf("secret mismatch: got %x, want %x", got, secret)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"io"
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
 )
@@ -109,7 +110,13 @@ func (ol *OnionLayer) Bytes() ([]byte, error) {
 	return out, nil
 }
 
+// BytesPadded returns the layer padded with random bytes to PacketSize.
 func (ol *OnionLayer) BytesPadded() ([]byte, error) {
+	return ol.BytesPaddedFrom(rand.Reader)
+}
+
+// BytesPaddedFrom is BytesPadded drawing the padding from r.
+func (ol *OnionLayer) BytesPaddedFrom(r io.Reader) ([]byte, error) {
 	rawBytes, err := ol.Bytes()
 	if err != nil {
 		return nil, err
@@ -125,7 +132,7 @@ func (ol *OnionLayer) BytesPadded() ([]byte, error) {
 
 	paddingStart := currentSize
 	if paddingStart < PacketSize {
-		if _, err := rand.Read(out[paddingStart:]); err != nil {
+		if _, err := io.ReadFull(r, out[paddingStart:]); err != nil {
 			return nil, fmt.Errorf("failed to generate random padding: %v", err)
 		}
 	}
@@ -138,6 +145,10 @@ func (ol *OnionLayer) Parse(data []byte) error {
 		return fmt.Errorf("data too short: need at least %d bytes for header, got %d",
 			FixedHeaderSize, len(data))
 	}
+	if len(data) > PacketSize {
+		return fmt.Errorf("data too long: layers are at most %d bytes, got %d",
+			PacketSize, len(data))
+	}
 
 	offset := 0
 
@@ -188,3 +199,28 @@ func (ol *OnionLayer) TrimCipherText(cipherKey [32]byte) error {
 	ol.CipherText = ol.CipherText[:realLen]
 	return nil
 }
+
+// Decrypt trims and decrypts the cipher text with the session key unwrapped
+// from the layer, and parses the result. This is what a relay does with every
+// layer it opens.
+func (ol *OnionLayer) Decrypt(sessionKey [32]byte) (*OnionLayerCiphered, error) {
+	if err := ol.TrimCipherText(sessionKey); err != nil {
+		return nil, fmt.Errorf("failed to trim CipherText: %w", err)
+	}
+
+	header, err := ol.HeaderBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := crypto.ChachaDecrypt(sessionKey, ol.PayloadNonce, ol.CipherText, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt CipherText: %w", err)
+	}
+
+	var olc OnionLayerCiphered
+	if err := olc.Parse(plaintext); err != nil {
+		return nil, fmt.Errorf("failed to parse plaintext: %w", err)
+	}
+	return &olc, nil
+}
@@ -8,33 +8,42 @@ import (
 )
 
 const (
-	// RRRRlnnh (1) + PayloadLength (2)
+	// ekkdlnnh (1) + PayloadLength (2)
 	InnerMetadataFixedSize = 1 + 2
 )
 
 // OnionLayerCiphered is the logical decrypted content of an OnionLayer.CipherText
 // It is NEVER transmitted as-is.
 type OnionLayerCiphered struct {
+	Redundancy        uint8 // next hops to send to in parallel, see GetRedundancy
+	Drop              bool  // cover traffic, discarded by the relay reading it
 	LastServer        bool
 	NextHops          []identity.Endpoint
+	Extensions        []Extension
 	UtilPayloadLength uint16 // Actual payload length before padding
 	Payload           []byte
 }
 
 // 0        7        15       23       31
 // +--------+--------+--------+--------+
-// |RRRRlnnh|   Payload Len   |  NH[0] |
+// |ekkdlnnh|   Payload Len   |  NH[0] |
 // +--------+--------+--------+--------+
 // |                                   |
 // ~ Next Hops List (Variable) [1:...] ~
 // |                                   |
 // +--------+--------+--------+--------+
 // |                                   |
+// ~ Extensions (Variable, if e is set)~
+// |                                   |
+// +--------+--------+--------+--------+
+// |                                   |
 // ~          Actual Payload           ~
 // |                                   |
 // +--------+--------+--------+--------+
 //
-// R        -> Reserved (4 bits)
+// e        -> Extensions (1 bit)
+// kk       -> Redundancy (2 bits)
+// d        -> Drop (1 bit)
 // l        -> LastServer (1 bit)
 // nnh      -> Nb NextHops (3 bits)
 
@@ -43,9 +52,21 @@ func (olc *OnionLayerCiphered) Bytes() ([]byte, error) {
 	for _, ep := range olc.NextHops {
 		headerLen += ep.BytesLen()
 	}
+	headerLen += extensionsLen(olc.Extensions)
 
 	out := make([]byte, 0, headerLen+len(olc.Payload))
+	if olc.Redundancy > MaxWrappedKey {
+		return nil, fmt.Errorf("redundancy %d out of range (max %d)", olc.Redundancy, MaxWrappedKey)
+	}
+
 	var flags uint8
+	flags |= (olc.Redundancy << 5) & FlagRedundancy
+	if len(olc.Extensions) > 0 {
+		flags |= FlagExtensions
+	}
+	if olc.Drop {
+		flags |= FlagDrop
+	}
 	if olc.LastServer {
 		flags |= FlagLastServer
 	}
@@ -68,6 +89,13 @@ func (olc *OnionLayerCiphered) Bytes() ([]byte, error) {
 		out = append(out, epBytes...)
 	}
 
+	if len(olc.Extensions) > 0 {
+		var err error
+		if out, err = appendExtensions(out, olc.Extensions); err != nil {
+			return nil, err
+		}
+	}
+
 	out = append(out, olc.Payload...)
 
 	return out, nil
@@ -80,8 +108,13 @@ func (olc *OnionLayerCiphered) Parse(data []byte) error {
 
 	offset := 0
 	flags := data[offset]
-	olc.LastServer = (flags & FlagLastServer) != 0
+	olc.Redundancy = GetRedundancy(flags)
+	olc.Drop = IsDrop(flags)
+	olc.LastServer = IsLastServer(flags)
 	nnh := int(flags & FlagNbNextHops)
+	if nnh > MaxWrappedKey {
+		return fmt.Errorf("too many next hops: %d (max %d)", nnh, MaxWrappedKey)
+	}
 	offset++
 
 	olc.UtilPayloadLength = binary.BigEndian.Uint16(data[offset : offset+2])
@@ -104,6 +137,16 @@ func (olc *OnionLayerCiphered) Parse(data []byte) error {
 		return fmt.Errorf("offset exceeds data length")
 	}
 
+	olc.Extensions = nil
+	if HasExtensions(flags) {
+		exts, n, err := parseExtensions(data[offset:])
+		if err != nil {
+			return fmt.Errorf("failed to parse extensions: %w", err)
+		}
+		olc.Extensions = exts
+		offset += n
+	}
+
 	olc.Payload = make([]byte, len(data)-offset)
 	copy(olc.Payload, data[offset:])
 
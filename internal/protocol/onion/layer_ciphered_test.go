@@ -56,6 +56,27 @@ func TestBytes(t *testing.T) {
 			wantErr:     false,
 			errContains: "",
 		},
+		{
+			name: "redundancy out of range",
+			layer: onion.OnionLayerCiphered{
+				Redundancy: onion.MaxWrappedKey + 1,
+			},
+			wantErr:     true,
+			errContains: "redundancy",
+		},
+		{
+			name: "drop",
+			layer: onion.OnionLayerCiphered{
+				Drop:              true,
+				LastServer:        true,
+				NextHops:          []identity.Endpoint{},
+				UtilPayloadLength: 3,
+				Payload:           []byte("DOR"),
+			},
+			want:        []byte{0x18, 0x00, 0x03, 'D', 'O', 'R'},
+			wantErr:     false,
+			errContains: "",
+		},
 		{
 			name: "with next hops",
 			layer: onion.OnionLayerCiphered{
@@ -185,6 +206,16 @@ func TestRoundedTrip(t *testing.T) {
 				Payload:           []byte("J'aime le fromage de vache"),
 			},
 		},
+		{
+			name: "redundancy and drop",
+			layer: onion.OnionLayerCiphered{
+				Redundancy:        2,
+				Drop:              true,
+				NextHops:          []identity.Endpoint{{IP: net.ParseIP("8.8.8.8"), Port: 31033}, {IP: net.ParseIP("8.8.4.4"), Port: 29103}},
+				UtilPayloadLength: 4,
+				Payload:           []byte("DORI"),
+			},
+		},
 		{
 			name: "no next hops",
 			layer: onion.OnionLayerCiphered{
@@ -212,6 +243,12 @@ func TestRoundedTrip(t *testing.T) {
 			if olc.LastServer != tt.layer.LastServer {
 				t.Fatalf("OnionLayerCiphered rounded trip LastServer \n\tgot  %v, \n\twant %v", olc.LastServer, tt.layer.LastServer)
 			}
+			if olc.Redundancy != tt.layer.Redundancy {
+				t.Fatalf("OnionLayerCiphered rounded trip Redundancy \n\tgot  %v, \n\twant %v", olc.Redundancy, tt.layer.Redundancy)
+			}
+			if olc.Drop != tt.layer.Drop {
+				t.Fatalf("OnionLayerCiphered rounded trip Drop \n\tgot  %v, \n\twant %v", olc.Drop, tt.layer.Drop)
+			}
 			if olc.UtilPayloadLength != tt.layer.UtilPayloadLength {
 				t.Fatalf("OnionLayerCiphered rounded trip UtilPayloadLength \n\tgot  %v, \n\twant %v", olc.UtilPayloadLength, tt.layer.UtilPayloadLength)
 			}
@@ -3,9 +3,11 @@ package onion_test
 import (
 	"bytes"
 	"encoding/binary"
+	"net"
 	"strings"
 	"testing"
 
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
 )
 
@@ -1116,6 +1118,59 @@ func TestOnionLayer_TrimCipherText(t *testing.T) {
 	}
 }
 
+func TestOnionLayer_Decrypt(t *testing.T) {
+	t.Parallel()
+
+	path := []identity.CryptoGroup{{Group: identity.RelayGroup{Relays: []identity.Relay{{
+		Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9001},
+		PubKey: [32]byte{0x09},
+	}}}}}
+	if err := path[0].GenerateCryptoMaterial(); err != nil {
+		t.Fatal(err)
+	}
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	payload := []byte("payload")
+
+	tests := []struct {
+		name    string
+		key     func() [32]byte
+		tamper  bool
+		wantErr bool
+	}{
+		{name: "group key", key: func() [32]byte { return path[0].CipherKey }},
+		{name: "wrong key", key: func() [32]byte { return [32]byte{0x01} }, wantErr: true},
+		{name: "tampered cipher text", key: func() [32]byte { return path[0].CipherKey }, tamper: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			layer, err := onion.BuildOnion(dest, path, payload)
+			if err != nil {
+				t.Fatalf("BuildOnion() failed: %v", err)
+			}
+			if tt.tamper {
+				layer.CipherText[0] ^= 0x01
+			}
+
+			olc, err := layer.Decrypt(tt.key())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !olc.LastServer {
+				t.Error("LastServer = false, want true")
+			}
+			if !bytes.Equal(olc.Payload, payload) {
+				t.Errorf("payload mismatch:\n\tgot:  %q\n\twant: %q", olc.Payload, payload)
+			}
+		})
+	}
+}
+
 // -------------------------
 // Benchmark functions
 // -------------------------
@@ -0,0 +1,329 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Extension types of the rendezvous protocol. All of them are read by the
+// last relay of the onion carrying them.
+//
+// A hidden service registers a token at its guard relay, which alone learns
+// its address, and publishes a descriptor naming its introduction relays.
+// Relays reach the service by sending onions ending at the guard with an
+// ExtGuardDeliver extension.
+//
+// A client leaves its sealed message at a rendezvous relay under a cookie
+// (ExtRendezvous), then asks an introduction relay to pass the cookie and the
+// rendezvous relay to the service (ExtIntroduce). The service joins the
+// rendezvous through its own path (ExtRendezvousJoin) and the rendezvous
+// relay hands it the message through its guard.
+const (
+	ExtServicePublish = 0x04
+	ExtIntroRegister  = 0x05
+	ExtIntroduce      = 0x06
+	ExtRendezvous     = 0x07
+	ExtRendezvousJoin = 0x08
+	ExtGuardDeliver   = 0x09
+)
+
+// Kinds of the data handed to a hidden service by its guard.
+const (
+	ServiceDataIntroduce = 0x01
+	ServiceDataMessage   = 0x02
+)
+
+var (
+	HKDFSaltServiceSeal = []byte("DORv1:ServiceSeal")
+	HKDFInfoServiceSeal = []byte("DORv1:ServiceSealKey")
+
+	introRegisterContext = []byte("DORv1:IntroRegister")
+)
+
+// SealedOverhead is the size added by Seal: EPK (32) + Nonce (12) + Tag (16).
+const SealedOverhead = 32 + 12 + crypto.Poly1305TagSize
+
+// Seal encrypts plaintext for the holder of the X25519 private key matching
+// pub, with a fresh ephemeral key.
+func Seal(pub [32]byte, plaintext []byte) ([]byte, error) {
+	var esk [32]byte
+	if _, err := rand.Read(esk[:]); err != nil {
+		return nil, err
+	}
+	epk, err := curve25519.X25519(esk[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := sealKey(esk[:], pub[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	ct, err := crypto.ChachaEncrypt(key, nonce, plaintext, epk)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, SealedOverhead+len(plaintext))
+	out = append(out, epk...)
+	out = append(out, nonce[:]...)
+	return append(out, ct...), nil
+}
+
+// Open decrypts data sealed for the X25519 private key priv.
+func Open(priv [32]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < SealedOverhead {
+		return nil, fmt.Errorf("sealed data too short: %d bytes", len(sealed))
+	}
+
+	epk := sealed[:32]
+	key, err := sealKey(priv[:], epk)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [12]byte
+	copy(nonce[:], sealed[32:44])
+	return crypto.ChachaDecrypt(key, nonce, sealed[44:], epk)
+}
+
+func sealKey(priv, pub []byte) ([32]byte, error) {
+	shared, err := curve25519.X25519(priv, pub)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	k, err := crypto.HKDFSha256(shared, HKDFSaltServiceSeal, HKDFInfoServiceSeal)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	var key [32]byte
+	copy(key[:], k)
+	return key, nil
+}
+
+func ServicePublishExtension(d identity.ServiceDescriptor) (Extension, error) {
+	b, err := d.Bytes()
+	if err != nil {
+		return Extension{}, err
+	}
+	return Extension{Type: ExtServicePublish, Value: b}, nil
+}
+
+// IntroRegistration asks an introduction relay to pass the introductions
+// for the service Key to its guard, under Token. It is signed by the service
+// for one introduction relay.
+//
+// +--------+--------+--------+--------+
+// | Key (32) | Token (16) | Guard (relay) | Sig (64) |
+// +--------+--------+--------+--------+
+type IntroRegistration struct {
+	Key   ed25519.PublicKey
+	Token [16]byte
+	Guard identity.Relay
+	Sig   [ed25519.SignatureSize]byte
+}
+
+func (r IntroRegistration) body() ([]byte, error) {
+	if len(r.Key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid service key size: %d", len(r.Key))
+	}
+	guard, err := r.Guard.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 32+16+len(guard)+ed25519.SignatureSize)
+	out = append(out, r.Key...)
+	out = append(out, r.Token[:]...)
+	return append(out, guard...), nil
+}
+
+func (r IntroRegistration) signedBytes(intro [16]byte) ([]byte, error) {
+	body, err := r.body()
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte(nil), introRegisterContext...)
+	msg = append(msg, intro[:]...)
+	return append(msg, body...), nil
+}
+
+// Sign fills Key and Sig for the introduction relay with the given UUID.
+func (r *IntroRegistration) Sign(si *identity.ServiceIdentity, intro [16]byte) error {
+	r.Key = si.PublicKey()
+	msg, err := r.signedBytes(intro)
+	if err != nil {
+		return err
+	}
+	copy(r.Sig[:], ed25519.Sign(si.SignKey, msg))
+	return nil
+}
+
+// Verify checks that the registration was signed for the introduction relay
+// with the given UUID.
+func (r IntroRegistration) Verify(intro [16]byte) error {
+	msg, err := r.signedBytes(intro)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(r.Key, msg, r.Sig[:]) {
+		return fmt.Errorf("invalid introduction registration signature")
+	}
+	return nil
+}
+
+func (r IntroRegistration) Extension() (Extension, error) {
+	body, err := r.body()
+	if err != nil {
+		return Extension{}, err
+	}
+	return Extension{Type: ExtIntroRegister, Value: append(body, r.Sig[:]...)}, nil
+}
+
+func ParseIntroRegistration(e Extension) (IntroRegistration, error) {
+	if e.Type != ExtIntroRegister {
+		return IntroRegistration{}, fmt.Errorf("not an introduction registration extension: 0x%02x", e.Type)
+	}
+	if len(e.Value) < 32+16 {
+		return IntroRegistration{}, fmt.Errorf("introduction registration too short: %d bytes", len(e.Value))
+	}
+
+	var r IntroRegistration
+	r.Key = ed25519.PublicKey(append([]byte(nil), e.Value[:32]...))
+	copy(r.Token[:], e.Value[32:48])
+
+	n, err := r.Guard.Parse(e.Value[48:])
+	if err != nil {
+		return IntroRegistration{}, fmt.Errorf("invalid guard: %w", err)
+	}
+	if len(e.Value)-48-n != ed25519.SignatureSize {
+		return IntroRegistration{}, fmt.Errorf("invalid introduction registration signature size")
+	}
+	copy(r.Sig[:], e.Value[48+n:])
+	return r, nil
+}
+
+// IntroduceExtension asks an introduction relay to pass the sealed
+// introduction in the payload to the service with the given key.
+func IntroduceExtension(key ed25519.PublicKey) Extension {
+	return Extension{Type: ExtIntroduce, Value: append([]byte(nil), key...)}
+}
+
+func ParseIntroduce(e Extension) (ed25519.PublicKey, error) {
+	if e.Type != ExtIntroduce || len(e.Value) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid introduce extension")
+	}
+	return ed25519.PublicKey(e.Value), nil
+}
+
+// Introduction is sealed by a client for a hidden service: it names the
+// rendezvous relay holding the message of the client under Cookie.
+type Introduction struct {
+	Cookie     [16]byte
+	Rendezvous identity.Relay
+}
+
+func (in Introduction) Bytes() ([]byte, error) {
+	r, err := in.Rendezvous.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return append(in.Cookie[:], r...), nil
+}
+
+func ParseIntroduction(data []byte) (Introduction, error) {
+	if len(data) < 16 {
+		return Introduction{}, fmt.Errorf("introduction too short: %d bytes", len(data))
+	}
+
+	var in Introduction
+	copy(in.Cookie[:], data[:16])
+	n, err := in.Rendezvous.Parse(data[16:])
+	if err != nil {
+		return Introduction{}, fmt.Errorf("invalid rendezvous relay: %w", err)
+	}
+	if 16+n != len(data) {
+		return Introduction{}, fmt.Errorf("trailing bytes after introduction")
+	}
+	return in, nil
+}
+
+// RendezvousExtension leaves the sealed message in the payload at the last
+// relay, under cookie.
+func RendezvousExtension(cookie [16]byte) Extension {
+	return Extension{Type: ExtRendezvous, Value: append([]byte(nil), cookie[:]...)}
+}
+
+func ParseRendezvous(e Extension) ([16]byte, error) {
+	var cookie [16]byte
+	if e.Type != ExtRendezvous || len(e.Value) != len(cookie) {
+		return cookie, fmt.Errorf("invalid rendezvous extension")
+	}
+	copy(cookie[:], e.Value)
+	return cookie, nil
+}
+
+// RendezvousJoin asks a rendezvous relay to pass the message left under
+// Cookie to the service registered under Token at Guard.
+type RendezvousJoin struct {
+	Cookie [16]byte
+	Token  [16]byte
+	Guard  identity.Relay
+}
+
+func (j RendezvousJoin) Extension() (Extension, error) {
+	guard, err := j.Guard.Bytes()
+	if err != nil {
+		return Extension{}, err
+	}
+
+	v := make([]byte, 0, 32+len(guard))
+	v = append(v, j.Cookie[:]...)
+	v = append(v, j.Token[:]...)
+	return Extension{Type: ExtRendezvousJoin, Value: append(v, guard...)}, nil
+}
+
+func ParseRendezvousJoin(e Extension) (RendezvousJoin, error) {
+	if e.Type != ExtRendezvousJoin || len(e.Value) < 32 {
+		return RendezvousJoin{}, fmt.Errorf("invalid rendezvous join extension")
+	}
+
+	var j RendezvousJoin
+	copy(j.Cookie[:], e.Value[:16])
+	copy(j.Token[:], e.Value[16:32])
+	n, err := j.Guard.Parse(e.Value[32:])
+	if err != nil {
+		return RendezvousJoin{}, fmt.Errorf("invalid guard: %w", err)
+	}
+	if 32+n != len(e.Value) {
+		return RendezvousJoin{}, fmt.Errorf("trailing bytes after rendezvous join")
+	}
+	return j, nil
+}
+
+// GuardDeliverExtension asks a guard relay to hand the payload to the
+// service registered under token.
+func GuardDeliverExtension(token [16]byte, kind uint8) Extension {
+	return Extension{Type: ExtGuardDeliver, Value: append(token[:], kind)}
+}
+
+func ParseGuardDeliver(e Extension) ([16]byte, uint8, error) {
+	var token [16]byte
+	if e.Type != ExtGuardDeliver || len(e.Value) != len(token)+1 {
+		return token, 0, fmt.Errorf("invalid guard deliver extension")
+	}
+	copy(token[:], e.Value)
+	return token, e.Value[16], nil
+}
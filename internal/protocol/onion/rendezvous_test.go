@@ -0,0 +1,131 @@
+package onion
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestSealOpen(t *testing.T) {
+	t.Parallel()
+
+	priv := [32]byte{1, 2, 3}
+	pubSlice, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pub [32]byte
+	copy(pub[:], pubSlice)
+
+	msg := []byte("for the service only")
+	sealed, err := Seal(pub, msg)
+	if err != nil {
+		t.Fatalf("Seal() failed: %v", err)
+	}
+	if len(sealed) != len(msg)+SealedOverhead {
+		t.Fatalf("sealed size %d, want %d", len(sealed), len(msg)+SealedOverhead)
+	}
+
+	got, err := Open(priv, sealed)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Open() = %q, want %q", got, msg)
+	}
+
+	if _, err := Open([32]byte{9}, sealed); err == nil {
+		t.Error("opened with the wrong key")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := Open(priv, sealed); err == nil {
+		t.Error("opened tampered data")
+	}
+}
+
+func TestIntroRegistration_SignVerify(t *testing.T) {
+	t.Parallel()
+
+	si, err := identity.LoadServiceIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadServiceIdentity() failed: %v", err)
+	}
+
+	intro := [16]byte{0x11}
+	r := IntroRegistration{
+		Token: [16]byte{0x22},
+		Guard: identity.Relay{Ep: identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 62503}, UUID: [16]byte{0x33}},
+	}
+	if err := r.Sign(si, intro); err != nil {
+		t.Fatalf("Sign() failed: %v", err)
+	}
+
+	ext, err := r.Extension()
+	if err != nil {
+		t.Fatalf("Extension() failed: %v", err)
+	}
+	got, err := ParseIntroRegistration(ext)
+	if err != nil {
+		t.Fatalf("ParseIntroRegistration() failed: %v", err)
+	}
+	if err := got.Verify(intro); err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+	if got.Token != r.Token || got.Guard.UUID != r.Guard.UUID {
+		t.Fatalf("round trip mismatch: %+v", got)
+	}
+
+	if err := got.Verify([16]byte{0x44}); err == nil {
+		t.Error("registration accepted by another introduction relay")
+	}
+	got.Token[0] ^= 1
+	if err := got.Verify(intro); err == nil {
+		t.Error("tampered registration accepted")
+	}
+}
+
+func TestRendezvousExtensions_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	relay := identity.Relay{Ep: identity.Endpoint{IP: net.ParseIP("::1"), Port: 62505}, UUID: [16]byte{5}, PubKey: [32]byte{6}}
+
+	in := Introduction{Cookie: [16]byte{7}, Rendezvous: relay}
+	raw, err := in.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() failed: %v", err)
+	}
+	gotIn, err := ParseIntroduction(raw)
+	if err != nil || gotIn.Cookie != in.Cookie || gotIn.Rendezvous.UUID != relay.UUID {
+		t.Fatalf("ParseIntroduction() = %+v, %v", gotIn, err)
+	}
+
+	join := RendezvousJoin{Cookie: [16]byte{8}, Token: [16]byte{9}, Guard: relay}
+	ext, err := join.Extension()
+	if err != nil {
+		t.Fatalf("Extension() failed: %v", err)
+	}
+	gotJoin, err := ParseRendezvousJoin(ext)
+	if err != nil || gotJoin.Cookie != join.Cookie || gotJoin.Token != join.Token || gotJoin.Guard.PubKey != relay.PubKey {
+		t.Fatalf("ParseRendezvousJoin() = %+v, %v", gotJoin, err)
+	}
+
+	cookie, err := ParseRendezvous(RendezvousExtension(join.Cookie))
+	if err != nil || cookie != join.Cookie {
+		t.Fatalf("ParseRendezvous() = %x, %v", cookie, err)
+	}
+
+	token, kind, err := ParseGuardDeliver(GuardDeliverExtension(join.Token, ServiceDataMessage))
+	if err != nil || token != join.Token || kind != ServiceDataMessage {
+		t.Fatalf("ParseGuardDeliver() = %x, %d, %v", token, kind, err)
+	}
+
+	if _, err := ParseRendezvousJoin(Extension{Type: ExtRendezvousJoin, Value: make([]byte, 10)}); err == nil {
+		t.Error("expected error for short rendezvous join")
+	}
+	if _, err := ParseIntroduce(Extension{Type: ExtIntroduce, Value: make([]byte, 5)}); err == nil {
+		t.Error("expected error for short introduce")
+	}
+}
@@ -0,0 +1,133 @@
+package onion
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/erasure"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+// MessageID (16) + Index (1) + K (1) + N (1) + Size (2)
+const ShareExtensionSize = 16 + 1 + 1 + 1 + 2
+
+// Share identifies an erasure-coded share of a message. It travels in an
+// ExtShare extension of the last layer, ahead of the share data.
+type Share struct {
+	MessageID [16]byte
+	Index     uint8
+	K         uint8
+	N         uint8
+	Size      uint16 // size of the whole message
+}
+
+func (s Share) Extension() Extension {
+	v := make([]byte, 0, ShareExtensionSize)
+	v = append(v, s.MessageID[:]...)
+	v = append(v, s.Index, s.K, s.N)
+	v = binary.BigEndian.AppendUint16(v, s.Size)
+	return Extension{Type: ExtShare, Value: v}
+}
+
+func ParseShare(e Extension) (Share, error) {
+	if e.Type != ExtShare {
+		return Share{}, fmt.Errorf("not a share extension: 0x%02x", e.Type)
+	}
+	if len(e.Value) != ShareExtensionSize {
+		return Share{}, fmt.Errorf("invalid share extension size: got %d, want %d", len(e.Value), ShareExtensionSize)
+	}
+
+	var s Share
+	copy(s.MessageID[:], e.Value[:16])
+	s.Index, s.K, s.N = e.Value[16], e.Value[17], e.Value[18]
+	s.Size = binary.BigEndian.Uint16(e.Value[19:21])
+
+	if s.K == 0 || s.N < s.K || s.Index >= s.N {
+		return Share{}, fmt.Errorf("invalid share %d (k=%d n=%d)", s.Index, s.K, s.N)
+	}
+	return s, nil
+}
+
+// ShareOnion is an onion carrying one share of a message, with the path it
+// was built for.
+type ShareOnion struct {
+	Layer *OnionLayer
+	Path  []identity.CryptoGroup
+}
+
+// BuildOnionShares Reed-Solomon-encodes payload into n shares, any k of which
+// let the last relay of the path rebuild it, and builds one onion per share.
+//
+// Share i only crosses relay i (modulo the group size) of every group but the
+// last one, so that no relay of those groups sees every share. The last group
+// is kept whole: its first reachable relay collects the shares. Each onion
+// gets its own crypto material.
+//
+// The message ID, then the crypto material and the layers of every share in
+// turn, are drawn from the reader set by WithRand.
+func BuildOnionShares(
+	dest identity.Endpoint,
+	path []identity.CryptoGroup,
+	payload []byte,
+	k, n int,
+	opts ...BuildOption,
+) ([]ShareOnion, error) {
+	if n > MaxWrappedKey || k < 1 || k > n {
+		return nil, fmt.Errorf("invalid share parameters k=%d n=%d (want 1 <= k <= n <= %d)", k, n, MaxWrappedKey)
+	}
+	if len(payload) > 0xFFFF {
+		return nil, fmt.Errorf("payload too large to share: %d bytes", len(payload))
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+
+	shards, err := erasure.Split(payload, k, n)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := buildConfig{rand: rand.Reader}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var msgID [16]byte
+	if _, err := io.ReadFull(cfg.rand, msgID[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate message id: %w", err)
+	}
+
+	out := make([]ShareOnion, n)
+	for i, shard := range shards {
+		sharePath := make([]identity.CryptoGroup, len(path))
+		for gi, g := range path {
+			relays := g.Group.Relays
+			if gi < len(path)-1 && len(relays) > 0 {
+				relays = []identity.Relay{relays[i%len(relays)]}
+			}
+			sharePath[gi].Group.Relays = relays
+			if err := sharePath[gi].GenerateCryptoMaterialFrom(cfg.rand); err != nil {
+				return nil, err
+			}
+		}
+
+		share := Share{
+			MessageID: msgID,
+			Index:     uint8(i),
+			K:         uint8(k),
+			N:         uint8(n),
+			Size:      uint16(len(payload)),
+		}
+
+		shareOpts := append(opts[:len(opts):len(opts)], WithExtensions(share.Extension()))
+		layer, err := BuildOnion(dest, sharePath, shard, shareOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("share %d: %w", i, err)
+		}
+		out[i] = ShareOnion{Layer: layer, Path: sharePath}
+	}
+
+	return out, nil
+}
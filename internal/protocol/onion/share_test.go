@@ -0,0 +1,137 @@
+package onion
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/erasure"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+// peel decrypts one layer with the cipher key of its group.
+func peel(t *testing.T, layer *OnionLayer, cipherKey [32]byte) *OnionLayerCiphered {
+	t.Helper()
+
+	olc, err := layer.Decrypt(cipherKey)
+	if err != nil {
+		t.Fatalf("Decrypt() failed: %v", err)
+	}
+	return olc
+}
+
+func relayGroup(base uint16, n int) identity.RelayGroup {
+	var g identity.RelayGroup
+	for i := range n {
+		g.Relays = append(g.Relays, identity.Relay{
+			Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: base + uint16(i)},
+			PubKey: generateValidX25519Key(),
+		})
+	}
+	return g
+}
+
+func TestShare_ExtensionRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	want := Share{MessageID: [16]byte{1, 2, 3}, Index: 2, K: 2, N: 3, Size: 1234}
+
+	got, err := ParseShare(want.Extension())
+	if err != nil {
+		t.Fatalf("ParseShare() failed: %v", err)
+	}
+	if got != want {
+		t.Fatalf("share mismatch:\n\tgot:  %+v\n\twant: %+v", got, want)
+	}
+
+	bad := []Extension{
+		{Type: ExtEnd, Value: want.Extension().Value},
+		{Type: ExtShare, Value: []byte{1, 2, 3}},
+		Share{Index: 3, K: 2, N: 3}.Extension(),
+		Share{Index: 0, K: 0, N: 3}.Extension(),
+	}
+	for i, e := range bad {
+		if _, err := ParseShare(e); err == nil {
+			t.Errorf("case %d: expected error", i)
+		}
+	}
+}
+
+func TestBuildOnionShares(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000}
+	path := []identity.CryptoGroup{
+		{Group: relayGroup(1000, 3)},
+		{Group: relayGroup(2000, 3)},
+	}
+	payload := bytes.Repeat([]byte("DOR shares "), 40)
+
+	shares, err := BuildOnionShares(dest, path, payload, 2, 3)
+	if err != nil {
+		t.Fatalf("BuildOnionShares() failed: %v", err)
+	}
+	if len(shares) != 3 {
+		t.Fatalf("got %d shares, want 3", len(shares))
+	}
+
+	shards := make([][]byte, 3)
+	entries := map[uint16]bool{}
+	for i, so := range shares {
+		if len(so.Path[0].Group.Relays) != 1 {
+			t.Fatalf("share %d: first group not pinned to a single relay", i)
+		}
+		entries[so.Path[0].Group.Relays[0].Ep.Port] = true
+		if len(so.Path[1].Group.Relays) != 3 {
+			t.Fatalf("share %d: last group should be kept whole", i)
+		}
+
+		olc := peel(t, so.Layer, so.Path[0].CipherKey)
+		next := &OnionLayer{}
+		if err := next.Parse(olc.Payload); err != nil {
+			t.Fatalf("share %d: next layer parse failed: %v", i, err)
+		}
+
+		last := peel(t, next, so.Path[1].CipherKey)
+		if !last.LastServer {
+			t.Fatalf("share %d: last layer not flagged as last", i)
+		}
+		ext, ok := FindExtension(last.Extensions, ExtShare)
+		if !ok {
+			t.Fatalf("share %d: missing share extension", i)
+		}
+		share, err := ParseShare(ext)
+		if err != nil {
+			t.Fatalf("share %d: %v", i, err)
+		}
+		if int(share.Index) != i || share.K != 2 || share.N != 3 || int(share.Size) != len(payload) {
+			t.Fatalf("share %d: unexpected header %+v", i, share)
+		}
+		shards[share.Index] = last.Payload
+	}
+	if len(entries) != 3 {
+		t.Fatalf("shares entered through %d distinct relays, want 3", len(entries))
+	}
+
+	shards[1] = nil
+	got, err := erasure.Join(shards, 2, len(payload))
+	if err != nil {
+		t.Fatalf("Join() failed: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("reassembled payload mismatch")
+	}
+}
+
+func TestBuildOnionShares_InvalidParams(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("192.168.1.1"), Port: 9000}
+	path := []identity.CryptoGroup{{Group: relayGroup(1000, 3)}}
+
+	for _, p := range [][2]int{{0, 2}, {3, 2}, {2, MaxWrappedKey + 1}} {
+		if _, err := BuildOnionShares(dest, path, []byte("x"), p[0], p[1]); err == nil {
+			t.Errorf("BuildOnionShares(k=%d, n=%d) should fail", p[0], p[1])
+		}
+	}
+}
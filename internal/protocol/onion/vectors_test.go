@@ -0,0 +1,388 @@
+package onion_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"golang.org/x/crypto/curve25519"
+)
+
+var updateVectors = flag.Bool("update", false, "rewrite testdata/vectors from the builder output")
+
+// vector is a known-answer vector of testdata/vectors, see the README there.
+type vector struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Seed        string        `json:"seed"`
+	Dest        string        `json:"dest"`
+	Payload     string        `json:"payload"`
+	MixClass    uint8         `json:"mix_class"`
+	Redundancy  uint8         `json:"redundancy"`
+	DropAt      int           `json:"drop_at"`
+	ShareK      int           `json:"share_k,omitempty"`
+	ShareN      int           `json:"share_n,omitempty"`
+	Relays      []vectorRelay `json:"relays"`
+	Hops        []vectorHop   `json:"hops"`
+	Cell        string        `json:"cell,omitempty"`
+	Shares      []vectorShare `json:"shares,omitempty"`
+}
+
+type vectorRelay struct {
+	Endpoint string `json:"endpoint"`
+	UUID     string `json:"uuid"`
+	PrivKey  string `json:"priv_key"`
+	PubKey   string `json:"pub_key"`
+}
+
+type vectorHop struct {
+	Relays    []int  `json:"relays"`
+	CipherKey string `json:"cipher_key,omitempty"`
+	ESK       string `json:"esk,omitempty"`
+	EPK       string `json:"epk,omitempty"`
+	Layer     string `json:"layer,omitempty"`     // as read by the group, without padding
+	Plaintext string `json:"plaintext,omitempty"` // decrypted OnionLayerCiphered
+}
+
+// vectorShare is the onion carrying one share of a shares vector.
+type vectorShare struct {
+	Hops []vectorHop `json:"hops"`
+	Cell string      `json:"cell"`
+}
+
+// vectorStream returns the random stream of a vector.
+func vectorStream(seed string) *sha3.SHAKE {
+	h := sha3.NewSHAKE256()
+	_, _ = h.Write([]byte(seed))
+	return h
+}
+
+// vectorRelays derives n relay identities from fixed seeds.
+func vectorRelays(t *testing.T, n int) []vectorRelay {
+	t.Helper()
+
+	relays := make([]vectorRelay, n)
+	for i := range relays {
+		s := vectorStream(fmt.Sprintf("DORv1 test vector relay %d", i))
+
+		var priv [32]byte
+		var uuid [16]byte
+		_, _ = s.Read(priv[:])
+		_, _ = s.Read(uuid[:])
+		priv[0] &= 248
+		priv[31] &= 127
+		priv[31] |= 64
+
+		pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relays[i] = vectorRelay{
+			Endpoint: fmt.Sprintf("10.0.0.%d:%d", i+1, 62503+i),
+			UUID:     hex.EncodeToString(uuid[:]),
+			PrivKey:  hex.EncodeToString(priv[:]),
+			PubKey:   hex.EncodeToString(pub),
+		}
+	}
+	return relays
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+// build fills the outputs of v from its inputs.
+func (v *vector) build(t *testing.T) {
+	t.Helper()
+
+	relays := make([]identity.Relay, len(v.Relays))
+	for i, r := range v.Relays {
+		ep, err := identity.ParseEpFromString(r.Endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relays[i] = identity.Relay{Ep: ep}
+		copy(relays[i].UUID[:], mustHex(t, r.UUID))
+		copy(relays[i].PubKey[:], mustHex(t, r.PubKey))
+	}
+
+	stream := vectorStream(v.Seed)
+	dest, err := identity.ParseEpFromString(v.Dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []onion.BuildOption{
+		onion.WithRand(stream),
+		onion.WithMixDelay(v.MixClass),
+		onion.WithRedundancy(v.Redundancy),
+	}
+	if v.DropAt >= 0 {
+		opts = append(opts, onion.WithDropAt(v.DropAt))
+	}
+
+	if v.ShareN > 0 {
+		v.buildShares(t, dest, relays, stream, opts)
+		return
+	}
+
+	path := make([]identity.CryptoGroup, len(v.Hops))
+	for i, hop := range v.Hops {
+		for _, j := range hop.Relays {
+			path[i].Group.Relays = append(path[i].Group.Relays, relays[j])
+		}
+		if err := path[i].GenerateCryptoMaterialFrom(stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layer, err := onion.BuildOnion(dest, path, mustHex(t, v.Payload), opts...)
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+	cell, err := layer.BytesPaddedFrom(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Cell = hex.EncodeToString(cell)
+	fillHops(t, layer, path, v.Hops)
+}
+
+// buildShares fills the shares of v, built from the groups of its hops.
+func (v *vector) buildShares(t *testing.T, dest identity.Endpoint, relays []identity.Relay, stream *sha3.SHAKE, opts []onion.BuildOption) {
+	t.Helper()
+
+	path := make([]identity.CryptoGroup, len(v.Hops))
+	for i, hop := range v.Hops {
+		for _, j := range hop.Relays {
+			path[i].Group.Relays = append(path[i].Group.Relays, relays[j])
+		}
+	}
+
+	shares, err := onion.BuildOnionShares(dest, path, mustHex(t, v.Payload), v.ShareK, v.ShareN, opts...)
+	if err != nil {
+		t.Fatalf("BuildOnionShares() failed: %v", err)
+	}
+
+	v.Shares = make([]vectorShare, len(shares))
+	for i, so := range shares {
+		cell, err := so.Layer.BytesPaddedFrom(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Share i crosses relay i of every group but the last one.
+		hops := make([]vectorHop, len(v.Hops))
+		for gi, hop := range v.Hops {
+			hops[gi].Relays = hop.Relays
+			if gi < len(v.Hops)-1 {
+				hops[gi].Relays = []int{hop.Relays[i%len(hop.Relays)]}
+			}
+		}
+		fillHops(t, so.Layer, so.Path, hops)
+		v.Shares[i] = vectorShare{Hops: hops, Cell: hex.EncodeToString(cell)}
+	}
+}
+
+// fillHops fills the outputs of hops from layer, built through path.
+func fillHops(t *testing.T, layer *onion.OnionLayer, path []identity.CryptoGroup, hops []vectorHop) {
+	t.Helper()
+
+	raw, err := layer.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range hops {
+		hop, g := &hops[i], &path[i]
+		hop.CipherKey = hex.EncodeToString(g.CipherKey[:])
+		hop.ESK = hex.EncodeToString(g.ESK[:])
+		hop.EPK = hex.EncodeToString(g.EPK[:])
+		hop.Layer = hex.EncodeToString(raw)
+
+		plaintext := decryptVectorLayer(t, raw, g.CipherKey)
+		hop.Plaintext = hex.EncodeToString(plaintext)
+
+		var olc onion.OnionLayerCiphered
+		if err := olc.Parse(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		raw = olc.Payload
+	}
+}
+
+func decryptVectorLayer(t *testing.T, raw []byte, key [32]byte) []byte {
+	t.Helper()
+
+	var l onion.OnionLayer
+	if err := l.Parse(raw); err != nil {
+		t.Fatalf("layer does not parse: %v", err)
+	}
+	if err := l.TrimCipherText(key); err != nil {
+		t.Fatal(err)
+	}
+	header, err := l.HeaderBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := crypto.ChachaDecrypt(key, l.PayloadNonce, l.CipherText, header)
+	if err != nil {
+		t.Fatalf("layer does not decrypt: %v", err)
+	}
+	return plaintext
+}
+
+// checkRelayView checks that every relay of each hop unwraps the session key
+// of its layer from the published cells.
+func (v *vector) checkRelayView(t *testing.T) {
+	t.Helper()
+
+	if v.ShareN == 0 {
+		v.checkCell(t, v.Cell, v.Hops)
+		return
+	}
+	if len(v.Shares) != v.ShareN {
+		t.Fatalf("%d shares, want %d", len(v.Shares), v.ShareN)
+	}
+	for _, share := range v.Shares {
+		v.checkCell(t, share.Cell, share.Hops)
+	}
+}
+
+func (v *vector) checkCell(t *testing.T, cellHex string, hops []vectorHop) {
+	t.Helper()
+
+	cell := mustHex(t, cellHex)
+	if len(cell) != onion.PacketSize {
+		t.Fatalf("cell is %d bytes, want %d", len(cell), onion.PacketSize)
+	}
+	if !bytes.HasPrefix(cell, mustHex(t, hops[0].Layer)) {
+		t.Fatal("cell does not start with the layer of the first hop")
+	}
+
+	for i, hop := range hops {
+		var l onion.OnionLayer
+		if err := l.Parse(mustHex(t, hop.Layer)); err != nil {
+			t.Fatalf("hop %d: %v", i, err)
+		}
+		for _, j := range hop.Relays {
+			var priv [32]byte
+			var uuid [16]byte
+			copy(priv[:], mustHex(t, v.Relays[j].PrivKey))
+			copy(uuid[:], mustHex(t, v.Relays[j].UUID))
+
+			key, err := onion.UnwrapSessionKey(priv, uuid, l.EPK, l.WrappedKeys)
+			if err != nil {
+				t.Fatalf("hop %d, relay %d: %v", i, j, err)
+			}
+			if hex.EncodeToString(key[:]) != hop.CipherKey {
+				t.Errorf("hop %d, relay %d: session key mismatch", i, j)
+			}
+		}
+	}
+}
+
+func TestVectors(t *testing.T) {
+	t.Parallel()
+
+	tests := []vector{
+		{
+			Name:        "single-hop",
+			Description: "One relay delivering a short payload",
+			Payload:     hex.EncodeToString([]byte("hello")),
+			DropAt:      -1,
+			Hops:        []vectorHop{{Relays: []int{0}}},
+		},
+		{
+			Name:        "three-hops",
+			Description: "Three single-relay groups",
+			Payload:     hex.EncodeToString([]byte("Dynamic Onion Routing test vector")),
+			DropAt:      -1,
+			Hops:        []vectorHop{{Relays: []int{0}}, {Relays: []int{1}}, {Relays: []int{2}}},
+		},
+		{
+			Name:        "relay-groups",
+			Description: "Groups of one to three relays, sending to two relays of the next group in parallel, and to a single relay of the exit group",
+			Payload:     hex.EncodeToString([]byte("redundant path")),
+			Redundancy:  2,
+			DropAt:      -1,
+			Hops:        []vectorHop{{Relays: []int{0, 1}}, {Relays: []int{2}}, {Relays: []int{3, 4, 5}}},
+		},
+		{
+			Name:        "cover",
+			Description: "Cover onion with mix delay class 3, discarded by the second group",
+			Payload:     "",
+			MixClass:    3,
+			DropAt:      1,
+			Hops:        []vectorHop{{Relays: []int{0}}, {Relays: []int{1}}, {Relays: []int{2}}},
+		},
+		{
+			Name:        "shares",
+			Description: "Payload split in three shares, any two of which rebuild it, each share crossing its own relay of the first group",
+			Payload:     hex.EncodeToString([]byte("erasure coded payload")),
+			DropAt:      -1,
+			ShareK:      2,
+			ShareN:      3,
+			Hops:        []vectorHop{{Relays: []int{0, 1, 2}}, {Relays: []int{3, 4}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			n := 0
+			for _, hop := range tt.Hops {
+				for _, j := range hop.Relays {
+					n = max(n, j+1)
+				}
+			}
+			tt.Seed = "DORv1 test vector " + tt.Name
+			tt.Dest = "[2001:db8::1]:8080"
+			tt.Relays = vectorRelays(t, n)
+			tt.build(t)
+			tt.checkRelayView(t)
+
+			got, err := json.MarshalIndent(tt, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			path := filepath.Join("testdata", "vectors", tt.Name+".json")
+			if *updateVectors {
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s differs from the builder output", path)
+			}
+
+			var published vector
+			if err := json.Unmarshal(want, &published); err != nil {
+				t.Fatal(err)
+			}
+			published.checkRelayView(t)
+		})
+	}
+}
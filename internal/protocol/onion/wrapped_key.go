@@ -1,13 +1,19 @@
 package onion
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
 type WrappedKey struct {
@@ -16,11 +22,53 @@ type WrappedKey struct {
 }
 
 var (
-	HKDFSaltWrappedKey = []byte("DORv1:WrappedKey")
-	HKDFInfoWrappedKey = []byte("DORv1:RelayKeyEncryption")
+	HKDFSaltWrappedKey       = []byte("DORv1:WrappedKey")
+	HKDFSaltWrappedKeyHybrid = []byte("DORv1:WrappedKeyHybrid")
+	HKDFInfoWrappedKey       = []byte("DORv1:RelayKeyEncryption")
 )
 
+// ErrNoWrappedKey is returned by UnwrapSessionKey when no slot of the layer
+// is meant for the relay.
+var ErrNoWrappedKey = errors.New("no matching wrapped key")
+
+// NewWrappedKeys wraps the cipher key of group for each of its relays, in
+// slots shuffled among random ones. The nonce of every slot is a tag derived
+// from the secret shared with its relay, so that the relay finds its slot
+// without trying to decrypt the others. To anyone else the tags look as
+// random as the nonces of the dummy slots.
 func NewWrappedKeys(group *identity.CryptoGroup) ([MaxWrappedKey]WrappedKey, error) {
+	return NewWrappedKeysFrom(group, rand.Reader)
+}
+
+// NewWrappedKeysFrom is NewWrappedKeys drawing the dummy slots and the slot
+// order from r.
+func NewWrappedKeysFrom(group *identity.CryptoGroup, r io.Reader) ([MaxWrappedKey]WrappedKey, error) {
+	return newWrappedKeys(group, true, nil, r)
+}
+
+// wrappingKeyAndTag derives the key wrapping the session key for the relay
+// sharing sharedSecret with the client, and the tag locating its slot. The
+// tag follows the key in the same HKDF stream, which keeps the key of layers
+// built without tags unchanged. Each secret wraps a single key, so the tag is
+// also a safe nonce for it.
+func wrappingKeyAndTag(sharedSecret []byte, salt []byte) ([32]byte, [12]byte, error) {
+	var key [32]byte
+	var tag [12]byte
+
+	h := hkdf.New(sha256.New, sharedSecret, salt, HKDFInfoWrappedKey)
+	if _, err := io.ReadFull(h, key[:]); err != nil {
+		return key, tag, err
+	}
+	if _, err := io.ReadFull(h, tag[:]); err != nil {
+		return key, tag, err
+	}
+	return key, tag, nil
+}
+
+// newWrappedKeys wraps the keys with tags as nonces, or random ones as done
+// before tags were introduced. A non-nil hybridSecret makes the keys hybrid.
+// Random bytes are drawn from r.
+func newWrappedKeys(group *identity.CryptoGroup, tagged bool, hybridSecret []byte, r io.Reader) ([MaxWrappedKey]WrappedKey, error) {
 	var finalKeys [MaxWrappedKey]WrappedKey
 	relays := group.Group.Relays
 
@@ -34,25 +82,25 @@ func NewWrappedKeys(group *identity.CryptoGroup) ([MaxWrappedKey]WrappedKey, err
 			return finalKeys, err
 		}
 
-		wrappingKeySlice, err := crypto.HKDFSha256(
-			sharedSecret,
-			HKDFSaltWrappedKey,
-			HKDFInfoWrappedKey,
-		)
+		salt := HKDFSaltWrappedKey
+		if hybridSecret != nil {
+			sharedSecret, salt = append(sharedSecret, hybridSecret...), HKDFSaltWrappedKeyHybrid
+		}
+
+		wrappingKey, tag, err := wrappingKeyAndTag(sharedSecret, salt)
 		if err != nil {
 			return finalKeys, err
 		}
 
-		var wrappingKey [32]byte
-		copy(wrappingKey[:], wrappingKeySlice)
-
 		plaintext := make([]byte, 48)
 		copy(plaintext[0:16], relay.UUID[:])
 		copy(plaintext[16:48], group.CipherKey[:])
 
-		var wkNonce [12]byte
-		if _, err = rand.Read(wkNonce[:]); err != nil {
-			return finalKeys, fmt.Errorf("nonce gen failed: %w", err)
+		wkNonce := tag
+		if !tagged {
+			if _, err = io.ReadFull(r, wkNonce[:]); err != nil {
+				return finalKeys, fmt.Errorf("nonce gen failed: %w", err)
+			}
 		}
 
 		encryptedWK, err := crypto.ChachaEncrypt(
@@ -80,17 +128,17 @@ func NewWrappedKeys(group *identity.CryptoGroup) ([MaxWrappedKey]WrappedKey, err
 
 	for i := len(relays); i < MaxWrappedKey; i++ {
 		var dummy WrappedKey
-		if _, err := rand.Read(dummy.Nonce[:]); err != nil {
+		if _, err := io.ReadFull(r, dummy.Nonce[:]); err != nil {
 			return finalKeys, fmt.Errorf("dummy nonce gen failed: %w", err)
 		}
-		if _, err := rand.Read(dummy.CipherText[:]); err != nil {
+		if _, err := io.ReadFull(r, dummy.CipherText[:]); err != nil {
 			return finalKeys, fmt.Errorf("dummy ciphertext gen failed: %w", err)
 		}
 		finalKeys[i] = dummy
 	}
 
 	for i := len(finalKeys) - 1; i > 0; i-- {
-		randIndexBig, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		randIndexBig, err := rand.Int(r, big.NewInt(int64(i+1)))
 		if err != nil {
 			return finalKeys, fmt.Errorf("shuffle failed: %w", err)
 		}
@@ -101,3 +149,112 @@ func NewWrappedKeys(group *identity.CryptoGroup) ([MaxWrappedKey]WrappedKey, err
 
 	return finalKeys, nil
 }
+
+// UnwrapSessionKey returns the session key wrapped for the relay of private
+// key priv and id uuid, epk being the ephemeral key of the layer. Only the
+// slot carrying the relay tag is opened: ErrNoWrappedKey is returned when
+// there is none.
+func UnwrapSessionKey(priv [32]byte, uuid [16]byte, epk [32]byte, wks [MaxWrappedKey]WrappedKey) ([32]byte, error) {
+	sessionKey, _, err := UnwrapSessionKeySlot(priv, uuid, epk, wks)
+	return sessionKey, err
+}
+
+// UnwrapSessionKeySlot is UnwrapSessionKey also returning the index of the
+// slot the key was found in.
+func UnwrapSessionKeySlot(priv [32]byte, uuid [16]byte, epk [32]byte, wks [MaxWrappedKey]WrappedKey) ([32]byte, int, error) {
+	sharedSecret, err := curve25519.X25519(priv[:], epk[:])
+	if err != nil {
+		return [32]byte{}, -1, fmt.Errorf("failed to generate shared secret: %w", err)
+	}
+	return unwrapWithSecret(sharedSecret, HKDFSaltWrappedKey, uuid, wks)
+}
+
+// UnwrapUntaggedSessionKeySlot is UnwrapSessionKeySlot for the layers built
+// before slots were tagged, whose nonces are random: every slot is opened
+// until one holds the key of the relay.
+func UnwrapUntaggedSessionKeySlot(priv [32]byte, uuid [16]byte, epk [32]byte, wks [MaxWrappedKey]WrappedKey) ([32]byte, int, error) {
+	var sessionKey [32]byte
+
+	sharedSecret, err := curve25519.X25519(priv[:], epk[:])
+	if err != nil {
+		return sessionKey, -1, fmt.Errorf("failed to generate shared secret: %w", err)
+	}
+	wrappingKey, _, err := wrappingKeyAndTag(sharedSecret, HKDFSaltWrappedKey)
+	if err != nil {
+		return sessionKey, -1, err
+	}
+
+	for i, wk := range wks {
+		if key, ok := openWrappedKey(wrappingKey, wk, uuid); ok {
+			return key, i, nil
+		}
+	}
+	return sessionKey, -1, ErrNoWrappedKey
+}
+
+// UnwrapHybridSessionKey is UnwrapSessionKey for hybrid layers, whose
+// hybrid secret came in the HybridEnvelope of the onion.
+func UnwrapHybridSessionKey(priv [32]byte, uuid [16]byte, epk [32]byte, hybridSecret [32]byte, wks [MaxWrappedKey]WrappedKey) ([32]byte, error) {
+	sessionKey, _, err := UnwrapHybridSessionKeySlot(priv, uuid, epk, hybridSecret, wks)
+	return sessionKey, err
+}
+
+// UnwrapHybridSessionKeySlot is UnwrapHybridSessionKey also returning the
+// index of the slot the key was found in.
+func UnwrapHybridSessionKeySlot(priv [32]byte, uuid [16]byte, epk [32]byte, hybridSecret [32]byte, wks [MaxWrappedKey]WrappedKey) ([32]byte, int, error) {
+	sharedSecret, err := curve25519.X25519(priv[:], epk[:])
+	if err != nil {
+		return [32]byte{}, -1, fmt.Errorf("failed to generate shared secret: %w", err)
+	}
+	return unwrapWithSecret(append(sharedSecret, hybridSecret[:]...), HKDFSaltWrappedKeyHybrid, uuid, wks)
+}
+
+// unwrapWithSecret is UnwrapSessionKeySlot once the secret shared with the
+// client is known.
+func unwrapWithSecret(sharedSecret []byte, salt []byte, uuid [16]byte, wks [MaxWrappedKey]WrappedKey) ([32]byte, int, error) {
+	var sessionKey [32]byte
+
+	wrappingKey, tag, err := wrappingKeyAndTag(sharedSecret, salt)
+	if err != nil {
+		return sessionKey, -1, err
+	}
+
+	i := findWrappedKey(wks, tag)
+	if i < 0 {
+		return sessionKey, -1, ErrNoWrappedKey
+	}
+	sessionKey, ok := openWrappedKey(wrappingKey, wks[i], uuid)
+	if !ok {
+		return sessionKey, -1, ErrNoWrappedKey
+	}
+	return sessionKey, i, nil
+}
+
+// openWrappedKey decrypts wk with wrappingKey and returns the session key it
+// holds if it is addressed to the relay of id uuid.
+func openWrappedKey(wrappingKey [32]byte, wk WrappedKey, uuid [16]byte) ([32]byte, bool) {
+	var sessionKey [32]byte
+
+	res, err := crypto.ChachaDecrypt(
+		wrappingKey,
+		wk.Nonce,
+		wk.CipherText[:],
+		[]byte("DORv1:WrappedKey"),
+	)
+	if err != nil || !bytes.Equal(res[:16], uuid[:]) {
+		return sessionKey, false
+	}
+	copy(sessionKey[:], res[16:48])
+	return sessionKey, true
+}
+
+// findWrappedKey returns the index of the slot whose nonce is tag, or -1.
+// All slots are compared so that the time taken does not depend on it.
+func findWrappedKey(wks [MaxWrappedKey]WrappedKey, tag [12]byte) int {
+	found := -1
+	for i, wk := range wks {
+		eq := subtle.ConstantTimeCompare(wk.Nonce[:], tag[:])
+		found = subtle.ConstantTimeSelect(eq, i, found)
+	}
+	return found
+}
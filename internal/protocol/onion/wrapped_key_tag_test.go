@@ -0,0 +1,248 @@
+package onion
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"golang.org/x/crypto/curve25519"
+)
+
+type testRelayKey struct {
+	priv  [32]byte
+	relay identity.Relay
+}
+
+func newTestGroup(tb testing.TB, n int) (*identity.CryptoGroup, []testRelayKey) {
+	tb.Helper()
+
+	keys := make([]testRelayKey, n)
+	group := &identity.CryptoGroup{}
+	for i := range keys {
+		_, _ = rand.Read(keys[i].priv[:])
+		pub, err := curve25519.X25519(keys[i].priv[:], curve25519.Basepoint)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		keys[i].relay.Ep = identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: uint16(9000 + i)}
+		_, _ = rand.Read(keys[i].relay.UUID[:])
+		copy(keys[i].relay.PubKey[:], pub)
+		group.Group.Relays = append(group.Group.Relays, keys[i].relay)
+	}
+	if err := group.GenerateCryptoMaterial(); err != nil {
+		tb.Fatal(err)
+	}
+	return group, keys
+}
+
+func TestUnwrapSessionKey(t *testing.T) {
+	t.Parallel()
+
+	group, keys := newTestGroup(t, MaxWrappedKey)
+	wks, err := NewWrappedKeys(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, k := range keys {
+		got, err := UnwrapSessionKey(k.priv, k.relay.UUID, group.EPK, wks)
+		if err != nil {
+			t.Fatalf("relay %d: UnwrapSessionKey() error = %v", i, err)
+		}
+		if got != group.CipherKey {
+			t.Errorf("relay %d: session key mismatch", i)
+		}
+	}
+
+	_, outsiders := newTestGroup(t, 1)
+	if _, err := UnwrapSessionKey(outsiders[0].priv, outsiders[0].relay.UUID, group.EPK, wks); !errors.Is(err, ErrNoWrappedKey) {
+		t.Errorf("outsider: error = %v, want %v", err, ErrNoWrappedKey)
+	}
+}
+
+func TestUnwrapUntaggedSessionKeySlot(t *testing.T) {
+	t.Parallel()
+
+	group, keys := newTestGroup(t, MaxWrappedKey)
+	wks, err := newWrappedKeys(group, false, nil, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, k := range keys {
+		if _, err := UnwrapSessionKey(k.priv, k.relay.UUID, group.EPK, wks); !errors.Is(err, ErrNoWrappedKey) {
+			t.Fatalf("relay %d: untagged slots located without opt-in: error = %v", i, err)
+		}
+
+		got, slot, err := UnwrapUntaggedSessionKeySlot(k.priv, k.relay.UUID, group.EPK, wks)
+		if err != nil {
+			t.Fatalf("relay %d: UnwrapUntaggedSessionKeySlot() error = %v", i, err)
+		}
+		if got != group.CipherKey || slot < 0 {
+			t.Errorf("relay %d: session key mismatch (slot %d)", i, slot)
+		}
+	}
+
+	_, outsiders := newTestGroup(t, 1)
+	if _, _, err := UnwrapUntaggedSessionKeySlot(outsiders[0].priv, outsiders[0].relay.UUID, group.EPK, wks); !errors.Is(err, ErrNoWrappedKey) {
+		t.Errorf("outsider: error = %v, want %v", err, ErrNoWrappedKey)
+	}
+}
+
+func TestUnwrapSessionKeySlot(t *testing.T) {
+	t.Parallel()
+
+	group, keys := newTestGroup(t, MaxWrappedKey)
+	wks, err := NewWrappedKeys(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int]bool)
+	for i, k := range keys {
+		_, slot, err := UnwrapSessionKeySlot(k.priv, k.relay.UUID, group.EPK, wks)
+		if err != nil {
+			t.Fatalf("relay %d: UnwrapSessionKeySlot() error = %v", i, err)
+		}
+		if slot < 0 || slot >= MaxWrappedKey || seen[slot] {
+			t.Errorf("relay %d: slot %d out of range or shared", i, slot)
+		}
+		seen[slot] = true
+	}
+
+	_, outsiders := newTestGroup(t, 1)
+	if _, slot, _ := UnwrapSessionKeySlot(outsiders[0].priv, outsiders[0].relay.UUID, group.EPK, wks); slot != -1 {
+		t.Errorf("outsider: slot = %d, want -1", slot)
+	}
+}
+
+func TestUnwrapSessionKey_WrongUUID(t *testing.T) {
+	t.Parallel()
+
+	group, keys := newTestGroup(t, 2)
+	wks, err := NewWrappedKeys(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UnwrapSessionKey(keys[0].priv, keys[1].relay.UUID, group.EPK, wks); !errors.Is(err, ErrNoWrappedKey) {
+		t.Errorf("error = %v, want %v", err, ErrNoWrappedKey)
+	}
+}
+
+func TestFindWrappedKey(t *testing.T) {
+	t.Parallel()
+
+	var wks [MaxWrappedKey]WrappedKey
+	for i := range wks {
+		_, _ = rand.Read(wks[i].Nonce[:])
+	}
+
+	for i := range wks {
+		if got := findWrappedKey(wks, wks[i].Nonce); got != i {
+			t.Errorf("findWrappedKey(slot %d) = %d", i, got)
+		}
+	}
+
+	var missing [12]byte
+	if got := findWrappedKey(wks, missing); got != -1 {
+		t.Errorf("findWrappedKey(missing) = %d, want -1", got)
+	}
+}
+
+// The benchmarks below measure the slot lookup alone. The X25519 operation,
+// which dominates the relay cost and is the same with or without tags, is
+// done beforehand. With tags a relay of the group (hit) opens its slot only
+// and one outside it (miss) opens none; trial decryption of untagged slots
+// opens two slots on average for a hit and all of them for a miss.
+
+// locateFunc finds the session key of a relay once its shared secret with
+// the client is known.
+type locateFunc func(secret []byte, uuid [16]byte, wks [MaxWrappedKey]WrappedKey) error
+
+func locateTagged(secret []byte, uuid [16]byte, wks [MaxWrappedKey]WrappedKey) error {
+	_, _, err := unwrapWithSecret(secret, HKDFSaltWrappedKey, uuid, wks)
+	return err
+}
+
+func locateTrial(secret []byte, uuid [16]byte, wks [MaxWrappedKey]WrappedKey) error {
+	wrappingKey, _, err := wrappingKeyAndTag(secret, HKDFSaltWrappedKey)
+	if err != nil {
+		return err
+	}
+	for _, wk := range wks {
+		if _, ok := openWrappedKey(wrappingKey, wk, uuid); ok {
+			return nil
+		}
+	}
+	return ErrNoWrappedKey
+}
+
+func benchmarkLocate(b *testing.B, tagged, hit, parallel bool) {
+	group, keys := newTestGroup(b, MaxWrappedKey)
+	wks, err := newWrappedKeys(group, tagged, nil, rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	locate := locateFunc(locateTrial)
+	if tagged {
+		locate = locateTagged
+	}
+
+	k := keys[MaxWrappedKey-1]
+	if !hit {
+		_, outsiders := newTestGroup(b, 1)
+		k = outsiders[0]
+	}
+	secret, err := curve25519.X25519(k.priv[:], group.EPK[:])
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	check := func(err error) bool {
+		if hit && err != nil {
+			b.Errorf("locate error = %v", err)
+			return false
+		}
+		return true
+	}
+
+	b.ResetTimer()
+	if !parallel {
+		for b.Loop() {
+			if !check(locate(secret, k.relay.UUID, wks)) {
+				return
+			}
+		}
+		return
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !check(locate(secret, k.relay.UUID, wks)) {
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkLocateWrappedKey(b *testing.B) {
+	for _, scheme := range []struct {
+		name   string
+		tagged bool
+	}{{"tagged", true}, {"trial", false}} {
+		b.Run(scheme.name+"/hit", func(b *testing.B) { benchmarkLocate(b, scheme.tagged, true, false) })
+		b.Run(scheme.name+"/miss", func(b *testing.B) { benchmarkLocate(b, scheme.tagged, false, false) })
+	}
+}
+
+func BenchmarkLocateWrappedKey_Parallel(b *testing.B) {
+	for _, scheme := range []struct {
+		name   string
+		tagged bool
+	}{{"tagged", true}, {"trial", false}} {
+		b.Run(scheme.name, func(b *testing.B) { benchmarkLocate(b, scheme.tagged, true, true) })
+	}
+}
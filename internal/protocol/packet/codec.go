@@ -7,7 +7,9 @@ import (
 	"io"
 )
 
-func ReadPacket(r io.Reader) (Packet, error) {
+// ReadPacket reads one packet from r, decoding it with the factories of reg.
+// A nil reg means DefaultRegistry.
+func ReadPacket(reg *Registry, r io.Reader) (Packet, error) {
 	header := make([]byte, HeaderSize)
 	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
@@ -16,11 +18,10 @@ func ReadPacket(r io.Reader) (Packet, error) {
 	packetType := header[0]
 	length := int(binary.BigEndian.Uint16(header[1:3]))
 
-	factory, ok := registry[packetType]
-	if !ok {
-		return nil, fmt.Errorf("unknown packet type: 0x%02x", packetType)
+	p, err := orDefault(reg).New(packetType)
+	if err != nil {
+		return nil, err
 	}
-	p := factory()
 
 	if exp, ok := p.ExpectedLen(); ok && exp != length {
 		return nil, fmt.Errorf(
@@ -29,7 +30,16 @@ func ReadPacket(r io.Reader) (Packet, error) {
 		)
 	}
 
-	lr := io.LimitReader(r, int64(length))
+	var lr io.Reader = &payloadReader{r: r, n: int64(length)}
+
+	t, conn := tapConn(r)
+	var frame *bytes.Buffer
+	if t != nil {
+		frame = bytes.NewBuffer(make([]byte, 0, HeaderSize+length))
+		frame.Write(header)
+		lr = io.TeeReader(lr, frame)
+	}
+
 	if err := p.Decode(lr); err != nil {
 		return nil, fmt.Errorf("failed to decode payload: %w", err)
 	}
@@ -40,31 +50,66 @@ func ReadPacket(r io.Reader) (Packet, error) {
 		return nil, fmt.Errorf("packet payload not fully consumed")
 	}
 
+	if t != nil {
+		t(conn, false, frame.Bytes())
+	}
 	return p, nil
 }
 
-func WritePacket(w io.Writer, p Packet) error {
+// payloadReader reads the n bytes of a packet payload from r. Unlike an
+// io.LimitReader, it fails with io.ErrUnexpectedEOF when r ends early, so
+// that variable-length payloads read to EOF cannot come out truncated.
+type payloadReader struct {
+	r io.Reader
+	n int64
+}
+
+func (pr *payloadReader) Read(p []byte) (int, error) {
+	if pr.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > pr.n {
+		p = p[:pr.n]
+	}
+	n, err := pr.r.Read(p)
+	pr.n -= int64(n)
+	if err == io.EOF && pr.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// WritePacket writes p to w. The packet type must be known to reg, a nil reg
+// meaning DefaultRegistry.
+func WritePacket(reg *Registry, w io.Writer, p Packet) error {
+	if !orDefault(reg).Has(p.Type()) {
+		return fmt.Errorf("unregistered packet type: 0x%02x", p.Type())
+	}
+
+	// The header is reserved up front so the whole frame goes out in a single
+	// Write, which keeps frames from concurrent writers from interleaving.
 	var buf bytes.Buffer
+	buf.Write(make([]byte, HeaderSize))
+
 	if err := p.Encode(&buf); err != nil {
 		return fmt.Errorf("failed to encode packet payload: %w", err)
 	}
 
-	payloadLen := buf.Len()
+	payloadLen := buf.Len() - HeaderSize
 	if payloadLen > 65535 {
 		return fmt.Errorf("packet too large: %d bytes (max 65535)", payloadLen)
 	}
 
-	header := make([]byte, 3)
-	header[0] = p.Type()
-	binary.BigEndian.PutUint16(header[1:3], uint16(payloadLen))
+	frame := buf.Bytes()
+	frame[0] = p.Type()
+	binary.BigEndian.PutUint16(frame[1:3], uint16(payloadLen))
 
-	if _, err := w.Write(header); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
 	}
 
-	if _, err := buf.WriteTo(w); err != nil {
-		return fmt.Errorf("failed to write payload: %w", err)
+	if t, conn := tapConn(w); t != nil {
+		t(conn, true, frame)
 	}
-
 	return nil
 }
@@ -75,8 +75,8 @@ func TestReadPacket(t *testing.T) {
 			errContains: "unknown packet type",
 		},
 		{
-			name:        "invalid payload length for GetIdentityResponse",
-			raw:         []byte{packet.TypeGetIdentityResponse, 0x00, 0x10},
+			name:        "invalid payload length for DeliveryAck",
+			raw:         []byte{packet.TypeDeliveryAck, 0x00, 0x10},
 			wantErr:     true,
 			errContains: "invalid payload length",
 		},
@@ -110,13 +110,19 @@ func TestReadPacket(t *testing.T) {
 			wantErr:     true,
 			errContains: "",
 		},
+		{
+			name:        "variable payload shorter than announced",
+			raw:         []byte{packet.TypeServiceLookupResponse, 0x00, 0x10, 0xAA},
+			wantErr:     true,
+			errContains: "unexpected EOF",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			p, err := packet.ReadPacket(bytes.NewReader(tt.raw))
+			p, err := packet.ReadPacket(packet.DefaultRegistry, bytes.NewReader(tt.raw))
 
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("ReadPacket() err = %v, wantErr %v", err, tt.wantErr)
@@ -206,7 +212,7 @@ func TestWritePacket(t *testing.T) {
 			t.Parallel()
 
 			var buf bytes.Buffer
-			err := packet.WritePacket(&buf, tt.packet)
+			err := packet.WritePacket(packet.DefaultRegistry, &buf, tt.packet)
 
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("WritePacket() err = %v, wantErr %v", err, tt.wantErr)
@@ -268,12 +274,12 @@ func TestWritePacket_RoundTrip(t *testing.T) {
 			t.Parallel()
 
 			var buf bytes.Buffer
-			err := packet.WritePacket(&buf, tt.packet)
+			err := packet.WritePacket(packet.DefaultRegistry, &buf, tt.packet)
 			if err != nil {
 				t.Fatalf("WritePacket() failed: %v", err)
 			}
 
-			p, err := packet.ReadPacket(&buf)
+			p, err := packet.ReadPacket(packet.DefaultRegistry, &buf)
 			if err != nil {
 				t.Fatalf("ReadPacket() failed: %v", err)
 			}
@@ -0,0 +1,39 @@
+package packet
+
+import "io"
+
+// DeliveryAck is sent by the last relay of a reply onion to the client that
+// built it, telling that its message reached the exit. The ID names the
+// message and the Tag authenticates the acknowledgement for the client.
+type DeliveryAck struct {
+	ID  [16]byte
+	Tag [16]byte
+}
+
+func (pkt *DeliveryAck) Type() uint8 {
+	return TypeDeliveryAck
+}
+
+func (pkt *DeliveryAck) Encode(w io.Writer) error {
+	if _, err := w.Write(pkt.ID[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(pkt.Tag[:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pkt *DeliveryAck) Decode(r io.Reader) error {
+	if _, err := io.ReadFull(r, pkt.ID[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, pkt.Tag[:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pkt *DeliveryAck) ExpectedLen() (int, bool) {
+	return 32, true
+}
@@ -0,0 +1,53 @@
+package packet_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func TestDeliveryAck_Type(t *testing.T) {
+	t.Parallel()
+
+	pkt := &packet.DeliveryAck{}
+	if got := pkt.Type(); got != packet.TypeDeliveryAck {
+		t.Errorf("Type() mismatch:\n\tgot:  0x%02x\n\twant: 0x%02x", got, packet.TypeDeliveryAck)
+	}
+}
+
+func TestDeliveryAck_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	want := packet.DeliveryAck{
+		ID:  [16]byte{0x01, 0x02, 0x03},
+		Tag: [16]byte{0xaa, 0xbb, 0xcc},
+	}
+
+	var buf bytes.Buffer
+	if err := packet.WritePacket(packet.DefaultRegistry, &buf, &want); err != nil {
+		t.Fatalf("WritePacket() failed: %v", err)
+	}
+
+	got, err := packet.ReadPacket(packet.DefaultRegistry, &buf)
+	if err != nil {
+		t.Fatalf("ReadPacket() failed: %v", err)
+	}
+
+	ack, ok := got.(*packet.DeliveryAck)
+	if !ok {
+		t.Fatalf("ReadPacket() returned %T, want *packet.DeliveryAck", got)
+	}
+	if *ack != want {
+		t.Fatalf("round trip mismatch:\n\tgot:  %+v\n\twant: %+v", *ack, want)
+	}
+}
+
+func TestDeliveryAck_Decode_Truncated(t *testing.T) {
+	t.Parallel()
+
+	var pkt packet.DeliveryAck
+	if err := pkt.Decode(bytes.NewReader(make([]byte, 20))); err == nil {
+		t.Fatal("expected error for truncated payload")
+	}
+}
@@ -0,0 +1,51 @@
+package packet
+
+import "io"
+
+// GetExitPolicyRequest asks a relay for the summary of its exit policy, used
+// to pick an exit compatible with the destination.
+type GetExitPolicyRequest struct{}
+
+func (pkt *GetExitPolicyRequest) Type() uint8 {
+	return TypeGetExitPolicyRequest
+}
+
+func (pkt *GetExitPolicyRequest) Encode(w io.Writer) error {
+	return nil
+}
+
+func (pkt *GetExitPolicyRequest) Decode(r io.Reader) error {
+	return nil
+}
+
+func (pkt *GetExitPolicyRequest) ExpectedLen() (int, bool) {
+	return 0, true
+}
+
+// GetExitPolicyResponse carries the encoded exit policy summary of a relay,
+// see identity.ExitSummary.
+type GetExitPolicyResponse struct {
+	Summary []byte
+}
+
+func (pkt *GetExitPolicyResponse) Type() uint8 {
+	return TypeGetExitPolicyResponse
+}
+
+func (pkt *GetExitPolicyResponse) Encode(w io.Writer) error {
+	_, err := w.Write(pkt.Summary)
+	return err
+}
+
+func (pkt *GetExitPolicyResponse) Decode(r io.Reader) error {
+	summary, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	pkt.Summary = summary
+	return nil
+}
+
+func (pkt *GetExitPolicyResponse) ExpectedLen() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,41 @@
+package packet_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func TestExitPolicyPackets_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		pkt  packet.Packet
+	}{
+		{"request", &packet.GetExitPolicyRequest{}},
+		{"response", &packet.GetExitPolicyResponse{Summary: []byte{1, 0, 1, 0, 80, 0, 80, 0, 0}}},
+		{"empty response", &packet.GetExitPolicyResponse{Summary: []byte{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			if err := packet.WritePacket(packet.DefaultRegistry, &buf, tt.pkt); err != nil {
+				t.Fatalf("WritePacket() failed: %v", err)
+			}
+
+			got, err := packet.ReadPacket(packet.DefaultRegistry, &buf)
+			if err != nil {
+				t.Fatalf("ReadPacket() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.pkt) {
+				t.Fatalf("round trip mismatch:\n\tgot:  %#v\n\twant: %#v", got, tt.pkt)
+			}
+		})
+	}
+}
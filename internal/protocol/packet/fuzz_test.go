@@ -0,0 +1,53 @@
+package packet_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func FuzzReadPacket(f *testing.F) {
+	seeds := []packet.Packet{
+		&packet.GetIdentityRequest{},
+		&packet.GetIdentityResponse{Ruuid: [16]byte{1}, PublicKey: [32]byte{2}},
+		&packet.Hello{MinVersion: 1, MaxVersion: 2, Capabilities: 3},
+		&packet.HelloAck{Version: 1, Capabilities: 3},
+		&packet.GetExitPolicyRequest{},
+		&packet.GetExitPolicyResponse{Summary: []byte{1, 0, 1, 0, 0, 0xff, 0xff, 0, 0}},
+		&packet.OnionPacket{},
+		&packet.DeliveryAck{ID: [16]byte{4}, Tag: [16]byte{5}},
+		&packet.SphinxPacket{},
+		&packet.HybridOnionPacket{},
+		&packet.ServiceLookupRequest{Key: [32]byte{6}},
+		&packet.ServiceLookupResponse{Descriptor: []byte("descriptor")},
+		&packet.GuardRegister{Token: [16]byte{7}, Port: 62503},
+		&packet.ServiceData{Token: [16]byte{8}, Kind: 1, Data: []byte("data")},
+	}
+	for _, p := range seeds {
+		var buf bytes.Buffer
+		if err := packet.WritePacket(packet.DefaultRegistry, &buf, p); err != nil {
+			f.Fatalf("WritePacket(%T) failed: %v", p, err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{packet.TypeGetIdentityRequest, 0x00})
+	f.Add([]byte{0xff, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		p, err := packet.ReadPacket(packet.DefaultRegistry, r)
+		if err != nil {
+			return
+		}
+		read := data[:len(data)-r.Len()]
+
+		var buf bytes.Buffer
+		if err := packet.WritePacket(packet.DefaultRegistry, &buf, p); err != nil {
+			t.Fatalf("WritePacket() of a read %T failed: %v", p, err)
+		}
+		if !bytes.Equal(buf.Bytes(), read) {
+			t.Fatalf("round trip mismatch for %T:\n\tgot:  %x\n\twant: %x", p, buf.Bytes(), read)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package packet
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Hello opens every DOR connection. The initiator advertises the range of
+// protocol versions it speaks and the capabilities it supports.
+type Hello struct {
+	MinVersion   uint8
+	MaxVersion   uint8
+	Capabilities uint32
+}
+
+func (pkt *Hello) Type() uint8 {
+	return TypeHello
+}
+
+func (pkt *Hello) Encode(w io.Writer) error {
+	var buf [6]byte
+	buf[0] = pkt.MinVersion
+	buf[1] = pkt.MaxVersion
+	binary.BigEndian.PutUint32(buf[2:6], pkt.Capabilities)
+
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func (pkt *Hello) Decode(r io.Reader) error {
+	var buf [6]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+
+	pkt.MinVersion = buf[0]
+	pkt.MaxVersion = buf[1]
+	pkt.Capabilities = binary.BigEndian.Uint32(buf[2:6])
+	return nil
+}
+
+func (pkt *Hello) ExpectedLen() (int, bool) {
+	return 6, true
+}
+
+// HelloAck answers a Hello with the negotiated version and the capabilities
+// both sides share. A zero Version means the responder rejects the peer.
+type HelloAck struct {
+	Version      uint8
+	Capabilities uint32
+}
+
+func (pkt *HelloAck) Type() uint8 {
+	return TypeHelloAck
+}
+
+func (pkt *HelloAck) Encode(w io.Writer) error {
+	var buf [5]byte
+	buf[0] = pkt.Version
+	binary.BigEndian.PutUint32(buf[1:5], pkt.Capabilities)
+
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func (pkt *HelloAck) Decode(r io.Reader) error {
+	var buf [5]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+
+	pkt.Version = buf[0]
+	pkt.Capabilities = binary.BigEndian.Uint32(buf[1:5])
+	return nil
+}
+
+func (pkt *HelloAck) ExpectedLen() (int, bool) {
+	return 5, true
+}
@@ -0,0 +1,100 @@
+package packet_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func TestHello_EncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		hello    packet.Hello
+		expected []byte
+	}{
+		{
+			name:     "zero values",
+			hello:    packet.Hello{},
+			expected: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:     "version range and capabilities",
+			hello:    packet.Hello{MinVersion: 1, MaxVersion: 3, Capabilities: 0xDEADBEEF},
+			expected: []byte{0x01, 0x03, 0xDE, 0xAD, 0xBE, 0xEF},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			if err := tt.hello.Encode(&buf); err != nil {
+				t.Fatalf("Encode() unexpected error: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.expected) {
+				t.Fatalf("Encode() mismatch:\n\tgot:  %x\n\twant: %x", buf.Bytes(), tt.expected)
+			}
+			if exp, _ := tt.hello.ExpectedLen(); exp != len(tt.expected) {
+				t.Fatalf("ExpectedLen() mismatch:\n\tgot:  %d\n\twant: %d", exp, len(tt.expected))
+			}
+
+			var got packet.Hello
+			if err := got.Decode(&buf); err != nil {
+				t.Fatalf("Decode() unexpected error: %v", err)
+			}
+			if got != tt.hello {
+				t.Fatalf("Decode() mismatch:\n\tgot:  %+v\n\twant: %+v", got, tt.hello)
+			}
+		})
+	}
+}
+
+func TestHelloAck_EncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		ack      packet.HelloAck
+		expected []byte
+	}{
+		{
+			name:     "rejection",
+			ack:      packet.HelloAck{},
+			expected: []byte{0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:     "accepted with capabilities",
+			ack:      packet.HelloAck{Version: 1, Capabilities: 0x00000005},
+			expected: []byte{0x01, 0x00, 0x00, 0x00, 0x05},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			if err := tt.ack.Encode(&buf); err != nil {
+				t.Fatalf("Encode() unexpected error: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.expected) {
+				t.Fatalf("Encode() mismatch:\n\tgot:  %x\n\twant: %x", buf.Bytes(), tt.expected)
+			}
+			if exp, _ := tt.ack.ExpectedLen(); exp != len(tt.expected) {
+				t.Fatalf("ExpectedLen() mismatch:\n\tgot:  %d\n\twant: %d", exp, len(tt.expected))
+			}
+
+			var got packet.HelloAck
+			if err := got.Decode(&buf); err != nil {
+				t.Fatalf("Decode() unexpected error: %v", err)
+			}
+			if got != tt.ack {
+				t.Fatalf("Decode() mismatch:\n\tgot:  %+v\n\twant: %+v", got, tt.ack)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package packet
+
+import (
+	"io"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+// HybridOnionPacket is an onion built with onion.WithHybridKEM, preceded by
+// the envelope sealing the hybrid secret of its layer for the relay it is
+// sent to.
+type HybridOnionPacket struct {
+	Envelope onion.HybridEnvelope
+	Data     [onion.PacketSize]byte
+}
+
+func (pkt *HybridOnionPacket) Type() uint8 {
+	return TypeHybridOnionPacket
+}
+
+func (pkt *HybridOnionPacket) Encode(w io.Writer) error {
+	if _, err := w.Write(pkt.Envelope[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(pkt.Data[:])
+	return err
+}
+
+func (pkt *HybridOnionPacket) Decode(r io.Reader) error {
+	if _, err := io.ReadFull(r, pkt.Envelope[:]); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r, pkt.Data[:])
+	return err
+}
+
+func (pkt *HybridOnionPacket) ExpectedLen() (int, bool) {
+	return onion.HybridEnvelopeSize + onion.PacketSize, true
+}
@@ -1,10 +1,19 @@
 package packet
 
-import "io"
+import (
+	"crypto/mlkem"
+	"fmt"
+	"io"
+)
 
 type GetIdentityResponse struct {
 	Ruuid     [16]byte
 	PublicKey [32]byte
+
+	// KEMKey is the ML-KEM-768 encapsulation key of the relay, sent to peers
+	// that negotiated hybrid onions only. Empty otherwise, which keeps the
+	// response readable by the others.
+	KEMKey []byte
 }
 
 func (pkt *GetIdentityResponse) Type() uint8 {
@@ -18,6 +27,9 @@ func (pkt *GetIdentityResponse) Encode(w io.Writer) error {
 	if _, err := w.Write(pkt.PublicKey[:]); err != nil {
 		return err
 	}
+	if _, err := w.Write(pkt.KEMKey); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -28,9 +40,21 @@ func (pkt *GetIdentityResponse) Decode(r io.Reader) error {
 	if _, err := io.ReadFull(r, pkt.PublicKey[:]); err != nil {
 		return err
 	}
+
+	key, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(key) != 0 && len(key) != mlkem.EncapsulationKeySize768 {
+		return fmt.Errorf("invalid KEM key size: got %d, want %d", len(key), mlkem.EncapsulationKeySize768)
+	}
+	pkt.KEMKey = nil
+	if len(key) > 0 {
+		pkt.KEMKey = key
+	}
 	return nil
 }
 
 func (pkt *GetIdentityResponse) ExpectedLen() (int, bool) {
-	return 48, true
+	return 0, false
 }
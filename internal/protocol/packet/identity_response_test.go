@@ -2,6 +2,7 @@ package packet_test
 
 import (
 	"bytes"
+	"crypto/mlkem"
 	"strings"
 	"testing"
 
@@ -23,14 +24,8 @@ func TestGetIdentityResponse_ExpectedLen(t *testing.T) {
 	t.Parallel()
 
 	pkt := &packet.GetIdentityResponse{}
-	length, ok := pkt.ExpectedLen()
-
-	if !ok {
-		t.Error("ExpectedLen() should return true for fixed length")
-	}
-
-	if length != 48 {
-		t.Errorf("ExpectedLen() mismatch:\n\tgot:  %d\n\twant: 48", length)
+	if _, ok := pkt.ExpectedLen(); ok {
+		t.Error("ExpectedLen() should return false: the KEM key is optional")
 	}
 }
 
@@ -164,6 +159,12 @@ func TestGetIdentityResponse_Decode(t *testing.T) {
 			wantErr:     true,
 			errContains: "",
 		},
+		{
+			name:        "decode truncated KEM key",
+			data:        make([]byte, 48+10),
+			wantErr:     true,
+			errContains: "invalid KEM key size",
+		},
 	}
 
 	for _, tt := range tests {
@@ -191,6 +192,10 @@ func TestGetIdentityResponse_Decode(t *testing.T) {
 			if pkt.PublicKey != tt.wantPubKey {
 				t.Errorf("PublicKey mismatch:\n\tgot:  %x\n\twant: %x", pkt.PublicKey, tt.wantPubKey)
 			}
+
+			if pkt.KEMKey != nil {
+				t.Errorf("KEMKey should be nil without one, got %d bytes", len(pkt.KEMKey))
+			}
 		})
 	}
 }
@@ -223,6 +228,13 @@ func TestGetIdentityResponse_EncodeDecodeRoundTrip(t *testing.T) {
 				PublicKey: [32]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
 			},
 		},
+		{
+			name: "roundtrip with KEM key",
+			pkt: packet.GetIdentityResponse{
+				Ruuid:  [16]byte{0x01},
+				KEMKey: bytes.Repeat([]byte{0x42}, mlkem.EncapsulationKeySize768),
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -248,6 +260,10 @@ func TestGetIdentityResponse_EncodeDecodeRoundTrip(t *testing.T) {
 			if decoded.PublicKey != tt.pkt.PublicKey {
 				t.Errorf("PublicKey mismatch after roundtrip:\n\tgot:  %x\n\twant: %x", decoded.PublicKey, tt.pkt.PublicKey)
 			}
+
+			if !bytes.Equal(decoded.KEMKey, tt.pkt.KEMKey) {
+				t.Errorf("KEMKey mismatch after roundtrip:\n\tgot:  %d bytes\n\twant: %d bytes", len(decoded.KEMKey), len(tt.pkt.KEMKey))
+			}
 		})
 	}
 }
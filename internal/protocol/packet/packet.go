@@ -3,10 +3,22 @@ package packet
 import "io"
 
 const (
-	TypeGetIdentityRequest  uint8 = 0x00
-	TypeGetIdentityResponse uint8 = 0x01
+	TypeGetIdentityRequest    uint8 = 0x00
+	TypeGetIdentityResponse   uint8 = 0x01
+	TypeHello                 uint8 = 0x02
+	TypeHelloAck              uint8 = 0x03
+	TypeGetExitPolicyRequest  uint8 = 0x06
+	TypeGetExitPolicyResponse uint8 = 0x07
 
-	TypeOnionPacket uint8 = 0x10
+	TypeOnionPacket       uint8 = 0x10
+	TypeDeliveryAck       uint8 = 0x11
+	TypeSphinxPacket      uint8 = 0x12
+	TypeHybridOnionPacket uint8 = 0x13
+
+	TypeServiceLookupRequest  uint8 = 0x20
+	TypeServiceLookupResponse uint8 = 0x21
+	TypeGuardRegister         uint8 = 0x22
+	TypeServiceData           uint8 = 0x23
 
 	HeaderSize int = 3
 )
@@ -1,10 +1,117 @@
 package packet
 
+import (
+	"fmt"
+	"maps"
+	"sync"
+)
+
 type PacketFactory func() Packet
 
-var registry = map[uint8]PacketFactory{
-	TypeGetIdentityRequest:  func() Packet { return &GetIdentityRequest{} },
-	TypeGetIdentityResponse: func() Packet { return &GetIdentityResponse{} },
+// Registry maps packet type identifiers to the factories used to decode them.
+// It is safe for concurrent use.
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[uint8]PacketFactory
+}
+
+// DefaultRegistry holds the built-in DOR packet types. It is used whenever a
+// nil *Registry is given to ReadPacket or WritePacket.
+var DefaultRegistry = newDefaultRegistry()
+
+func newDefaultRegistry() *Registry {
+	r := NewRegistry()
+
+	r.MustRegister(TypeGetIdentityRequest, func() Packet { return &GetIdentityRequest{} })
+	r.MustRegister(TypeGetIdentityResponse, func() Packet { return &GetIdentityResponse{} })
+	r.MustRegister(TypeHello, func() Packet { return &Hello{} })
+	r.MustRegister(TypeHelloAck, func() Packet { return &HelloAck{} })
+	r.MustRegister(TypeGetExitPolicyRequest, func() Packet { return &GetExitPolicyRequest{} })
+	r.MustRegister(TypeGetExitPolicyResponse, func() Packet { return &GetExitPolicyResponse{} })
+
+	r.MustRegister(TypeOnionPacket, func() Packet { return &OnionPacket{} })
+	r.MustRegister(TypeDeliveryAck, func() Packet { return &DeliveryAck{} })
+	r.MustRegister(TypeSphinxPacket, func() Packet { return &SphinxPacket{} })
+	r.MustRegister(TypeHybridOnionPacket, func() Packet { return &HybridOnionPacket{} })
+
+	r.MustRegister(TypeServiceLookupRequest, func() Packet { return &ServiceLookupRequest{} })
+	r.MustRegister(TypeServiceLookupResponse, func() Packet { return &ServiceLookupResponse{} })
+	r.MustRegister(TypeGuardRegister, func() Packet { return &GuardRegister{} })
+	r.MustRegister(TypeServiceData, func() Packet { return &ServiceData{} })
+
+	return r
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: make(map[uint8]PacketFactory),
+	}
+}
+
+// Register adds a factory for the given packet type. It fails if the type is
+// already registered or if the factory builds packets of another type.
+func (r *Registry) Register(t uint8, f PacketFactory) error {
+	if f == nil {
+		return fmt.Errorf("nil factory for packet type 0x%02x", t)
+	}
+	if got := f().Type(); got != t {
+		return fmt.Errorf("factory for packet type 0x%02x builds packets of type 0x%02x", t, got)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.factories[t]; exists {
+		return fmt.Errorf("duplicate packet type: 0x%02x", t)
+	}
+	r.factories[t] = f
+
+	return nil
+}
+
+// MustRegister is like Register but panics on error. It is meant for
+// registrations done at init time.
+func (r *Registry) MustRegister(t uint8, f PacketFactory) {
+	if err := r.Register(t, f); err != nil {
+		panic(err)
+	}
+}
+
+// New returns an empty packet of the given type.
+func (r *Registry) New(t uint8) (Packet, error) {
+	r.mu.RLock()
+	factory, ok := r.factories[t]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown packet type: 0x%02x", t)
+	}
+	return factory(), nil
+}
+
+// Has reports whether a factory is registered for the given packet type.
+func (r *Registry) Has(t uint8) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.factories[t]
+	return ok
+}
+
+// Clone returns an independent copy of the registry, typically used to extend
+// DefaultRegistry without altering it.
+func (r *Registry) Clone() *Registry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &Registry{
+		factories: maps.Clone(r.factories),
+	}
+}
 
-	TypeOnionPacket: func() Packet { return &OnionPacket{} },
+func orDefault(r *Registry) *Registry {
+	if r == nil {
+		return DefaultRegistry
+	}
+	return r
 }
@@ -1,10 +1,36 @@
 package packet
 
 import (
+	"bytes"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
 )
 
+type testPacket struct {
+	typ  uint8
+	Data [4]byte
+}
+
+func (pkt *testPacket) Type() uint8 {
+	return pkt.typ
+}
+
+func (pkt *testPacket) Encode(w io.Writer) error {
+	_, err := w.Write(pkt.Data[:])
+	return err
+}
+
+func (pkt *testPacket) Decode(r io.Reader) error {
+	_, err := io.ReadFull(r, pkt.Data[:])
+	return err
+}
+
+func (pkt *testPacket) ExpectedLen() (int, bool) {
+	return 4, true
+}
+
 func TestRegistry(t *testing.T) {
 	t.Parallel()
 
@@ -23,6 +49,16 @@ func TestRegistry(t *testing.T) {
 			t:    TypeGetIdentityResponse,
 			want: &GetIdentityResponse{},
 		},
+		{
+			name: "TypeHello",
+			t:    TypeHello,
+			want: &Hello{},
+		},
+		{
+			name: "TypeHelloAck",
+			t:    TypeHelloAck,
+			want: &HelloAck{},
+		},
 		{
 			name: "TypeOnion",
 			t:    TypeOnionPacket,
@@ -32,12 +68,11 @@ func TestRegistry(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			factory, ok := registry[tt.t]
-			if !ok {
-				t.Fatalf("no factory for type %#x", tt.t)
+			pkt, err := DefaultRegistry.New(tt.t)
+			if err != nil {
+				t.Fatalf("no factory for type %#x: %v", tt.t, err)
 			}
 
-			pkt := factory()
 			if reflect.TypeOf(pkt) != reflect.TypeOf(tt.want) {
 				t.Fatalf("wrong packet type for %#x: \n\tgot %T \n\twant %T",
 					tt.t, pkt, tt.want)
@@ -45,3 +80,132 @@ func TestRegistry(t *testing.T) {
 		})
 	}
 }
+
+func TestRegistry_Register(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		t           uint8
+		factory     PacketFactory
+		wantErr     bool
+		errContains string
+	}{
+		{
+			name:    "new type",
+			t:       0x7F,
+			factory: func() Packet { return &testPacket{typ: 0x7F} },
+			wantErr: false,
+		},
+		{
+			name:        "duplicate built-in type",
+			t:           TypeOnionPacket,
+			factory:     func() Packet { return &OnionPacket{} },
+			wantErr:     true,
+			errContains: "duplicate packet type",
+		},
+		{
+			name:        "factory type mismatch",
+			t:           0x7E,
+			factory:     func() Packet { return &testPacket{typ: 0x7D} },
+			wantErr:     true,
+			errContains: "builds packets of type",
+		},
+		{
+			name:        "nil factory",
+			t:           0x7C,
+			factory:     nil,
+			wantErr:     true,
+			errContains: "nil factory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := DefaultRegistry.Clone()
+			err := r.Register(tt.t, tt.factory)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Register() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), tt.errContains) {
+					t.Fatalf("Register() error mismatch:\n\tgot:  %v\n\twant to contain: %s", err, tt.errContains)
+				}
+				return
+			}
+			if !r.Has(tt.t) {
+				t.Fatalf("Has(0x%02x) = false after Register()", tt.t)
+			}
+		})
+	}
+}
+
+func TestRegistry_MustRegister_Panics(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MustRegister() did not panic on duplicate type")
+		}
+	}()
+
+	r := NewRegistry()
+	r.MustRegister(0x7F, func() Packet { return &testPacket{typ: 0x7F} })
+	r.MustRegister(0x7F, func() Packet { return &testPacket{typ: 0x7F} })
+}
+
+func TestRegistry_Clone_Independent(t *testing.T) {
+	t.Parallel()
+
+	clone := DefaultRegistry.Clone()
+	clone.MustRegister(0x7B, func() Packet { return &testPacket{typ: 0x7B} })
+
+	if DefaultRegistry.Has(0x7B) {
+		t.Fatal("registering on a clone modified DefaultRegistry")
+	}
+	if !clone.Has(TypeOnionPacket) {
+		t.Fatal("clone lost built-in packet types")
+	}
+}
+
+func TestRegistry_CustomPacketRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	r.MustRegister(0x7A, func() Packet { return &testPacket{typ: 0x7A} })
+
+	in := &testPacket{typ: 0x7A, Data: [4]byte{0xDE, 0xAD, 0xBE, 0xEF}}
+
+	var buf bytes.Buffer
+	if err := WritePacket(r, &buf, in); err != nil {
+		t.Fatalf("WritePacket() failed: %v", err)
+	}
+
+	raw := bytes.Clone(buf.Bytes())
+	if _, err := ReadPacket(nil, bytes.NewReader(raw)); err == nil {
+		t.Fatal("default registry should not know the custom packet type")
+	}
+
+	out, err := ReadPacket(r, &buf)
+	if err != nil {
+		t.Fatalf("ReadPacket() failed: %v", err)
+	}
+	if got := out.(*testPacket).Data; got != in.Data {
+		t.Fatalf("payload mismatch:\n\tgot:  %x\n\twant: %x", got, in.Data)
+	}
+}
+
+func TestWritePacket_UnregisteredType(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := WritePacket(NewRegistry(), &buf, &GetIdentityRequest{})
+	if err == nil || !strings.Contains(err.Error(), "unregistered packet type") {
+		t.Fatalf("WritePacket() error mismatch:\n\tgot:  %v\n\twant to contain: unregistered packet type", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("WritePacket() wrote %d bytes for an unregistered type", buf.Len())
+	}
+}
@@ -0,0 +1,169 @@
+package packet
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ServiceLookupRequest asks a relay for the descriptor of the hidden service
+// with the given signing key.
+type ServiceLookupRequest struct {
+	Key [32]byte
+}
+
+func (pkt *ServiceLookupRequest) Type() uint8 {
+	return TypeServiceLookupRequest
+}
+
+func (pkt *ServiceLookupRequest) Encode(w io.Writer) error {
+	_, err := w.Write(pkt.Key[:])
+	return err
+}
+
+func (pkt *ServiceLookupRequest) Decode(r io.Reader) error {
+	_, err := io.ReadFull(r, pkt.Key[:])
+	return err
+}
+
+func (pkt *ServiceLookupRequest) ExpectedLen() (int, bool) {
+	return 32, true
+}
+
+// ServiceLookupResponse carries the descriptor found by a lookup, empty when
+// the relay knows none.
+type ServiceLookupResponse struct {
+	Descriptor []byte
+}
+
+func (pkt *ServiceLookupResponse) Type() uint8 {
+	return TypeServiceLookupResponse
+}
+
+func (pkt *ServiceLookupResponse) Encode(w io.Writer) error {
+	_, err := w.Write(pkt.Descriptor)
+	return err
+}
+
+func (pkt *ServiceLookupResponse) Decode(r io.Reader) error {
+	var err error
+	pkt.Descriptor, err = io.ReadAll(r)
+	return err
+}
+
+func (pkt *ServiceLookupResponse) ExpectedLen() (int, bool) {
+	return 0, false
+}
+
+// guardRegisterContext prefixes the bytes a GuardRegister signature covers.
+var guardRegisterContext = []byte("DORv1:GuardRegister")
+
+// GuardRegister is sent by a hidden service to its guard relay: onions
+// delivered to Token are handed to the service on Port of the address the
+// request came from. It is signed with the service key Key at Time, in Unix
+// seconds, so that only the service can move its token, and not the relays
+// it hands the token to.
+//
+// +--------+--------+--------+--------+
+// | Token (16) | Port (2) | Key (32) | Time (8) | Sig (64) |
+// +--------+--------+--------+--------+
+type GuardRegister struct {
+	Token [16]byte
+	Port  uint16
+	Key   [ed25519.PublicKeySize]byte
+	Time  uint64
+	Sig   [ed25519.SignatureSize]byte
+}
+
+const guardRegisterLen = 16 + 2 + ed25519.PublicKeySize + 8 + ed25519.SignatureSize
+
+func (pkt *GuardRegister) Type() uint8 {
+	return TypeGuardRegister
+}
+
+func (pkt *GuardRegister) body() []byte {
+	buf := make([]byte, 0, guardRegisterLen)
+	buf = append(buf, pkt.Token[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, pkt.Port)
+	buf = append(buf, pkt.Key[:]...)
+	return binary.BigEndian.AppendUint64(buf, pkt.Time)
+}
+
+// Sign fills Key and Sig with the service signing key.
+func (pkt *GuardRegister) Sign(key ed25519.PrivateKey) {
+	copy(pkt.Key[:], key.Public().(ed25519.PublicKey))
+	msg := append(append([]byte(nil), guardRegisterContext...), pkt.body()...)
+	copy(pkt.Sig[:], ed25519.Sign(key, msg))
+}
+
+// Verify checks that the registration was signed with Key.
+func (pkt *GuardRegister) Verify() error {
+	msg := append(append([]byte(nil), guardRegisterContext...), pkt.body()...)
+	if !ed25519.Verify(pkt.Key[:], msg, pkt.Sig[:]) {
+		return fmt.Errorf("invalid guard registration signature")
+	}
+	return nil
+}
+
+func (pkt *GuardRegister) Encode(w io.Writer) error {
+	_, err := w.Write(append(pkt.body(), pkt.Sig[:]...))
+	return err
+}
+
+func (pkt *GuardRegister) Decode(r io.Reader) error {
+	var buf [guardRegisterLen]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	copy(pkt.Token[:], buf[:16])
+	pkt.Port = binary.BigEndian.Uint16(buf[16:18])
+	copy(pkt.Key[:], buf[18:50])
+	pkt.Time = binary.BigEndian.Uint64(buf[50:58])
+	copy(pkt.Sig[:], buf[58:])
+	return nil
+}
+
+func (pkt *GuardRegister) ExpectedLen() (int, bool) {
+	return guardRegisterLen, true
+}
+
+// ServiceData is handed by a guard relay to the hidden service registered
+// under Token. Kind tells what the opaque Data holds.
+type ServiceData struct {
+	Token [16]byte
+	Kind  uint8
+	Data  []byte
+}
+
+func (pkt *ServiceData) Type() uint8 {
+	return TypeServiceData
+}
+
+func (pkt *ServiceData) Encode(w io.Writer) error {
+	if _, err := w.Write(pkt.Token[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{pkt.Kind}); err != nil {
+		return err
+	}
+	_, err := w.Write(pkt.Data)
+	return err
+}
+
+func (pkt *ServiceData) Decode(r io.Reader) error {
+	var head [17]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return err
+	}
+	copy(pkt.Token[:], head[:16])
+	pkt.Kind = head[16]
+
+	var err error
+	pkt.Data, err = io.ReadAll(r)
+	return err
+}
+
+func (pkt *ServiceData) ExpectedLen() (int, bool) {
+	return 0, false
+}
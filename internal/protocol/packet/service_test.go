@@ -0,0 +1,79 @@
+package packet_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+func TestServicePackets_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		pkt  packet.Packet
+	}{
+		{"lookup request", &packet.ServiceLookupRequest{Key: [32]byte{0x01, 0x02}}},
+		{"lookup response", &packet.ServiceLookupResponse{Descriptor: []byte("descriptor")}},
+		{"empty lookup response", &packet.ServiceLookupResponse{Descriptor: []byte{}}},
+		{"guard register", &packet.GuardRegister{Token: [16]byte{0xaa}, Port: 62700, Key: [32]byte{0xcc}, Time: 1700000000, Sig: [64]byte{0xdd}}},
+		{"service data", &packet.ServiceData{Token: [16]byte{0xbb}, Kind: 2, Data: []byte("sealed")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			if err := packet.WritePacket(packet.DefaultRegistry, &buf, tt.pkt); err != nil {
+				t.Fatalf("WritePacket() failed: %v", err)
+			}
+
+			got, err := packet.ReadPacket(packet.DefaultRegistry, &buf)
+			if err != nil {
+				t.Fatalf("ReadPacket() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.pkt) {
+				t.Fatalf("round trip mismatch:\n\tgot:  %+v\n\twant: %+v", got, tt.pkt)
+			}
+		})
+	}
+}
+
+func TestGuardRegister_Verify(t *testing.T) {
+	t.Parallel()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+
+	reg := packet.GuardRegister{Token: [16]byte{0xaa}, Port: 62700, Time: 1700000000}
+	reg.Sign(key)
+	if err := reg.Verify(); err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+
+	tampered := reg
+	tampered.Port++
+	if err := tampered.Verify(); err == nil {
+		t.Fatal("Verify() accepted a registration moved to another port")
+	}
+	tampered = reg
+	tampered.Time++
+	if err := tampered.Verify(); err == nil {
+		t.Fatal("Verify() accepted a registration with another time")
+	}
+}
+
+func TestServiceData_Decode_Truncated(t *testing.T) {
+	t.Parallel()
+
+	var pkt packet.ServiceData
+	if err := pkt.Decode(bytes.NewReader(make([]byte, 10))); err == nil {
+		t.Fatal("expected error for truncated payload")
+	}
+}
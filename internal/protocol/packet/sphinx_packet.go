@@ -0,0 +1,29 @@
+package packet
+
+import (
+	"io"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/sphinx"
+)
+
+type SphinxPacket struct {
+	Data [sphinx.PacketSize]byte
+}
+
+func (pkt *SphinxPacket) Type() uint8 {
+	return TypeSphinxPacket
+}
+
+func (pkt *SphinxPacket) Encode(w io.Writer) error {
+	_, err := w.Write(pkt.Data[:])
+	return err
+}
+
+func (pkt *SphinxPacket) Decode(r io.Reader) error {
+	_, err := io.ReadFull(r, pkt.Data[:])
+	return err
+}
+
+func (pkt *SphinxPacket) ExpectedLen() (int, bool) {
+	return sphinx.PacketSize, true
+}
@@ -0,0 +1,57 @@
+package packet_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/sphinx"
+)
+
+func TestSphinxPacket_Type(t *testing.T) {
+	t.Parallel()
+
+	pkt := &packet.SphinxPacket{}
+	if got := pkt.Type(); got != packet.TypeSphinxPacket {
+		t.Errorf("Type() mismatch:\n\tgot:  0x%02x\n\twant: 0x%02x", got, packet.TypeSphinxPacket)
+	}
+	if n, fixed := pkt.ExpectedLen(); !fixed || n != sphinx.PacketSize {
+		t.Errorf("ExpectedLen() = (%d, %v), want (%d, true)", n, fixed, sphinx.PacketSize)
+	}
+}
+
+func TestSphinxPacket_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var want packet.SphinxPacket
+	for i := range want.Data {
+		want.Data[i] = byte(i)
+	}
+
+	var buf bytes.Buffer
+	if err := packet.WritePacket(packet.DefaultRegistry, &buf, &want); err != nil {
+		t.Fatalf("WritePacket() failed: %v", err)
+	}
+
+	got, err := packet.ReadPacket(packet.DefaultRegistry, &buf)
+	if err != nil {
+		t.Fatalf("ReadPacket() failed: %v", err)
+	}
+
+	pkt, ok := got.(*packet.SphinxPacket)
+	if !ok {
+		t.Fatalf("ReadPacket() returned %T, want *packet.SphinxPacket", got)
+	}
+	if *pkt != want {
+		t.Fatal("round trip mismatch")
+	}
+}
+
+func TestSphinxPacket_Decode_Truncated(t *testing.T) {
+	t.Parallel()
+
+	var pkt packet.SphinxPacket
+	if err := pkt.Decode(bytes.NewReader(make([]byte, 100))); err == nil {
+		t.Fatal("expected error for truncated payload")
+	}
+}
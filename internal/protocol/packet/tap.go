@@ -0,0 +1,37 @@
+package packet
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Tap observes the frames read and written on connections by ReadPacket and
+// WritePacket, header included, sent telling their direction. It is called
+// once the frame is fully read or written, and must not retain frame.
+type Tap func(conn net.Conn, sent bool, frame []byte)
+
+var tap atomic.Pointer[Tap]
+
+// SetTap installs t on every connection of the process, replacing the
+// previous one. A nil t removes it.
+func SetTap(t Tap) {
+	if t == nil {
+		tap.Store(nil)
+		return
+	}
+	tap.Store(&t)
+}
+
+// tapConn returns the tap to call for frames carried by rw, nil if there is
+// none or rw is not a connection.
+func tapConn(rw any) (Tap, net.Conn) {
+	t := tap.Load()
+	if t == nil {
+		return nil, nil
+	}
+	conn, ok := rw.(net.Conn)
+	if !ok {
+		return nil, nil
+	}
+	return *t, conn
+}
@@ -0,0 +1,66 @@
+package packet_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+type tapped struct {
+	conn  net.Conn
+	sent  bool
+	frame []byte
+}
+
+func TestSetTap(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	var mu sync.Mutex
+	var got []tapped
+	packet.SetTap(func(conn net.Conn, sent bool, frame []byte) {
+		if conn != client && conn != server {
+			return // a connection of a parallel test
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, tapped{conn, sent, bytes.Clone(frame)})
+	})
+	defer packet.SetTap(nil)
+
+	sent := &packet.Hello{MinVersion: 1, MaxVersion: 2, Capabilities: 3}
+	var want bytes.Buffer
+	if err := packet.WritePacket(nil, &want, sent); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatal("frame written to a non connection tapped")
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- packet.WritePacket(nil, client, sent) }()
+	if _, err := packet.ReadPacket(nil, server); err != nil {
+		t.Fatalf("ReadPacket() failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("WritePacket() failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("tapped frames mismatch:\n\tgot:  %d\n\twant: 2", len(got))
+	}
+	for _, tf := range got {
+		if wantSent := tf.conn == client; tf.sent != wantSent {
+			t.Errorf("direction mismatch on the %v side", map[bool]string{true: "client", false: "server"}[wantSent])
+		}
+		if !bytes.Equal(tf.frame, want.Bytes()) {
+			t.Errorf("frame mismatch:\n\tgot:  %x\n\twant: %x", tf.frame, want.Bytes())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package sphinx
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"golang.org/x/crypto/curve25519"
+)
+
+type buildConfig struct {
+	mixDelayClass uint8
+}
+
+type BuildOption func(*buildConfig)
+
+// WithMixDelay asks every relay of the path to hold the packet for the given
+// delay class before forwarding it. Relays not running in mix mode ignore it.
+func WithMixDelay(class uint8) BuildOption {
+	return func(c *buildConfig) {
+		c.mixDelayClass = class
+	}
+}
+
+// Build builds a packet carrying msg to dest through path, one relay per hop.
+func Build(
+	dest identity.Endpoint,
+	path []identity.Relay,
+	msg []byte,
+	opts ...BuildOption,
+) (*Packet, error) {
+	var cfg buildConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.mixDelayClass > onion.MaxMixDelayClass {
+		return nil, fmt.Errorf("mix delay class %d out of range (max %d)", cfg.mixDelayClass, onion.MaxMixDelayClass)
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+	if len(path) > MaxHops {
+		return nil, fmt.Errorf("max hops value is %d", MaxHops)
+	}
+	if len(msg) > MaxMessageSize {
+		return nil, fmt.Errorf("message too large: %d bytes (max %d)", len(msg), MaxMessageSize)
+	}
+
+	var esk [32]byte
+	_, _ = rand.Read(esk[:]) // never fails since Go 1.24
+
+	alpha, keys, err := sharedKeys(esk, path)
+	if err != nil {
+		return nil, err
+	}
+
+	routing := make([][RoutingSize]byte, len(path))
+	for i := range path {
+		next, flags := dest, byte(FlagExit)
+		if i < len(path)-1 {
+			next, flags = path[i+1].Ep, 0
+		}
+		if routing[i], err = routingBlock(next, flags|cfg.mixDelayClass); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Packet{}
+	copy(p.Alpha[:], alpha)
+	buildHeader(p, keys, routing)
+	if err := buildPayload(p, keys, msg); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// sharedKeys returns the first alpha, and the keys shared with every hop of
+// path: the secret of hop i is its public key multiplied by esk and by the
+// blinding factors of the hops before it.
+func sharedKeys(esk [32]byte, path []identity.Relay) ([]byte, []hopKeys, error) {
+	alpha0, err := curve25519.X25519(esk[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	alpha := alpha0
+	factors := make([][]byte, 0, len(path))
+	keys := make([]hopKeys, len(path))
+	for i, r := range path {
+		secret, err := curve25519.X25519(esk[:], r.PubKey[:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to compute shared secret with hop %d: %w", i, err)
+		}
+		for _, b := range factors {
+			if secret, err = blind(secret, b); err != nil {
+				return nil, nil, err
+			}
+		}
+		if keys[i], err = deriveKeys(secret); err != nil {
+			return nil, nil, err
+		}
+
+		b := blindingFactor(alpha, secret)
+		factors = append(factors, b)
+		if alpha, err = blind(alpha, b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return alpha0, keys, nil
+}
+
+func routingBlock(next identity.Endpoint, flags byte) ([RoutingSize]byte, error) {
+	var out [RoutingSize]byte
+	ep, err := next.Bytes()
+	if err != nil {
+		return out, err
+	}
+	if len(ep) > RoutingSize-1 {
+		return out, fmt.Errorf("endpoint %s does not fit a routing block (%d bytes, max %d)", next, len(ep), RoutingSize-1)
+	}
+	out[0] = flags
+	copy(out[1:], ep)
+	return out, nil
+}
+
+// buildHeader fills beta and gamma from the last hop to the first. Every hop
+// prepends its routing block and the MAC for the next hop, then encrypts the
+// result, the bytes pushed out at the tail being replaced with the filler
+// each hop will regenerate.
+func buildHeader(p *Packet, keys []hopKeys, routing [][RoutingSize]byte) {
+	filler := generateFiller(keys[:len(keys)-1])
+
+	var beta [BetaSize]byte
+	_, _ = rand.Read(beta[:]) // never fails since Go 1.24
+
+	var gamma [MACSize]byte
+	for i := len(keys) - 1; i >= 0; i-- {
+		copy(beta[HopSize:], beta[:BetaSize-HopSize])
+		copy(beta[:RoutingSize], routing[i][:])
+		copy(beta[RoutingSize:HopSize], gamma[:])
+		xorKeyStream(beta[:], keys[i].rho)
+
+		if i == len(keys)-1 {
+			copy(beta[BetaSize-len(filler):], filler)
+		}
+		gamma = headerMAC(keys[i].mu, beta[:])
+	}
+
+	p.Beta, p.Gamma = beta, gamma
+}
+
+// generateFiller returns the bytes that the hops of keys append to beta,
+// as seen by the hop after them.
+func generateFiller(keys []hopKeys) []byte {
+	filler := make([]byte, 0, len(keys)*HopSize)
+	stream := make([]byte, BetaSize+HopSize)
+	for _, k := range keys {
+		filler = append(filler, make([]byte, HopSize)...)
+
+		clear(stream)
+		xorKeyStream(stream, k.rho)
+		for j := range filler {
+			filler[j] ^= stream[len(stream)-len(filler)+j]
+		}
+	}
+	return filler
+}
+
+// buildPayload lays out msg behind a zero tag and its length, then enciphers
+// it once per hop, the first hop last.
+func buildPayload(p *Packet, keys []hopKeys, msg []byte) error {
+	payload := p.Payload[:]
+	_, _ = rand.Read(payload) // never fails since Go 1.24
+	clear(payload[:payloadTagSize])
+	binary.BigEndian.PutUint16(payload[payloadTagSize:], uint16(len(msg)))
+	copy(payload[payloadTagSize+2:], msg)
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		l, err := newLioness(keys[i].pi)
+		if err != nil {
+			return err
+		}
+		l.encrypt(payload)
+	}
+	return nil
+}
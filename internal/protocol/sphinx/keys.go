@@ -0,0 +1,59 @@
+package sphinx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
+	"golang.org/x/crypto/curve25519"
+)
+
+// hopKeys are the keys derived from the secret shared with one hop.
+type hopKeys struct {
+	rho    [32]byte // routing header stream
+	mu     [32]byte // routing header MAC
+	pi     [32]byte // payload wide-block cipher
+	replay [16]byte // tag of the packet in the replay cache
+}
+
+func deriveKeys(secret []byte) (hopKeys, error) {
+	var k hopKeys
+	for _, d := range []struct {
+		dst  []byte
+		info string
+	}{
+		{k.rho[:], "DORv1:Sphinx:Rho"},
+		{k.mu[:], "DORv1:Sphinx:Mu"},
+		{k.pi[:], "DORv1:Sphinx:Pi"},
+		{k.replay[:], "DORv1:Sphinx:Replay"},
+	} {
+		b, err := crypto.HKDFSha256(secret, hkdfSalt, []byte(d.info))
+		if err != nil {
+			return k, err
+		}
+		copy(d.dst, b)
+	}
+	return k, nil
+}
+
+// blindingFactor is the scalar by which alpha is multiplied between a hop
+// and the next.
+func blindingFactor(alpha []byte, secret []byte) []byte {
+	h := sha256.New()
+	h.Write(alpha)
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+func blind(point []byte, factor []byte) ([]byte, error) {
+	return curve25519.X25519(factor, point)
+}
+
+func headerMAC(mu [32]byte, beta []byte) [MACSize]byte {
+	mac := hmac.New(sha256.New, mu[:])
+	mac.Write(beta)
+
+	var out [MACSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
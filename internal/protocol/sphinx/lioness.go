@@ -0,0 +1,81 @@
+package sphinx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
+	"golang.org/x/crypto/chacha20"
+)
+
+// lioness is the LIONESS wide-block cipher built from ChaCha20 and
+// HMAC-SHA256. Flipping any bit of a block scrambles the whole of it once
+// deciphered, which is what makes the payload non-malleable.
+type lioness struct {
+	k1, k2, k3, k4 [32]byte
+}
+
+var lionessInfo = [4][]byte{
+	[]byte("DORv1:Sphinx:LionessK1"),
+	[]byte("DORv1:Sphinx:LionessK2"),
+	[]byte("DORv1:Sphinx:LionessK3"),
+	[]byte("DORv1:Sphinx:LionessK4"),
+}
+
+func newLioness(key [32]byte) (*lioness, error) {
+	var l lioness
+	for i, k := range []*[32]byte{&l.k1, &l.k2, &l.k3, &l.k4} {
+		b, err := crypto.HKDFSha256(key[:], hkdfSalt, lionessInfo[i])
+		if err != nil {
+			return nil, err
+		}
+		copy(k[:], b)
+	}
+	return &l, nil
+}
+
+// streamXOR xors dst with the ChaCha20 keystream of key xored with left.
+func streamXOR(dst []byte, left []byte, key [32]byte) {
+	var k [32]byte
+	for i := range k {
+		k[i] = left[i] ^ key[i]
+	}
+	xorKeyStream(dst, k)
+}
+
+func hashXOR(left []byte, right []byte, key [32]byte) {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(right)
+	for i, b := range mac.Sum(nil) {
+		left[i] ^= b
+	}
+}
+
+// encrypt enciphers block in place. Blocks are longer than 32 bytes.
+func (l *lioness) encrypt(block []byte) {
+	left, right := block[:32], block[32:]
+	streamXOR(right, left, l.k1)
+	hashXOR(left, right, l.k2)
+	streamXOR(right, left, l.k3)
+	hashXOR(left, right, l.k4)
+}
+
+// decrypt deciphers block in place.
+func (l *lioness) decrypt(block []byte) {
+	left, right := block[:32], block[32:]
+	hashXOR(left, right, l.k4)
+	streamXOR(right, left, l.k3)
+	hashXOR(left, right, l.k2)
+	streamXOR(right, left, l.k1)
+}
+
+// xorKeyStream xors dst with the ChaCha20 keystream of key. Keys are never
+// reused, so the nonce is fixed.
+func xorKeyStream(dst []byte, key [32]byte) {
+	var nonce [chacha20.NonceSize]byte
+	c, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	if err != nil {
+		panic(err) // key and nonce sizes are constant
+	}
+	c.XORKeyStream(dst, dst)
+}
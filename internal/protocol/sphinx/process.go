@@ -0,0 +1,99 @@
+package sphinx
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	ErrInvalidMAC     = errors.New("sphinx header MAC mismatch")
+	ErrCorruptPayload = errors.New("sphinx payload corrupted")
+)
+
+// Processed is a packet once peeled by a relay.
+type Processed struct {
+	Next          identity.Endpoint
+	Exit          bool  // Next is the destination of Message
+	MixDelayClass uint8 // asked to this relay
+
+	Packet  *Packet // for Next, unless Exit
+	Message []byte  // if Exit
+
+	// ReplayTag identifies the packet among the ones processed with the same
+	// key; a relay drops the packets whose tag it has already seen.
+	ReplayTag [16]byte
+}
+
+// Process peels the layer of p meant for the relay of private key priv. p is
+// left untouched.
+func Process(priv [32]byte, p *Packet) (*Processed, error) {
+	secret, err := curve25519.X25519(priv[:], p.Alpha[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	keys, err := deriveKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := headerMAC(keys.mu, p.Beta[:])
+	if !hmac.Equal(mac[:], p.Gamma[:]) {
+		return nil, ErrInvalidMAC
+	}
+
+	var ext [BetaSize + HopSize]byte
+	copy(ext[:], p.Beta[:])
+	xorKeyStream(ext[:], keys.rho)
+
+	out := &Processed{
+		Exit:          ext[0]&FlagExit != 0,
+		MixDelayClass: ext[0] & FlagMixDelayClass,
+		ReplayTag:     keys.replay,
+	}
+	if _, err := out.Next.Parse(ext[1:RoutingSize]); err != nil {
+		return nil, fmt.Errorf("invalid next hop: %w", err)
+	}
+
+	payload := p.Payload
+	l, err := newLioness(keys.pi)
+	if err != nil {
+		return nil, err
+	}
+	l.decrypt(payload[:])
+
+	if out.Exit {
+		if out.Message, err = openPayload(payload[:]); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+
+	next := &Packet{Payload: payload}
+	alpha, err := blind(p.Alpha[:], blindingFactor(p.Alpha[:], secret))
+	if err != nil {
+		return nil, err
+	}
+	copy(next.Alpha[:], alpha)
+	copy(next.Gamma[:], ext[RoutingSize:HopSize])
+	copy(next.Beta[:], ext[HopSize:])
+	out.Packet = next
+	return out, nil
+}
+
+func openPayload(payload []byte) ([]byte, error) {
+	var zero [payloadTagSize]byte
+	if !hmac.Equal(payload[:payloadTagSize], zero[:]) {
+		return nil, ErrCorruptPayload
+	}
+	n := int(binary.BigEndian.Uint16(payload[payloadTagSize:]))
+	if n > MaxMessageSize {
+		return nil, ErrCorruptPayload
+	}
+	start := payloadTagSize + 2
+	return append([]byte(nil), payload[start:start+n]...), nil
+}
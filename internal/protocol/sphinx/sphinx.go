@@ -0,0 +1,89 @@
+// Package sphinx implements a Sphinx-style packet format, alongside the
+// layered onions of package onion.
+//
+// The routing header has the same size at every hop: each relay shifts out
+// its own routing block and refills the tail with bytes derived from its key,
+// so that a packet does not tell how far it is from the end of its path. The
+// group element is blinded at each hop instead of carrying one ephemeral key
+// per layer, and the payload is enciphered with a wide-block cipher, so any
+// tampering destroys it instead of flipping chosen bits.
+//
+// Every hop is a single relay: unlike onions, Sphinx packets cannot be
+// opened by any relay of a group.
+package sphinx
+
+import (
+	"fmt"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+const (
+	MaxHops = onion.MaxJump
+
+	// Flags (1) + next hop endpoint, zero-padded (19)
+	RoutingSize = 1 + 19
+	MACSize     = 32
+	HopSize     = RoutingSize + MACSize
+
+	BetaSize   = MaxHops * HopSize
+	HeaderSize = 32 + BetaSize + MACSize
+
+	PacketSize  = onion.PacketSize
+	PayloadSize = PacketSize - HeaderSize
+
+	// Zero tag (16) + message length (2)
+	payloadTagSize = 16
+	MaxMessageSize = PayloadSize - payloadTagSize - 2
+)
+
+// Routing flags, read by the relay a routing block is meant for.
+const (
+	FlagExit          = 0x80 // the next hop is the destination of the message
+	FlagMixDelayClass = 0x0F
+)
+
+var hkdfSalt = []byte("DORv1:Sphinx")
+
+// 0        7        15       23       31
+// +--------+--------+--------+--------+
+// ~        Alpha (32 bytes)           ~
+// +--------+--------+--------+--------+
+// ~  Beta (MaxHops * 52 bytes)        ~
+// +--------+--------+--------+--------+
+// ~        Gamma (32 bytes)           ~
+// +--------+--------+--------+--------+
+// ~  Payload (up to PacketSize)       ~
+// +--------+--------+--------+--------+
+//
+// Alpha   -> blinded group element, shared secret with the current hop
+// Beta    -> routing blocks (flags, next hop, next gamma) of the hops left,
+// .          encrypted, followed by filler
+// Gamma   -> HMAC of Beta for the current hop
+// Payload -> LIONESS-enciphered once per hop
+type Packet struct {
+	Alpha   [32]byte
+	Beta    [BetaSize]byte
+	Gamma   [MACSize]byte
+	Payload [PayloadSize]byte
+}
+
+func (p *Packet) Bytes() [PacketSize]byte {
+	var out [PacketSize]byte
+	n := copy(out[:], p.Alpha[:])
+	n += copy(out[n:], p.Beta[:])
+	n += copy(out[n:], p.Gamma[:])
+	copy(out[n:], p.Payload[:])
+	return out
+}
+
+func (p *Packet) Parse(data []byte) error {
+	if len(data) != PacketSize {
+		return fmt.Errorf("invalid sphinx packet size: got %d, want %d", len(data), PacketSize)
+	}
+	n := copy(p.Alpha[:], data)
+	n += copy(p.Beta[:], data[n:])
+	n += copy(p.Gamma[:], data[n:])
+	copy(p.Payload[:], data[n:])
+	return nil
+}
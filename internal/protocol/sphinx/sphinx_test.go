@@ -0,0 +1,264 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"golang.org/x/crypto/curve25519"
+)
+
+type testRelay struct {
+	priv  [32]byte
+	relay identity.Relay
+}
+
+func newTestPath(t *testing.T, n int) []testRelay {
+	t.Helper()
+
+	out := make([]testRelay, n)
+	for i := range out {
+		_, _ = rand.Read(out[i].priv[:])
+		pub, err := curve25519.X25519(out[i].priv[:], curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i].relay.Ep = identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: uint16(9000 + i)}
+		copy(out[i].relay.PubKey[:], pub)
+	}
+	return out
+}
+
+func relaysOf(path []testRelay) []identity.Relay {
+	out := make([]identity.Relay, len(path))
+	for i, r := range path {
+		out[i] = r.relay
+	}
+	return out
+}
+
+func TestBuildProcess_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("::1"), Port: 7000}
+
+	tests := []struct {
+		name string
+		hops int
+		msg  []byte
+	}{
+		{name: "single hop", hops: 1, msg: []byte("hello")},
+		{name: "three hops", hops: 3, msg: []byte("hello through three hops")},
+		{name: "max hops", hops: MaxHops, msg: bytes.Repeat([]byte{0xAB}, 1000)},
+		{name: "max message size", hops: 2, msg: bytes.Repeat([]byte{0x42}, MaxMessageSize)},
+		{name: "empty message", hops: 2, msg: []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := newTestPath(t, tt.hops)
+			p, err := Build(dest, relaysOf(path), tt.msg, WithMixDelay(3))
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			for i, r := range path {
+				data := p.Bytes()
+				if len(data) != PacketSize {
+					t.Fatalf("hop %d: packet size = %d, want %d", i, len(data), PacketSize)
+				}
+
+				out, err := Process(r.priv, p)
+				if err != nil {
+					t.Fatalf("hop %d: Process() error = %v", i, err)
+				}
+				if out.MixDelayClass != 3 {
+					t.Errorf("hop %d: mix delay class = %d, want 3", i, out.MixDelayClass)
+				}
+
+				if i < len(path)-1 {
+					if out.Exit {
+						t.Fatalf("hop %d: unexpected exit", i)
+					}
+					if out.Next.String() != path[i+1].relay.Ep.String() {
+						t.Fatalf("hop %d: next = %s, want %s", i, out.Next, path[i+1].relay.Ep)
+					}
+					p = out.Packet
+					continue
+				}
+
+				if !out.Exit {
+					t.Fatal("last hop: expected exit")
+				}
+				if out.Next.String() != dest.String() {
+					t.Errorf("next = %s, want %s", out.Next, dest)
+				}
+				if !bytes.Equal(out.Message, tt.msg) {
+					t.Errorf("message mismatch: got %d bytes, want %d", len(out.Message), len(tt.msg))
+				}
+			}
+		})
+	}
+}
+
+func TestBuild_Errors(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 7000}
+
+	tests := []struct {
+		name string
+		dest identity.Endpoint // dest when unset
+		hops int
+		msg  []byte
+		opts []BuildOption
+	}{
+		{name: "empty path", hops: 0, msg: []byte("x")},
+		{name: "too many hops", hops: MaxHops + 1, msg: []byte("x")},
+		{name: "message too large", hops: 1, msg: make([]byte, MaxMessageSize+1)},
+		{name: "mix delay class out of range", hops: 1, msg: []byte("x"), opts: []BuildOption{WithMixDelay(0x10)}},
+		{name: "domain too long for a routing block", dest: identity.Endpoint{Host: "mail.example.com", Port: 443}, hops: 1, msg: []byte("x")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dest := dest
+			if tt.dest.Port != 0 {
+				dest = tt.dest
+			}
+			if _, err := Build(dest, relaysOf(newTestPath(t, tt.hops)), tt.msg, tt.opts...); err == nil {
+				t.Fatal("Build() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestProcess_Tampering(t *testing.T) {
+	t.Parallel()
+
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 7000}
+
+	tests := []struct {
+		name   string
+		tamper func(p *Packet)
+		want   error
+	}{
+		{name: "beta", tamper: func(p *Packet) { p.Beta[10] ^= 1 }, want: ErrInvalidMAC},
+		{name: "gamma", tamper: func(p *Packet) { p.Gamma[0] ^= 1 }, want: ErrInvalidMAC},
+		{name: "payload", tamper: func(p *Packet) { p.Payload[100] ^= 1 }, want: ErrCorruptPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := newTestPath(t, 2)
+			p, err := Build(dest, relaysOf(path), []byte("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(p)
+
+			var perr error
+			for _, r := range path {
+				out, err := Process(r.priv, p)
+				if err != nil {
+					perr = err
+					break
+				}
+				p = out.Packet
+			}
+			if !errors.Is(perr, tt.want) {
+				t.Errorf("error = %v, want %v", perr, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcess_WrongKey(t *testing.T) {
+	t.Parallel()
+
+	path := newTestPath(t, 2)
+	p, err := Build(identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 7000}, relaysOf(path), []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Process(path[1].priv, p); !errors.Is(err, ErrInvalidMAC) {
+		t.Errorf("error = %v, want %v", err, ErrInvalidMAC)
+	}
+}
+
+func TestProcess_ReplayTagStable(t *testing.T) {
+	t.Parallel()
+
+	path := newTestPath(t, 1)
+	p, err := Build(identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 7000}, relaysOf(path), []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := Process(path[0].priv, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Process(path[0].priv, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ReplayTag != b.ReplayTag {
+		t.Error("replay tag differs between two copies of a packet")
+	}
+}
+
+func TestPacket_ParseBytes(t *testing.T) {
+	t.Parallel()
+
+	path := newTestPath(t, 1)
+	p, err := Build(identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 7000}, relaysOf(path), []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := p.Bytes()
+	var got Packet
+	if err := got.Parse(data[:]); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got != *p {
+		t.Error("Parse(Bytes()) mismatch")
+	}
+	if err := got.Parse(data[:PacketSize-1]); err == nil {
+		t.Error("Parse() of a short packet should fail")
+	}
+}
+
+func TestLioness_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var key [32]byte
+	_, _ = rand.Read(key[:])
+	l, err := newLioness(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make([]byte, PayloadSize)
+	_, _ = rand.Read(block)
+	orig := append([]byte(nil), block...)
+
+	l.encrypt(block)
+	if bytes.Equal(block, orig) {
+		t.Fatal("encrypt left the block unchanged")
+	}
+	l.decrypt(block)
+	if !bytes.Equal(block, orig) {
+		t.Fatal("decrypt(encrypt(b)) != b")
+	}
+}
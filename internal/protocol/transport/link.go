@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+// Dialer opens connections to the endpoints of relays and destinations.
+// Endpoints stay the identities of nodes, whatever carries the connection:
+// implementations map them to their own addresses. A stream-oriented
+// transport such as QUIC fits behind it by returning its streams as
+// net.Conn.
+type Dialer interface {
+	Dial(ep identity.Endpoint, timeout time.Duration) (net.Conn, error)
+}
+
+// Listener accepts the connections dialed to an endpoint, with the matching
+// Dialer.
+type Listener interface {
+	Listen(ep identity.Endpoint) (net.Listener, error)
+}
+
+// DialFunc adapts a function to a Dialer.
+type DialFunc func(ep identity.Endpoint, timeout time.Duration) (net.Conn, error)
+
+func (f DialFunc) Dial(ep identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+	return f(ep, timeout)
+}
+
+// ListenFunc adapts a function to a Listener.
+type ListenFunc func(ep identity.Endpoint) (net.Listener, error)
+
+func (f ListenFunc) Listen(ep identity.Endpoint) (net.Listener, error) {
+	return f(ep)
+}
+
+// TCP carries connections over TCP, to the address of the endpoint. It is the
+// default.
+type TCP struct{}
+
+func (TCP) Dial(ep identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+	return dialEndpoint(ep, timeout)
+}
+
+func (TCP) Listen(ep identity.Endpoint) (net.Listener, error) {
+	return net.Listen(ep.Network(), ep.String())
+}
+
+// Unix carries connections over Unix sockets, one per endpoint in Dir. It
+// suits relays running next to each other, or behind a sidecar forwarding
+// their traffic. Peers are seen without an IP address, so per-source limits
+// and guard registration do not apply to them.
+type Unix struct {
+	Dir string
+}
+
+// Path returns the socket of ep.
+func (u Unix) Path(ep identity.Endpoint) string {
+	host := ep.IP.String()
+	if ep.IsDomain() {
+		host = ep.Host
+	}
+	return filepath.Join(u.Dir, fmt.Sprintf("%s_%d.sock", host, ep.Port))
+}
+
+func (u Unix) Dial(ep identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+	if ep.IsDomain() {
+		return nil, ErrDomainEndpoint
+	}
+	d := net.Dialer{Timeout: timeout}
+	return d.Dial("unix", u.Path(ep))
+}
+
+// Listen listens on the socket of ep, replacing a stale one left by a
+// previous run.
+func (u Unix) Listen(ep identity.Endpoint) (net.Listener, error) {
+	path := u.Path(ep)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// serveOne accepts a single connection on ln and returns the packet read from
+// it.
+func serveOne(ln net.Listener) <-chan packet.Packet {
+	received := make(chan packet.Packet, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		if p, err := acceptAndRead(conn); err == nil {
+			received <- p
+		}
+	}()
+	return received
+}
+
+func TestLinks_Send(t *testing.T) {
+	t.Parallel()
+
+	mem, unix := NewMem(), Unix{Dir: t.TempDir()}
+	tests := []struct {
+		name     string
+		dialer   Dialer
+		listener Listener
+		ep       identity.Endpoint
+	}{
+		{
+			name:     "tcp",
+			dialer:   TCP{},
+			listener: TCP{},
+			ep:       identity.Endpoint{IP: net.ParseIP("127.0.0.1")},
+		},
+		{
+			name:     "unix",
+			dialer:   unix,
+			listener: unix,
+			ep:       identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 62503},
+		},
+		{
+			name:     "mem",
+			dialer:   mem,
+			listener: mem,
+			ep:       identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 62503},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ln, err := tt.listener.Listen(tt.ep)
+			if err != nil {
+				t.Fatalf("Listen() failed: %v", err)
+			}
+			defer func() { _ = ln.Close() }()
+
+			ep := tt.ep
+			if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+				ep.Port = uint16(addr.Port)
+			}
+			received := serveOne(ln)
+
+			tr := NewTransport(WithDialer(tt.dialer))
+			if err := tr.Send(ep, &packet.GetIdentityRequest{}); err != nil {
+				t.Fatalf("Send() failed: %v", err)
+			}
+
+			select {
+			case p := <-received:
+				if p.Type() != packet.TypeGetIdentityRequest {
+					t.Errorf("packet type mismatch:\n\tgot:  %d\n\twant: %d", p.Type(), packet.TypeGetIdentityRequest)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("packet not received")
+			}
+		})
+	}
+}
+
+func TestLinks_DialDomain(t *testing.T) {
+	t.Parallel()
+
+	unix := Unix{Dir: t.TempDir()}
+	ep := identity.Endpoint{Host: "localhost", Port: 62503}
+
+	// A listener on the socket the domain maps to must not be reached.
+	ln, err := unix.Listen(ep)
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	if got, want := unix.Path(ep), filepath.Join(unix.Dir, "localhost_62503.sock"); got != want {
+		t.Errorf("Path() mismatch:\n\tgot:  %s\n\twant: %s", got, want)
+	}
+
+	for name, d := range map[string]Dialer{"tcp": TCP{}, "unix": unix, "mem": NewMem()} {
+		if _, err := d.Dial(ep, time.Second); !errors.Is(err, ErrDomainEndpoint) {
+			t.Errorf("%s: Dial() error = %v, want %v", name, err, ErrDomainEndpoint)
+		}
+	}
+}
+
+func TestUnix_Listen_StaleSocket(t *testing.T) {
+	t.Parallel()
+
+	u := Unix{Dir: t.TempDir()}
+	ep := identity.Endpoint{IP: net.ParseIP("::1"), Port: 62503}
+
+	// A socket file left behind, as after a crash.
+	stale, err := net.Listen("unix", u.Path(ep))
+	if err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := u.Listen(ep)
+	if err != nil {
+		t.Fatalf("Listen() over a stale socket failed: %v", err)
+	}
+	_ = ln.Close()
+}
+
+func TestMem(t *testing.T) {
+	t.Parallel()
+
+	m := NewMem()
+	ep := identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 62503}
+	src := identity.Endpoint{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+
+	if _, err := m.Dial(ep, time.Second); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Dial() without listener: got %v, want %v", err, ErrUnreachable)
+	}
+
+	ln, err := m.Listen(ep)
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	if _, err := m.Listen(ep); err == nil {
+		t.Error("second Listen() on the same endpoint succeeded")
+	}
+
+	// Nobody accepts yet.
+	if _, err := m.From(src).Dial(ep, 10*time.Millisecond); err == nil {
+		t.Error("Dial() without Accept succeeded")
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := m.From(src).Dial(ep, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	server := <-accepted
+	defer func() { _ = server.Close() }()
+
+	if got, want := server.RemoteAddr().String(), src.String(); got != want {
+		t.Errorf("remote address mismatch:\n\tgot:  %s\n\twant: %s", got, want)
+	}
+	if got, want := conn.RemoteAddr().String(), ep.String(); got != want {
+		t.Errorf("remote address mismatch:\n\tgot:  %s\n\twant: %s", got, want)
+	}
+
+	_ = ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after Close: got %v, want %v", err, net.ErrClosed)
+	}
+	if m.Listening(ep) {
+		t.Error("endpoint still listening after Close")
+	}
+}
@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+// ErrUnreachable is returned by Mem when nothing listens on the dialed
+// endpoint.
+var ErrUnreachable = errors.New("host unreachable")
+
+// Mem carries connections in memory, between the dialers and listeners of
+// the same Mem. Connections report the TCP addresses of their endpoints, so
+// that relays see their peers as they would on a real network.
+type Mem struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	port      uint16 // last source port given to an anonymous dialer
+}
+
+func NewMem() *Mem {
+	return &Mem{listeners: make(map[string]*memListener)}
+}
+
+// Dial connects to ep from a fresh loopback source port.
+func (m *Mem) Dial(ep identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+	m.mu.Lock()
+	m.port++
+	src := identity.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 1024 + m.port%64512}
+	m.mu.Unlock()
+
+	return m.dial(src, ep, timeout)
+}
+
+// From returns a Dialer whose connections come from src.
+func (m *Mem) From(src identity.Endpoint) Dialer {
+	return DialFunc(func(ep identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+		return m.dial(src, ep, timeout)
+	})
+}
+
+func (m *Mem) dial(src, ep identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "mem", Source: tcpAddr(src), Addr: tcpAddr(ep), Err: err}
+	}
+	if ep.IsDomain() {
+		return nil, opErr(ErrDomainEndpoint)
+	}
+
+	m.mu.Lock()
+	l, ok := m.listeners[ep.String()]
+	m.mu.Unlock()
+	if !ok {
+		return nil, opErr(ErrUnreachable)
+	}
+
+	local, remote := net.Pipe()
+	client := &memConn{Conn: local, local: tcpAddr(src), remote: tcpAddr(ep)}
+	server := &memConn{Conn: remote, local: tcpAddr(ep), remote: tcpAddr(src)}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		_ = client.Close()
+		_ = server.Close()
+		return nil, opErr(ErrUnreachable)
+	case <-deadline:
+		_ = client.Close()
+		_ = server.Close()
+		return nil, opErr(os.ErrDeadlineExceeded)
+	}
+}
+
+// Listen accepts the connections dialed to ep until the listener is closed.
+func (m *Mem) Listen(ep identity.Endpoint) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.listeners[ep.String()]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: tcpAddr(ep), Err: errors.New("address already in use")}
+	}
+	l := &memListener{
+		m:     m,
+		ep:    ep,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	m.listeners[ep.String()] = l
+	return l, nil
+}
+
+// Listening reports whether something listens on ep.
+func (m *Mem) Listening(ep identity.Endpoint) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.listeners[ep.String()]
+	return ok
+}
+
+func tcpAddr(ep identity.Endpoint) *net.TCPAddr {
+	return &net.TCPAddr{IP: ep.IP, Port: int(ep.Port)}
+}
+
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+type memListener struct {
+	m  *Mem
+	ep identity.Endpoint
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+
+		l.m.mu.Lock()
+		if l.m.listeners[l.ep.String()] == l {
+			delete(l.m.listeners, l.ep.String())
+		}
+		l.m.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return tcpAddr(l.ep)
+}
@@ -1,38 +1,123 @@
 package transport
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
 )
 
+// ErrMissingCapability is returned when a packet needs a capability the peer
+// did not negotiate.
+var ErrMissingCapability = errors.New("peer lacks capability")
+
+// ErrDomainEndpoint is returned when dialing an endpoint given by domain.
+// Only the exit resolves domains, with its own resolver and exit policy.
+var ErrDomainEndpoint = errors.New("endpoint given by domain")
+
 type Transport struct {
 	dialTimeout  time.Duration
 	writeTimeout time.Duration
 	readTimeout  time.Duration
+
+	registry  *packet.Registry
+	handshake handshake.Config
+
+	dialer Dialer
+}
+
+type Option func(*Transport)
+
+// WithRegistry sets the packet registry used to encode requests and decode
+// responses. Defaults to packet.DefaultRegistry.
+func WithRegistry(reg *packet.Registry) Option {
+	return func(t *Transport) {
+		t.registry = reg
+	}
+}
+
+// WithHandshake sets the versions and capabilities offered in the Hello sent
+// on every new connection. Defaults to handshake.DefaultConfig().
+func WithHandshake(cfg handshake.Config) Option {
+	return func(t *Transport) {
+		t.handshake = cfg
+	}
+}
+
+// WithDialer sets how connections to endpoints are opened. Defaults to TCP.
+func WithDialer(d Dialer) Option {
+	return func(t *Transport) {
+		t.dialer = d
+	}
 }
 
 func dialEndpoint(ep identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+	if ep.IsDomain() {
+		return nil, ErrDomainEndpoint
+	}
 	d := net.Dialer{Timeout: timeout}
 	return d.Dial(ep.Network(), ep.String())
 }
 
-func NewTransport() *Transport {
-	return &Transport{
+func NewTransport(opts ...Option) *Transport {
+	t := &Transport{
 		dialTimeout:  3 * time.Second,
 		writeTimeout: 2 * time.Second,
 		readTimeout:  5 * time.Second,
+
+		registry:  packet.DefaultRegistry,
+		handshake: handshake.DefaultConfig(),
+
+		dialer: TCP{},
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
+	return t
 }
 
 func (t *Transport) dial(ep identity.Endpoint) (net.Conn, error) {
-	return dialEndpoint(ep, t.dialTimeout)
+	return t.dialer.Dial(ep, t.dialTimeout)
 }
 
-func (t *Transport) Send(ep identity.Endpoint, p packet.Packet) error {
+// connect dials ep and runs the version handshake on the new connection. A
+// peer that closes the connection on the Hello predates the handshake: when
+// legacy peers are allowed, it is dialed again and spoken to without one.
+// The connection is closed and an error returned when the negotiated session
+// lacks the capability needed to send p.
+func (t *Transport) connect(ep identity.Endpoint, p packet.Packet) (net.Conn, error) {
 	conn, err := t.dial(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := handshake.Initiate(conn, t.registry, t.handshake)
+	if err != nil {
+		_ = conn.Close()
+		if !t.handshake.AllowLegacy || !errors.Is(err, handshake.ErrPeerClosed) {
+			return nil, fmt.Errorf("handshake with %s failed: %w", ep.String(), err)
+		}
+		if conn, err = t.dial(ep); err != nil {
+			return nil, err
+		}
+		sess = handshake.Session{Version: handshake.VersionLegacy}
+	}
+
+	if need := handshake.Required(p.Type()); !sess.Capabilities.Has(need) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %s did not negotiate %s", ErrMissingCapability, ep.String(), need)
+	}
+
+	return conn, nil
+}
+
+func (t *Transport) Send(ep identity.Endpoint, p packet.Packet) error {
+	conn, err := t.connect(ep, p)
 	if err != nil {
 		return err
 	}
@@ -42,11 +127,11 @@ func (t *Transport) Send(ep identity.Endpoint, p packet.Packet) error {
 		return err
 	}
 
-	return packet.WritePacket(conn, p)
+	return packet.WritePacket(t.registry, conn, p)
 }
 
 func (t *Transport) Request(ep identity.Endpoint, req packet.Packet) (packet.Packet, error) {
-	conn, err := t.dial(ep)
+	conn, err := t.connect(ep, req)
 	if err != nil {
 		return nil, err
 	}
@@ -55,17 +140,84 @@ func (t *Transport) Request(ep identity.Endpoint, req packet.Packet) (packet.Pac
 	if err = conn.SetWriteDeadline(time.Now().Add(t.writeTimeout)); err != nil {
 		return nil, err
 	}
-	if err = packet.WritePacket(conn, req); err != nil {
+	if err = packet.WritePacket(t.registry, conn, req); err != nil {
 		return nil, err
 	}
 
 	if err = conn.SetReadDeadline(time.Now().Add(t.readTimeout)); err != nil {
 		return nil, err
 	}
-	resp, err := packet.ReadPacket(conn)
+	resp, err := packet.ReadPacket(t.registry, conn)
 	if err != nil {
 		return nil, err
 	}
 
 	return resp, nil
 }
+
+// SendResult is the outcome of sending a packet to one endpoint.
+type SendResult struct {
+	Ep  identity.Endpoint
+	Err error
+}
+
+// SendRedundant sends p to k of the endpoints in parallel, each sender moving
+// on to the next untried endpoint when its current one fails. With k <= 1 it
+// is a plain sequential failover. The results of every attempt are returned
+// in completion order.
+func (t *Transport) SendRedundant(eps []identity.Endpoint, k int, p packet.Packet) []SendResult {
+	return t.SendRedundantFunc(eps, k, func(identity.Endpoint) (packet.Packet, error) {
+		return p, nil
+	})
+}
+
+// SendRedundantFunc is SendRedundant with a packet built for each endpoint
+// by build, as when the packet is sealed for the relay it is sent to. A
+// build error counts as a failed attempt.
+func (t *Transport) SendRedundantFunc(eps []identity.Endpoint, k int, build func(identity.Endpoint) (packet.Packet, error)) []SendResult {
+	k = max(1, min(k, len(eps)))
+
+	next := make(chan identity.Endpoint, len(eps))
+	for _, ep := range eps {
+		next <- ep
+	}
+	close(next)
+
+	var (
+		mu      sync.Mutex
+		results []SendResult
+		wg      sync.WaitGroup
+	)
+	for range k {
+		wg.Go(func() {
+			for ep := range next {
+				p, err := build(ep)
+				if err == nil {
+					err = t.Send(ep, p)
+				}
+
+				mu.Lock()
+				results = append(results, SendResult{Ep: ep, Err: err})
+				mu.Unlock()
+
+				if err == nil {
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Delivered counts the successful results.
+func Delivered(results []SendResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Err == nil {
+			n++
+		}
+	}
+	return n
+}
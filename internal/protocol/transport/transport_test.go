@@ -1,14 +1,25 @@
 package transport
 
 import (
+	"errors"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
 )
 
+func acceptAndRead(conn net.Conn) (packet.Packet, error) {
+	_, p, err := handshake.Accept(conn, packet.DefaultRegistry, handshake.DefaultConfig())
+	if err != nil || p != nil {
+		return p, err
+	}
+	return packet.ReadPacket(packet.DefaultRegistry, conn)
+}
+
 func TestNewTransport(t *testing.T) {
 	t.Parallel()
 
@@ -124,7 +135,7 @@ func TestTransport_Send_WithMockServer(t *testing.T) {
 		}
 		defer func() { _ = conn.Close() }()
 
-		_, _ = packet.ReadPacket(conn)
+		_, _ = acceptAndRead(conn)
 	}()
 
 	addr := listener.Addr().(*net.TCPAddr)
@@ -144,6 +155,42 @@ func TestTransport_Send_WithMockServer(t *testing.T) {
 	<-done
 }
 
+func TestTransport_Send_WithDialer(t *testing.T) {
+	t.Parallel()
+
+	local, remote := net.Pipe()
+	received := make(chan packet.Packet, 1)
+	go func() {
+		defer func() { _ = remote.Close() }()
+		if p, err := acceptAndRead(remote); err == nil {
+			received <- p
+		}
+	}()
+
+	var dialed identity.Endpoint
+	tr := NewTransport(WithDialer(DialFunc(func(ep identity.Endpoint, _ time.Duration) (net.Conn, error) {
+		dialed = ep
+		return local, nil
+	})))
+
+	ep := identity.Endpoint{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+	if err := tr.Send(ep, &packet.GetIdentityRequest{}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if dialed.String() != ep.String() {
+		t.Errorf("dialed endpoint mismatch:\n\tgot:  %s\n\twant: %s", dialed, ep)
+	}
+
+	select {
+	case p := <-received:
+		if p.Type() != packet.TypeGetIdentityRequest {
+			t.Errorf("packet type mismatch:\n\tgot:  %d\n\twant: %d", p.Type(), packet.TypeGetIdentityRequest)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not received")
+	}
+}
+
 func TestTransport_Request_WithMockServer(t *testing.T) {
 	t.Parallel()
 
@@ -166,7 +213,7 @@ func TestTransport_Request_WithMockServer(t *testing.T) {
 		}
 		defer func() { _ = conn.Close() }()
 
-		_, err = packet.ReadPacket(conn)
+		_, err = acceptAndRead(conn)
 		if err != nil {
 			done <- err
 			return
@@ -177,7 +224,7 @@ func TestTransport_Request_WithMockServer(t *testing.T) {
 			PublicKey: testPubKey,
 		}
 
-		err = packet.WritePacket(conn, resp)
+		err = packet.WritePacket(packet.DefaultRegistry, conn, resp)
 		if err != nil {
 			done <- err
 			return
@@ -228,12 +275,15 @@ func TestTransport_Request_ServerClosesEarly(t *testing.T) {
 	}
 	defer func() { _ = listener.Close() }()
 
+	// The legacy fallback dials again after the first close.
 	go func() {
-		conn, err := listener.Accept()
-		if err != nil {
-			return
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
 		}
-		_ = conn.Close()
 	}()
 
 	addr := listener.Addr().(*net.TCPAddr)
@@ -271,7 +321,7 @@ func TestTransport_Send_MultiplePackets(t *testing.T) {
 				return
 			}
 
-			_, err = packet.ReadPacket(conn)
+			_, err = acceptAndRead(conn)
 			if err == nil {
 				packetsReceived++
 			}
@@ -358,7 +408,7 @@ func BenchmarkTransport_Send(b *testing.B) {
 			}
 			go func(c net.Conn) {
 				defer func() { _ = c.Close() }()
-				_, _ = packet.ReadPacket(c)
+				_, _ = acceptAndRead(c)
 			}(conn)
 		}
 	}()
@@ -396,13 +446,13 @@ func BenchmarkTransport_Request(b *testing.B) {
 			}
 			go func(c net.Conn) {
 				defer func() { _ = c.Close() }()
-				_, _ = packet.ReadPacket(c)
+				_, _ = acceptAndRead(c)
 
 				resp := &packet.GetIdentityResponse{
 					Ruuid:     testUUID,
 					PublicKey: testPubKey,
 				}
-				_ = packet.WritePacket(c, resp)
+				_ = packet.WritePacket(packet.DefaultRegistry, c, resp)
 			}(conn)
 		}
 	}()
@@ -421,3 +471,290 @@ func BenchmarkTransport_Request(b *testing.B) {
 		_, _ = tr.Request(ep, req)
 	}
 }
+
+func TestTransport_Send_VersionMismatch(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	received := make(chan bool, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		cfg := handshake.DefaultConfig()
+		cfg.MinVersion, cfg.MaxVersion = 0xF0, 0xFF
+		if _, _, err := handshake.Accept(conn, packet.DefaultRegistry, cfg); err != nil {
+			received <- false
+			return
+		}
+		_, err = packet.ReadPacket(packet.DefaultRegistry, conn)
+		received <- err == nil
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	ep := identity.Endpoint{
+		IP:   addr.IP,
+		Port: uint16(addr.Port),
+	}
+
+	err = NewTransport().Send(ep, &packet.GetIdentityRequest{})
+	if !errors.Is(err, handshake.ErrVersionMismatch) {
+		t.Fatalf("Send() error mismatch:\n\tgot:  %v\n\twant: %v", err, handshake.ErrVersionMismatch)
+	}
+
+	if <-received {
+		t.Error("packet must not be sent after a failed handshake")
+	}
+}
+
+func TestTransport_Request_LegacyPeer(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	testUUID := [16]byte{0x01, 0x02, 0x03, 0x04}
+
+	go func() {
+		// A relay that predates the handshake fails on the unknown Hello and
+		// drops the connection, then answers the request sent without one.
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = packet.ReadPacket(packet.DefaultRegistry, conn)
+		_ = conn.Close()
+
+		conn, err = listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		p, err := packet.ReadPacket(packet.DefaultRegistry, conn)
+		if err != nil {
+			return
+		}
+		if _, ok := p.(*packet.GetIdentityRequest); !ok {
+			return
+		}
+		_ = packet.WritePacket(packet.DefaultRegistry, conn, &packet.GetIdentityResponse{Ruuid: testUUID})
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	ep := identity.Endpoint{IP: addr.IP, Port: uint16(addr.Port)}
+
+	resp, err := NewTransport().Request(ep, &packet.GetIdentityRequest{})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if r, ok := resp.(*packet.GetIdentityResponse); !ok || r.Ruuid != testUUID {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	cfg := handshake.DefaultConfig()
+	cfg.AllowLegacy = false
+	if _, err := NewTransport(WithHandshake(cfg)).Request(deadHelloEndpoint(t), &packet.GetIdentityRequest{}); !errors.Is(err, handshake.ErrPeerClosed) {
+		t.Fatalf("Request() error mismatch:\n\tgot:  %v\n\twant: %v", err, handshake.ErrPeerClosed)
+	}
+}
+
+// deadHelloEndpoint returns an endpoint that closes every connection as soon
+// as it reads the Hello.
+func deadHelloEndpoint(t *testing.T) identity.Endpoint {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = packet.ReadPacket(packet.DefaultRegistry, conn)
+			_ = conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return identity.Endpoint{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestTransport_Send_MissingCapability(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	received := make(chan bool, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		cfg := handshake.DefaultConfig()
+		cfg.Capabilities = 0
+		if _, _, err := handshake.Accept(conn, packet.DefaultRegistry, cfg); err != nil {
+			received <- false
+			return
+		}
+		_, err = packet.ReadPacket(packet.DefaultRegistry, conn)
+		received <- err == nil
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	ep := identity.Endpoint{IP: addr.IP, Port: uint16(addr.Port)}
+
+	err = NewTransport().Send(ep, &packet.SphinxPacket{})
+	if !errors.Is(err, ErrMissingCapability) {
+		t.Fatalf("Send() error mismatch:\n\tgot:  %v\n\twant: %v", err, ErrMissingCapability)
+	}
+
+	if <-received {
+		t.Error("sphinx packet must not reach a peer without the capability")
+	}
+}
+
+// packetSink accepts connections on a local listener and counts the packets
+// received until the test ends.
+func packetSink(t *testing.T) (identity.Endpoint, func() int) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if _, err := acceptAndRead(conn); err == nil {
+					mu.Lock()
+					n++
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	ep := identity.Endpoint{IP: addr.IP, Port: uint16(addr.Port)}
+	return ep, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+func deadEndpoint(t *testing.T) identity.Endpoint {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	_ = listener.Close()
+
+	return identity.Endpoint{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestTransport_SendRedundant(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		k             int
+		wantDelivered int
+	}{
+		{name: "failover", k: 1, wantDelivered: 1},
+		{name: "two of three", k: 2, wantDelivered: 2},
+		{name: "k above live hops", k: 3, wantDelivered: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ep1, count1 := packetSink(t)
+			ep2, count2 := packetSink(t)
+			eps := []identity.Endpoint{deadEndpoint(t), ep1, ep2}
+
+			results := NewTransport().SendRedundant(eps, tt.k, &packet.GetIdentityRequest{})
+
+			if got := Delivered(results); got != tt.wantDelivered {
+				t.Fatalf("Delivered() = %d, want %d (results: %v)", got, tt.wantDelivered, results)
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for count1()+count2() != tt.wantDelivered {
+				if time.Now().After(deadline) {
+					t.Fatalf("packets received = %d, want %d", count1()+count2(), tt.wantDelivered)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestTransport_SendRedundantFunc(t *testing.T) {
+	t.Parallel()
+
+	ep1, count1 := packetSink(t)
+	ep2, count2 := packetSink(t)
+	eps := []identity.Endpoint{ep1, ep2}
+
+	// The packet cannot be built for ep1: the sender moves on to ep2.
+	results := NewTransport().SendRedundantFunc(eps, 1, func(ep identity.Endpoint) (packet.Packet, error) {
+		if ep.Port == ep1.Port {
+			return nil, errors.New("no packet for this hop")
+		}
+		return &packet.GetIdentityRequest{}, nil
+	})
+
+	if len(results) != 2 || results[0].Err == nil || results[1].Err != nil {
+		t.Fatalf("results mismatch: %v", results)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for count2() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("packets received on the second hop = %d, want 1", count2())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := count1(); n != 0 {
+		t.Errorf("packets received on the first hop = %d, want 0", n)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+)
+
+func listenLocal(t *testing.T) (net.Listener, identity.Endpoint) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	ep, err := identity.NewEndpoint("127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("NewEndpoint() failed: %v", err)
+	}
+	return ln, ep
+}
+
+// startTestServer serves a relay with a fresh identity on a local port
+// until the test ends. Its exit policy allows private addresses unless opts
+// set another.
+func startTestServer(t *testing.T, opts ...Option) (*Server, identity.Endpoint) {
+	t.Helper()
+
+	ln, ep := listenLocal(t)
+	exit := identity.DefaultExitPolicy()
+	exit.RejectPrivate = false // destinations are local
+	s := &Server{
+		ln:   ln,
+		ep:   ep,
+		Pi:   testPrivateIdentity(t),
+		exit: &exit,
+		stop: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return s, ep
+}
+
+func TestServer_DeliveryAck(t *testing.T) {
+	s, ep := startTestServer(t)
+
+	ackLn, ackEp := listenLocal(t)
+	defer func() { _ = ackLn.Close() }()
+
+	acks := make(chan *packet.DeliveryAck, 1)
+	go func() {
+		conn, err := ackLn.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, p, err := handshake.Accept(conn, packet.DefaultRegistry, handshake.DefaultConfig())
+		if err != nil {
+			return
+		}
+		if p == nil {
+			if p, err = packet.ReadPacket(packet.DefaultRegistry, conn); err != nil {
+				return
+			}
+		}
+		if ack, ok := p.(*packet.DeliveryAck); ok {
+			acks <- ack
+		}
+	}()
+
+	self := identity.Relay{Ep: ep, UUID: s.Pi.UUID, PubKey: s.Pi.PubKey}
+	path := func() []identity.CryptoGroup {
+		p := []identity.CryptoGroup{{Group: identity.RelayGroup{Relays: []identity.Relay{self}}}}
+		if err := p[0].GenerateCryptoMaterial(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	token := bytes.Repeat([]byte{0x5a}, 32)
+	req, err := onion.BuildAckRequest(ackEp, path(), token)
+	if err != nil {
+		t.Fatalf("BuildAckRequest() failed: %v", err)
+	}
+	ext, err := req.Extension()
+	if err != nil {
+		t.Fatalf("Extension() failed: %v", err)
+	}
+
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	layer, err := onion.BuildOnion(dest, path(), []byte("hello"), onion.WithExtensions(ext))
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+	raw, err := layer.BytesPadded()
+	if err != nil {
+		t.Fatalf("BytesPadded() failed: %v", err)
+	}
+	var pkt packet.OnionPacket
+	copy(pkt.Data[:], raw)
+
+	if err := transport.NewTransport().Send(ep, &pkt); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+
+	select {
+	case ack := <-acks:
+		if !bytes.Equal(ack.ID[:], token[:16]) || !bytes.Equal(ack.Tag[:], token[16:]) {
+			t.Fatalf("ack mismatch: %x %x", ack.ID, ack.Tag)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no ack received: %s", s.Metrics())
+	}
+
+	// The ack may reach us before the relay counts it.
+	deadline := time.Now().Add(time.Second)
+	for s.Metrics().AcksDelivered == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := s.Metrics(); m.AcksSent != 1 || m.AcksDelivered != 1 {
+		t.Errorf("metrics mismatch: %s", m)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/cover"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+// CoverConfig configures the cover traffic generated by the relay. Loop
+// onions cross Hops-1 peers and come back to be dropped by this relay; drop
+// onions cross Hops peers and are dropped by the last one.
+type CoverConfig struct {
+	LoopRate float64 // loop onions per second (0 = none)
+	DropRate float64 // drop onions per second (0 = none)
+	Hops     int
+
+	Peers []identity.Endpoint
+}
+
+// DefaultCoverConfig returns a disabled cover traffic configuration.
+func DefaultCoverConfig() CoverConfig {
+	return CoverConfig{
+		Hops: cover.DefaultHops,
+	}
+}
+
+func (c CoverConfig) enabled() bool {
+	return c.LoopRate > 0 || c.DropRate > 0
+}
+
+func (c CoverConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.LoopRate < 0 || c.DropRate < 0 {
+		return fmt.Errorf("cover rates cannot be negative")
+	}
+	if c.Hops < 1 || c.Hops > onion.MaxJump {
+		return fmt.Errorf("cover hops must be in [1, %d], got %d", onion.MaxJump, c.Hops)
+	}
+	if len(c.Peers) == 0 && (c.DropRate > 0 || c.Hops > 1) {
+		return fmt.Errorf("cover traffic needs at least one peer")
+	}
+	return nil
+}
+
+// WithCover makes the server emit loop and drop cover onions. Disabled by
+// default.
+func WithCover(cfg CoverConfig) Option {
+	return func(s *Server) {
+		s.cover = cfg
+	}
+}
+
+// coverLinks records, for every cover peer, whether the last onion relayed
+// to it was hybrid, for the cover sent to it to travel in the same packets.
+// It is built before the server starts and only its values change.
+type coverLinks map[string]*atomic.Bool
+
+func newCoverLinks(peers []identity.Endpoint) coverLinks {
+	l := make(coverLinks, len(peers))
+	for _, ep := range peers {
+		l[ep.String()] = new(atomic.Bool)
+	}
+	return l
+}
+
+// relayed notes the kind of the onion just relayed to ep.
+func (l coverLinks) relayed(ep identity.Endpoint, hybrid bool) {
+	if b, ok := l[ep.String()]; ok {
+		b.Store(hybrid)
+	}
+}
+
+func (l coverLinks) hybrid(ep identity.Endpoint) bool {
+	b, ok := l[ep.String()]
+	return ok && b.Load()
+}
+
+// coverGenerator is owned by the goroutine running it.
+type coverGenerator struct {
+	s   *Server
+	cfg CoverConfig
+
+	self  identity.Relay
+	peers map[string]identity.Relay // resolved peers, by endpoint
+}
+
+func (s *Server) runCover() {
+	g := &coverGenerator{
+		s:   s,
+		cfg: s.cover,
+		self: identity.Relay{
+			Ep:     s.ep,
+			UUID:   s.Pi.UUID,
+			PubKey: s.Pi.PubKey,
+		},
+		peers: make(map[string]identity.Relay),
+	}
+
+	rate := g.cfg.LoopRate + g.cfg.DropRate
+	timer := time.NewTimer(cover.Interval(rate))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+		}
+
+		loop := rand.Float64()*rate < g.cfg.LoopRate
+		if err := g.send(loop); err != nil {
+			logger.Debugf("cover packet not sent: %v", err)
+		}
+		timer.Reset(cover.Interval(rate))
+	}
+}
+
+// resolve fetches the identity of the peers not known yet.
+func (g *coverGenerator) resolve() []identity.Relay {
+	trans := g.s.transport()
+	for _, ep := range g.cfg.Peers {
+		if _, ok := g.peers[ep.String()]; ok {
+			continue
+		}
+
+		resp, err := trans.Request(ep, &packet.GetIdentityRequest{})
+		if err != nil {
+			logger.With("next_hop", ep.String()).Debugf("cover peer unreachable: %v", err)
+			continue
+		}
+		id, ok := resp.(*packet.GetIdentityResponse)
+		if !ok {
+			logger.With("next_hop", ep.String()).Debugf("cover peer: unexpected packet type %T", resp)
+			continue
+		}
+
+		r := identity.Relay{Ep: ep}
+		r.HydrateIdentity(id.Ruuid, id.PublicKey)
+		g.peers[ep.String()] = r
+	}
+
+	relays := make([]identity.Relay, 0, len(g.peers))
+	for _, r := range g.peers {
+		relays = append(relays, r)
+	}
+	return relays
+}
+
+func (g *coverGenerator) send(loop bool) error {
+	hops := g.cfg.Hops
+	if loop {
+		hops--
+	}
+
+	var path []identity.Relay
+	if hops > 0 {
+		var err error
+		path, err = cover.RandomPath(g.resolve(), hops)
+		if err != nil {
+			return err
+		}
+	}
+	if loop {
+		path = append(path, g.self)
+	}
+
+	entry := path[0]
+	hybrid := g.s.links.hybrid(entry.Ep)
+
+	var opts []onion.BuildOption
+	if hybrid {
+		opts = append(opts, onion.WithHybridKEM())
+	}
+	layer, groups, err := cover.BuildGroups(path, len(path)-1, opts...)
+	if err != nil {
+		return err
+	}
+	raw, err := layer.BytesPadded()
+	if err != nil {
+		return err
+	}
+
+	// Cover travels in the same packets as the onions relayed to the entry.
+	var pkt packet.Packet
+	if hybrid {
+		kemKey, err := g.s.nextHopKEMKeys().get(entry.Ep, g.s.fetchKEMKey)
+		if err != nil {
+			return fmt.Errorf("failed to get KEM key: %w", err)
+		}
+		secret, err := onion.HybridSecret(groups[0].CipherKey)
+		if err != nil {
+			return err
+		}
+		env, err := onion.SealHybridEnvelope(kemKey, secret)
+		if err != nil {
+			return err
+		}
+		hpkt := &packet.HybridOnionPacket{Envelope: env}
+		copy(hpkt.Data[:], raw)
+		pkt = hpkt
+	} else {
+		opkt := &packet.OnionPacket{}
+		copy(opkt.Data[:], raw)
+		pkt = opkt
+	}
+
+	if err := g.s.transport().Send(entry.Ep, pkt); err != nil {
+		// Resolve it again next time, its identity may have changed.
+		delete(g.peers, entry.Ep.String())
+		return err
+	}
+
+	if loop {
+		g.s.metrics.CoverLoopsSent.Add(1)
+	} else {
+		g.s.metrics.CoverDropsSent.Add(1)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"golang.org/x/crypto/curve25519"
+)
+
+func testPrivateIdentity(t *testing.T) *identity.PrivateIdentity {
+	t.Helper()
+
+	pi := &identity.PrivateIdentity{}
+	if _, err := rand.Read(pi.UUID[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(pi.PrivKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := curve25519.X25519(pi.PrivKey[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(pi.PubKey[:], pub)
+	return pi
+}
+
+func TestCoverConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	peer := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 62503}
+
+	tests := []struct {
+		name    string
+		cfg     CoverConfig
+		wantErr bool
+	}{
+		{name: "disabled", cfg: DefaultCoverConfig()},
+		{name: "loop to self only", cfg: CoverConfig{LoopRate: 1, Hops: 1}},
+		{name: "drop with peers", cfg: CoverConfig{DropRate: 1, Hops: 3, Peers: []identity.Endpoint{peer}}},
+		{name: "drop without peers", cfg: CoverConfig{DropRate: 1, Hops: 3}, wantErr: true},
+		{name: "loop without peers", cfg: CoverConfig{LoopRate: 1, Hops: 2}, wantErr: true},
+		{name: "too many hops", cfg: CoverConfig{LoopRate: 1, Hops: 6, Peers: []identity.Endpoint{peer}}, wantErr: true},
+		{name: "negative rate", cfg: CoverConfig{LoopRate: 1, DropRate: -1, Hops: 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_CoverLoop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+
+	ep, err := identity.NewEndpoint("127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("NewEndpoint() failed: %v", err)
+	}
+
+	s := &Server{
+		ln:    ln,
+		ep:    ep,
+		Pi:    testPrivateIdentity(t),
+		stop:  make(chan struct{}),
+		cover: CoverConfig{LoopRate: 1, Hops: 1},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx)
+		close(done)
+	}()
+
+	g := &coverGenerator{
+		s:     s,
+		cfg:   s.cover,
+		self:  identity.Relay{Ep: s.ep, UUID: s.Pi.UUID, PubKey: s.Pi.PubKey},
+		peers: make(map[string]identity.Relay),
+	}
+	if err := g.send(true); err != nil {
+		t.Fatalf("send() failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Metrics().CoverDropped == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("loop never came back: %s", s.Metrics())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if m := s.Metrics(); m.CoverLoopsSent == 0 {
+		t.Errorf("metrics mismatch: %s", m)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestServer_CoverMatchesLink(t *testing.T) {
+	for _, hybrid := range []bool{false, true} {
+		t.Run(fmt.Sprintf("hybrid=%t", hybrid), func(t *testing.T) {
+			received := make(chan uint8, 1)
+			record := func(s *Server) {
+				s.Use(func(next HandlerFunc) HandlerFunc {
+					return func(p packet.Packet, conn net.Conn, s *Server) {
+						if t := p.Type(); t == packet.TypeOnionPacket || t == packet.TypeHybridOnionPacket {
+							received <- t
+						}
+						next(p, conn, s)
+					}
+				})
+			}
+			peer, peerEp := startTestServer(t, withKEM(t), record)
+
+			s := &Server{
+				Pi:    testPrivateIdentity(t),
+				cover: CoverConfig{DropRate: 1, Hops: 1, Peers: []identity.Endpoint{peerEp}},
+			}
+			withKEM(t)(s)
+			s.links = newCoverLinks(s.cover.Peers)
+			s.links.relayed(peerEp, hybrid)
+
+			g := &coverGenerator{
+				s:     s,
+				cfg:   s.cover,
+				self:  identity.Relay{Ep: s.ep, UUID: s.Pi.UUID, PubKey: s.Pi.PubKey},
+				peers: make(map[string]identity.Relay),
+			}
+			if err := g.send(false); err != nil {
+				t.Fatalf("send() failed: %v", err)
+			}
+
+			want := packet.TypeOnionPacket
+			if hybrid {
+				want = packet.TypeHybridOnionPacket
+			}
+			select {
+			case got := <-received:
+				if got != want {
+					t.Fatalf("cover sent as packet type 0x%02x, want 0x%02x", got, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("cover never reached the peer")
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for peer.Metrics().CoverDropped == 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("cover never dropped: %s", peer.Metrics())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDedupSize is the default number of layers remembered.
+	DefaultDedupSize = 1 << 16
+	// DefaultDedupTTL is how long a layer is remembered by default. Copies
+	// sent in parallel arrive well within it.
+	DefaultDedupTTL = 2 * time.Minute
+)
+
+type dedupKey [16]byte
+
+// dedupCache remembers the onion layers already processed, so that copies
+// received from several relays of the previous group are handled once.
+// A nil *dedupCache remembers nothing.
+type dedupCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[dedupKey]time.Time
+
+	now func() time.Time
+}
+
+func newDedupCache(size int, ttl time.Duration) *dedupCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &dedupCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[dedupKey]time.Time),
+		now:     time.Now,
+	}
+}
+
+// layerKey identifies a layer by its header: the ephemeral key and the
+// payload nonce make it unique, the ciphertext is bound to it by the AEAD.
+func layerKey(header []byte) dedupKey {
+	sum := sha256.Sum256(header)
+	var k dedupKey
+	copy(k[:], sum[:])
+	return k
+}
+
+// seen records k and reports whether it was already there.
+func (c *dedupCache) seen(k dedupKey) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if exp, ok := c.entries[k]; ok && now.Before(exp) {
+		return true
+	}
+
+	if len(c.entries) >= c.size {
+		c.sweep(now)
+	}
+	c.entries[k] = now.Add(c.ttl)
+	return false
+}
+
+// sweep drops the expired entries then, if the cache is still full, the
+// eighth closest to expiry. Callers hold c.mu.
+func (c *dedupCache) sweep(now time.Time) {
+	for k, exp := range c.entries {
+		if !now.Before(exp) {
+			delete(c.entries, k)
+		}
+	}
+	if len(c.entries) < c.size {
+		return
+	}
+
+	type entry struct {
+		k   dedupKey
+		exp time.Time
+	}
+	all := make([]entry, 0, len(c.entries))
+	for k, exp := range c.entries {
+		all = append(all, entry{k, exp})
+	}
+	slices.SortFunc(all, func(a, b entry) int {
+		return a.exp.Compare(b.exp)
+	})
+
+	evict := max(1, len(all)-c.size*7/8)
+	for _, e := range all[:evict] {
+		delete(c.entries, e.k)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/cover"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
+)
+
+func TestDedupCache_seen(t *testing.T) {
+	t.Parallel()
+
+	c := newDedupCache(8, time.Minute)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	k := layerKey([]byte("layer"))
+	if c.seen(k) {
+		t.Fatal("first occurrence reported as seen")
+	}
+	if !c.seen(k) {
+		t.Fatal("second occurrence not reported as seen")
+	}
+
+	now = now.Add(time.Minute)
+	if c.seen(k) {
+		t.Fatal("expired entry reported as seen")
+	}
+}
+
+func TestDedupCache_Full(t *testing.T) {
+	t.Parallel()
+
+	c := newDedupCache(8, time.Minute)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	for i := range 100 {
+		now = now.Add(time.Millisecond)
+		c.seen(layerKey([]byte{byte(i)}))
+		if len(c.entries) > 8 {
+			t.Fatalf("cache grew to %d entries, max 8", len(c.entries))
+		}
+	}
+
+	// The most recent layer is still remembered.
+	if !c.seen(layerKey([]byte{99})) {
+		t.Fatal("most recent entry evicted")
+	}
+}
+
+func TestDedupCache_Nil(t *testing.T) {
+	t.Parallel()
+
+	if c := newDedupCache(0, time.Minute); c != nil {
+		t.Fatal("zero size should disable the cache")
+	}
+
+	var c *dedupCache
+	k := layerKey([]byte("layer"))
+	if c.seen(k) || c.seen(k) {
+		t.Fatal("nil cache should never report a layer as seen")
+	}
+}
+
+func TestHandleOnionPacket_Duplicate(t *testing.T) {
+	t.Parallel()
+
+	pi := testPrivateIdentity(t)
+	s := &Server{
+		Pi:    pi,
+		dedup: newDedupCache(DefaultDedupSize, DefaultDedupTTL),
+	}
+
+	self := identity.Relay{
+		Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 62503},
+		UUID:   pi.UUID,
+		PubKey: pi.PubKey,
+	}
+	layer, err := cover.Build([]identity.Relay{self}, 0)
+	if err != nil {
+		t.Fatalf("cover.Build() failed: %v", err)
+	}
+
+	// The previous group pads each copy with its own random bytes.
+	for range 2 {
+		raw, err := layer.BytesPadded()
+		if err != nil {
+			t.Fatalf("BytesPadded() failed: %v", err)
+		}
+		var pkt packet.OnionPacket
+		copy(pkt.Data[:], raw)
+
+		handleOnionPacket(&pkt, testutil.NewMockConn(nil), s)
+	}
+
+	m := s.Metrics()
+	if m.CoverDropped != 1 || m.DuplicatesDropped != 1 {
+		t.Fatalf("metrics mismatch: %s", m)
+	}
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
+)
+
+func TestHandleGetExitPolicy(t *testing.T) {
+	t.Parallel()
+
+	web, err := identity.ParseExitPolicy("accept *:80, accept *:443", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		exit *identity.ExitPolicy
+		want identity.ExitSummary
+	}{
+		{
+			name: "default",
+			want: identity.DefaultExitPolicy().Summary(),
+		},
+		{
+			name: "web only",
+			exit: &web,
+			want: identity.ExitSummary{
+				RejectPrivate: true,
+				IPv4:          []identity.PortRange{{Min: 80, Max: 80}, {Min: 443, Max: 443}},
+				IPv6:          []identity.PortRange{{Min: 80, Max: 80}, {Min: 443, Max: 443}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &Server{exit: tt.exit}
+			conn := testutil.NewMockConn([]byte{})
+
+			handleGetExitPolicy(&packet.GetExitPolicyRequest{}, conn, s)
+
+			p, err := packet.ReadPacket(packet.DefaultRegistry, bytes.NewReader(conn.GetWrittenBytes()))
+			if err != nil {
+				t.Fatalf("ReadPacket() failed: %v", err)
+			}
+			resp, ok := p.(*packet.GetExitPolicyResponse)
+			if !ok {
+				t.Fatalf("got %T, want *packet.GetExitPolicyResponse", p)
+			}
+			if !bytes.Equal(resp.Summary, tt.want.Bytes()) {
+				t.Fatalf("summary mismatch:\n\tgot:  %x\n\twant: %x", resp.Summary, tt.want.Bytes())
+			}
+		})
+	}
+}
+
+// acceptAck returns the first delivery ack received on ln.
+func acceptAck(ln net.Listener) <-chan *packet.DeliveryAck {
+	acks := make(chan *packet.DeliveryAck, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, p, err := handshake.Accept(conn, packet.DefaultRegistry, handshake.DefaultConfig())
+		if err != nil {
+			return
+		}
+		if p == nil {
+			if p, err = packet.ReadPacket(packet.DefaultRegistry, conn); err != nil {
+				return
+			}
+		}
+		if ack, ok := p.(*packet.DeliveryAck); ok {
+			acks <- ack
+		}
+	}()
+	return acks
+}
+
+func TestServer_ExitPolicyRejected(t *testing.T) {
+	var delivered atomic.Bool
+	s, ep := startTestServer(t,
+		WithExitPolicy(identity.DefaultExitPolicy()),
+		WithDeliver(func(identity.Endpoint, []byte) { delivered.Store(true) }),
+	)
+
+	ackLn, ackEp := listenLocal(t)
+	defer func() { _ = ackLn.Close() }()
+	acks := acceptAck(ackLn)
+
+	self := identity.Relay{Ep: ep, UUID: s.Pi.UUID, PubKey: s.Pi.PubKey}
+	path := func() []identity.CryptoGroup {
+		p := []identity.CryptoGroup{{Group: identity.RelayGroup{Relays: []identity.Relay{self}}}}
+		if err := p[0].GenerateCryptoMaterial(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	req, err := onion.BuildAckRequest(ackEp, path(), bytes.Repeat([]byte{0x7e}, 32))
+	if err != nil {
+		t.Fatalf("BuildAckRequest() failed: %v", err)
+	}
+	ext, err := req.Extension()
+	if err != nil {
+		t.Fatalf("Extension() failed: %v", err)
+	}
+
+	// Loopback is private: the payload must be dropped, and not acknowledged.
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	layer, err := onion.BuildOnion(dest, path(), []byte("hello"), onion.WithExtensions(ext))
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+	raw, err := layer.BytesPadded()
+	if err != nil {
+		t.Fatalf("BytesPadded() failed: %v", err)
+	}
+	var pkt packet.OnionPacket
+	copy(pkt.Data[:], raw)
+
+	if err := transport.NewTransport().Send(ep, &pkt); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for s.Metrics().ExitRejected == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := s.Metrics(); m.ExitRejected != 1 || m.AcksSent != 0 {
+		t.Fatalf("metrics mismatch: %s", m)
+	}
+	if delivered.Load() {
+		t.Error("payload delivered despite the exit policy")
+	}
+	select {
+	case <-acks:
+		t.Error("rejected payload acknowledged")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// fakeResolver maps domains to addresses, failing for the others.
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestDeliverPayload_Domain(t *testing.T) {
+	t.Parallel()
+
+	dns := fakeResolver{
+		"public.example":  {netip.MustParseAddr("93.184.216.34")},
+		"private.example": {netip.MustParseAddr("10.0.0.1")},
+		"mixed.example":   {netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("2606:2800:220:1::1")},
+		"mapped.example":  {netip.MustParseAddr("::ffff:93.184.216.34")},
+	}
+
+	tests := []struct {
+		name     string
+		host     string
+		expected string // delivered destination, "" when dropped
+		rejected uint64
+		failed   uint64
+	}{
+		{name: "public", host: "public.example", expected: "93.184.216.34:443"},
+		{name: "private", host: "private.example", rejected: 1},
+		{name: "first allowed address", host: "mixed.example", expected: "[2606:2800:220:1::1]:443"},
+		{name: "IPv4-mapped", host: "mapped.example", expected: "93.184.216.34:443"},
+		{name: "unknown", host: "unknown.example", failed: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got string
+			s := &Server{
+				dns:     dns,
+				deliver: func(dest identity.Endpoint, _ []byte) { got = dest.String() },
+			}
+			dest := identity.Endpoint{Host: tt.host, Port: 443}
+
+			ok := deliverPayload(context.Background(), dest, []byte("hello"), s, testutil.NewMockConn(nil))
+			if ok != (tt.expected != "") || got != tt.expected {
+				t.Errorf("delivery mismatch:\n\tgot:  %t %q\n\twant: %q", ok, got, tt.expected)
+			}
+			if m := s.Metrics(); m.ExitRejected != tt.rejected || m.ResolveFailed != tt.failed {
+				t.Errorf("metrics mismatch: %s", m)
+			}
+		})
+	}
+}
+
+// slowResolver answers with addr once release is closed, failing if the
+// lookup times out first.
+type slowResolver struct {
+	release chan struct{}
+	addr    netip.Addr
+}
+
+func (r slowResolver) LookupNetIP(ctx context.Context, _, _ string) ([]netip.Addr, error) {
+	select {
+	case <-r.release:
+		return []netip.Addr{r.addr}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDeliverPayload_ResolveTimeout(t *testing.T) {
+	t.Parallel()
+
+	delivered := false
+	s := &Server{
+		dns:        slowResolver{release: make(chan struct{})},
+		dnsTimeout: 50 * time.Millisecond,
+		deliver:    func(identity.Endpoint, []byte) { delivered = true },
+	}
+	dest := identity.Endpoint{Host: "slow.example", Port: 443}
+
+	start := time.Now()
+	if deliverPayload(context.Background(), dest, []byte("hello"), s, testutil.NewMockConn(nil)) || delivered {
+		t.Fatal("payload delivered without an address")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("lookup not bounded: returned after %s", d)
+	}
+	if m := s.Metrics(); m.ResolveFailed != 1 {
+		t.Errorf("metrics mismatch: %s", m)
+	}
+}
+
+func TestWhenResolved(t *testing.T) {
+	t.Parallel()
+
+	dns := slowResolver{release: make(chan struct{}), addr: netip.MustParseAddr("93.184.216.34")}
+	var delivered atomic.Int64
+	s := &Server{
+		dns:     dns,
+		deliver: func(identity.Endpoint, []byte) { delivered.Add(1) },
+	}
+	dest := identity.Endpoint{Host: "slow.example", Port: 443}
+	conn := testutil.NewMockConn(nil)
+
+	// The lookups hold neither the caller, a worker of the pool, nor each
+	// other, up to DefaultResolveConcurrency of them.
+	done := make(chan struct{})
+	go func() {
+		for range DefaultResolveConcurrency + 1 {
+			s.whenResolved(dest, conn, func(ctx context.Context) { deliverPayload(ctx, dest, nil, s, conn) })
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("whenResolved() blocked on the lookup")
+	}
+	if m := s.Metrics(); m.ResolveFailed != 1 {
+		t.Errorf("lookup past the bound not dropped: %s", m)
+	}
+
+	close(dns.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for delivered.Load() != DefaultResolveConcurrency {
+		if time.Now().After(deadline) {
+			t.Fatalf("delivered %d payloads, want %d", delivered.Load(), DefaultResolveConcurrency)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWhenResolved_Close(t *testing.T) {
+	t.Parallel()
+
+	var delivered atomic.Bool
+	s := &Server{
+		dns:     slowResolver{release: make(chan struct{})},
+		deliver: func(identity.Endpoint, []byte) { delivered.Store(true) },
+		stop:    make(chan struct{}),
+	}
+	dest := identity.Endpoint{Host: "slow.example", Port: 443}
+	conn := testutil.NewMockConn(nil)
+
+	var returned atomic.Bool
+	s.whenResolved(dest, conn, func(ctx context.Context) {
+		defer returned.Store(true)
+		deliverPayload(ctx, dest, nil, s, conn)
+	})
+
+	start := time.Now()
+	if err := s.close(); err != nil {
+		t.Fatalf("close() failed: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("close() waited for the lookup timeout: returned after %s", d)
+	}
+	if !returned.Load() {
+		t.Fatal("close() returned before the pending delivery")
+	}
+	if delivered.Load() {
+		t.Fatal("payload delivered after close")
+	}
+}
+
+func TestSendOnion_DomainNextHop(t *testing.T) {
+	t.Parallel()
+
+	var dialed atomic.Bool
+	s := &Server{dialer: transport.DialFunc(func(identity.Endpoint, time.Duration) (net.Conn, error) {
+		dialed.Store(true)
+		return nil, transport.ErrUnreachable
+	})}
+
+	next := []identity.Endpoint{{Host: "relay.example", Port: 62503}}
+	sendOnion(&onion.OnionLayer{}, next, 1, 0, nil, s, testutil.NewMockConn(nil))
+	if dialed.Load() {
+		t.Error("next hop given by domain dialed")
+	}
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
 )
 
@@ -16,51 +20,241 @@ type HandlerFunc func(
 	s *Server,
 )
 
-var handlerRegistry = map[uint8]HandlerFunc{
-	packet.TypeGetIdentityRequest: handleGetIdentity,
-	packet.TypeOnionPacket:        handleOnionPacket,
+// Middleware wraps a HandlerFunc. Middlewares registered with Server.Use are
+// applied to every dispatch, the first registered being the outermost.
+type Middleware func(HandlerFunc) HandlerFunc
+
+var defaultHandlers = map[uint8]HandlerFunc{
+	packet.TypeGetIdentityRequest:   handleGetIdentity,
+	packet.TypeGetExitPolicyRequest: handleGetExitPolicy,
+	packet.TypeOnionPacket:          handleOnionPacket,
+	packet.TypeSphinxPacket:         handleSphinxPacket,
+	packet.TypeHybridOnionPacket:    handleHybridOnionPacket,
+
+	packet.TypeServiceLookupRequest: handleServiceLookup,
+	packet.TypeGuardRegister:        handleGuardRegister,
+}
+
+// Handle registers h for the given packet type, replacing any previous
+// handler (built-in ones included). A nil handler unregisters the type.
+func (s *Server) Handle(packetType uint8, h HandlerFunc) {
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+
+	if s.handlers == nil {
+		s.handlers = maps.Clone(defaultHandlers)
+	}
+
+	if h == nil {
+		delete(s.handlers, packetType)
+	} else {
+		s.handlers[packetType] = h
+	}
+	s.compose()
+}
+
+// Use appends middlewares to the chain applied around every handler.
+func (s *Server) Use(mw ...Middleware) {
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+
+	s.middlewares = append(s.middlewares, mw...)
+	s.compose()
+}
+
+// compose wraps every handler in the middlewares once, so that dispatching
+// a packet is a lookup. It is called with hmu held.
+func (s *Server) compose() {
+	handlers := s.handlers
+	if handlers == nil {
+		handlers = defaultHandlers
+	}
+
+	s.chain = make(map[uint8]HandlerFunc, len(handlers))
+	for t, h := range handlers {
+		for i := len(s.middlewares) - 1; i >= 0; i-- {
+			h = s.middlewares[i](h)
+		}
+		s.chain[t] = h
+	}
+}
+
+func (s *Server) handler(packetType uint8) (HandlerFunc, bool) {
+	s.hmu.RLock()
+	defer s.hmu.RUnlock()
+
+	chain := s.chain
+	if chain == nil {
+		chain = defaultHandlers
+	}
+	h, ok := chain[packetType]
+	return h, ok
+}
+
+// peerConn is the connection handed to handlers once the handshake is done.
+// Writes are serialized so that concurrent handlers never interleave frames.
+type peerConn struct {
+	net.Conn
+	session handshake.Session
+	log     *logger.Entry
+
+	wmu sync.Mutex
+}
+
+func (pc *peerConn) Write(b []byte) (int, error) {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	return pc.Conn.Write(b)
+}
+
+// packetConn is the connection handed to the handler of one packet, logging
+// with the correlation ID of that packet.
+type packetConn struct {
+	net.Conn
+	log *logger.Entry
+}
+
+// withLog returns conn logging with log for the rest of the handling of a
+// packet.
+func withLog(conn net.Conn, log *logger.Entry) net.Conn {
+	if pc, ok := conn.(*packetConn); ok {
+		conn = pc.Conn
+	}
+	return &packetConn{Conn: conn, log: log}
+}
+
+// PeerSession returns the handshake outcome of a connection given to a
+// HandlerFunc.
+func PeerSession(conn net.Conn) (handshake.Session, bool) {
+	if pc, ok := conn.(*packetConn); ok {
+		conn = pc.Conn
+	}
+	pc, ok := conn.(*peerConn)
+	if !ok {
+		return handshake.Session{}, false
+	}
+	return pc.session, true
+}
+
+// connLog returns the log entry of a connection given to a HandlerFunc, with
+// its correlation IDs, or one with the remote address of other connections.
+func connLog(conn net.Conn) *logger.Entry {
+	switch c := conn.(type) {
+	case *packetConn:
+		return c.log
+	case *peerConn:
+		return c.log
+	}
+	return logger.With("remote", conn.RemoteAddr().String())
 }
 
-func (s *Server) handleConn(conn net.Conn) {
+func (s *Server) handleConn(rawConn net.Conn) {
 	var wg sync.WaitGroup
 
+	log := logger.With("conn", logger.NewID(), "remote", rawConn.RemoteAddr().String())
+
 	defer func() {
 		wg.Wait()
 
-		if err := conn.Close(); err != nil {
-			logger.Warnf("error closing connection: %v", err)
+		if err := rawConn.Close(); err != nil {
+			log.Warnf("error closing connection: %v", err)
 		}
 	}()
 
-	remote := conn.RemoteAddr().String()
+	sess, first, err := handshake.Accept(rawConn, s.packets(), s.handshakeConfig())
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Warnf("handshake failed: %v", err)
+		}
+		return
+	}
+	log.Debugf("handshake done %s", sess)
+
+	conn := &peerConn{Conn: rawConn, session: sess, log: log}
 
 	for {
-		pkt, err := packet.ReadPacket(conn)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return // remote closed the connection
+		// A legacy peer's first packet was already read in place of a Hello.
+		pkt := first
+		first = nil
+		if pkt == nil {
+			pkt, err = packet.ReadPacket(s.packets(), conn)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return // remote closed the connection
+				}
+				log.Warnf("read packet failed: %v", err)
+				return
 			}
-			logger.Warnf("[%s] read packet failed: %v", remote, err)
+		}
+
+		plog := log.With("packet", logger.NewID(), "type", fmt.Sprintf("0x%02x", pkt.Type()))
+
+		if need := handshake.Required(pkt.Type()); !sess.Capabilities.Has(need) {
+			plog.Warnf("packet needs capability %s, not negotiated", need)
 			return
 		}
 
-		h, ok := handlerRegistry[pkt.Type()]
+		if !s.limiter.allowPacket(rawConn.RemoteAddr()) {
+			s.metrics.PacketsRateLimited.Add(1)
+			s.warnDropped(plog)
+			plog.Debugf("packet dropped: rate limit exceeded")
+			continue
+		}
+
+		h, ok := s.handler(pkt.Type())
 		if !ok {
-			logger.Warnf("[%s] no handler for packet type 0x%02x", remote, pkt.Type())
+			plog.Warnf("no handler for packet type")
 			return
 		}
 
-		wg.Add(1)
-		go func(p packet.Packet) {
-			defer wg.Done()
+		if !s.limiter.tryAcquireHandler() {
+			s.metrics.HandlersThrottled.Add(1)
+			if !s.limiter.acquireHandler(s.stop) {
+				return // server stopping
+			}
+		}
 
+		run := func() {
+			defer s.limiter.releaseHandler()
+
+			start := time.Now()
 			defer func() {
 				if r := recover(); r != nil {
-					logger.Errorf("[%s] PANIC in handler: %v", remote, r)
+					plog.Errorf("PANIC in handler: %v", r)
+					return
 				}
+				plog.With("duration", time.Since(start)).Debugf("packet handled")
 			}()
 
-			h(p, conn, s)
-		}(pkt)
+			h(pkt, withLog(conn, plog), s)
+		}
+
+		// Onion, hybrid onion and Sphinx packets carry the costly crypto work
+		// and go through the pool; the other packets are cheap and answered
+		// in order on this goroutine.
+		var costly bool
+		switch pkt.Type() {
+		case packet.TypeOnionPacket, packet.TypeHybridOnionPacket, packet.TypeSphinxPacket:
+			costly = true
+		}
+		if !costly || s.pool == nil {
+			run()
+			continue
+		}
+
+		wg.Add(1)
+		job := func() {
+			defer wg.Done()
+			run()
+		}
+
+		if !s.pool.trySubmit(job) {
+			s.metrics.QueueFull.Add(1)
+			if !s.pool.submit(s.stop, job) {
+				wg.Done()
+				s.limiter.releaseHandler()
+				return // server stopping
+			}
+		}
 	}
 }
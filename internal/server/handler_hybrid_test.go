@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
+)
+
+// withKEM gives the server a fresh ML-KEM key.
+func withKEM(t *testing.T) Option {
+	t.Helper()
+
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(s *Server) {
+		s.Pi.KEM = dk
+	}
+}
+
+func TestHandleGetIdentity_KEMKey(t *testing.T) {
+	t.Parallel()
+
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		kem  *mlkem.DecapsulationKey768
+		caps handshake.Capability
+		want []byte
+	}{
+		{name: "hybrid peer", kem: dk, caps: handshake.CapHybrid, want: dk.EncapsulationKey().Bytes()},
+		{name: "classic peer", kem: dk, caps: handshake.CapSphinx, want: nil},
+		{name: "no KEM key", kem: nil, caps: handshake.CapHybrid, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &Server{Pi: &identity.PrivateIdentity{KEM: tt.kem}}
+			mock := testutil.NewMockConn([]byte{})
+			conn := &peerConn{Conn: mock, session: handshake.Session{Version: handshake.Version1, Capabilities: tt.caps}}
+
+			handleGetIdentity(&packet.GetIdentityRequest{}, conn, s)
+
+			p, err := packet.ReadPacket(packet.DefaultRegistry, bytes.NewReader(mock.GetWrittenBytes()))
+			if err != nil {
+				t.Fatalf("ReadPacket() failed: %v", err)
+			}
+			resp, ok := p.(*packet.GetIdentityResponse)
+			if !ok {
+				t.Fatalf("got %T, want *packet.GetIdentityResponse", p)
+			}
+			if !bytes.Equal(resp.KEMKey, tt.want) {
+				t.Fatalf("KEM key mismatch: got %d bytes, want %d", len(resp.KEMKey), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestServer_HybridOnion(t *testing.T) {
+	delivered := make(chan []byte, 1)
+	entry, entryEp := startTestServer(t, withKEM(t))
+	exit, exitEp := startTestServer(t, withKEM(t),
+		WithDeliver(func(_ identity.Endpoint, payload []byte) { delivered <- payload }),
+	)
+
+	ackLn, ackEp := listenLocal(t)
+	defer func() { _ = ackLn.Close() }()
+	acks := acceptAck(ackLn)
+
+	relay := func(s *Server, ep identity.Endpoint) identity.Relay {
+		return identity.Relay{Ep: ep, UUID: s.Pi.UUID, PubKey: s.Pi.PubKey, KEMKey: s.Pi.KEMKey()}
+	}
+	path := func(relays ...identity.Relay) []identity.CryptoGroup {
+		p := make([]identity.CryptoGroup, len(relays))
+		for i, r := range relays {
+			p[i].Group.Relays = []identity.Relay{r}
+			if err := p[i].GenerateCryptoMaterial(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return p
+	}
+
+	// The exit sends the hybrid reply onion back through the entry relay,
+	// sealing the secret it is given for it.
+	replyPath := path(relay(entry, entryEp))
+	token := bytes.Repeat([]byte{0x42}, 32)
+	req, err := onion.BuildAckRequest(ackEp, replyPath, token, onion.WithHybridKEM())
+	if err != nil {
+		t.Fatalf("BuildAckRequest() failed: %v", err)
+	}
+	ext, err := req.Extension()
+	if err != nil {
+		t.Fatalf("Extension() failed: %v", err)
+	}
+	replySecret, err := onion.HybridSecret(replyPath[0].CipherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward := path(relay(entry, entryEp), relay(exit, exitEp))
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	payload := []byte("hello")
+	layer, err := onion.BuildOnion(dest, forward, payload, onion.WithHybridKEM(),
+		onion.WithExtensions(ext, onion.HybridSecretExtension(replySecret)),
+	)
+	if err != nil {
+		t.Fatalf("BuildOnion() failed: %v", err)
+	}
+	raw, err := layer.BytesPadded()
+	if err != nil {
+		t.Fatalf("BytesPadded() failed: %v", err)
+	}
+	secret, err := onion.HybridSecret(forward[0].CipherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := onion.SealHybridEnvelope(entry.Pi.KEMKey(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := &packet.HybridOnionPacket{Envelope: env}
+	copy(pkt.Data[:], raw)
+
+	if err := transport.NewTransport().Send(entryEp, pkt); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+
+	select {
+	case got := <-delivered:
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("payload mismatch: got %q, want %q", got, payload)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("payload never delivered: entry=%s exit=%s", entry.Metrics(), exit.Metrics())
+	}
+
+	select {
+	case ack := <-acks:
+		if !bytes.Equal(ack.ID[:], token[:16]) {
+			t.Fatalf("ack mismatch: %x", ack.ID)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no ack received: entry=%s exit=%s", entry.Metrics(), exit.Metrics())
+	}
+}
+
+func TestServer_HybridOnion_NoKEMKey(t *testing.T) {
+	_, ep := startTestServer(t)
+
+	err := transport.NewTransport().Send(ep, &packet.HybridOnionPacket{})
+	if !errors.Is(err, transport.ErrMissingCapability) {
+		t.Fatalf("Send() error = %v, want %v", err, transport.ErrMissingCapability)
+	}
+}
@@ -3,19 +3,34 @@ package server
 import (
 	"net"
 
-	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
 )
 
 func handleGetIdentity(p packet.Packet, conn net.Conn, s *Server) {
-	logger.Debugf("[%s] GetIdentityRequest received", conn.RemoteAddr())
+	connLog(conn).Debugf("GetIdentityRequest received")
 
 	resp := &packet.GetIdentityResponse{
 		Ruuid:     s.Pi.UUID,
 		PublicKey: s.Pi.PubKey,
 	}
+	// Peers that did not negotiate hybrid onions may expect the fixed
+	// 48 bytes response of earlier versions.
+	if sess, ok := PeerSession(conn); ok && sess.Capabilities.Has(handshake.CapHybrid) {
+		resp.KEMKey = s.Pi.KEMKey()
+	}
+
+	if err := packet.WritePacket(s.packets(), conn, resp); err != nil {
+		connLog(conn).Warnf("failed to send identity response: %v", err)
+	}
+}
+
+func handleGetExitPolicy(p packet.Packet, conn net.Conn, s *Server) {
+	connLog(conn).Debugf("GetExitPolicyRequest received")
+
+	resp := &packet.GetExitPolicyResponse{Summary: s.exitPolicy().Summary().Bytes()}
 
-	if err := packet.WritePacket(conn, resp); err != nil {
-		logger.Warnf("[%s] failed to send identity response: %v", conn.RemoteAddr(), err)
+	if err := packet.WritePacket(s.packets(), conn, resp); err != nil {
+		connLog(conn).Warnf("failed to send exit policy response: %v", err)
 	}
 }
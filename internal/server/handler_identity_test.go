@@ -13,6 +13,10 @@ import (
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
 )
 
+// identityResponseSize is the payload of an identity response without KEM
+// key: the UUID and the X25519 public key.
+const identityResponseSize = 48
+
 func TestHandleGetIdentity_Success(t *testing.T) {
 	testUUID := [16]byte{
 		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
@@ -37,8 +41,7 @@ func TestHandleGetIdentity_Success(t *testing.T) {
 
 	handleGetIdentity(pkt, conn, s)
 
-	expectedResponsePacket := packet.GetIdentityResponse{}
-	expectedPayloadSize, _ := expectedResponsePacket.ExpectedLen()
+	expectedPayloadSize := identityResponseSize
 	expectedTotalLen := 3 + expectedPayloadSize
 
 	if conn.GetWrittenLen() != expectedTotalLen {
@@ -123,8 +126,7 @@ func TestHandleGetIdentity_ZeroValues(t *testing.T) {
 
 	handleGetIdentity(pkt, conn, s)
 
-	expectedResponsePacket := packet.GetIdentityResponse{}
-	expectedPayloadSize, _ := expectedResponsePacket.ExpectedLen()
+	expectedPayloadSize := identityResponseSize
 	expectedTotalLen := 3 + expectedPayloadSize
 
 	if conn.GetWrittenLen() != expectedTotalLen {
@@ -158,8 +160,7 @@ func TestHandleGetIdentity_MultipleRequests(t *testing.T) {
 	}
 
 	pkt := &packet.GetIdentityRequest{}
-	expectedResponsePacket := packet.GetIdentityResponse{}
-	expectedPayloadSize, _ := expectedResponsePacket.ExpectedLen()
+	expectedPayloadSize := identityResponseSize
 	expectedTotalLen := 3 + expectedPayloadSize
 
 	for i := range 5 {
@@ -196,8 +197,7 @@ func TestHandleGetIdentity_ConcurrentRequests(t *testing.T) {
 	}
 
 	pkt := &packet.GetIdentityRequest{}
-	expectedResponsePacket := packet.GetIdentityResponse{}
-	expectedPayloadSize, _ := expectedResponsePacket.ExpectedLen()
+	expectedPayloadSize := identityResponseSize
 	expectedTotalLen := 3 + expectedPayloadSize
 
 	var wg sync.WaitGroup
@@ -293,8 +293,7 @@ func TestHandleGetIdentity_DifferentRemoteAddresses(t *testing.T) {
 
 			handleGetIdentity(pkt, conn, s)
 
-			expectedResponsePacket := packet.GetIdentityResponse{}
-			expectedPayloadSize, _ := expectedResponsePacket.ExpectedLen()
+			expectedPayloadSize := identityResponseSize
 			expectedTotalLen := 3 + expectedPayloadSize
 
 			if conn.GetWrittenLen() != expectedTotalLen {
@@ -1,20 +1,21 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
-	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/crypto"
-	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
-	"golang.org/x/crypto/curve25519"
 )
 
 func handleOnionPacket(p packet.Packet, conn net.Conn, s *Server) {
-	logger.Debugf("[%s] Onion packet received", conn.RemoteAddr())
+	connLog(conn).Debugf("Onion packet received")
 
 	onionPkt, err := assertOnionPacketType(
 		p,
@@ -25,15 +26,66 @@ func handleOnionPacket(p packet.Packet, conn net.Conn, s *Server) {
 	}
 
 	layer, err := parseInboundLayer(
-		onionPkt,
+		onionPkt.Data[:],
 		conn,
 	)
 	if err != nil {
 		return
 	}
 
+	processOnionLayer(
+		layer,
+		nil,
+		s,
+		conn,
+	)
+}
+
+// handleHybridOnionPacket opens the envelope sealed for this relay, and
+// processes the layer it travels with using the hybrid secret it carries.
+func handleHybridOnionPacket(p packet.Packet, conn net.Conn, s *Server) {
+	connLog(conn).Debugf("Hybrid onion packet received")
+
+	pkt, ok := p.(*packet.HybridOnionPacket)
+	if !ok {
+		connLog(conn).Warnf("Failed to cast packet to HybridOnionPacket")
+		return
+	}
+	if s.Pi.KEM == nil {
+		connLog(conn).Warnf("Hybrid onion received but this relay has no KEM key")
+		return
+	}
+
+	secret, err := onion.OpenHybridEnvelope(s.Pi.KEM, pkt.Envelope)
+	if err != nil {
+		connLog(conn).Warnf("Failed to open hybrid envelope: %v", err)
+		return
+	}
+
+	layer, err := parseInboundLayer(
+		pkt.Data[:],
+		conn,
+	)
+	if err != nil {
+		return
+	}
+
+	processOnionLayer(
+		layer,
+		&secret,
+		s,
+		conn,
+	)
+}
+
+// processOnionLayer peels layer and delivers or relays what it carries.
+// hybrid is the hybrid secret of the layer, nil for classic onions.
+func processOnionLayer(layer *onion.OnionLayer, hybrid *[32]byte, s *Server, conn net.Conn) {
+	conn = withLog(conn, connLog(conn).With("layer", layerFingerprint(layer)))
+
 	sessionKey, err := unwrapSessionKey(
 		layer,
+		hybrid,
 		s,
 		conn,
 	)
@@ -50,9 +102,20 @@ func handleOnionPacket(p packet.Packet, conn net.Conn, s *Server) {
 		return
 	}
 
+	if isDuplicate(layer, s, conn) {
+		return
+	}
+
+	if olc.Drop {
+		s.metrics.CoverDropped.Add(1)
+		connLog(conn).Debugf("Cover packet dropped")
+		return
+	}
+
 	if olc.LastServer {
 		handleFinalDestination(
 			olc,
+			s,
 			conn,
 		)
 		return
@@ -60,6 +123,8 @@ func handleOnionPacket(p packet.Packet, conn net.Conn, s *Server) {
 
 	relayToNextHops(
 		olc,
+		hybrid != nil,
+		s,
 		conn,
 	)
 }
@@ -67,7 +132,7 @@ func handleOnionPacket(p packet.Packet, conn net.Conn, s *Server) {
 func assertOnionPacketType(p packet.Packet, conn net.Conn) (*packet.OnionPacket, error) {
 	onionPkt, ok := p.(*packet.OnionPacket)
 	if !ok {
-		logger.Warnf("[%s] Failed to cast packet to OnionPacket", conn.RemoteAddr())
+		connLog(conn).Warnf("Failed to cast packet to OnionPacket")
 		return nil, fmt.Errorf("invalid type, wanted OnionPacket %d, got %d",
 			packet.TypeOnionPacket, p.Type(),
 		)
@@ -75,140 +140,333 @@ func assertOnionPacketType(p packet.Packet, conn net.Conn) (*packet.OnionPacket,
 	return onionPkt, nil
 }
 
-func parseInboundLayer(pkt *packet.OnionPacket, conn net.Conn) (*onion.OnionLayer, error) {
+func parseInboundLayer(data []byte, conn net.Conn) (*onion.OnionLayer, error) {
 	layer := &onion.OnionLayer{}
-	if err := layer.Parse(pkt.Data[:]); err != nil {
-		logger.Warnf("[%s] Failed to parse onion layer: %v", conn.RemoteAddr(), err)
+	if err := layer.Parse(data); err != nil {
+		connLog(conn).Warnf("Failed to parse onion layer: %v", err)
 		return nil, err
 	}
 
-	logger.Debugf("[%s] Onion Layer informations: {\n\tepk: %x\n\twrappingKeySlice: [%d]\n\tflags: %d\n\tnonce: %x\n\tct: %x...\n}",
-		conn.RemoteAddr(),
-		layer.EPK,
-		len(layer.WrappedKeys),
-		layer.Flags,
-		layer.PayloadNonce,
-		layer.CipherText[:3],
-	)
+	connLog(conn).With(
+		"epk", hex.EncodeToString(layer.EPK[:]),
+		"wrapped_keys", len(layer.WrappedKeys),
+		"flags", layer.Flags,
+		"nonce", hex.EncodeToString(layer.PayloadNonce[:]),
+		"ciphertext", len(layer.CipherText),
+	).Debugf("Onion layer parsed")
 	return layer, nil
 }
 
-func unwrapSessionKey(layer *onion.OnionLayer, s *Server, conn net.Conn) ([32]byte, error) {
-	sharedSecret, err := curve25519.X25519(s.Pi.PrivKey[:], layer.EPK[:])
-	if err != nil {
-		logger.Warnf("[%s] Failed to generate shared secret: %v", conn.RemoteAddr(), err)
-		return [32]byte{}, err
-	}
-
-	wrappingKeySlice, err := crypto.HKDFSha256(
-		sharedSecret,
-		onion.HKDFSaltWrappedKey,
-		onion.HKDFInfoWrappedKey,
-	)
+// layerFingerprint identifies a layer in the logs by its dedup key, so that
+// the copies of a layer sent in parallel log the same one.
+func layerFingerprint(layer *onion.OnionLayer) string {
+	header, err := layer.HeaderBytes()
 	if err != nil {
-		logger.Warnf("[%s] Failed to generate wrappingKeySlice: %v", conn.RemoteAddr(), err)
-		return [32]byte{}, err
+		return ""
 	}
+	k := layerKey(header)
+	return hex.EncodeToString(k[:4])
+}
 
-	var wrappingKey [32]byte
-	copy(wrappingKey[:], wrappingKeySlice)
-
-	for _, wk := range layer.WrappedKeys {
-		res, err := crypto.ChachaDecrypt(
-			wrappingKey,
-			wk.Nonce,
-			wk.CipherText[:],
-			[]byte("DORv1:WrappedKey"),
-		)
-		if err != nil {
-			continue
-		}
+func unwrapSessionKey(layer *onion.OnionLayer, hybrid *[32]byte, s *Server, conn net.Conn) ([32]byte, error) {
+	var sessionKey [32]byte
+	var err error
 
-		if bytes.Equal(res[:16], s.Pi.UUID[:]) {
-			var sessionKey [32]byte
-			copy(sessionKey[:], res[16:48])
-			return sessionKey, nil
+	if hybrid != nil {
+		sessionKey, err = onion.UnwrapHybridSessionKey(s.Pi.PrivKey, s.Pi.UUID, layer.EPK, *hybrid, layer.WrappedKeys)
+	} else {
+		sessionKey, err = onion.UnwrapSessionKey(s.Pi.PrivKey, s.Pi.UUID, layer.EPK, layer.WrappedKeys)
+		if errors.Is(err, onion.ErrNoWrappedKey) && s.untaggedSlots {
+			sessionKey, _, err = onion.UnwrapUntaggedSessionKeySlot(s.Pi.PrivKey, s.Pi.UUID, layer.EPK, layer.WrappedKeys)
 		}
 	}
 
-	logger.Warnf("[%s] No matching wrapped key found (not in this route)", conn.RemoteAddr())
-	return [32]byte{}, fmt.Errorf("no matching wrapped key")
+	if errors.Is(err, onion.ErrNoWrappedKey) {
+		connLog(conn).Warnf("No matching wrapped key found (not in this route)")
+		return sessionKey, err
+	}
+	if err != nil {
+		connLog(conn).Warnf("Failed to unwrap session key: %v", err)
+		return sessionKey, err
+	}
+	return sessionKey, nil
 }
 
 func decryptNextLayer(layer *onion.OnionLayer, sessionKey [32]byte, conn net.Conn) (*onion.OnionLayerCiphered, error) {
-	if err := layer.TrimCipherText(sessionKey); err != nil {
-		logger.Warnf("[%s] failed to trim CipherText: %v", conn.RemoteAddr(), err)
+	olc, err := layer.Decrypt(sessionKey)
+	if err != nil {
+		connLog(conn).Warnf("Failed to decrypt layer: %v", err)
 		return nil, err
 	}
 
+	connLog(conn).With(
+		"last_server", olc.LastServer,
+		"next_hops", len(olc.NextHops),
+		"payload_length", olc.UtilPayloadLength,
+		"payload", len(olc.Payload),
+	).Debugf("OnionLayerCiphered parsed")
+
+	return olc, nil
+}
+
+// isDuplicate reports whether the layer was already processed, as happens
+// when the previous group sends copies in parallel. It is checked once the
+// layer is authenticated so that forged copies cannot shadow the real one.
+func isDuplicate(layer *onion.OnionLayer, s *Server, conn net.Conn) bool {
 	header, err := layer.HeaderBytes()
 	if err != nil {
-		logger.Warnf("[%s] Failed to get header bytes: %v", conn.RemoteAddr(), err)
-		return nil, err
+		return false
 	}
 
-	plaintext, err := crypto.ChachaDecrypt(
-		sessionKey,
-		layer.PayloadNonce,
-		layer.CipherText,
-		header,
-	)
+	if s.dedup.seen(layerKey(header)) {
+		s.metrics.DuplicatesDropped.Add(1)
+		connLog(conn).Debugf("Duplicate onion layer dropped")
+		return true
+	}
+	return false
+}
+
+func handleFinalDestination(olc *onion.OnionLayerCiphered, s *Server, conn net.Conn) {
+	if _, ok := onion.FindExtension(olc.Extensions, onion.ExtAckDeliver); ok {
+		deliverAck(olc, s, conn)
+		return
+	}
+	if handleServiceExtensions(olc, s, conn) {
+		return
+	}
+
+	payload := olc.Payload
+
+	if ext, ok := onion.FindExtension(olc.Extensions, onion.ExtShare); ok {
+		share, err := onion.ParseShare(ext)
+		if err != nil {
+			connLog(conn).Warnf("Invalid share extension: %v", err)
+			return
+		}
+		s.metrics.SharesReceived.Add(1)
+
+		msg, err := s.reassembly().add(share, olc.Payload)
+		if err != nil {
+			connLog(conn).Warnf("Failed to reassemble message %x: %v", share.MessageID[:4], err)
+			return
+		}
+		if msg == nil {
+			connLog(conn).Debugf("Share %d/%d of message %x stored (%d needed)",
+				share.Index+1, share.N, share.MessageID[:4], share.K,
+			)
+			return
+		}
+
+		s.metrics.MessagesReassembled.Add(1)
+		connLog(conn).Debugf("Message %x reassembled from %d shares", share.MessageID[:4], share.K)
+		payload = msg
+	}
+
+	var dest identity.Endpoint
+	if len(olc.NextHops) > 0 {
+		dest = olc.NextHops[0]
+	}
+	s.whenResolved(dest, conn, func(ctx context.Context) {
+		if !deliverPayload(ctx, dest, payload, s, conn) {
+			return
+		}
+
+		if ext, ok := onion.FindExtension(olc.Extensions, onion.ExtAckRequest); ok {
+			sendAck(ext, olc.Extensions, s, conn)
+		}
+	})
+}
+
+// sendAck sends back the reply onion of an ack request, hybrid when exts
+// carry the hybrid secret of its entry group.
+func sendAck(ext onion.Extension, exts []onion.Extension, s *Server, conn net.Conn) {
+	req, err := onion.ParseAckRequest(ext)
 	if err != nil {
-		logger.Warnf("[%s] failed to decrypt layer.Ciphertext: %v", conn.RemoteAddr(), err)
-		return nil, err
+		connLog(conn).Warnf("Invalid ack request: %v", err)
+		return
 	}
 
-	var olc onion.OnionLayerCiphered
-	if err := olc.Parse(plaintext); err != nil {
-		logger.Warnf("[%s] failed to parse plaintext: %v", conn.RemoteAddr(), err)
-		return nil, err
+	reply := &onion.OnionLayer{}
+	if err := reply.Parse(req.Reply); err != nil {
+		connLog(conn).Warnf("Ack request reply is not a valid OnionLayer: %v", err)
+		return
 	}
 
-	logger.Debugf("[%s] OnionLayerCiphered parsed: {\n\tLastServer: %v\n\tNextHops: %d\n\tUtilPayloadLength: %d\n\tPayload: %d bytes\n}",
-		conn.RemoteAddr(), olc.LastServer, len(olc.NextHops), olc.UtilPayloadLength, len(olc.Payload),
-	)
+	var hybrid *[32]byte
+	if secret, ok := onion.NextHybridSecret(exts); ok {
+		hybrid = &secret
+	}
 
-	return &olc, nil
+	s.metrics.AcksSent.Add(1)
+	connLog(conn).Debugf("Sending delivery ack")
+	sendOnion(reply, req.Entry, 1, 0, hybrid, s, conn)
 }
 
-func handleFinalDestination(olc *onion.OnionLayerCiphered, conn net.Conn) {
-	logger.Infof("[%s] Final destination reached! Processing payload (%d bytes)...",
-		conn.RemoteAddr(), len(olc.Payload),
+// deliverAck hands the token at the end of a reply onion to the client
+// waiting for it.
+func deliverAck(olc *onion.OnionLayerCiphered, s *Server, conn net.Conn) {
+	var ack packet.DeliveryAck
+	if len(olc.NextHops) != 1 || len(olc.Payload) != len(ack.ID)+len(ack.Tag) {
+		connLog(conn).Warnf("Malformed delivery ack (%d hops, %d bytes)",
+			len(olc.NextHops), len(olc.Payload),
+		)
+		return
+	}
+	copy(ack.ID[:], olc.Payload[:len(ack.ID)])
+	copy(ack.Tag[:], olc.Payload[len(ack.ID):])
+
+	if !byAddress(olc.NextHops, conn) {
+		return
+	}
+	dest := olc.NextHops[0]
+	if err := s.transport().Send(dest, &ack); err != nil {
+		connLog(conn).With("next_hop", dest.String()).Warnf("Failed to deliver ack: %v", err)
+		return
+	}
+	s.metrics.AcksDelivered.Add(1)
+	connLog(conn).With("next_hop", dest.String()).Debugf("Delivery ack handed over")
+}
+
+// deliverPayload hands payload to the deliver function when the exit policy
+// allows dest, resolved first if it is a domain, and reports whether it did.
+// Nothing is delivered once ctx is done.
+func deliverPayload(ctx context.Context, dest identity.Endpoint, payload []byte, s *Server, conn net.Conn) bool {
+	if dest.IsDomain() {
+		resolved, err := s.resolve(ctx, dest)
+		if err != nil {
+			s.metrics.ResolveFailed.Add(1)
+			connLog(conn).With("next_hop", dest.String()).Warnf("Failed to resolve destination: %v", err)
+			return false
+		}
+		dest = resolved
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+	if !s.exitPolicy().Allows(dest) {
+		s.metrics.ExitRejected.Add(1)
+		connLog(conn).With("next_hop", dest.String()).Warnf("Destination rejected by the exit policy")
+		return false
+	}
+
+	connLog(conn).Infof("Final destination reached! Processing payload (%d bytes)...",
+		len(payload),
 	)
+	if s.deliver != nil {
+		s.deliver(dest, payload)
+	}
+	return true
 }
 
-func relayToNextHops(olc *onion.OnionLayerCiphered, conn net.Conn) {
+// byAddress reports whether the hops are all given by IP address, logging the
+// first that is not. Only the exit resolves domains, with its own resolver and
+// exit policy: a relay dialing one would hand it to the system resolver and
+// reach whatever it points to.
+func byAddress(hops []identity.Endpoint, conn net.Conn) bool {
+	for _, ep := range hops {
+		if ep.IsDomain() {
+			connLog(conn).With("next_hop", ep.String()).Warnf("Next hop given by domain, packet dropped")
+			return false
+		}
+	}
+	return true
+}
+
+// relayToNextHops sends the next layer to the next group, hybrid if the
+// layer it was read from was.
+func relayToNextHops(olc *onion.OnionLayerCiphered, hybrid bool, s *Server, conn net.Conn) {
 	if len(olc.NextHops) == 0 {
-		logger.Warnf("[%s] Relay node but no next hop defined!", conn.RemoteAddr())
+		connLog(conn).Warnf("Relay node but no next hop defined!")
 		return
 	}
 
+	var next *[32]byte
+	if hybrid {
+		secret, ok := onion.NextHybridSecret(olc.Extensions)
+		if !ok {
+			connLog(conn).Warnf("Hybrid layer without the hybrid secret of the next group")
+			return
+		}
+		next = &secret
+	}
+
 	nextLayer := &onion.OnionLayer{}
 	if err := nextLayer.Parse(olc.Payload); err != nil {
-		logger.Warnf("[%s] Decrypted payload is not a valid OnionLayer: %v", conn.RemoteAddr(), err)
+		connLog(conn).Warnf("Decrypted payload is not a valid OnionLayer: %v", err)
 		return
 	}
 
-	bytes, err := nextLayer.BytesPadded()
+	sendOnion(
+		nextLayer,
+		olc.NextHops,
+		int(olc.Redundancy),
+		onion.MixDelayClass(olc.Extensions),
+		next,
+		s,
+		conn,
+	)
+}
+
+// sendOnion pads layer and sends it to nextHops, through the mix if the
+// server runs one, unless one of them is a domain. With a hybrid secret, the
+// layer travels in a HybridOnionPacket carrying the secret sealed for each
+// next hop.
+func sendOnion(layer *onion.OnionLayer, nextHops []identity.Endpoint, k int, class uint8, hybrid *[32]byte, s *Server, conn net.Conn) {
+	if !byAddress(nextHops, conn) {
+		return
+	}
+
+	bytes, err := layer.BytesPadded()
 	if err != nil {
-		logger.Warnf("[%s] Failed to pad next layer: %v", conn.RemoteAddr(), err)
+		connLog(conn).Warnf("Failed to pad next layer: %v", err)
 		return
 	}
 
 	var outPkt packet.OnionPacket
 	copy(outPkt.Data[:], bytes)
 
-	trans := transport.NewTransport()
-	for _, nh := range olc.NextHops {
-		if err := trans.Send(nh, &outPkt); err != nil {
-			logger.Warnf("[%s] Failed to relay packet to %s: %v",
-				conn.RemoteAddr(), nh.String(), err,
-			)
+	forward := func() {
+		forwardToNextHops(&outPkt, nextHops, k, hybrid, s, conn)
+	}
+
+	if s.mixer != nil {
+		connLog(conn).Debugf("Packet queued in mix (class %d)", class)
+		s.mixer.submit(class, forward)
+		return
+	}
+	forward()
+}
+
+// forwardToNextHops sends pkt to the first reachable next hop, or to k of them
+// in parallel when the layer asks for redundancy.
+func forwardToNextHops(pkt *packet.OnionPacket, nextHops []identity.Endpoint, k int, hybrid *[32]byte, s *Server, conn net.Conn) {
+	start := time.Now()
+	trans := s.transport()
+
+	var results []transport.SendResult
+	if hybrid == nil {
+		results = trans.SendRedundant(nextHops, k, pkt)
+	} else {
+		results = trans.SendRedundantFunc(nextHops, k, func(ep identity.Endpoint) (packet.Packet, error) {
+			kemKey, err := s.nextHopKEMKeys().get(ep, s.fetchKEMKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get KEM key: %w", err)
+			}
+			env, err := onion.SealHybridEnvelope(kemKey, *hybrid)
+			if err != nil {
+				return nil, err
+			}
+			return &packet.HybridOnionPacket{Envelope: env, Data: pkt.Data}, nil
+		})
+	}
+	for _, r := range results {
+		log := connLog(conn).With("next_hop", r.Ep.String())
+		if r.Err != nil {
+			log.Warnf("Failed to relay packet: %v", r.Err)
 			continue
 		}
-		logger.Debugf("[%s] Packet successfully relayed to %s",
-			conn.RemoteAddr(), nh.String(),
-		)
-		return
+		s.links.relayed(r.Ep, hybrid != nil)
+		log.With("duration", time.Since(start)).Debugf("Packet successfully relayed")
 	}
 }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/sphinx"
+)
+
+func handleSphinxPacket(p packet.Packet, conn net.Conn, s *Server) {
+	connLog(conn).Debugf("Sphinx packet received")
+
+	pkt, ok := p.(*packet.SphinxPacket)
+	if !ok {
+		connLog(conn).Warnf("Failed to cast packet to SphinxPacket")
+		return
+	}
+
+	var in sphinx.Packet
+	if err := in.Parse(pkt.Data[:]); err != nil {
+		connLog(conn).Warnf("Failed to parse sphinx packet: %v", err)
+		return
+	}
+
+	out, err := sphinx.Process(s.Pi.PrivKey, &in)
+	if err != nil {
+		if errors.Is(err, sphinx.ErrInvalidMAC) {
+			connLog(conn).Warnf("Sphinx packet not for this relay, or tampered with")
+			return
+		}
+		connLog(conn).Warnf("Failed to process sphinx packet: %v", err)
+		return
+	}
+
+	// The tag is derived from the shared secret, so a replayed packet has the
+	// same one whatever the bytes it is sent with.
+	if s.dedup.seen(dedupKey(out.ReplayTag)) {
+		s.metrics.DuplicatesDropped.Add(1)
+		connLog(conn).Debugf("Replayed sphinx packet dropped")
+		return
+	}
+	s.metrics.SphinxProcessed.Add(1)
+
+	if out.Exit {
+		s.whenResolved(out.Next, conn, func(ctx context.Context) {
+			_ = deliverPayload(ctx, out.Next, out.Message, s, conn)
+		})
+		return
+	}
+	if !byAddress([]identity.Endpoint{out.Next}, conn) {
+		return
+	}
+
+	var next packet.SphinxPacket
+	next.Data = out.Packet.Bytes()
+
+	forward := func() {
+		if err := s.transport().Send(out.Next, &next); err != nil {
+			connLog(conn).With("next_hop", out.Next.String()).Warnf("Failed to relay sphinx packet: %v", err)
+			return
+		}
+		connLog(conn).With("next_hop", out.Next.String()).Debugf("Sphinx packet successfully relayed")
+	}
+
+	if s.mixer != nil {
+		connLog(conn).Debugf("Packet queued in mix (class %d)", out.MixDelayClass)
+		s.mixer.submit(out.MixDelayClass, forward)
+		return
+	}
+	forward()
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/sphinx"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+)
+
+func TestServer_SphinxPacket(t *testing.T) {
+	entry, entryEp := startTestServer(t)
+	exit, exitEp := startTestServer(t)
+
+	path := []identity.Relay{
+		{Ep: entryEp, UUID: entry.Pi.UUID, PubKey: entry.Pi.PubKey},
+		{Ep: exitEp, UUID: exit.Pi.UUID, PubKey: exit.Pi.PubKey},
+	}
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	p, err := sphinx.Build(dest, path, []byte("hello"))
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	pkt := packet.SphinxPacket{Data: p.Bytes()}
+
+	if err := transport.NewTransport().Send(entryEp, &pkt); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for exit.Metrics().SphinxProcessed == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := entry.Metrics(); m.SphinxProcessed != 1 {
+		t.Errorf("entry metrics mismatch: %s", m)
+	}
+	if m := exit.Metrics(); m.SphinxProcessed != 1 {
+		t.Errorf("exit metrics mismatch: %s", m)
+	}
+}
+
+func TestHandleSphinxPacket_Replay(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{Pi: testPrivateIdentity(t), dedup: newDedupCache(16, time.Minute)}
+	self := identity.Relay{PubKey: s.Pi.PubKey}
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	p, err := sphinx.Build(dest, []identity.Relay{self}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	pkt := packet.SphinxPacket{Data: p.Bytes()}
+
+	client, conn := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = conn.Close() }()
+
+	handleSphinxPacket(&pkt, conn, s)
+	handleSphinxPacket(&pkt, conn, s)
+
+	if m := s.Metrics(); m.SphinxProcessed != 1 || m.DuplicatesDropped != 1 {
+		t.Errorf("metrics mismatch: %s", m)
+	}
+}
@@ -2,19 +2,50 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
 )
 
+// helloAckLen is the size of the HelloAck written before any response.
+const helloAckLen = packet.HeaderSize + 5
+
+func withHello(frames ...[]byte) []byte {
+	return withHelloCaps(0, frames...)
+}
+
+// withHelloCaps is withHello offering caps.
+func withHelloCaps(caps handshake.Capability, frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	hello := &packet.Hello{
+		MinVersion:   handshake.MinVersion,
+		MaxVersion:   handshake.MaxVersion,
+		Capabilities: uint32(caps),
+	}
+	if err := packet.WritePacket(nil, &buf, hello); err != nil {
+		panic(err)
+	}
+	for _, f := range frames {
+		buf.Write(f)
+	}
+	return buf.Bytes()
+}
+
 func TestServer_handleConn_EOF(t *testing.T) {
 	conn := testutil.NewMockConn([]byte{})
 	conn.ReadErr = io.EOF
@@ -99,9 +130,10 @@ func TestHandlerRegistry_AllTypesRegistered(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, exists := handlerRegistry[tt.packetType]
+			s := &Server{}
+			_, exists := s.handler(tt.packetType)
 			if exists != tt.wantExists {
-				t.Errorf("handlerRegistry[0x%02x] exists = %v, want %v",
+				t.Errorf("handler(0x%02x) exists = %v, want %v",
 					tt.packetType, exists, tt.wantExists)
 			}
 		})
@@ -109,7 +141,7 @@ func TestHandlerRegistry_AllTypesRegistered(t *testing.T) {
 }
 
 func TestHandlerRegistry_HandlersNotNil(t *testing.T) {
-	for typ, handler := range handlerRegistry {
+	for typ, handler := range defaultHandlers {
 		t.Run("", func(t *testing.T) {
 			if handler == nil {
 				t.Errorf("handler for type 0x%02x is nil", typ)
@@ -118,6 +150,215 @@ func TestHandlerRegistry_HandlersNotNil(t *testing.T) {
 	}
 }
 
+func TestServer_Handle(t *testing.T) {
+	const customType uint8 = 0x7F
+
+	noop := func(packet.Packet, net.Conn, *Server) {}
+
+	tests := []struct {
+		name       string
+		register   func(s *Server)
+		packetType uint8
+		wantExists bool
+	}{
+		{
+			name:       "custom type registered",
+			register:   func(s *Server) { s.Handle(customType, noop) },
+			packetType: customType,
+			wantExists: true,
+		},
+		{
+			name:       "built-in handlers kept after registration",
+			register:   func(s *Server) { s.Handle(customType, noop) },
+			packetType: packet.TypeOnionPacket,
+			wantExists: true,
+		},
+		{
+			name:       "nil handler unregisters built-in",
+			register:   func(s *Server) { s.Handle(packet.TypeOnionPacket, nil) },
+			packetType: packet.TypeOnionPacket,
+			wantExists: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			tt.register(s)
+
+			_, exists := s.handler(tt.packetType)
+			if exists != tt.wantExists {
+				t.Errorf("handler(0x%02x) exists = %v, want %v",
+					tt.packetType, exists, tt.wantExists)
+			}
+		})
+	}
+
+	if _, exists := defaultHandlers[customType]; exists {
+		t.Error("Handle() must not modify the default handlers")
+	}
+}
+
+func TestServer_Use_Order(t *testing.T) {
+	s := &Server{}
+
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(p packet.Packet, c net.Conn, s *Server) {
+				calls = append(calls, name)
+				next(p, c, s)
+			}
+		}
+	}
+
+	s.Handle(packet.TypeGetIdentityRequest, func(packet.Packet, net.Conn, *Server) {
+		calls = append(calls, "handler")
+	})
+	s.Use(record("outer"), record("inner"))
+
+	h, ok := s.handler(packet.TypeGetIdentityRequest)
+	if !ok {
+		t.Fatal("handler not found")
+	}
+	h(&packet.GetIdentityRequest{}, testutil.NewMockConn(nil), s)
+
+	want := []string{"outer", "inner", "handler"}
+	if len(calls) != len(want) {
+		t.Fatalf("call chain mismatch:\n\tgot:  %v\n\twant: %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("call chain mismatch:\n\tgot:  %v\n\twant: %v", calls, want)
+		}
+	}
+}
+
+func TestServer_Use_ComposedOnce(t *testing.T) {
+	s := &Server{}
+
+	wraps := 0
+	s.Use(func(next HandlerFunc) HandlerFunc {
+		wraps++
+		return next
+	})
+	built := wraps
+
+	for range 3 {
+		if _, ok := s.handler(packet.TypeGetIdentityRequest); !ok {
+			t.Fatal("handler not found")
+		}
+	}
+	if wraps != built {
+		t.Errorf("middleware applied on dispatch: %d wraps after Use, %d after 3 dispatches", built, wraps)
+	}
+}
+
+func TestServer_handleConn_Middleware(t *testing.T) {
+	packetData := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
+	conn := testutil.NewMockConn(withHello(packetData))
+
+	s := &Server{}
+	s.Handle(packet.TypeGetIdentityRequest, func(packet.Packet, net.Conn, *Server) {})
+
+	called := make(chan uint8, 1)
+	s.Use(func(next HandlerFunc) HandlerFunc {
+		return func(p packet.Packet, c net.Conn, s *Server) {
+			called <- p.Type()
+			next(p, c, s)
+		}
+	})
+
+	s.handleConn(conn)
+
+	select {
+	case typ := <-called:
+		if typ != packet.TypeGetIdentityRequest {
+			t.Errorf("middleware saw wrong type:\n\tgot:  0x%02x\n\twant: 0x%02x",
+				typ, packet.TypeGetIdentityRequest)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("middleware was not executed")
+	}
+}
+
+func TestServer_handleConn_Handshake(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		wantAck     bool
+		wantVersion uint8
+		wantHandled bool
+	}{
+		{
+			name:        "hello then request",
+			data:        withHello([]byte{packet.TypeGetIdentityRequest, 0x00, 0x00}),
+			wantAck:     true,
+			wantVersion: handshake.Version1,
+			wantHandled: true,
+		},
+		{
+			name:        "legacy request without hello",
+			data:        []byte{packet.TypeGetIdentityRequest, 0x00, 0x00},
+			wantAck:     false,
+			wantHandled: true,
+		},
+		{
+			name: "unsupported version range",
+			data: func() []byte {
+				var buf bytes.Buffer
+				_ = packet.WritePacket(nil, &buf, &packet.Hello{MinVersion: 0xF0, MaxVersion: 0xFF})
+				buf.Write([]byte{packet.TypeGetIdentityRequest, 0x00, 0x00})
+				return buf.Bytes()
+			}(),
+			wantAck:     true,
+			wantVersion: 0,
+			wantHandled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := testutil.NewMockConn(tt.data)
+
+			var handled atomic.Bool
+			s := &Server{}
+			s.Handle(packet.TypeGetIdentityRequest, func(p packet.Packet, c net.Conn, s *Server) {
+				if _, ok := PeerSession(c); !ok {
+					t.Error("handler conn carries no peer session")
+				}
+				handled.Store(true)
+			})
+
+			s.handleConn(conn)
+
+			if handled.Load() != tt.wantHandled {
+				t.Errorf("handled = %v, want %v", handled.Load(), tt.wantHandled)
+			}
+
+			written := conn.GetWrittenBytes()
+			if !tt.wantAck {
+				if len(written) != 0 {
+					t.Errorf("unexpected bytes written: %x", written)
+				}
+				return
+			}
+
+			p, err := packet.ReadPacket(nil, bytes.NewReader(written))
+			if err != nil {
+				t.Fatalf("failed to read hello ack: %v", err)
+			}
+			ack, ok := p.(*packet.HelloAck)
+			if !ok {
+				t.Fatalf("expected *HelloAck, got %T", p)
+			}
+			if ack.Version != tt.wantVersion {
+				t.Errorf("negotiated version mismatch:\n\tgot:  %d\n\twant: %d", ack.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
 func TestServer_handleConn_UnknownPacket(t *testing.T) {
 	client, server := net.Pipe()
 	t.Cleanup(func() {
@@ -133,6 +374,10 @@ func TestServer_handleConn_UnknownPacket(t *testing.T) {
 		close(done)
 	}()
 
+	if _, err := handshake.Initiate(client, nil, handshake.DefaultConfig()); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
 	_, err := client.Write([]byte{0xFE, 0x00, 0x00})
 	if err != nil {
 		t.Fatalf("write failed: %v", err)
@@ -157,7 +402,7 @@ func TestServer_handleConn_GetIdentityRequest(t *testing.T) {
 	}
 
 	packetData := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
-	conn := testutil.NewMockConn(packetData)
+	conn := testutil.NewMockConn(withHello(packetData))
 
 	done := make(chan struct{})
 	go func() {
@@ -168,11 +413,11 @@ func TestServer_handleConn_GetIdentityRequest(t *testing.T) {
 	<-done
 	time.Sleep(50 * time.Millisecond)
 
-	if conn.GetWrittenLen() == 0 {
+	if conn.GetWrittenLen() <= helloAckLen {
 		t.Error("expected GetIdentityResponse to be written")
 	}
 
-	responseData := conn.GetWrittenBytes()
+	responseData := conn.GetWrittenBytes()[helloAckLen:]
 
 	if len(responseData) < 3 {
 		t.Fatalf("response too short: %d bytes", len(responseData))
@@ -202,6 +447,34 @@ func TestServer_handleConn_GetIdentityRequest(t *testing.T) {
 	}
 }
 
+func TestServer_handleConn_MissingCapability(t *testing.T) {
+	called := false
+	s := &Server{}
+	s.Handle(packet.TypeSphinxPacket, func(packet.Packet, net.Conn, *Server) { called = true })
+
+	var frame bytes.Buffer
+	if err := packet.WritePacket(nil, &frame, &packet.SphinxPacket{}); err != nil {
+		t.Fatalf("failed to encode sphinx packet: %v", err)
+	}
+
+	// withHello offers no capabilities, so the session lacks CapSphinx.
+	conn := testutil.NewMockConn(withHello(frame.Bytes()))
+
+	done := make(chan struct{})
+	go func() {
+		s.handleConn(conn)
+		close(done)
+	}()
+	<-done
+
+	if called {
+		t.Error("sphinx handler must not run without the negotiated capability")
+	}
+	if conn.GetWrittenLen() != helloAckLen {
+		t.Errorf("only the HelloAck must be written, got %d bytes", conn.GetWrittenLen())
+	}
+}
+
 func TestServer_handleConn_OnionPacket(t *testing.T) {
 	s := &Server{
 		Pi: &identity.PrivateIdentity{
@@ -216,7 +489,7 @@ func TestServer_handleConn_OnionPacket(t *testing.T) {
 	binary.BigEndian.PutUint16(packetData[1:3], uint16(len(payload)))
 	copy(packetData[3:], payload)
 
-	conn := testutil.NewMockConn(packetData)
+	conn := testutil.NewMockConn(withHello(packetData))
 
 	done := make(chan struct{})
 	go func() {
@@ -233,16 +506,14 @@ func TestServer_handleConn_OnionPacket(t *testing.T) {
 
 func TestServer_handleConn_HandlerExecution(t *testing.T) {
 	validPacketData := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
-	conn := testutil.NewMockConn(validPacketData)
+	conn := testutil.NewMockConn(withHello(validPacketData))
 
 	s := &Server{}
 	done := make(chan struct{})
 
-	originalHandler := handlerRegistry[packet.TypeGetIdentityRequest]
-	handlerRegistry[packet.TypeGetIdentityRequest] = func(p packet.Packet, c net.Conn, s *Server) {
+	s.Handle(packet.TypeGetIdentityRequest, func(p packet.Packet, c net.Conn, s *Server) {
 		close(done)
-	}
-	defer func() { handlerRegistry[packet.TypeGetIdentityRequest] = originalHandler }()
+	})
 
 	s.handleConn(conn)
 
@@ -259,17 +530,15 @@ func TestServer_handleConn_HandlerExecution(t *testing.T) {
 
 func TestServer_handleConn_PanicRecovery(t *testing.T) {
 	packetData := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
-	conn := testutil.NewMockConn(packetData)
+	conn := testutil.NewMockConn(withHello(packetData))
 	s := &Server{}
 
 	handlerCalled := make(chan struct{})
 
-	originalHandler := handlerRegistry[packet.TypeGetIdentityRequest]
-	handlerRegistry[packet.TypeGetIdentityRequest] = func(p packet.Packet, c net.Conn, s *Server) {
+	s.Handle(packet.TypeGetIdentityRequest, func(p packet.Packet, c net.Conn, s *Server) {
 		close(handlerCalled)
 		panic("test panic")
-	}
-	defer func() { handlerRegistry[packet.TypeGetIdentityRequest] = originalHandler }()
+	})
 
 	s.handleConn(conn)
 
@@ -298,7 +567,7 @@ func TestServer_handleConn_MultiplePackets(t *testing.T) {
 	numPackets := 3
 	for i := range numPackets {
 		packetData := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
-		conn := testutil.NewMockConn(packetData)
+		conn := testutil.NewMockConn(withHello(packetData))
 
 		done := make(chan struct{})
 		go func() {
@@ -313,7 +582,7 @@ func TestServer_handleConn_MultiplePackets(t *testing.T) {
 			t.Errorf("connection %d should be closed", i)
 		}
 
-		if conn.GetWrittenLen() == 0 {
+		if conn.GetWrittenLen() <= helloAckLen {
 			t.Errorf("connection %d: expected response to be written", i)
 		}
 	}
@@ -339,7 +608,7 @@ func TestServer_handleConn_ConcurrentHandlers(t *testing.T) {
 			defer wg.Done()
 
 			packetData := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
-			conn := testutil.NewMockConn(packetData)
+			conn := testutil.NewMockConn(withHello(packetData))
 
 			s.handleConn(conn)
 
@@ -351,3 +620,75 @@ func TestServer_handleConn_ConcurrentHandlers(t *testing.T) {
 
 	wg.Wait()
 }
+
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []map[string]string
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := map[string]string{"msg": r.Message}
+	r.Attrs(func(a slog.Attr) bool {
+		fields[a.Key] = a.Value.String()
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, fields)
+	return nil
+}
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestServer_handleConn_CorrelationIDs(t *testing.T) {
+	rec := &recordingHandler{}
+	logger.SetHandler(rec)
+	logger.SetLevel(logger.Debug)
+	defer func() {
+		logger.SetHandler(nil)
+		logger.SetLevel(logger.Info)
+	}()
+
+	req := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
+	conn := testutil.NewMockConn(withHello(req, req))
+
+	s := &Server{}
+	s.Handle(packet.TypeGetIdentityRequest, func(p packet.Packet, c net.Conn, s *Server) {
+		connLog(c).Infof("in handler")
+	})
+	s.handleConn(conn)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	var handled []map[string]string
+	for _, r := range rec.records {
+		if r["msg"] == "in handler" {
+			handled = append(handled, r)
+		}
+	}
+	if len(handled) != 2 {
+		t.Fatalf("handler line count mismatch:\n\tgot:  %d\n\twant: 2", len(handled))
+	}
+
+	a, b := handled[0], handled[1]
+	for _, k := range []string{"conn", "remote", "packet", "type"} {
+		if a[k] == "" || b[k] == "" {
+			t.Errorf("missing field %s: %v %v", k, a, b)
+		}
+	}
+	if !strings.HasPrefix(a["remote"], "anon:") {
+		t.Errorf("remote address logged in clear: %s", a["remote"])
+	}
+	if a["conn"] != b["conn"] {
+		t.Errorf("conn ID differs between packets of a connection: %s != %s", a["conn"], b["conn"])
+	}
+	if a["packet"] == b["packet"] {
+		t.Errorf("packets share the ID %s", a["packet"])
+	}
+	if want := fmt.Sprintf("0x%02x", packet.TypeGetIdentityRequest); a["type"] != want {
+		t.Errorf("type mismatch:\n\tgot:  %s\n\twant: %s", a["type"], want)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+const (
+	// DefaultKEMKeyCacheSize is the number of next hop ML-KEM keys
+	// remembered.
+	DefaultKEMKeyCacheSize = 1024
+	// DefaultKEMKeyTTL is how long a next hop ML-KEM key is used before it
+	// is fetched again.
+	DefaultKEMKeyTTL = 10 * time.Minute
+)
+
+type kemKeyEntry struct {
+	key []byte
+	exp time.Time
+}
+
+// kemKeyCache remembers the ML-KEM keys of the relays hybrid onions are
+// forwarded to, so that a busy link does not cost an identity request per
+// packet.
+type kemKeyCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]kemKeyEntry
+
+	now func() time.Time
+}
+
+func newKEMKeyCache(size int, ttl time.Duration) *kemKeyCache {
+	return &kemKeyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]kemKeyEntry),
+		now:     time.Now,
+	}
+}
+
+// get returns the ML-KEM key of ep, fetched with fetch when it is not
+// cached or has expired.
+func (c *kemKeyCache) get(ep identity.Endpoint, fetch func(identity.Endpoint) ([]byte, error)) ([]byte, error) {
+	k := ep.String()
+
+	c.mu.Lock()
+	e, ok := c.entries[k]
+	c.mu.Unlock()
+	if ok && c.now().Before(e.exp) {
+		return e.key, nil
+	}
+
+	key, err := fetch(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if _, ok := c.entries[k]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[k] = kemKeyEntry{key: key, exp: now.Add(c.ttl)}
+	return key, nil
+}
+
+// evict drops the expired entries, or the one closest to expiry if none is.
+// Callers hold c.mu.
+func (c *kemKeyCache) evict(now time.Time) {
+	var (
+		oldest string
+		exp    time.Time
+	)
+	for k, e := range c.entries {
+		if !now.Before(e.exp) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldest == "" || e.exp.Before(exp) {
+			oldest, exp = k, e.exp
+		}
+	}
+	if len(c.entries) >= c.size {
+		delete(c.entries, oldest)
+	}
+}
+
+// fetchKEMKey asks ep for its identity, which carries its ML-KEM key when
+// both relays negotiated hybrid onions.
+func (s *Server) fetchKEMKey(ep identity.Endpoint) ([]byte, error) {
+	resp, err := s.transport().Request(ep, &packet.GetIdentityRequest{})
+	if err != nil {
+		return nil, err
+	}
+	id, ok := resp.(*packet.GetIdentityResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected packet type %T", resp)
+	}
+	if len(id.KEMKey) == 0 {
+		return nil, fmt.Errorf("relay %s has no KEM key", ep.String())
+	}
+	return id.KEMKey, nil
+}
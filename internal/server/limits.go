@@ -0,0 +1,285 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+)
+
+// Limits bounds the resources a relay spends on its peers. A zero value for
+// any field disables the corresponding limit.
+type Limits struct {
+	// MaxConns caps the number of concurrently open connections.
+	MaxConns int
+	// MaxConnsPerSource caps the open connections per source prefix.
+	MaxConnsPerSource int
+	// SourcePrefixV4 and SourcePrefixV6 set how source addresses are grouped.
+	SourcePrefixV4 int
+	SourcePrefixV6 int
+
+	// PacketRate is the sustained packets per second allowed per source
+	// prefix, PacketBurst the bucket size.
+	PacketRate  float64
+	PacketBurst int
+
+	// MaxInFlight caps the handlers running at once across all connections.
+	// Reading stops while the bound is reached.
+	MaxInFlight int
+
+	// Exempt lists the sources not subject to the per-source limits, such as
+	// the relays forwarding to this one: they open a connection per packet
+	// for all the clients behind them.
+	Exempt []netip.Prefix
+}
+
+// DefaultLimits leaves room for an upstream relay forwarding a busy route.
+// Relays known to forward more belong in Exempt.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxConns:          1024,
+		MaxConnsPerSource: 128,
+		SourcePrefixV4:    32,
+		SourcePrefixV6:    64,
+		PacketRate:        1000,
+		PacketBurst:       2000,
+		MaxInFlight:       256,
+	}
+}
+
+var (
+	errTooManyConns          = errors.New("too many connections")
+	errTooManyConnsPerSource = errors.New("too many connections from source")
+)
+
+// bucketSweepSize is the bucket count above which idle buckets are pruned.
+const bucketSweepSize = 4096
+
+// dropWarnInterval spaces the warnings about the traffic dropped by the
+// per-source limits, which would flood the logs under attack.
+const dropWarnInterval = 10 * time.Second
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter enforces Limits. A nil *limiter allows everything.
+type limiter struct {
+	limits Limits
+	now    func() time.Time
+
+	mu        sync.Mutex
+	conns     int
+	perSource map[netip.Prefix]int
+	buckets   map[netip.Prefix]*tokenBucket
+	dropped   int // since lastWarn
+	lastWarn  time.Time
+
+	inflight chan struct{}
+}
+
+func newLimiter(l Limits) *limiter {
+	if l.SourcePrefixV4 <= 0 || l.SourcePrefixV4 > 32 {
+		l.SourcePrefixV4 = 32
+	}
+	if l.SourcePrefixV6 <= 0 || l.SourcePrefixV6 > 128 {
+		l.SourcePrefixV6 = 64
+	}
+	if l.PacketRate > 0 && l.PacketBurst < 1 {
+		l.PacketBurst = 1
+	}
+
+	lim := &limiter{
+		limits:    l,
+		now:       time.Now,
+		perSource: make(map[netip.Prefix]int),
+		buckets:   make(map[netip.Prefix]*tokenBucket),
+	}
+	if l.MaxInFlight > 0 {
+		lim.inflight = make(chan struct{}, l.MaxInFlight)
+	}
+	return lim
+}
+
+func (l *limiter) sourceOf(addr net.Addr) (netip.Prefix, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	ip := ap.Addr().Unmap()
+	for _, p := range l.limits.Exempt {
+		if p.Contains(ip) {
+			return netip.Prefix{}, false
+		}
+	}
+
+	bits := l.limits.SourcePrefixV6
+	if ip.Is4() {
+		bits = l.limits.SourcePrefixV4
+	}
+
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+// acquireConn reserves a connection slot for addr. The returned func must be
+// called once the connection is closed.
+func (l *limiter) acquireConn(addr net.Addr) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	src, hasSrc := l.sourceOf(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.MaxConns > 0 && l.conns >= l.limits.MaxConns {
+		return nil, errTooManyConns
+	}
+	if hasSrc && l.limits.MaxConnsPerSource > 0 && l.perSource[src] >= l.limits.MaxConnsPerSource {
+		return nil, errTooManyConnsPerSource
+	}
+
+	l.conns++
+	if hasSrc {
+		l.perSource[src]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.conns--
+			if hasSrc {
+				if l.perSource[src] <= 1 {
+					delete(l.perSource, src)
+				} else {
+					l.perSource[src]--
+				}
+			}
+		})
+	}, nil
+}
+
+// allowPacket takes one token from the bucket of addr's source prefix.
+func (l *limiter) allowPacket(addr net.Addr) bool {
+	if l == nil || l.limits.PacketRate <= 0 {
+		return true
+	}
+
+	src, ok := l.sourceOf(addr)
+	if !ok {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	burst := float64(l.limits.PacketBurst)
+
+	b, ok := l.buckets[src]
+	if !ok {
+		if len(l.buckets) >= bucketSweepSize {
+			l.sweepBuckets(now)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[src] = b
+	}
+
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limits.PacketRate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// noteDrop counts a packet or connection dropped by the per-source limits.
+// Every dropWarnInterval at most, it returns the drops since the previous
+// warning and true, for the caller to warn about them.
+func (l *limiter) noteDrop() (int, bool) {
+	if l == nil {
+		return 0, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.dropped++
+	now := l.now()
+	if !l.lastWarn.IsZero() && now.Sub(l.lastWarn) < dropWarnInterval {
+		return 0, false
+	}
+	n := l.dropped
+	l.dropped, l.lastWarn = 0, now
+	return n, true
+}
+
+// sweepBuckets drops the buckets that refilled completely, which are
+// equivalent to a fresh one. Must be called with l.mu held.
+func (l *limiter) sweepBuckets(now time.Time) {
+	burst := float64(l.limits.PacketBurst)
+	for src, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limits.PacketRate >= burst {
+			delete(l.buckets, src)
+		}
+	}
+}
+
+// tryAcquireHandler reserves an in-flight handler slot without blocking.
+func (l *limiter) tryAcquireHandler() bool {
+	if l == nil || l.inflight == nil {
+		return true
+	}
+
+	select {
+	case l.inflight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquireHandler blocks until an in-flight handler slot is free or stop is
+// closed, in which case it returns false.
+func (l *limiter) acquireHandler(stop <-chan struct{}) bool {
+	if l == nil || l.inflight == nil {
+		return true
+	}
+
+	select {
+	case l.inflight <- struct{}{}:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func (l *limiter) releaseHandler() {
+	if l == nil || l.inflight == nil {
+		return
+	}
+	<-l.inflight
+}
+
+// warnDropped warns, at most every dropWarnInterval, about the traffic the
+// per-source limits dropped, naming the source that tripped them.
+func (s *Server) warnDropped(log *logger.Entry) {
+	if n, ok := s.limiter.noteDrop(); ok {
+		log.Warnf("%d packets or connections dropped by the per-source limits since the last warning; exempt relay peers if legitimate", n)
+	}
+}
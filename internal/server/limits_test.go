@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
+)
+
+func tcpAddr(ip string, port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestLimiter_acquireConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		addrs   []net.Addr
+		wantErr []error
+	}{
+		{
+			name:   "global cap",
+			limits: Limits{MaxConns: 2},
+			addrs: []net.Addr{
+				tcpAddr("192.0.2.1", 1000),
+				tcpAddr("192.0.2.2", 1000),
+				tcpAddr("192.0.2.3", 1000),
+			},
+			wantErr: []error{nil, nil, errTooManyConns},
+		},
+		{
+			name:   "per-source cap on IPv4 host",
+			limits: Limits{MaxConnsPerSource: 1},
+			addrs: []net.Addr{
+				tcpAddr("192.0.2.1", 1000),
+				tcpAddr("192.0.2.1", 1001),
+				tcpAddr("192.0.2.2", 1000),
+			},
+			wantErr: []error{nil, errTooManyConnsPerSource, nil},
+		},
+		{
+			name:   "IPv6 sources grouped by /64",
+			limits: Limits{MaxConnsPerSource: 1, SourcePrefixV6: 64},
+			addrs: []net.Addr{
+				tcpAddr("2001:db8::1", 1000),
+				tcpAddr("2001:db8::2", 1000),
+				tcpAddr("2001:db8:0:1::1", 1000),
+			},
+			wantErr: []error{nil, errTooManyConnsPerSource, nil},
+		},
+		{
+			name:   "IPv4-mapped addresses grouped with IPv4",
+			limits: Limits{MaxConnsPerSource: 1},
+			addrs: []net.Addr{
+				tcpAddr("192.0.2.1", 1000),
+				tcpAddr("::ffff:192.0.2.1", 1001),
+			},
+			wantErr: []error{nil, errTooManyConnsPerSource},
+		},
+		{
+			name: "exempt sources only count toward the global cap",
+			limits: Limits{
+				MaxConns:          3,
+				MaxConnsPerSource: 1,
+				Exempt:            []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+			},
+			addrs: []net.Addr{
+				tcpAddr("198.51.100.7", 1000),
+				tcpAddr("198.51.100.7", 1001),
+				tcpAddr("::ffff:198.51.100.8", 1000),
+				tcpAddr("198.51.100.9", 1000),
+			},
+			wantErr: []error{nil, nil, nil, errTooManyConns},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(tt.limits)
+			for i, addr := range tt.addrs {
+				_, err := l.acquireConn(addr)
+				if err != tt.wantErr[i] {
+					t.Fatalf("acquireConn(%s) #%d error mismatch:\n\tgot:  %v\n\twant: %v",
+						addr, i, err, tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter_acquireConn_Release(t *testing.T) {
+	l := newLimiter(Limits{MaxConns: 1, MaxConnsPerSource: 1})
+	addr := tcpAddr("192.0.2.1", 1000)
+
+	release, err := l.acquireConn(addr)
+	if err != nil {
+		t.Fatalf("first acquireConn() failed: %v", err)
+	}
+	if _, err := l.acquireConn(addr); err == nil {
+		t.Fatal("second acquireConn() should fail while the first is held")
+	}
+
+	release()
+	release() // releasing twice must not free an extra slot
+
+	if _, err := l.acquireConn(addr); err != nil {
+		t.Fatalf("acquireConn() after release failed: %v", err)
+	}
+	if _, err := l.acquireConn(tcpAddr("192.0.2.2", 1000)); err == nil {
+		t.Fatal("double release freed an extra slot")
+	}
+}
+
+func TestLimiter_allowPacket(t *testing.T) {
+	l := newLimiter(Limits{PacketRate: 10, PacketBurst: 3})
+
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	a := tcpAddr("192.0.2.1", 1000)
+	b := tcpAddr("192.0.2.2", 1000)
+
+	for i := range 3 {
+		if !l.allowPacket(a) {
+			t.Fatalf("packet %d within burst was refused", i)
+		}
+	}
+	if l.allowPacket(a) {
+		t.Fatal("packet above burst was allowed")
+	}
+	if !l.allowPacket(b) {
+		t.Fatal("another source must have its own bucket")
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	if !l.allowPacket(a) {
+		t.Fatal("bucket did not refill after 1/rate")
+	}
+	if l.allowPacket(a) {
+		t.Fatal("bucket refilled more than one token")
+	}
+
+	now = now.Add(time.Hour)
+	for i := range 3 {
+		if !l.allowPacket(a) {
+			t.Fatalf("packet %d after long idle was refused", i)
+		}
+	}
+	if l.allowPacket(a) {
+		t.Fatal("bucket refilled above burst")
+	}
+}
+
+func TestLimiter_allowPacket_Exempt(t *testing.T) {
+	l := newLimiter(Limits{
+		PacketRate:  1,
+		PacketBurst: 1,
+		Exempt:      []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")},
+	})
+
+	for i := range 10 {
+		if !l.allowPacket(tcpAddr("2001:db8::1", 1000)) {
+			t.Fatalf("packet %d from exempt source was refused", i)
+		}
+	}
+}
+
+func TestLimiter_noteDrop(t *testing.T) {
+	l := newLimiter(Limits{})
+
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	if n, warn := l.noteDrop(); !warn || n != 1 {
+		t.Fatalf("first drop: got (%d, %v), want (1, true)", n, warn)
+	}
+	for range 4 {
+		if _, warn := l.noteDrop(); warn {
+			t.Fatal("warned again within dropWarnInterval")
+		}
+	}
+
+	now = now.Add(dropWarnInterval)
+	if n, warn := l.noteDrop(); !warn || n != 5 {
+		t.Fatalf("drop after dropWarnInterval: got (%d, %v), want (5, true)", n, warn)
+	}
+}
+
+func TestLimiter_Handlers(t *testing.T) {
+	l := newLimiter(Limits{MaxInFlight: 1})
+
+	if !l.tryAcquireHandler() {
+		t.Fatal("first tryAcquireHandler() failed")
+	}
+	if l.tryAcquireHandler() {
+		t.Fatal("tryAcquireHandler() above bound succeeded")
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if l.acquireHandler(stop) {
+		t.Fatal("acquireHandler() must give up once stop is closed")
+	}
+
+	l.releaseHandler()
+	if !l.acquireHandler(nil) {
+		t.Fatal("acquireHandler() after release failed")
+	}
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var l *limiter
+
+	release, err := l.acquireConn(tcpAddr("192.0.2.1", 1000))
+	if err != nil {
+		t.Fatalf("nil limiter refused a connection: %v", err)
+	}
+	release()
+
+	if !l.allowPacket(tcpAddr("192.0.2.1", 1000)) {
+		t.Fatal("nil limiter refused a packet")
+	}
+	if !l.tryAcquireHandler() || !l.acquireHandler(nil) {
+		t.Fatal("nil limiter refused a handler slot")
+	}
+	l.releaseHandler()
+}
+
+func TestServer_handleConn_RateLimited(t *testing.T) {
+	frame := []byte{packet.TypeGetIdentityRequest, 0x00, 0x00}
+	conn := testutil.NewMockConn(withHello(frame, frame, frame))
+
+	s := &Server{limiter: newLimiter(Limits{PacketRate: 0.001, PacketBurst: 1})}
+
+	handled := make(chan struct{}, 3)
+	s.Handle(packet.TypeGetIdentityRequest, func(packet.Packet, net.Conn, *Server) {
+		handled <- struct{}{}
+	})
+
+	s.handleConn(conn)
+
+	if got := len(handled); got != 1 {
+		t.Errorf("handled packets mismatch:\n\tgot:  %d\n\twant: 1", got)
+	}
+	if got := s.Metrics().PacketsRateLimited; got != 2 {
+		t.Errorf("PacketsRateLimited mismatch:\n\tgot:  %d\n\twant: 2", got)
+	}
+}
+
+func TestServer_Serve_ConnCap(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+
+	s := &Server{
+		ln:      ln,
+		stop:    make(chan struct{}),
+		limiter: newLimiter(Limits{MaxConns: 1}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx)
+		close(done)
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("first dial failed: %v", err)
+	}
+	defer func() { _ = first.Close() }()
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("second dial failed: %v", err)
+	}
+	defer func() { _ = second.Close() }()
+
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Error("second connection should have been closed by the server")
+	}
+
+	m := s.Metrics()
+	if m.ConnsAccepted != 1 || m.ConnsRejectedGlobal != 1 {
+		t.Errorf("metrics mismatch: %s", m)
+	}
+
+	_ = first.Close()
+	cancel()
+	<-done
+}
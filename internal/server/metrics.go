@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Metrics holds the server counters. All fields are safe for concurrent use.
+type Metrics struct {
+	ConnsAccepted        atomic.Uint64
+	ConnsRejectedGlobal  atomic.Uint64
+	ConnsRejectedSource  atomic.Uint64
+	PacketsRateLimited   atomic.Uint64
+	HandlersThrottled    atomic.Uint64
+	QueueFull            atomic.Uint64
+	CoverLoopsSent       atomic.Uint64
+	CoverDropsSent       atomic.Uint64
+	CoverDropped         atomic.Uint64
+	DuplicatesDropped    atomic.Uint64
+	SharesReceived       atomic.Uint64
+	MessagesReassembled  atomic.Uint64
+	AcksSent             atomic.Uint64
+	AcksDelivered        atomic.Uint64
+	DescriptorsStored    atomic.Uint64
+	IntroductionsRelayed atomic.Uint64
+	RendezvousJoined     atomic.Uint64
+	SphinxProcessed      atomic.Uint64
+	ExitRejected         atomic.Uint64
+	ResolveFailed        atomic.Uint64
+}
+
+// MetricsSnapshot is a point-in-time copy of Metrics.
+type MetricsSnapshot struct {
+	ConnsAccepted        uint64
+	ConnsRejectedGlobal  uint64
+	ConnsRejectedSource  uint64
+	PacketsRateLimited   uint64
+	HandlersThrottled    uint64
+	QueueFull            uint64
+	CoverLoopsSent       uint64
+	CoverDropsSent       uint64
+	CoverDropped         uint64
+	DuplicatesDropped    uint64
+	SharesReceived       uint64
+	MessagesReassembled  uint64
+	AcksSent             uint64
+	AcksDelivered        uint64
+	DescriptorsStored    uint64
+	IntroductionsRelayed uint64
+	RendezvousJoined     uint64
+	SphinxProcessed      uint64
+	ExitRejected         uint64
+	ResolveFailed        uint64
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		ConnsAccepted:        m.ConnsAccepted.Load(),
+		ConnsRejectedGlobal:  m.ConnsRejectedGlobal.Load(),
+		ConnsRejectedSource:  m.ConnsRejectedSource.Load(),
+		PacketsRateLimited:   m.PacketsRateLimited.Load(),
+		HandlersThrottled:    m.HandlersThrottled.Load(),
+		QueueFull:            m.QueueFull.Load(),
+		CoverLoopsSent:       m.CoverLoopsSent.Load(),
+		CoverDropsSent:       m.CoverDropsSent.Load(),
+		CoverDropped:         m.CoverDropped.Load(),
+		DuplicatesDropped:    m.DuplicatesDropped.Load(),
+		SharesReceived:       m.SharesReceived.Load(),
+		MessagesReassembled:  m.MessagesReassembled.Load(),
+		AcksSent:             m.AcksSent.Load(),
+		AcksDelivered:        m.AcksDelivered.Load(),
+		DescriptorsStored:    m.DescriptorsStored.Load(),
+		IntroductionsRelayed: m.IntroductionsRelayed.Load(),
+		RendezvousJoined:     m.RendezvousJoined.Load(),
+		SphinxProcessed:      m.SphinxProcessed.Load(),
+		ExitRejected:         m.ExitRejected.Load(),
+		ResolveFailed:        m.ResolveFailed.Load(),
+	}
+}
+
+func (m MetricsSnapshot) String() string {
+	return fmt.Sprintf(
+		"{accepted=%d rejected_global=%d rejected_source=%d rate_limited=%d throttled=%d queue_full=%d cover_loops_sent=%d cover_drops_sent=%d cover_dropped=%d duplicates=%d shares=%d reassembled=%d acks_sent=%d acks_delivered=%d descriptors=%d introductions=%d rendezvous=%d sphinx=%d exit_rejected=%d resolve_failed=%d}",
+		m.ConnsAccepted,
+		m.ConnsRejectedGlobal,
+		m.ConnsRejectedSource,
+		m.PacketsRateLimited,
+		m.HandlersThrottled,
+		m.QueueFull,
+		m.CoverLoopsSent,
+		m.CoverDropsSent,
+		m.CoverDropped,
+		m.DuplicatesDropped,
+		m.SharesReceived,
+		m.MessagesReassembled,
+		m.AcksSent,
+		m.AcksDelivered,
+		m.DescriptorsStored,
+		m.IntroductionsRelayed,
+		m.RendezvousJoined,
+		m.SphinxProcessed,
+		m.ExitRejected,
+		m.ResolveFailed,
+	)
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MixMode selects how a relay holds decrypted packets before forwarding them,
+// so that the order and timing of its output do not mirror its input.
+type MixMode int
+
+const (
+	// MixNone forwards every packet as soon as it is decrypted.
+	MixNone MixMode = iota
+	// MixPoisson delays every packet independently by an exponentially
+	// distributed amount (continuous-time mix).
+	MixPoisson
+	// MixTimed pools packets and flushes them in a shuffled order every
+	// Interval, or as soon as Threshold packets are pooled.
+	MixTimed
+)
+
+func (m MixMode) String() string {
+	switch m {
+	case MixNone:
+		return "none"
+	case MixPoisson:
+		return "poisson"
+	case MixTimed:
+		return "timed"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseMixMode parses the name of a MixMode as returned by its String method.
+func ParseMixMode(s string) (MixMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return MixNone, nil
+	case "poisson":
+		return MixPoisson, nil
+	case "timed":
+		return MixTimed, nil
+	default:
+		return MixNone, fmt.Errorf("unknown mix mode %q (none, poisson, timed)", s)
+	}
+}
+
+// MixConfig configures the relay mix.
+//
+// Packets may request a delay class through the onion layer flags. In
+// poisson mode a class c uses a mean delay of c*ClassUnit instead of
+// MeanDelay; in timed mode the packet stays in the pool for c extra flushes.
+type MixConfig struct {
+	Mode MixMode
+
+	MeanDelay time.Duration // poisson: mean delay of packets without class
+	ClassUnit time.Duration // poisson: mean delay added per requested class
+	MaxDelay  time.Duration // poisson: upper bound of any delay (0 = none)
+
+	Threshold int           // timed: pool size triggering a flush (0 = timer only)
+	Interval  time.Duration // timed: flush period
+}
+
+// DefaultMixConfig returns a disabled mix with sensible values for the
+// other modes.
+func DefaultMixConfig() MixConfig {
+	return MixConfig{
+		Mode:      MixNone,
+		MeanDelay: 200 * time.Millisecond,
+		ClassUnit: 100 * time.Millisecond,
+		MaxDelay:  5 * time.Second,
+		Threshold: 16,
+		Interval:  time.Second,
+	}
+}
+
+// mixer holds outbound sends and releases them later. close flushes what is
+// still pending.
+type mixer interface {
+	submit(class uint8, send func())
+	close()
+}
+
+func newMixer(cfg MixConfig) (mixer, error) {
+	switch cfg.Mode {
+	case MixNone:
+		return nil, nil
+	case MixPoisson:
+		if cfg.MeanDelay < 0 || cfg.ClassUnit < 0 || cfg.MaxDelay < 0 {
+			return nil, fmt.Errorf("mix delays cannot be negative")
+		}
+		return newPoissonMixer(cfg), nil
+	case MixTimed:
+		if cfg.Interval <= 0 {
+			return nil, fmt.Errorf("mix interval must be positive, got %s", cfg.Interval)
+		}
+		if cfg.Threshold < 0 {
+			return nil, fmt.Errorf("mix threshold cannot be negative, got %d", cfg.Threshold)
+		}
+		return newTimedMixer(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown mix mode %d", cfg.Mode)
+	}
+}
+
+type poissonMixer struct {
+	cfg MixConfig
+
+	mu      sync.Mutex
+	pending map[*time.Timer]func()
+	closed  bool
+	wg      sync.WaitGroup
+
+	// sample draws an exponential variate of mean 1; replaced in tests.
+	sample func() float64
+}
+
+func newPoissonMixer(cfg MixConfig) *poissonMixer {
+	return &poissonMixer{
+		cfg:     cfg,
+		pending: make(map[*time.Timer]func()),
+		sample:  rand.ExpFloat64,
+	}
+}
+
+func (m *poissonMixer) delay(class uint8) time.Duration {
+	mean := m.cfg.MeanDelay
+	if class > 0 {
+		mean = time.Duration(class) * m.cfg.ClassUnit
+	}
+
+	d := time.Duration(m.sample() * float64(mean))
+	if m.cfg.MaxDelay > 0 && d > m.cfg.MaxDelay {
+		d = m.cfg.MaxDelay
+	}
+	return d
+}
+
+func (m *poissonMixer) submit(class uint8, send func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		m.wg.Go(send)
+		return
+	}
+
+	m.wg.Add(1)
+	var t *time.Timer
+	t = time.AfterFunc(m.delay(class), func() {
+		defer m.wg.Done()
+
+		m.mu.Lock()
+		_, ok := m.pending[t]
+		delete(m.pending, t)
+		m.mu.Unlock()
+
+		if ok {
+			send()
+		}
+	})
+	m.pending[t] = send
+}
+
+func (m *poissonMixer) close() {
+	m.mu.Lock()
+	m.closed = true
+	var flush []func()
+	for t, send := range m.pending {
+		// Timers that already fired send on their own.
+		if t.Stop() {
+			flush = append(flush, send)
+			delete(m.pending, t)
+			m.wg.Done()
+		}
+	}
+	m.mu.Unlock()
+
+	for _, send := range flush {
+		send()
+	}
+	m.wg.Wait()
+}
+
+type mixEntry struct {
+	rounds uint8
+	send   func()
+}
+
+type timedMixer struct {
+	cfg MixConfig
+
+	mu   sync.Mutex
+	pool []mixEntry
+	wg   sync.WaitGroup // flushed sends still running
+
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+func newTimedMixer(cfg MixConfig) *timedMixer {
+	m := &timedMixer{
+		cfg:  cfg,
+		full: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *timedMixer) submit(class uint8, send func()) {
+	m.mu.Lock()
+	m.pool = append(m.pool, mixEntry{rounds: class, send: send})
+	reached := m.cfg.Threshold > 0 && len(m.pool) >= m.cfg.Threshold
+	m.mu.Unlock()
+
+	if reached {
+		select {
+		case m.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *timedMixer) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.flush(false)
+		case <-m.full:
+			m.flush(false)
+		case <-m.stop:
+			m.flush(true)
+			return
+		}
+	}
+}
+
+// flush sends the pooled packets whose rounds are over, in a random order.
+// The other ones get one round closer. With all set, everything is sent.
+// Each send runs on its own goroutine, so that an unreachable next hop does
+// not hold back the rest of the round nor the next ones.
+func (m *timedMixer) flush(all bool) {
+	m.mu.Lock()
+	var out []mixEntry
+	kept := m.pool[:0]
+	for _, e := range m.pool {
+		if all || e.rounds == 0 {
+			out = append(out, e)
+			continue
+		}
+		e.rounds--
+		kept = append(kept, e)
+	}
+	clear(m.pool[len(kept):])
+	m.pool = kept
+	m.mu.Unlock()
+
+	rand.Shuffle(len(out), func(i, j int) {
+		out[i], out[j] = out[j], out[i]
+	})
+	for _, e := range out {
+		m.wg.Go(e.send)
+	}
+}
+
+func (m *timedMixer) close() {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+	<-m.done
+
+	// Late submissions made while the final flush was running.
+	m.flush(true)
+	m.wg.Wait()
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseMixMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in      string
+		want    MixMode
+		wantErr bool
+	}{
+		{in: "", want: MixNone},
+		{in: "none", want: MixNone},
+		{in: "Poisson", want: MixPoisson},
+		{in: "timed", want: MixTimed},
+		{in: "pool", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseMixMode(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMixMode(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Fatalf("ParseMixMode(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMixer(t *testing.T) {
+	t.Parallel()
+
+	m, err := newMixer(MixConfig{Mode: MixNone})
+	if err != nil || m != nil {
+		t.Fatalf("newMixer(none) = %v, %v; want nil, nil", m, err)
+	}
+
+	if _, err := newMixer(MixConfig{Mode: MixTimed}); err == nil {
+		t.Fatal("expected error for timed mix without interval")
+	}
+	if _, err := newMixer(MixConfig{Mode: MixPoisson, MeanDelay: -1}); err == nil {
+		t.Fatal("expected error for negative delay")
+	}
+	if _, err := newMixer(MixConfig{Mode: MixMode(42)}); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+// recorder collects the order in which mixed sends run.
+type recorder struct {
+	mu  sync.Mutex
+	ids []int
+}
+
+func (r *recorder) send(id int) func() {
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.ids = append(r.ids, id)
+	}
+}
+
+func (r *recorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.ids)
+}
+
+func TestPoissonMixer_Delay(t *testing.T) {
+	t.Parallel()
+
+	m := newPoissonMixer(MixConfig{
+		Mode:      MixPoisson,
+		MeanDelay: 100 * time.Millisecond,
+		ClassUnit: 10 * time.Millisecond,
+		MaxDelay:  time.Second,
+	})
+	m.sample = func() float64 { return 2 }
+
+	if got := m.delay(0); got != 200*time.Millisecond {
+		t.Errorf("delay(0) = %s, want 200ms", got)
+	}
+	if got := m.delay(3); got != 60*time.Millisecond {
+		t.Errorf("delay(3) = %s, want 60ms", got)
+	}
+
+	m.sample = func() float64 { return 50 }
+	if got := m.delay(0); got != time.Second {
+		t.Errorf("delay capped = %s, want 1s", got)
+	}
+}
+
+func TestPoissonMixer_SendsAfterDelay(t *testing.T) {
+	t.Parallel()
+
+	m := newPoissonMixer(MixConfig{Mode: MixPoisson, MeanDelay: 20 * time.Millisecond})
+	m.sample = func() float64 { return 1 }
+
+	var r recorder
+	m.submit(0, r.send(1))
+
+	if r.len() != 0 {
+		t.Fatal("packet forwarded before its delay")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet never forwarded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	m.close()
+}
+
+func TestPoissonMixer_CloseFlushes(t *testing.T) {
+	t.Parallel()
+
+	m := newPoissonMixer(MixConfig{Mode: MixPoisson, MeanDelay: time.Hour})
+	m.sample = func() float64 { return 1 }
+
+	var r recorder
+	for i := range 5 {
+		m.submit(0, r.send(i))
+	}
+	m.close()
+
+	if got := r.len(); got != 5 {
+		t.Fatalf("sent after close = %d, want 5", got)
+	}
+}
+
+func TestTimedMixer_Threshold(t *testing.T) {
+	t.Parallel()
+
+	m := newTimedMixer(MixConfig{Mode: MixTimed, Threshold: 4, Interval: time.Hour})
+	defer m.close()
+
+	var r recorder
+	for i := range 3 {
+		m.submit(0, r.send(i))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := r.len(); got != 0 {
+		t.Fatalf("sent below threshold = %d, want 0", got)
+	}
+
+	m.submit(0, r.send(3))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.len() != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("sent after threshold = %d, want 4", r.len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTimedMixer_Rounds(t *testing.T) {
+	t.Parallel()
+
+	m := newTimedMixer(MixConfig{Mode: MixTimed, Interval: time.Hour})
+	defer m.close()
+
+	var r recorder
+	m.submit(0, r.send(0))
+	m.submit(2, r.send(1))
+
+	m.flush(false)
+	m.wg.Wait()
+	if got := r.len(); got != 1 {
+		t.Fatalf("sent after first flush = %d, want 1", got)
+	}
+	m.flush(false)
+	m.wg.Wait()
+	if got := r.len(); got != 1 {
+		t.Fatalf("sent after second flush = %d, want 1", got)
+	}
+	m.flush(false)
+	m.wg.Wait()
+	if got := r.len(); got != 2 {
+		t.Fatalf("sent after third flush = %d, want 2", got)
+	}
+}
+
+func TestTimedMixer_CloseFlushes(t *testing.T) {
+	t.Parallel()
+
+	m := newTimedMixer(MixConfig{Mode: MixTimed, Interval: time.Hour})
+
+	var r recorder
+	for i := range 5 {
+		m.submit(uint8(i), r.send(i))
+	}
+	m.close()
+
+	if got := r.len(); got != 5 {
+		t.Fatalf("sent after close = %d, want 5", got)
+	}
+}
+
+func TestTimedMixer_StalledSend(t *testing.T) {
+	t.Parallel()
+
+	m := newTimedMixer(MixConfig{Mode: MixTimed, Interval: time.Hour})
+
+	stalled := make(chan struct{})
+	var r recorder
+	m.submit(0, func() { <-stalled })
+	for i := range 3 {
+		m.submit(0, r.send(i))
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		m.flush(false)
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("flush blocked on a stalled send")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.len() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("sent beside the stalled one = %d, want 3", r.len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(stalled)
+	m.close()
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+)
+
+// workerPool runs jobs on a fixed set of goroutines fed by a bounded queue.
+type workerPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+
+	closeOnce sync.Once
+}
+
+// DefaultWorkers returns the default pool size: one worker per CPU.
+func DefaultWorkers() int {
+	return runtime.NumCPU()
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	if workers < 1 {
+		workers = DefaultWorkers()
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &workerPool{
+		jobs: make(chan func(), queueSize),
+	}
+	for range workers {
+		p.wg.Go(func() {
+			for job := range p.jobs {
+				job()
+			}
+		})
+	}
+	return p
+}
+
+// trySubmit queues job without blocking. It reports whether it was queued.
+func (p *workerPool) trySubmit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// submit queues job, blocking while the queue is full. It returns false if
+// stop is closed first, in which case job will never run.
+func (p *workerPool) submit(stop <-chan struct{}, job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// close stops accepting jobs and waits for the queued ones to complete.
+func (p *workerPool) close() {
+	p.closeOnce.Do(func() {
+		close(p.jobs)
+	})
+	p.wg.Wait()
+}
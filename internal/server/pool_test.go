@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
+)
+
+func TestWorkerPool_BoundedConcurrency(t *testing.T) {
+	const workers = 2
+
+	p := newWorkerPool(workers, 16)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		p.submit(nil, func() {
+			defer wg.Done()
+			n := running.Add(1)
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			running.Add(-1)
+		})
+	}
+	wg.Wait()
+	p.close()
+
+	if got := peak.Load(); got > workers {
+		t.Fatalf("concurrent jobs exceeded pool size:\n\tgot:  %d\n\twant: <= %d", got, workers)
+	}
+}
+
+func TestWorkerPool_Backpressure(t *testing.T) {
+	p := newWorkerPool(1, 1)
+	defer p.close()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p.submit(nil, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	if !p.trySubmit(func() {}) {
+		t.Fatal("trySubmit() failed while the queue had room")
+	}
+	if p.trySubmit(func() {}) {
+		t.Fatal("trySubmit() succeeded on a full queue")
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if p.submit(stop, func() {}) {
+		t.Fatal("submit() on a full queue must give up once stop is closed")
+	}
+
+	close(release)
+}
+
+func TestServer_handleConn_OnionPacketsUsePool(t *testing.T) {
+	tests := []packet.Packet{
+		&packet.OnionPacket{},
+		&packet.SphinxPacket{},
+		&packet.HybridOnionPacket{},
+	}
+
+	for _, pkt := range tests {
+		t.Run(fmt.Sprintf("%T", pkt), func(t *testing.T) {
+			var frame bytes.Buffer
+			if err := packet.WritePacket(nil, &frame, pkt); err != nil {
+				t.Fatalf("WritePacket() failed: %v", err)
+			}
+			raw := frame.Bytes()
+
+			caps := handshake.CapSphinx | handshake.CapHybrid
+			conn := testutil.NewMockConn(withHelloCaps(caps, raw, raw, raw))
+
+			s := &Server{Pi: &identity.PrivateIdentity{}, pool: newWorkerPool(1, 1)}
+			withKEM(t)(s)
+			defer s.pool.close()
+
+			var handled atomic.Int32
+			s.Handle(pkt.Type(), func(packet.Packet, net.Conn, *Server) {
+				time.Sleep(20 * time.Millisecond)
+				handled.Add(1)
+			})
+
+			s.handleConn(conn)
+
+			if got := handled.Load(); got != 3 {
+				t.Fatalf("handleConn returned before pooled jobs completed:\n\tgot:  %d\n\twant: 3", got)
+			}
+			// One packet runs, one waits in the queue, the third finds it full.
+			if got := s.Metrics().QueueFull; got == 0 {
+				t.Fatal("packets were not queued on the pool")
+			}
+			if !conn.IsClosed() {
+				t.Error("connection should be closed")
+			}
+		})
+	}
+}
+
+func TestPeerConn_SerializedWrites(t *testing.T) {
+	mock := testutil.NewMockConn(nil)
+	conn := &peerConn{Conn: mock}
+
+	const writers = 16
+
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Go(func() {
+			resp := &packet.GetIdentityResponse{Ruuid: [16]byte{byte(i)}}
+			if err := packet.WritePacket(nil, conn, resp); err != nil {
+				t.Errorf("WritePacket() failed: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	r := bytes.NewReader(mock.GetWrittenBytes())
+	for i := range writers {
+		p, err := packet.ReadPacket(nil, r)
+		if err != nil {
+			t.Fatalf("frame %d corrupted: %v", i, err)
+		}
+		if p.Type() != packet.TypeGetIdentityResponse {
+			t.Fatalf("frame %d type mismatch: 0x%02x", i, p.Type())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/erasure"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+)
+
+const (
+	// reassemblyTTL is how long the shares of an incomplete message are kept.
+	reassemblyTTL = time.Minute
+	// maxPendingMessages bounds the messages being reassembled at once.
+	maxPendingMessages = 4096
+)
+
+type pendingMessage struct {
+	k, n    uint8
+	size    uint16
+	shards  [][]byte
+	count   int
+	done    bool // rebuilt already, late shares are ignored
+	expires time.Time
+}
+
+// reassembler collects the erasure-coded shares of messages until any k of
+// them rebuild the payload.
+type reassembler struct {
+	mu      sync.Mutex
+	pending map[[16]byte]*pendingMessage
+
+	now func() time.Time
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		pending: make(map[[16]byte]*pendingMessage),
+		now:     time.Now,
+	}
+}
+
+// add stores the data of share. It returns the rebuilt message once k shares
+// of it were received, and nil before that.
+func (r *reassembler) add(share onion.Share, data []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	m, ok := r.pending[share.MessageID]
+	if ok && !now.Before(m.expires) {
+		delete(r.pending, share.MessageID)
+		ok = false
+	}
+
+	if !ok {
+		if len(r.pending) >= maxPendingMessages {
+			r.sweep(now)
+			if len(r.pending) >= maxPendingMessages {
+				return nil, fmt.Errorf("too many messages being reassembled")
+			}
+		}
+		m = &pendingMessage{
+			k:       share.K,
+			n:       share.N,
+			size:    share.Size,
+			shards:  make([][]byte, share.N),
+			expires: now.Add(reassemblyTTL),
+		}
+		r.pending[share.MessageID] = m
+	}
+
+	if m.done {
+		return nil, nil
+	}
+	if share.K != m.k || share.N != m.n || share.Size != m.size {
+		return nil, fmt.Errorf("share %d does not match the other shares of its message", share.Index)
+	}
+	if m.shards[share.Index] != nil {
+		return nil, nil
+	}
+
+	m.shards[share.Index] = data
+	m.count++
+	if m.count < int(m.k) {
+		return nil, nil
+	}
+
+	msg, err := erasure.Join(m.shards, int(m.k), int(m.size))
+	if err != nil {
+		delete(r.pending, share.MessageID)
+		return nil, err
+	}
+
+	m.done = true
+	m.shards = nil
+	return msg, nil
+}
+
+// sweep drops the expired messages. Callers hold r.mu.
+func (r *reassembler) sweep(now time.Time) {
+	for id, m := range r.pending {
+		if !now.Before(m.expires) {
+			delete(r.pending, id)
+		}
+	}
+}
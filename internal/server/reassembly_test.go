@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/erasure"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil"
+)
+
+func TestReassembler_add(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("erasure-coded message")
+	shards, err := erasure.Split(payload, 2, 3)
+	if err != nil {
+		t.Fatalf("Split() failed: %v", err)
+	}
+
+	r := newReassembler()
+	share := onion.Share{MessageID: [16]byte{1}, K: 2, N: 3, Size: uint16(len(payload))}
+
+	share.Index = 2
+	if msg, err := r.add(share, shards[2]); err != nil || msg != nil {
+		t.Fatalf("first share: got %q, %v; want nil, nil", msg, err)
+	}
+	if msg, err := r.add(share, shards[2]); err != nil || msg != nil {
+		t.Fatalf("repeated share: got %q, %v; want nil, nil", msg, err)
+	}
+
+	share.Index = 0
+	msg, err := r.add(share, shards[0])
+	if err != nil {
+		t.Fatalf("second share failed: %v", err)
+	}
+	if !bytes.Equal(msg, payload) {
+		t.Fatalf("reassembled %q, want %q", msg, payload)
+	}
+
+	share.Index = 1
+	if msg, err := r.add(share, shards[1]); err != nil || msg != nil {
+		t.Fatalf("late share: got %q, %v; want nil, nil", msg, err)
+	}
+}
+
+func TestReassembler_Mismatch(t *testing.T) {
+	t.Parallel()
+
+	r := newReassembler()
+	share := onion.Share{MessageID: [16]byte{1}, K: 2, N: 3, Size: 10}
+	if _, err := r.add(share, make([]byte, 5)); err != nil {
+		t.Fatalf("add() failed: %v", err)
+	}
+
+	share.Index, share.K = 1, 3
+	if _, err := r.add(share, make([]byte, 5)); err == nil {
+		t.Fatal("expected error for inconsistent share")
+	}
+}
+
+func TestReassembler_Expiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	r := newReassembler()
+	r.now = func() time.Time { return now }
+
+	payload := []byte("expiring")
+	shards, err := erasure.Split(payload, 2, 2)
+	if err != nil {
+		t.Fatalf("Split() failed: %v", err)
+	}
+	share := onion.Share{MessageID: [16]byte{1}, K: 2, N: 2, Size: uint16(len(payload))}
+
+	if _, err := r.add(share, shards[0]); err != nil {
+		t.Fatalf("add() failed: %v", err)
+	}
+
+	now = now.Add(reassemblyTTL)
+	share.Index = 1
+	if msg, err := r.add(share, shards[1]); err != nil || msg != nil {
+		t.Fatalf("share after expiry: got %q, %v; want nil, nil", msg, err)
+	}
+}
+
+func TestHandleOnionPacket_Shares(t *testing.T) {
+	t.Parallel()
+
+	pi := testPrivateIdentity(t)
+	s := &Server{Pi: pi}
+
+	path := []identity.CryptoGroup{{
+		Group: identity.RelayGroup{Relays: []identity.Relay{{
+			Ep:     identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 62503},
+			UUID:   pi.UUID,
+			PubKey: pi.PubKey,
+		}}},
+	}}
+	dest := identity.Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	shares, err := onion.BuildOnionShares(dest, path, []byte("split me"), 2, 3)
+	if err != nil {
+		t.Fatalf("BuildOnionShares() failed: %v", err)
+	}
+
+	for _, so := range shares[1:] {
+		raw, err := so.Layer.BytesPadded()
+		if err != nil {
+			t.Fatalf("BytesPadded() failed: %v", err)
+		}
+		var pkt packet.OnionPacket
+		copy(pkt.Data[:], raw)
+
+		handleOnionPacket(&pkt, testutil.NewMockConn(nil), s)
+	}
+
+	m := s.Metrics()
+	if m.SharesReceived != 2 || m.MessagesReassembled != 1 {
+		t.Fatalf("metrics mismatch: %s", m)
+	}
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+const (
+	// maxDescriptorTTL caps how long a descriptor is kept, whatever its
+	// expiry.
+	maxDescriptorTTL = 3 * time.Hour
+	// introTTL is how long an introduction registration is kept. Services
+	// renew theirs well before.
+	introTTL = 10 * time.Minute
+	// guardTTL is how long a guard keeps the address of a service.
+	guardTTL = 10 * time.Minute
+	// guardClockSkew bounds how far the time of a guard registration may be
+	// from the clock of the guard.
+	guardClockSkew = 5 * time.Minute
+	// rendezvousTTL is how long a message waits for its service to join.
+	rendezvousTTL = time.Minute
+	// maxServiceEntries bounds each table of the rendezvous state.
+	maxServiceEntries = 4096
+)
+
+type expiringEntry[V any] struct {
+	v       V
+	expires time.Time
+}
+
+// expiringMap is a bounded map whose entries expire. Callers hold the lock
+// of the rendezvous state.
+type expiringMap[K comparable, V any] struct {
+	m map[K]expiringEntry[V]
+}
+
+func newExpiringMap[K comparable, V any]() expiringMap[K, V] {
+	return expiringMap[K, V]{m: make(map[K]expiringEntry[V])}
+}
+
+func (e expiringMap[K, V]) put(k K, v V, expires, now time.Time) error {
+	if _, ok := e.m[k]; !ok && len(e.m) >= maxServiceEntries {
+		for k, entry := range e.m {
+			if !now.Before(entry.expires) {
+				delete(e.m, k)
+			}
+		}
+		if len(e.m) >= maxServiceEntries {
+			return fmt.Errorf("table full")
+		}
+	}
+	e.m[k] = expiringEntry[V]{v: v, expires: expires}
+	return nil
+}
+
+func (e expiringMap[K, V]) get(k K, now time.Time) (V, bool) {
+	entry, ok := e.m[k]
+	if !ok || !now.Before(entry.expires) {
+		delete(e.m, k)
+		var zero V
+		return zero, false
+	}
+	return entry.v, true
+}
+
+func (e expiringMap[K, V]) take(k K, now time.Time) (V, bool) {
+	v, ok := e.get(k, now)
+	delete(e.m, k)
+	return v, ok
+}
+
+// rendezvousState holds what a relay knows as a descriptor directory,
+// introduction relay, rendezvous relay and guard of hidden services.
+type rendezvousState struct {
+	mu sync.Mutex
+
+	descriptors expiringMap[[32]byte, []byte]
+	intros      expiringMap[[32]byte, onion.IntroRegistration]
+	messages    expiringMap[[16]byte, []byte]
+	guards      expiringMap[[16]byte, guardEntry]
+
+	now func() time.Time
+}
+
+// guardEntry is the address of a service at its guard, with the key the
+// token is pinned to and the time of the registration it came from.
+type guardEntry struct {
+	ep   identity.Endpoint
+	key  [32]byte
+	time uint64
+}
+
+func newRendezvousState() *rendezvousState {
+	return &rendezvousState{
+		descriptors: newExpiringMap[[32]byte, []byte](),
+		intros:      newExpiringMap[[32]byte, onion.IntroRegistration](),
+		messages:    newExpiringMap[[16]byte, []byte](),
+		guards:      newExpiringMap[[16]byte, guardEntry](),
+		now:         time.Now,
+	}
+}
+
+func serviceKey(key ed25519.PublicKey) [32]byte {
+	var k [32]byte
+	copy(k[:], key)
+	return k
+}
+
+func handleServiceLookup(p packet.Packet, conn net.Conn, s *Server) {
+	req, ok := p.(*packet.ServiceLookupRequest)
+	if !ok {
+		connLog(conn).Warnf("Failed to cast packet to ServiceLookupRequest")
+		return
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	desc, _ := rs.descriptors.get(req.Key, rs.now())
+	rs.mu.Unlock()
+
+	connLog(conn).Debugf("Service lookup (found: %v)", desc != nil)
+
+	resp := &packet.ServiceLookupResponse{Descriptor: desc}
+	if err := packet.WritePacket(s.packets(), conn, resp); err != nil {
+		connLog(conn).Warnf("failed to send service lookup response: %v", err)
+	}
+}
+
+func handleGuardRegister(p packet.Packet, conn net.Conn, s *Server) {
+	req, ok := p.(*packet.GuardRegister)
+	if !ok {
+		connLog(conn).Warnf("Failed to cast packet to GuardRegister")
+		return
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		connLog(conn).Warnf("Guard registration over a non-TCP connection")
+		return
+	}
+	entry := guardEntry{
+		ep:   identity.Endpoint{IP: addr.IP, Port: req.Port},
+		key:  req.Key,
+		time: req.Time,
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	err := rs.registerGuard(req, entry)
+	rs.mu.Unlock()
+
+	if err != nil {
+		connLog(conn).Warnf("Guard registration refused: %v", err)
+		return
+	}
+	connLog(conn).With("token", hex.EncodeToString(req.Token[:4])).Debugf("Service registered at guard")
+}
+
+// registerGuard records entry under the token of req once req is signed,
+// fresh, and neither replayed nor from another key than the one the token
+// is pinned to while registered. Callers hold rs.mu.
+func (rs *rendezvousState) registerGuard(req *packet.GuardRegister, entry guardEntry) error {
+	if err := req.Verify(); err != nil {
+		return err
+	}
+
+	now := rs.now()
+	at := time.Unix(int64(req.Time), 0)
+	if at.Before(now.Add(-guardClockSkew)) || at.After(now.Add(guardClockSkew)) {
+		return fmt.Errorf("registration time %s too far from %s", at.UTC(), now.UTC())
+	}
+
+	if prev, ok := rs.guards.get(req.Token, now); ok {
+		if prev.key != entry.key {
+			return fmt.Errorf("token registered by another service key")
+		}
+		if entry.time < prev.time || entry.time == prev.time && !sameEndpoint(prev.ep, entry.ep) {
+			return fmt.Errorf("registration replayed")
+		}
+	}
+	return rs.guards.put(req.Token, entry, now.Add(guardTTL), now)
+}
+
+func sameEndpoint(a, b identity.Endpoint) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// handleServiceExtensions runs the rendezvous extensions of a last layer. It
+// reports whether the layer was one of them, in which case its payload is
+// not delivered further.
+func handleServiceExtensions(olc *onion.OnionLayerCiphered, s *Server, conn net.Conn) bool {
+	for _, ext := range olc.Extensions {
+		switch ext.Type {
+		case onion.ExtGuardDeliver:
+			deliverToService(ext, olc.Payload, s, conn)
+		case onion.ExtServicePublish:
+			storeDescriptor(ext, s, conn)
+		case onion.ExtIntroRegister:
+			registerIntro(ext, s, conn)
+		case onion.ExtIntroduce:
+			relayIntroduction(ext, olc.Payload, s, conn)
+		case onion.ExtRendezvous:
+			holdRendezvous(ext, olc.Payload, s, conn)
+		case onion.ExtRendezvousJoin:
+			joinRendezvous(ext, s, conn)
+		default:
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func deliverToService(ext onion.Extension, payload []byte, s *Server, conn net.Conn) {
+	token, kind, err := onion.ParseGuardDeliver(ext)
+	if err != nil {
+		connLog(conn).Warnf("%v", err)
+		return
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	entry, ok := rs.guards.get(token, rs.now())
+	rs.mu.Unlock()
+	ep := entry.ep
+	if !ok {
+		connLog(conn).With("token", hex.EncodeToString(token[:4])).Warnf("No service registered under token")
+		return
+	}
+
+	if !byAddress([]identity.Endpoint{ep}, conn) {
+		return
+	}
+	data := &packet.ServiceData{Token: token, Kind: kind, Data: payload}
+	if err := s.transport().Send(ep, data); err != nil {
+		connLog(conn).Warnf("Failed to hand data to service: %v", err)
+		return
+	}
+	connLog(conn).With("token", hex.EncodeToString(token[:4])).Debugf("Data of kind %d handed to service", kind)
+}
+
+func storeDescriptor(ext onion.Extension, s *Server, conn net.Conn) {
+	desc, err := identity.ParseServiceDescriptor(ext.Value)
+	if err != nil {
+		connLog(conn).Warnf("Invalid service descriptor: %v", err)
+		return
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := rs.now()
+	if err := desc.Verify(now); err != nil {
+		connLog(conn).Warnf("Service descriptor rejected: %v", err)
+		return
+	}
+
+	expires := desc.Expires
+	if limit := now.Add(maxDescriptorTTL); expires.After(limit) {
+		expires = limit
+	}
+	if err := rs.descriptors.put(serviceKey(desc.Key), ext.Value, expires, now); err != nil {
+		connLog(conn).Warnf("Service descriptor refused: %v", err)
+		return
+	}
+
+	s.metrics.DescriptorsStored.Add(1)
+	connLog(conn).With("service", identity.ServiceAddress(desc.Key)).Debugf("Descriptor stored")
+}
+
+func registerIntro(ext onion.Extension, s *Server, conn net.Conn) {
+	reg, err := onion.ParseIntroRegistration(ext)
+	if err != nil {
+		connLog(conn).Warnf("%v", err)
+		return
+	}
+	if err := reg.Verify(s.Pi.UUID); err != nil {
+		connLog(conn).Warnf("Introduction registration rejected: %v", err)
+		return
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	now := rs.now()
+	err = rs.intros.put(serviceKey(reg.Key), reg, now.Add(introTTL), now)
+	rs.mu.Unlock()
+
+	if err != nil {
+		connLog(conn).Warnf("Introduction registration refused: %v", err)
+		return
+	}
+	connLog(conn).With("service", identity.ServiceAddress(reg.Key)).Debugf("Introduction point registered")
+}
+
+func relayIntroduction(ext onion.Extension, payload []byte, s *Server, conn net.Conn) {
+	key, err := onion.ParseIntroduce(ext)
+	if err != nil {
+		connLog(conn).Warnf("%v", err)
+		return
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	reg, ok := rs.intros.get(serviceKey(key), rs.now())
+	rs.mu.Unlock()
+	if !ok {
+		connLog(conn).With("service", identity.ServiceAddress(key)).Warnf("Introduction for unknown service")
+		return
+	}
+
+	s.metrics.IntroductionsRelayed.Add(1)
+	sendToGuard(reg.Guard, reg.Token, onion.ServiceDataIntroduce, payload, s, conn)
+}
+
+func holdRendezvous(ext onion.Extension, payload []byte, s *Server, conn net.Conn) {
+	cookie, err := onion.ParseRendezvous(ext)
+	if err != nil {
+		connLog(conn).Warnf("%v", err)
+		return
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	now := rs.now()
+	err = rs.messages.put(cookie, payload, now.Add(rendezvousTTL), now)
+	rs.mu.Unlock()
+
+	if err != nil {
+		connLog(conn).Warnf("Rendezvous refused: %v", err)
+		return
+	}
+	connLog(conn).With("cookie", hex.EncodeToString(cookie[:4])).Debugf("Message held for rendezvous")
+}
+
+func joinRendezvous(ext onion.Extension, s *Server, conn net.Conn) {
+	join, err := onion.ParseRendezvousJoin(ext)
+	if err != nil {
+		connLog(conn).Warnf("%v", err)
+		return
+	}
+
+	rs := s.rendezvous()
+	rs.mu.Lock()
+	msg, ok := rs.messages.take(join.Cookie, rs.now())
+	rs.mu.Unlock()
+	if !ok {
+		connLog(conn).With("cookie", hex.EncodeToString(join.Cookie[:4])).Warnf("No message for rendezvous")
+		return
+	}
+
+	s.metrics.RendezvousJoined.Add(1)
+	sendToGuard(join.Guard, join.Token, onion.ServiceDataMessage, msg, s, conn)
+}
+
+// sendToGuard sends data to the service registered under token at guard,
+// through a one-hop onion.
+func sendToGuard(guard identity.Relay, token [16]byte, kind uint8, data []byte, s *Server, conn net.Conn) {
+	path := []identity.CryptoGroup{{Group: identity.RelayGroup{Relays: []identity.Relay{guard}}}}
+	if err := path[0].GenerateCryptoMaterial(); err != nil {
+		connLog(conn).Warnf("Failed to generate crypto material: %v", err)
+		return
+	}
+
+	layer, err := onion.BuildOnion(guard.Ep, path, data,
+		onion.WithExtensions(onion.GuardDeliverExtension(token, kind)),
+	)
+	if err != nil {
+		connLog(conn).With("next_hop", guard.Ep.String()).Warnf("Failed to build onion for guard: %v", err)
+		return
+	}
+
+	sendOnion(layer, []identity.Endpoint{guard.Ep}, 1, 0, nil, s, conn)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/service"
+)
+
+func TestExpiringMap(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	m := newExpiringMap[int, string]()
+
+	if err := m.put(1, "a", now.Add(time.Second), now); err != nil {
+		t.Fatalf("put() failed: %v", err)
+	}
+	if v, ok := m.get(1, now); !ok || v != "a" {
+		t.Fatalf("get() = %q, %v; want a, true", v, ok)
+	}
+	if _, ok := m.get(1, now.Add(time.Second)); ok {
+		t.Fatal("expired entry returned")
+	}
+
+	if err := m.put(2, "b", now.Add(time.Second), now); err != nil {
+		t.Fatalf("put() failed: %v", err)
+	}
+	if v, ok := m.take(2, now); !ok || v != "b" {
+		t.Fatalf("take() = %q, %v; want b, true", v, ok)
+	}
+	if _, ok := m.get(2, now); ok {
+		t.Fatal("taken entry still present")
+	}
+}
+
+func TestExpiringMap_Full(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	m := newExpiringMap[int, int]()
+	for i := range maxServiceEntries {
+		if err := m.put(i, i, now.Add(time.Second), now); err != nil {
+			t.Fatalf("put(%d) failed: %v", i, err)
+		}
+	}
+
+	if err := m.put(-1, 0, now.Add(time.Second), now); err == nil {
+		t.Fatal("expected error on a full map")
+	}
+	if err := m.put(-1, 0, now.Add(2*time.Second), now.Add(time.Second)); err != nil {
+		t.Fatalf("put() after expiry failed: %v", err)
+	}
+}
+
+func TestRendezvousState_registerGuard(t *testing.T) {
+	t.Parallel()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	rs := newRendezvousState()
+	rs.now = func() time.Time { return now }
+
+	service := identity.Endpoint{IP: net.ParseIP("192.0.2.1"), Port: 62700}
+	attacker := identity.Endpoint{IP: net.ParseIP("198.51.100.1"), Port: 62700}
+	register := func(signer ed25519.PrivateKey, ep identity.Endpoint, at time.Time) error {
+		req := &packet.GuardRegister{Token: [16]byte{0xaa}, Port: ep.Port, Time: uint64(at.Unix())}
+		req.Sign(signer)
+		return rs.registerGuard(req, guardEntry{ep: ep, key: req.Key, time: req.Time})
+	}
+
+	if err := register(key, service, now); err != nil {
+		t.Fatalf("first registration refused: %v", err)
+	}
+
+	unsigned := &packet.GuardRegister{Token: [16]byte{0xaa}, Port: attacker.Port, Time: uint64(now.Unix())}
+	if err := rs.registerGuard(unsigned, guardEntry{ep: attacker, time: unsigned.Time}); err == nil {
+		t.Fatal("unsigned registration accepted")
+	}
+	if err := register(other, attacker, now.Add(time.Second)); err == nil {
+		t.Fatal("registration with another key accepted over a live one")
+	}
+	if err := register(key, attacker, now); err == nil {
+		t.Fatal("replayed registration accepted from another address")
+	}
+	if err := register(key, service, now.Add(-guardClockSkew-time.Second)); err == nil {
+		t.Fatal("stale registration accepted")
+	}
+
+	rs.mu.Lock()
+	entry, _ := rs.guards.get([16]byte{0xaa}, now)
+	rs.mu.Unlock()
+	if !sameEndpoint(entry.ep, service) {
+		t.Fatalf("token moved to %s", entry.ep)
+	}
+
+	now = now.Add(time.Minute)
+	if err := register(key, attacker, now); err != nil {
+		t.Fatalf("fresh registration of the service from a new address refused: %v", err)
+	}
+
+	now = now.Add(guardTTL)
+	if err := register(other, attacker, now); err != nil {
+		t.Fatalf("registration after expiry refused: %v", err)
+	}
+}
+
+func drainEvents(c *client.Client) {
+	go func() {
+		for range c.Events() {
+		}
+	}()
+}
+
+func TestRendezvous_EndToEnd(t *testing.T) {
+	guard, guardEp := startTestServer(t)
+	dir, dirEp := startTestServer(t)
+	_, rdvEp := startTestServer(t)
+
+	si, err := identity.LoadServiceIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadServiceIdentity() failed: %v", err)
+	}
+
+	ln, listenEp := listenLocal(t)
+	_ = ln.Close()
+
+	received := make(chan []byte, 1)
+	svcClient := client.New()
+	drainEvents(svcClient)
+	svc := service.New(svcClient, service.Config{
+		Identity: si,
+		Listen:   listenEp,
+		Guard:    identity.Relay{Ep: guardEp},
+		HSDir:    identity.Relay{Ep: dirEp},
+		Intro:    []identity.Relay{{Ep: dirEp}},
+	}, func(msg []byte) { received <- msg })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = svc.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		svcClient.Close()
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		rs := dir.rendezvous()
+		rs.mu.Lock()
+		_, registered := rs.intros.get(serviceKey(si.PublicKey()), rs.now())
+		rs.mu.Unlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("service never registered: %s", dir.Metrics())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c := client.New(client.WithHSDir(dirEp))
+	drainEvents(c)
+	defer c.Close()
+
+	rdv := identity.Relay{Ep: rdvEp}
+	if err := c.RetrieveRelayIdentity(&rdv); err != nil {
+		t.Fatalf("RetrieveRelayIdentity() failed: %v", err)
+	}
+	path := []identity.CryptoGroup{{Group: identity.RelayGroup{Relays: []identity.Relay{rdv}}}}
+
+	if err := c.SendToService(svc.Address(), path, []byte("hello hidden service")); err != nil {
+		t.Fatalf("SendToService() failed: %v", err)
+	}
+
+	select {
+	case msg := <-received:
+		if string(msg) != "hello hidden service" {
+			t.Fatalf("received %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("message never reached the service: dir=%s guard=%s", dir.Metrics(), guard.Metrics())
+	}
+}
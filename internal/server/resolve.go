@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+)
+
+const (
+	// DefaultResolveTimeout bounds the lookup of a domain destination.
+	DefaultResolveTimeout = 5 * time.Second
+	// DefaultResolveConcurrency bounds the lookups in flight. They run
+	// outside the worker pool, so that a slow resolver does not hold up the
+	// packets relayed meanwhile.
+	DefaultResolveConcurrency = 64
+)
+
+// Resolver looks up the addresses of the domain destinations reaching the
+// server as exit. *net.Resolver implements it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+func (s *Server) resolver() Resolver {
+	if s.dns == nil {
+		return net.DefaultResolver
+	}
+	return s.dns
+}
+
+func (s *Server) initResolve() {
+	s.resolving = make(chan struct{}, DefaultResolveConcurrency)
+	s.resolveCtx, s.cancelResolve = context.WithCancel(context.Background())
+}
+
+// whenResolved runs deliver, on a goroutine of its own when dest is a domain
+// to resolve first. The payload is dropped when DefaultResolveConcurrency
+// lookups are already in flight. The context given to deliver is cancelled
+// when the server closes, which waits for the goroutine.
+func (s *Server) whenResolved(dest identity.Endpoint, conn net.Conn, deliver func(ctx context.Context)) {
+	s.resolveOnce.Do(s.initResolve)
+	if !dest.IsDomain() {
+		deliver(s.resolveCtx)
+		return
+	}
+
+	select {
+	case s.resolving <- struct{}{}:
+	default:
+		s.metrics.ResolveFailed.Add(1)
+		connLog(conn).With("next_hop", dest.String()).Warnf("Too many destinations being resolved, payload dropped")
+		return
+	}
+	s.resolveWG.Go(func() {
+		defer func() { <-s.resolving }()
+		deliver(s.resolveCtx)
+	})
+}
+
+// resolve returns dest with its domain replaced by the first of its
+// addresses the exit policy allows or, when it allows none, by the first one
+// for the policy to reject.
+func (s *Server) resolve(ctx context.Context, dest identity.Endpoint) (identity.Endpoint, error) {
+	timeout := s.dnsTimeout
+	if timeout == 0 {
+		timeout = DefaultResolveTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addrs, err := s.resolver().LookupNetIP(ctx, "ip", dest.Host)
+	if err != nil {
+		// The errors of net.Resolver name the domain, kept out of the logs.
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return identity.Endpoint{}, errors.New(dnsErr.Err)
+		}
+		return identity.Endpoint{}, err
+	}
+	if len(addrs) == 0 {
+		return identity.Endpoint{}, fmt.Errorf("no address")
+	}
+
+	policy := s.exitPolicy()
+	var out identity.Endpoint
+	for i, addr := range addrs {
+		ep := identity.Endpoint{IP: net.IP(addr.Unmap().AsSlice()), Port: dest.Port}
+		if i == 0 {
+			out = ep
+		}
+		if policy.Allows(ep) {
+			return ep, nil
+		}
+	}
+	return out, nil
+}
@@ -8,7 +8,10 @@ import (
 	"time"
 
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/logger"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
 	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
 )
 
 type Server struct {
@@ -17,12 +20,160 @@ type Server struct {
 	ep identity.Endpoint
 	Pi *identity.PrivateIdentity
 
+	registry  *packet.Registry
+	handshake *handshake.Config
+
+	limiter *limiter
+	metrics Metrics
+	pool    *workerPool
+	mix     MixConfig
+	mixer   mixer
+	cover   CoverConfig
+	links   coverLinks // nil without cover traffic
+	dedup   *dedupCache
+	deliver DeliverFunc
+	exit    *identity.ExitPolicy
+	dns     Resolver
+
+	dnsTimeout    time.Duration // DefaultResolveTimeout when 0
+	resolveOnce   sync.Once
+	resolving     chan struct{} // one per lookup in flight
+	resolveCtx    context.Context
+	cancelResolve context.CancelFunc // on close
+	resolveWG     sync.WaitGroup
+
+	untaggedSlots bool
+
+	listener transport.Listener
+	dialer   transport.Dialer
+
+	sharesOnce sync.Once
+	shares     *reassembler
+
+	rendezvousOnce  sync.Once
+	rendezvousState *rendezvousState
+
+	kemKeysOnce sync.Once
+	kemKeys     *kemKeyCache
+
+	workers   int
+	queueSize int
+
+	hmu         sync.RWMutex
+	handlers    map[uint8]HandlerFunc
+	middlewares []Middleware
+	chain       map[uint8]HandlerFunc // handlers wrapped in middlewares
+
 	wg       sync.WaitGroup
 	stop     chan struct{}
 	stopOnce sync.Once
 }
 
-func New(addr, idDir string, port uint16) (*Server, error) {
+type Option func(*Server)
+
+// WithRegistry sets the packet registry used to decode inbound packets and to
+// encode outbound ones. Defaults to packet.DefaultRegistry.
+func WithRegistry(reg *packet.Registry) Option {
+	return func(s *Server) {
+		s.registry = reg
+	}
+}
+
+// WithHandshake sets the protocol versions and capabilities accepted from
+// peers. Defaults to handshake.DefaultConfig().
+func WithHandshake(cfg handshake.Config) Option {
+	return func(s *Server) {
+		s.handshake = &cfg
+	}
+}
+
+// WithLimits enables connection caps, per-source packet rate limiting and
+// the global in-flight handler bound.
+func WithLimits(l Limits) Option {
+	return func(s *Server) {
+		s.limiter = newLimiter(l)
+	}
+}
+
+// WithWorkers sets the size of the pool processing onion packets and the
+// length of its queue. Reads stop while the queue is full.
+func WithWorkers(workers, queueSize int) Option {
+	return func(s *Server) {
+		s.workers, s.queueSize = workers, queueSize
+	}
+}
+
+// WithMix makes the server hold relayed packets in a mix before forwarding
+// them. Disabled by default.
+func WithMix(cfg MixConfig) Option {
+	return func(s *Server) {
+		s.mix = cfg
+	}
+}
+
+// WithDedup sets how many onion layers are remembered, and for how long, to
+// drop the copies of a layer sent in parallel. A zero size disables it.
+func WithDedup(size int, ttl time.Duration) Option {
+	return func(s *Server) {
+		s.dedup = newDedupCache(size, ttl)
+	}
+}
+
+// WithListener sets how the server listens on its endpoint. Defaults to TCP.
+func WithListener(l transport.Listener) Option {
+	return func(s *Server) {
+		s.listener = l
+	}
+}
+
+// WithDialer sets how the server connects to other relays and destinations.
+// Defaults to TCP.
+func WithDialer(d transport.Dialer) Option {
+	return func(s *Server) {
+		s.dialer = d
+	}
+}
+
+// DeliverFunc receives the payloads reaching this relay as the exit of their
+// route, along with the destination they are addressed to, domains resolved.
+type DeliverFunc func(dest identity.Endpoint, payload []byte)
+
+// WithDeliver sets the function the exit payloads are handed to. By default
+// they are only logged.
+func WithDeliver(fn DeliverFunc) Option {
+	return func(s *Server) {
+		s.deliver = fn
+	}
+}
+
+// WithExitPolicy sets the destinations the server delivers exit payloads
+// to. Defaults to identity.DefaultExitPolicy(), which rejects private
+// addresses.
+func WithExitPolicy(p identity.ExitPolicy) Option {
+	return func(s *Server) {
+		s.exit = &p
+	}
+}
+
+// WithResolver sets how the domain destinations are resolved. Defaults to
+// net.DefaultResolver, the resolver of the system.
+func WithResolver(r Resolver) Option {
+	return func(s *Server) {
+		s.dns = r
+	}
+}
+
+// WithUntaggedSlots makes the server also accept the classic layers built
+// before wrapped key slots were tagged, by opening each of their slots when
+// none carries the tag of the relay. Off by default, since any layer not
+// meant for the relay then costs a decryption per slot.
+func WithUntaggedSlots() Option {
+	return func(s *Server) {
+		s.untaggedSlots = true
+	}
+}
+
+func New(addr, idDir string, port uint16, opts ...Option) (*Server, error) {
 	ep, err := identity.NewEndpoint(addr, port)
 	if err != nil {
 		return nil, err
@@ -33,21 +184,115 @@ func New(addr, idDir string, port uint16) (*Server, error) {
 		return nil, err
 	}
 
-	ln, err := net.Listen(ep.Network(), ep.String())
+	s := &Server{
+		ep: ep,
+		Pi: pi,
+
+		stop: make(chan struct{}),
+
+		workers:   DefaultWorkers(),
+		queueSize: 4 * DefaultWorkers(),
+
+		dedup: newDedupCache(DefaultDedupSize, DefaultDedupTTL),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.listener == nil {
+		s.listener = transport.TCP{}
+	}
+	ln, err := s.listener.Listen(ep)
+	if err != nil {
+		return nil, err
+	}
+	s.ln = ln
+
+	logger.Debugf("New server listening on %s (%s).", ln.Addr(), ln.Addr().Network())
+
+	if err := s.cover.validate(); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if s.cover.enabled() {
+		s.links = newCoverLinks(s.cover.Peers)
+	}
+
+	s.mixer, err = newMixer(s.mix)
 	if err != nil {
+		_ = ln.Close()
 		return nil, err
 	}
+	if s.mixer != nil {
+		logger.Infof("Mix mode enabled (%s).", s.mix.Mode)
+	}
 
-	logger.Debugf("New server listening on %s (%s).", ep.String(), ep.Network())
+	s.pool = newWorkerPool(s.workers, s.queueSize)
 
-	return &Server{
-		ln: ln,
+	return s, nil
+}
 
-		ep: ep,
-		Pi: pi,
+func (s *Server) packets() *packet.Registry {
+	if s.registry == nil {
+		return packet.DefaultRegistry
+	}
+	return s.registry
+}
 
-		stop: make(chan struct{}),
-	}, nil
+func (s *Server) exitPolicy() identity.ExitPolicy {
+	if s.exit == nil {
+		return identity.DefaultExitPolicy()
+	}
+	return *s.exit
+}
+
+// Metrics returns a snapshot of the server counters.
+func (s *Server) Metrics() MetricsSnapshot {
+	return s.metrics.Snapshot()
+}
+
+func (s *Server) reassembly() *reassembler {
+	s.sharesOnce.Do(func() {
+		s.shares = newReassembler()
+	})
+	return s.shares
+}
+
+func (s *Server) rendezvous() *rendezvousState {
+	s.rendezvousOnce.Do(func() {
+		s.rendezvousState = newRendezvousState()
+	})
+	return s.rendezvousState
+}
+
+func (s *Server) nextHopKEMKeys() *kemKeyCache {
+	s.kemKeysOnce.Do(func() {
+		s.kemKeys = newKEMKeyCache(DefaultKEMKeyCacheSize, DefaultKEMKeyTTL)
+	})
+	return s.kemKeys
+}
+
+func (s *Server) handshakeConfig() handshake.Config {
+	cfg := handshake.DefaultConfig()
+	if s.handshake != nil {
+		cfg = *s.handshake
+	}
+	// Hybrid onions cannot be opened without an ML-KEM key.
+	if s.Pi == nil || s.Pi.KEM == nil {
+		cfg.Capabilities &^= handshake.CapHybrid
+	}
+	return cfg
+}
+
+func (s *Server) transport() *transport.Transport {
+	opts := []transport.Option{
+		transport.WithRegistry(s.packets()),
+		transport.WithHandshake(s.handshakeConfig()),
+	}
+	if s.dialer != nil {
+		opts = append(opts, transport.WithDialer(s.dialer))
+	}
+	return transport.NewTransport(opts...)
 }
 
 func (s *Server) Serve(ctx context.Context) error {
@@ -55,6 +300,13 @@ func (s *Server) Serve(ctx context.Context) error {
 
 	errCh := make(chan error, 1)
 
+	if s.cover.enabled() {
+		logger.Infof("Cover traffic enabled (loop=%g/s drop=%g/s hops=%d).",
+			s.cover.LoopRate, s.cover.DropRate, s.cover.Hops,
+		)
+		s.wg.Go(s.runCover)
+	}
+
 	s.wg.Go(func() {
 		for {
 			conn, err := s.ln.Accept()
@@ -76,7 +328,23 @@ func (s *Server) Serve(ctx context.Context) error {
 				}
 			}
 
+			release, err := s.limiter.acquireConn(conn.RemoteAddr())
+			if err != nil {
+				log := logger.With("remote", conn.RemoteAddr().String())
+				if errors.Is(err, errTooManyConnsPerSource) {
+					s.metrics.ConnsRejectedSource.Add(1)
+					s.warnDropped(log)
+				} else {
+					s.metrics.ConnsRejectedGlobal.Add(1)
+				}
+				log.Debugf("connection rejected: %v", err)
+				_ = conn.Close()
+				continue
+			}
+			s.metrics.ConnsAccepted.Add(1)
+
 			s.wg.Go(func() {
+				defer release()
 				s.handleConn(conn)
 			})
 		}
@@ -103,7 +371,17 @@ func (s *Server) close() error {
 			err = s.ln.Close()
 		}
 		s.wg.Wait()
+		if s.pool != nil {
+			s.pool.close()
+		}
+		// Deliveries waiting for a lookup may still queue packets in the mix.
+		s.resolveOnce.Do(s.initResolve)
+		s.cancelResolve()
+		s.resolveWG.Wait()
+		if s.mixer != nil {
+			s.mixer.close()
+		}
 	})
-	logger.Infof("Server closed.")
+	logger.Infof("Server closed. Metrics: %s", s.Metrics())
 	return err
 }
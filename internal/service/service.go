@@ -0,0 +1,251 @@
+// Package service hosts a hidden service reachable through its .dor address.
+//
+// The service registers a token at its guard relay, the only relay learning
+// its address, then publishes its descriptor and its introduction points
+// through onions. Introductions and messages reach it through the guard.
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/handshake"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/onion"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/packet"
+)
+
+const (
+	// DefaultRefresh is how often registrations are renewed, well within
+	// what relays keep them.
+	DefaultRefresh = 5 * time.Minute
+	// DescriptorLifetime is the validity of published descriptors.
+	DescriptorLifetime = time.Hour
+)
+
+type Config struct {
+	Identity *identity.ServiceIdentity
+
+	Listen identity.Endpoint // where the guard hands data over
+	Guard  identity.Relay
+	HSDir  identity.Relay
+	Intro  []identity.Relay
+
+	// Path holds the groups crossed by the onions of the service before
+	// their target relay. It may be empty.
+	Path []identity.RelayGroup
+
+	Refresh time.Duration
+}
+
+// Handler is called with every message received by the service.
+type Handler func(msg []byte)
+
+type Service struct {
+	c       *client.Client
+	cfg     Config
+	handler Handler
+	token   [16]byte
+
+	wg sync.WaitGroup
+}
+
+func New(c *client.Client, cfg Config, h Handler) *Service {
+	s := &Service{c: c, cfg: cfg, handler: h}
+	_, _ = rand.Read(s.token[:]) // never fails since Go 1.24
+	return s
+}
+
+func (s *Service) Address() string {
+	return s.cfg.Identity.Address()
+}
+
+// Run resolves the relays of the configuration, then serves until ctx is
+// done, renewing the registrations of the service.
+func (s *Service) Run(ctx context.Context) error {
+	if len(s.cfg.Intro) == 0 || len(s.cfg.Intro) > identity.MaxIntroPoints {
+		return fmt.Errorf("service needs 1 to %d introduction relays", identity.MaxIntroPoints)
+	}
+	if err := s.resolve(); err != nil {
+		return err
+	}
+
+	ln, err := s.c.Listen(s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	// Connections are drained before returning, so that the client can be
+	// closed once Run is done.
+	s.wg.Go(func() { s.serve(ln) })
+	defer func() {
+		_ = ln.Close()
+		s.wg.Wait()
+	}()
+
+	refresh := s.cfg.Refresh
+	if refresh <= 0 {
+		refresh = DefaultRefresh
+	}
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		if err := s.register(); err != nil {
+			s.c.EmitLog(fmt.Sprintf("registration failed: %v", err))
+		} else {
+			s.c.EmitLog(fmt.Sprintf("service %s registered", s.Address()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) resolve() error {
+	relays := []*identity.Relay{&s.cfg.Guard, &s.cfg.HSDir}
+	for i := range s.cfg.Intro {
+		relays = append(relays, &s.cfg.Intro[i])
+	}
+	for gi := range s.cfg.Path {
+		for ri := range s.cfg.Path[gi].Relays {
+			relays = append(relays, &s.cfg.Path[gi].Relays[ri])
+		}
+	}
+
+	for _, r := range relays {
+		if err := s.c.RetrieveRelayIdentity(r); err != nil {
+			return fmt.Errorf("relay %s: %w", r.Ep.String(), err)
+		}
+	}
+	return nil
+}
+
+// register renews the token at the guard, the descriptor and the
+// introduction points.
+func (s *Service) register() error {
+	reg := &packet.GuardRegister{Token: s.token, Port: s.cfg.Listen.Port, Time: uint64(time.Now().Unix())}
+	reg.Sign(s.cfg.Identity.SignKey)
+	if err := s.c.SendPacket(s.cfg.Guard.Ep, reg); err != nil {
+		return fmt.Errorf("guard %s: %w", s.cfg.Guard.Ep.String(), err)
+	}
+
+	desc := identity.ServiceDescriptor{
+		EncKey:  s.cfg.Identity.EncPub,
+		Expires: time.Now().Add(DescriptorLifetime).Truncate(time.Second),
+		Intro:   s.cfg.Intro,
+	}
+	if err := desc.Sign(s.cfg.Identity); err != nil {
+		return err
+	}
+	ext, err := onion.ServicePublishExtension(desc)
+	if err != nil {
+		return err
+	}
+	if err := s.send(s.cfg.HSDir, nil, ext); err != nil {
+		return fmt.Errorf("descriptor directory %s: %w", s.cfg.HSDir.Ep.String(), err)
+	}
+
+	registered := 0
+	for _, ip := range s.cfg.Intro {
+		r := onion.IntroRegistration{Token: s.token, Guard: s.cfg.Guard}
+		if err := r.Sign(s.cfg.Identity, ip.UUID); err != nil {
+			return err
+		}
+		ext, err := r.Extension()
+		if err != nil {
+			return err
+		}
+		if err := s.send(ip, nil, ext); err != nil {
+			s.c.EmitLog(fmt.Sprintf("introduction relay %s: %v", ip.Ep.String(), err))
+			continue
+		}
+		registered++
+	}
+	if registered == 0 {
+		return fmt.Errorf("no introduction relay reachable")
+	}
+	return nil
+}
+
+func (s *Service) send(target identity.Relay, payload []byte, ext onion.Extension) error {
+	path, err := client.PathTo(s.cfg.Path, target)
+	if err != nil {
+		return err
+	}
+	return s.c.SendExtension(path, payload, ext)
+}
+
+func (s *Service) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Go(func() { s.handleConn(conn) })
+	}
+}
+
+func (s *Service) handleConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	cfg := handshake.DefaultConfig()
+	_, p, err := handshake.Accept(conn, packet.DefaultRegistry, cfg)
+	if err != nil {
+		return
+	}
+	if p == nil {
+		if err := conn.SetReadDeadline(time.Now().Add(cfg.Timeout)); err != nil {
+			return
+		}
+		if p, err = packet.ReadPacket(packet.DefaultRegistry, conn); err != nil {
+			return
+		}
+	}
+	data, ok := p.(*packet.ServiceData)
+	if !ok || data.Token != s.token {
+		return
+	}
+
+	if err := s.handleData(data); err != nil {
+		s.c.EmitLog(err.Error())
+	}
+}
+
+func (s *Service) handleData(data *packet.ServiceData) error {
+	plain, err := onion.Open(s.cfg.Identity.EncPriv, data.Data)
+	if err != nil {
+		return fmt.Errorf("failed to open service data: %w", err)
+	}
+
+	switch data.Kind {
+	case onion.ServiceDataIntroduce:
+		in, err := onion.ParseIntroduction(plain)
+		if err != nil {
+			return err
+		}
+		join := onion.RendezvousJoin{Cookie: in.Cookie, Token: s.token, Guard: s.cfg.Guard}
+		ext, err := join.Extension()
+		if err != nil {
+			return err
+		}
+		if err := s.send(in.Rendezvous, nil, ext); err != nil {
+			return fmt.Errorf("failed to join rendezvous relay %s: %w", in.Rendezvous.Ep.String(), err)
+		}
+		s.c.EmitLog(fmt.Sprintf("joined rendezvous %x", in.Cookie[:4]))
+	case onion.ServiceDataMessage:
+		if s.handler != nil {
+			s.handler(plain)
+		}
+	default:
+		return fmt.Errorf("unknown service data kind %d", data.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/service"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/testutil/simnet"
+)
+
+const (
+	guard = iota
+	hsdir
+	intro
+	rendezvous
+)
+
+// runService starts a hidden service on n, before any other client, with the
+// relays above as guard, descriptor directory and introduction point, and
+// stops it when the test ends. Received messages are sent on the returned
+// channel.
+func runService(t *testing.T, n *simnet.Network) (*service.Service, <-chan []byte) {
+	t.Helper()
+
+	si, err := identity.LoadServiceIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadServiceIdentity() failed: %v", err)
+	}
+	// The guard hands data over to the address the service registered from,
+	// that of the first client of the network.
+	listen, err := identity.NewEndpoint("10.99.2.1", 40100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []byte, 1)
+	svc := service.New(n.Client(), service.Config{
+		Identity: si,
+		Listen:   listen,
+		Guard:    identity.Relay{Ep: n.Relays[guard].Ep()},
+		HSDir:    identity.Relay{Ep: n.Relays[hsdir].Ep()},
+		Intro:    []identity.Relay{{Ep: n.Relays[intro].Ep()}},
+		Path:     []identity.RelayGroup{{Relays: []identity.Relay{{Ep: n.Relays[rendezvous].Ep()}}}},
+	}, func(msg []byte) { received <- msg })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		if err := svc.Run(ctx); err != nil {
+			t.Errorf("Run() failed: %v", err)
+		}
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return svc, received
+}
+
+// lookup polls the descriptor directory until the service is published.
+func lookup(t *testing.T, c *client.Client, addr string) identity.ServiceDescriptor {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		desc, err := c.LookupService(addr)
+		if err == nil {
+			return desc
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("LookupService() failed: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestService_PublishLookup(t *testing.T) {
+	t.Parallel()
+
+	n := simnet.New(t, 4)
+	svc, _ := runService(t, n)
+
+	c := n.Client(client.WithHSDir(n.Relays[hsdir].Ep()))
+	desc := lookup(t, c, svc.Address())
+
+	if identity.ServiceAddress(desc.Key) != svc.Address() {
+		t.Errorf("descriptor key mismatch: got %s, want %s", identity.ServiceAddress(desc.Key), svc.Address())
+	}
+	if len(desc.Intro) != 1 || desc.Intro[0].UUID != n.Relays[intro].Identity.UUID {
+		t.Errorf("introduction points mismatch: got %v", desc.Intro)
+	}
+	if !desc.Expires.After(time.Now()) {
+		t.Errorf("descriptor already expired at %s", desc.Expires)
+	}
+
+	if _, err := c.LookupService(identity.ServiceAddress(make([]byte, 32))); err == nil {
+		t.Error("lookup of an unpublished service succeeded")
+	}
+}
+
+func TestService_Rendezvous(t *testing.T) {
+	t.Parallel()
+
+	n := simnet.New(t, 4)
+	svc, received := runService(t, n)
+
+	c := n.Client(client.WithHSDir(n.Relays[hsdir].Ep()))
+	lookup(t, c, svc.Address())
+
+	msg := []byte("hello hidden service")
+	if err := c.SendToService(svc.Address(), n.Path([]int{rendezvous}), msg); err != nil {
+		t.Fatalf("SendToService() failed: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, msg) {
+			t.Errorf("message mismatch:\n\tgot:  %q\n\twant: %q", got, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message never reached the service: intro=%s rendezvous=%s guard=%s",
+			n.Relays[intro].Metrics(), n.Relays[rendezvous].Metrics(), n.Relays[guard].Metrics())
+	}
+}
@@ -0,0 +1,78 @@
+package simnet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+)
+
+// ErrDropped is returned when a connection is lost to the link loss rate.
+// Dialing across a partition fails with transport.ErrUnreachable.
+var ErrDropped = errors.New("simnet: connection dropped")
+
+// Link are the conditions of the link between two endpoints, in both
+// directions. Relays send one packet per connection, so they apply to whole
+// packets.
+type Link struct {
+	Latency time.Duration // added to every dial
+	Loss    float64       // probability of a dial failing, in [0, 1]
+}
+
+type linkKey [2]string
+
+func keyOf(a, b identity.Endpoint) linkKey {
+	ka, kb := a.String(), b.String()
+	if ka > kb {
+		ka, kb = kb, ka
+	}
+	return linkKey{ka, kb}
+}
+
+// dialer returns the dial function of the node at from.
+func (n *Network) dialer(from identity.Endpoint) transport.Dialer {
+	return transport.DialFunc(func(to identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+		return n.dial(from, to, timeout)
+	})
+}
+
+// dial applies the conditions of the link between from and to before
+// connecting them.
+func (n *Network) dial(from, to identity.Endpoint, timeout time.Duration) (net.Conn, error) {
+	opErr := func(err error) error {
+		return &net.OpError{
+			Op:     "dial",
+			Net:    "simnet",
+			Source: &net.TCPAddr{IP: from.IP, Port: int(from.Port)},
+			Addr:   &net.TCPAddr{IP: to.IP, Port: int(to.Port)},
+			Err:    err,
+		}
+	}
+
+	n.mu.Lock()
+	link := n.linkLocked(from, to)
+	partitioned := n.partitionedLocked(from, to)
+	lost := link.Loss > 0 && n.rng.Float64() < link.Loss
+	n.mu.Unlock()
+
+	if link.Latency > 0 {
+		if timeout > 0 && link.Latency >= timeout {
+			time.Sleep(timeout)
+			return nil, opErr(os.ErrDeadlineExceeded)
+		}
+		time.Sleep(link.Latency)
+		timeout -= link.Latency
+	}
+
+	switch {
+	case partitioned:
+		return nil, opErr(transport.ErrUnreachable)
+	case lost:
+		n.dropped.Add(1)
+		return nil, opErr(ErrDropped)
+	}
+	return n.mem.From(from).Dial(to, timeout)
+}
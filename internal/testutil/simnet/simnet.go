@@ -0,0 +1,342 @@
+// Package simnet runs relays in-process on an in-memory network, for
+// multi-relay integration tests under go test. Links between nodes can be
+// given latency and loss, and nodes can be partitioned from each other.
+package simnet
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/server"
+)
+
+const (
+	relayPort  = 62503
+	destPort   = 8080
+	clientPort = 40000
+)
+
+// Relay is a relay of the network.
+type Relay struct {
+	*server.Server
+
+	// Identity is the public identity of the relay, as a client retrieves it.
+	Identity identity.Relay
+	Dir      string // holding the private identity files
+}
+
+// Ep returns the endpoint the relay listens on.
+func (r *Relay) Ep() identity.Endpoint {
+	return r.Identity.Ep
+}
+
+// Delivery is a payload handed to a destination by an exit relay.
+type Delivery struct {
+	Exit    identity.Endpoint
+	Payload []byte
+}
+
+// Destination is a stub destination recording the payloads delivered to it.
+type Destination struct {
+	Ep         identity.Endpoint
+	deliveries chan Delivery
+}
+
+// Receive waits up to timeout for the next delivery.
+func (d *Destination) Receive(timeout time.Duration) (Delivery, bool) {
+	select {
+	case dl := <-d.deliveries:
+		return dl, true
+	case <-time.After(timeout):
+		return Delivery{}, false
+	}
+}
+
+type config struct {
+	link       Link
+	seed       uint64
+	serverOpts []server.Option
+}
+
+type Option func(*config)
+
+// WithLink sets the conditions of every link without specific ones.
+func WithLink(l Link) Option {
+	return func(c *config) {
+		c.link = l
+	}
+}
+
+// WithSeed seeds the random source deciding packet loss. Defaults to 1.
+func WithSeed(seed uint64) Option {
+	return func(c *config) {
+		c.seed = seed
+	}
+}
+
+// WithServerOptions adds opts to the options every relay is created with.
+func WithServerOptions(opts ...server.Option) Option {
+	return func(c *config) {
+		c.serverOpts = append(c.serverOpts, opts...)
+	}
+}
+
+// Network is a set of relays, clients and destinations connected in memory.
+type Network struct {
+	tb     testing.TB
+	Relays []*Relay
+
+	mu           sync.Mutex
+	rng          *rand.Rand
+	mem          *transport.Mem
+	defaultLink  Link
+	links        map[linkKey]Link
+	partitions   map[linkKey]bool
+	destinations map[string]*Destination
+	clients      []identity.Endpoint
+
+	dropped atomic.Uint64
+}
+
+// New starts n relays with fresh identities, stopped when the test ends.
+func New(tb testing.TB, n int, opts ...Option) *Network {
+	tb.Helper()
+
+	cfg := config{seed: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	nw := &Network{
+		tb:           tb,
+		rng:          rand.New(rand.NewPCG(cfg.seed, cfg.seed)),
+		mem:          transport.NewMem(),
+		defaultLink:  cfg.link,
+		links:        make(map[linkKey]Link),
+		partitions:   make(map[linkKey]bool),
+		destinations: make(map[string]*Destination),
+	}
+	for i := range n {
+		nw.Relays = append(nw.Relays, nw.startRelay(i, cfg.serverOpts))
+	}
+	return nw
+}
+
+func (n *Network) startRelay(i int, serverOpts []server.Option) *Relay {
+	n.tb.Helper()
+
+	addr := fmt.Sprintf("10.99.0.%d", i+1)
+	ep, err := identity.NewEndpoint(addr, relayPort)
+	if err != nil {
+		n.tb.Fatalf("relay %d: %v", i, err)
+	}
+
+	// The simulated addresses, destinations included, are private ones.
+	exit := identity.DefaultExitPolicy()
+	exit.RejectPrivate = false
+
+	dir := n.tb.TempDir()
+	opts := append([]server.Option{
+		server.WithListener(n.mem),
+		server.WithDialer(n.dialer(ep)),
+		server.WithExitPolicy(exit),
+		server.WithDeliver(func(dest identity.Endpoint, payload []byte) {
+			n.deliver(ep, dest, payload)
+		}),
+	}, serverOpts...)
+
+	s, err := server.New(addr, dir, relayPort, opts...)
+	if err != nil {
+		n.tb.Fatalf("relay %d: %v", i, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx)
+		close(done)
+	}()
+	n.tb.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return &Relay{
+		Server: s,
+		Identity: identity.Relay{
+			Ep:     ep,
+			UUID:   s.Pi.UUID,
+			PubKey: s.Pi.PubKey,
+			KEMKey: s.Pi.KEMKey(),
+		},
+		Dir: dir,
+	}
+}
+
+// Client returns a client on its own endpoint of the network, closed when the
+// test ends. Its events are drained.
+func (n *Network) Client(opts ...client.Option) *client.Client {
+	n.tb.Helper()
+
+	n.mu.Lock()
+	ep, err := identity.NewEndpoint(fmt.Sprintf("10.99.2.%d", len(n.clients)+1), clientPort)
+	if err == nil {
+		n.clients = append(n.clients, ep)
+	}
+	n.mu.Unlock()
+	if err != nil {
+		n.tb.Fatalf("client: %v", err)
+	}
+
+	c := client.New(append([]client.Option{
+		client.WithDialer(n.dialer(ep)),
+		client.WithListener(n.mem),
+	}, opts...)...)
+	go func() {
+		for range c.Events() {
+		}
+	}()
+	n.tb.Cleanup(c.Close)
+	return c
+}
+
+// Destination registers a new stub destination.
+func (n *Network) Destination() *Destination {
+	n.tb.Helper()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr := fmt.Sprintf("10.99.1.%d", len(n.destinations)+1)
+	ep, err := identity.NewEndpoint(addr, destPort)
+	if err != nil {
+		n.tb.Fatalf("destination: %v", err)
+	}
+
+	d := &Destination{Ep: ep, deliveries: make(chan Delivery, 64)}
+	n.destinations[ep.String()] = d
+	return d
+}
+
+// deliver hands payload to dest unless the link from the exit relay is cut,
+// or loses it.
+func (n *Network) deliver(exit, dest identity.Endpoint, payload []byte) {
+	n.mu.Lock()
+	d, ok := n.destinations[dest.String()]
+	link := n.linkLocked(exit, dest)
+	partitioned := n.partitionedLocked(exit, dest)
+	lost := link.Loss > 0 && n.rng.Float64() < link.Loss
+	n.mu.Unlock()
+	if !ok || partitioned {
+		return
+	}
+	if lost {
+		n.dropped.Add(1)
+		return
+	}
+
+	dl := Delivery{Exit: exit, Payload: append([]byte(nil), payload...)}
+	select {
+	case d.deliveries <- dl:
+	default:
+		n.tb.Errorf("destination %s: delivery buffer full", dest.String())
+	}
+}
+
+// Path returns a path with fresh crypto material whose groups are made of the
+// relays at the given indices.
+func (n *Network) Path(groups ...[]int) []identity.CryptoGroup {
+	n.tb.Helper()
+
+	path := make([]identity.CryptoGroup, len(groups))
+	for i, idx := range groups {
+		for _, j := range idx {
+			path[i].Group.Relays = append(path[i].Group.Relays, n.Relays[j].Identity)
+		}
+		if err := path[i].GenerateCryptoMaterial(); err != nil {
+			n.tb.Fatalf("path: %v", err)
+		}
+	}
+	return path
+}
+
+// SetLink sets the conditions of the link between a and b.
+func (n *Network) SetLink(a, b identity.Endpoint, l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.links[keyOf(a, b)] = l
+}
+
+func (n *Network) linkLocked(a, b identity.Endpoint) Link {
+	if l, ok := n.links[keyOf(a, b)]; ok {
+		return l
+	}
+	return n.defaultLink
+}
+
+// Partition cuts every link between the endpoints of side and the others,
+// until Heal.
+func (n *Network) Partition(side ...identity.Endpoint) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	in := make(map[string]bool, len(side))
+	for _, ep := range side {
+		in[ep.String()] = true
+	}
+
+	for _, a := range side {
+		for _, b := range n.nodesLocked() {
+			if !in[b.String()] {
+				n.partitions[keyOf(a, b)] = true
+			}
+		}
+	}
+}
+
+// Cut cuts the link between a and b, until Heal.
+func (n *Network) Cut(a, b identity.Endpoint) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partitions[keyOf(a, b)] = true
+}
+
+// Heal restores every link cut by Partition or Cut.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	clear(n.partitions)
+}
+
+func (n *Network) partitionedLocked(a, b identity.Endpoint) bool {
+	return n.partitions[keyOf(a, b)]
+}
+
+// nodesLocked returns the endpoints of the relays, destinations and clients.
+func (n *Network) nodesLocked() []identity.Endpoint {
+	var eps []identity.Endpoint
+	for _, r := range n.Relays {
+		eps = append(eps, r.Ep())
+	}
+	for _, d := range n.destinations {
+		eps = append(eps, d.Ep)
+	}
+	return append(eps, n.clients...)
+}
+
+// Dropped returns how many connections and deliveries were lost to link
+// loss.
+func (n *Network) Dropped() uint64 {
+	return n.dropped.Load()
+}
@@ -0,0 +1,237 @@
+package simnet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/client"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/identity"
+	"github.com/Grolleau-Benjamin/Dynamic_Onion_Routing/internal/protocol/transport"
+)
+
+const deliveryTimeout = 5 * time.Second
+
+func TestNetwork_Delivery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		opts   []client.Option
+		groups [][]int
+	}{
+		{"single relay groups", nil, [][]int{{0}, {1}, {2}}},
+		{"multi relay groups", nil, [][]int{{0, 1}, {2}, {3, 4}}},
+		{"redundancy", []client.Option{client.WithRedundancy(2)}, [][]int{{0, 1}, {2, 3}, {4}}},
+		{"sphinx", []client.Option{client.WithSphinx()}, [][]int{{0}, {1}, {2}}},
+		{"hybrid", []client.Option{client.WithHybridKEM()}, [][]int{{0, 1}, {2}, {3, 4}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			n := New(t, 5)
+			dest := n.Destination()
+			c := n.Client(tt.opts...)
+
+			payload := []byte("hello through the simulated network")
+			if _, err := c.SendMessage(dest.Ep, n.Path(tt.groups...), payload); err != nil {
+				t.Fatalf("SendMessage() failed: %v", err)
+			}
+
+			dl, ok := dest.Receive(deliveryTimeout)
+			if !ok {
+				t.Fatal("payload not delivered")
+			}
+			if !bytes.Equal(dl.Payload, payload) {
+				t.Errorf("payload mismatch:\n\tgot:  %q\n\twant: %q", dl.Payload, payload)
+			}
+
+			exits := tt.groups[len(tt.groups)-1]
+			found := false
+			for _, i := range exits {
+				found = found || dl.Exit.String() == n.Relays[i].Ep().String()
+			}
+			if !found {
+				t.Errorf("delivered by %s, not an exit of the path", dl.Exit)
+			}
+		})
+	}
+}
+
+func TestNetwork_RedundancySingleDelivery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		groups [][]int
+	}{
+		{"multi relay exit", [][]int{{0, 1}, {2, 3}}},
+		{"entry is exit", [][]int{{0, 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			n := New(t, 4)
+			dest := n.Destination()
+			c := n.Client(client.WithRedundancy(2))
+
+			if _, err := c.SendMessage(dest.Ep, n.Path(tt.groups...), []byte("once")); err != nil {
+				t.Fatalf("SendMessage() failed: %v", err)
+			}
+			if _, ok := dest.Receive(deliveryTimeout); !ok {
+				t.Fatal("payload not delivered")
+			}
+			if dl, ok := dest.Receive(500 * time.Millisecond); ok {
+				t.Fatalf("payload delivered twice, again by %s", dl.Exit)
+			}
+		})
+	}
+}
+
+func TestNetwork_Partition(t *testing.T) {
+	t.Parallel()
+
+	n := New(t, 4)
+	dest := n.Destination()
+	c := n.Client()
+
+	// The first relay of the middle group is cut off, the group fails over.
+	n.Partition(n.Relays[1].Ep())
+	if _, err := c.SendMessage(dest.Ep, n.Path([]int{0}, []int{1, 2}, []int{3}), []byte("failover")); err != nil {
+		t.Fatalf("SendMessage() failed: %v", err)
+	}
+	if _, ok := dest.Receive(deliveryTimeout); !ok {
+		t.Fatal("payload not delivered around the partition")
+	}
+
+	// With its only relay cut off, the middle group drops the onion.
+	n.Heal()
+	n.Partition(n.Relays[2].Ep())
+	if _, err := c.SendMessage(dest.Ep, n.Path([]int{0}, []int{2}, []int{3}), []byte("lost")); err != nil {
+		t.Fatalf("SendMessage() failed: %v", err)
+	}
+	if dl, ok := dest.Receive(500 * time.Millisecond); ok {
+		t.Fatalf("payload %q delivered across a partition", dl.Payload)
+	}
+
+	n.Heal()
+	if _, err := c.SendMessage(dest.Ep, n.Path([]int{0}, []int{2}, []int{3}), []byte("healed")); err != nil {
+		t.Fatalf("SendMessage() failed: %v", err)
+	}
+	if _, ok := dest.Receive(deliveryTimeout); !ok {
+		t.Fatal("payload not delivered once healed")
+	}
+}
+
+func TestNetwork_Cut(t *testing.T) {
+	t.Parallel()
+
+	n := New(t, 2)
+	dest := n.Destination()
+	c := n.Client()
+
+	n.Cut(n.Relays[1].Ep(), dest.Ep)
+	if _, err := c.SendMessage(dest.Ep, n.Path([]int{0}, []int{1}), []byte("cut")); err != nil {
+		t.Fatalf("SendMessage() failed: %v", err)
+	}
+	if _, ok := dest.Receive(500 * time.Millisecond); ok {
+		t.Fatal("payload delivered over a cut link")
+	}
+}
+
+func TestNetwork_Loss(t *testing.T) {
+	t.Parallel()
+
+	n := New(t, 2, WithLink(Link{Loss: 1}))
+	dest := n.Destination()
+	c := n.Client()
+
+	_, err := c.SendMessage(dest.Ep, n.Path([]int{0}, []int{1}), []byte("lost"))
+	if err == nil {
+		t.Fatal("SendMessage() succeeded over a lossy link")
+	}
+	if n.Dropped() == 0 {
+		t.Error("no connection dropped")
+	}
+}
+
+func TestNetwork_Latency(t *testing.T) {
+	t.Parallel()
+
+	const latency = 50 * time.Millisecond
+
+	n := New(t, 3)
+	dest := n.Destination()
+	c := n.Client()
+
+	// Only the link between the first two relays is slow.
+	n.SetLink(n.Relays[0].Ep(), n.Relays[1].Ep(), Link{Latency: latency})
+
+	start := time.Now()
+	if _, err := c.SendMessage(dest.Ep, n.Path([]int{0}, []int{1}, []int{2}), []byte("slow")); err != nil {
+		t.Fatalf("SendMessage() failed: %v", err)
+	}
+	if _, ok := dest.Receive(deliveryTimeout); !ok {
+		t.Fatal("payload not delivered")
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("delivered in %v, faster than the link latency %v", elapsed, latency)
+	}
+}
+
+func TestNetwork_dial(t *testing.T) {
+	t.Parallel()
+
+	n := New(t, 1)
+	r := n.Relays[0].Ep()
+	dest := n.Destination()
+
+	if _, err := n.dial(r, dest.Ep, time.Second); !errors.Is(err, transport.ErrUnreachable) {
+		t.Errorf("dial to a non listening endpoint: got %v, want %v", err, transport.ErrUnreachable)
+	}
+
+	n.SetLink(dest.Ep, r, Link{Latency: time.Second})
+	if _, err := n.dial(dest.Ep, r, 10*time.Millisecond); err == nil {
+		t.Error("dial slower than its timeout succeeded")
+	}
+
+	n.SetLink(dest.Ep, r, Link{})
+	conn, err := n.dial(dest.Ep, r, time.Second)
+	if err != nil {
+		t.Fatalf("dial() failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if got, want := conn.RemoteAddr().String(), r.String(); got != want {
+		t.Errorf("remote address mismatch:\n\tgot:  %s\n\twant: %s", got, want)
+	}
+}
+
+func TestNetwork_Acks(t *testing.T) {
+	t.Parallel()
+
+	n := New(t, 3)
+	dest := n.Destination()
+
+	listen, err := identity.NewEndpoint("10.99.3.1", 9000)
+	if err != nil {
+		t.Fatalf("NewEndpoint() failed: %v", err)
+	}
+	c := n.Client(client.WithAcks(client.AckConfig{Listen: listen, Timeout: deliveryTimeout}))
+
+	d, err := c.SendMessage(dest.Ep, n.Path([]int{0}, []int{1}, []int{2}), []byte("acked"))
+	if err != nil {
+		t.Fatalf("SendMessage() failed: %v", err)
+	}
+	if d.Status != client.StatusDelivered {
+		t.Errorf("delivery status mismatch:\n\tgot:  %s\n\twant: %s", d.Status, client.StatusDelivered)
+	}
+	if _, ok := dest.Receive(deliveryTimeout); !ok {
+		t.Fatal("payload not delivered")
+	}
+}
@@ -87,7 +87,8 @@ for i in $(seq 1 $NUM_SERVERS); do
   mkdir -p "$DIR"
   COLOR="${COLORS[$(( (i-1) % ${#COLORS[@]} ))]}"
 
-  CMD="$BINARY_NAME --id-dir=$DIR --port=$PORT $SERVER_ARGS"
+  # The relays are local, and so is the destination of the README example.
+  CMD="$BINARY_NAME --id-dir=$DIR --port=$PORT --exit-allow-private $SERVER_ARGS"
 
   if [ "$USE_CONSOLE" = true ]; then
     echo -e "${COLOR}[START] Server on port $PORT${RESET}"
@@ -95,7 +96,7 @@ for i in $(seq 1 $NUM_SERVERS); do
         echo -e "${COLOR}[${PORT}]${RESET} $line"
       done &
   else
-    $CMD > "$LOGDIR/server_$PORT.log" 2>&1 &
+    $CMD --log-file="$LOGDIR/server_$PORT.log" > /dev/null &
   fi
 done
 
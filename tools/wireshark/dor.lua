@@ -7,17 +7,42 @@ dor_proto.prefs.ports = Pref.string("TCP Ports", "62503,62504,62505,62506,62507,
 local PACKET_SIZE = 4096
 local MAX_WRAPPED_KEY = 3
 local WRAPPED_KEY_SIZE = 76
+local KEM_CIPHERTEXT_SIZE = 1088
+local KEM_KEY_SIZE = 1184
+local HYBRID_ENVELOPE_SIZE = KEM_CIPHERTEXT_SIZE + 32 + 16
 
 -- Packet type constants
 local TYPE_GET_IDENTITY_REQUEST = 0x00
 local TYPE_GET_IDENTITY_RESPONSE = 0x01
+local TYPE_HELLO = 0x02
+local TYPE_HELLO_ACK = 0x03
+local TYPE_GET_EXIT_POLICY_REQUEST = 0x06
+local TYPE_GET_EXIT_POLICY_RESPONSE = 0x07
 local TYPE_ONION_PACKET = 0x10
+local TYPE_DELIVERY_ACK = 0x11
+local TYPE_SPHINX_PACKET = 0x12
+local TYPE_HYBRID_ONION_PACKET = 0x13
+local TYPE_SERVICE_LOOKUP_REQUEST = 0x20
+local TYPE_SERVICE_LOOKUP_RESPONSE = 0x21
+local TYPE_GUARD_REGISTER = 0x22
+local TYPE_SERVICE_DATA = 0x23
 
 -- Field definitions
 local f_type = ProtoField.uint8("dor.type", "Packet Type", base.HEX, {
   [TYPE_GET_IDENTITY_REQUEST] = "GetIdentityRequest",
   [TYPE_GET_IDENTITY_RESPONSE] = "GetIdentityResponse",
+  [TYPE_HELLO] = "Hello",
+  [TYPE_HELLO_ACK] = "HelloAck",
+  [TYPE_GET_EXIT_POLICY_REQUEST] = "GetExitPolicyRequest",
+  [TYPE_GET_EXIT_POLICY_RESPONSE] = "GetExitPolicyResponse",
   [TYPE_ONION_PACKET] = "OnionPacket",
+  [TYPE_DELIVERY_ACK] = "DeliveryAck",
+  [TYPE_SPHINX_PACKET] = "SphinxPacket",
+  [TYPE_HYBRID_ONION_PACKET] = "HybridOnionPacket",
+  [TYPE_SERVICE_LOOKUP_REQUEST] = "ServiceLookupRequest",
+  [TYPE_SERVICE_LOOKUP_RESPONSE] = "ServiceLookupResponse",
+  [TYPE_GUARD_REGISTER] = "GuardRegister",
+  [TYPE_SERVICE_DATA] = "ServiceData",
 })
 local f_len = ProtoField.uint16("dor.length", "Payload Length", base.DEC)
 local f_payload = ProtoField.bytes("dor.payload", "Payload")
@@ -25,6 +50,36 @@ local f_payload = ProtoField.bytes("dor.payload", "Payload")
 -- Identity fields
 local f_ruuid = ProtoField.bytes("dor.identity.ruuid", "Relay UUID", base.SPACE)
 local f_pubkey = ProtoField.bytes("dor.identity.pubkey", "Public Key", base.SPACE)
+local f_kem_key = ProtoField.bytes("dor.identity.kem_key", "ML-KEM-768 Encapsulation Key", base.SPACE)
+
+-- Exit policy fields
+local f_exit_flags = ProtoField.uint8("dor.exit.flags", "Flags", base.HEX)
+local f_exit_reject_private = ProtoField.bool("dor.exit.flags.reject_private", "Rejects Private Addresses", 8, nil, 0x01)
+local f_exit_ipv4_count = ProtoField.uint16("dor.exit.ipv4_count", "IPv4 Port Ranges", base.DEC)
+local f_exit_ipv6_count = ProtoField.uint16("dor.exit.ipv6_count", "IPv6 Port Ranges", base.DEC)
+local f_exit_port_min = ProtoField.uint16("dor.exit.port_min", "First Port", base.DEC)
+local f_exit_port_max = ProtoField.uint16("dor.exit.port_max", "Last Port", base.DEC)
+
+-- Handshake fields
+local f_hello_min_version = ProtoField.uint8("dor.hello.min_version", "Min Version", base.DEC)
+local f_hello_max_version = ProtoField.uint8("dor.hello.max_version", "Max Version", base.DEC)
+local f_hello_version = ProtoField.uint8("dor.hello.version", "Negotiated Version", base.DEC)
+local f_hello_caps = ProtoField.uint32("dor.hello.capabilities", "Capabilities", base.HEX)
+
+-- Delivery ack fields
+local f_ack_id = ProtoField.bytes("dor.ack.id", "Message ID", base.SPACE)
+local f_ack_tag = ProtoField.bytes("dor.ack.tag", "Tag", base.SPACE)
+
+-- Hidden service fields
+local f_service_key = ProtoField.bytes("dor.service.key", "Service Key", base.SPACE)
+local f_service_descriptor = ProtoField.bytes("dor.service.descriptor", "Descriptor", base.SPACE)
+local f_service_token = ProtoField.bytes("dor.service.token", "Token", base.SPACE)
+local f_service_port = ProtoField.uint16("dor.service.port", "Port", base.DEC)
+local f_service_kind = ProtoField.uint8("dor.service.kind", "Kind", base.DEC, {
+  [1] = "Introduce",
+  [2] = "Message",
+})
+local f_service_data = ProtoField.bytes("dor.service.data", "Sealed Data", base.SPACE)
 
 -- Onion Layer fields
 local f_onion_epk = ProtoField.bytes("dor.onion.epk", "Ephemeral Public Key", base.SPACE)
@@ -36,19 +91,49 @@ local f_onion_payload_nonce = ProtoField.bytes("dor.onion.payload_nonce", "Paylo
 local f_onion_ct_len_xor = ProtoField.uint16("dor.onion.ct_len_xor", "Ciphertext Length (XOR masked)", base.HEX)
 local f_onion_ciphertext = ProtoField.bytes("dor.onion.ciphertext", "Ciphertext + Padding", base.SPACE)
 
+-- Hybrid envelope fields
+local f_hybrid_envelope = ProtoField.bytes("dor.hybrid.envelope", "Hybrid Envelope", base.SPACE)
+local f_hybrid_kem_ciphertext = ProtoField.bytes("dor.hybrid.kem_ciphertext", "ML-KEM Ciphertext", base.SPACE)
+local f_hybrid_sealed_secret = ProtoField.bytes("dor.hybrid.sealed_secret", "Sealed Hybrid Secret", base.SPACE)
+
+-- Sphinx packet fields
+local f_sphinx_alpha = ProtoField.bytes("dor.sphinx.alpha", "Alpha (blinded key)", base.SPACE)
+local f_sphinx_beta = ProtoField.bytes("dor.sphinx.beta", "Beta (routing info)", base.SPACE)
+local f_sphinx_gamma = ProtoField.bytes("dor.sphinx.gamma", "Gamma (header MAC)", base.SPACE)
+local f_sphinx_payload = ProtoField.bytes("dor.sphinx.payload", "Payload", base.SPACE)
+
 dor_proto.fields = {
   f_type, f_len, f_payload,
-  f_ruuid, f_pubkey,
+  f_ruuid, f_pubkey, f_kem_key,
+  f_exit_flags, f_exit_reject_private, f_exit_ipv4_count, f_exit_ipv6_count,
+  f_exit_port_min, f_exit_port_max,
+  f_hello_min_version, f_hello_max_version, f_hello_version, f_hello_caps,
+  f_ack_id, f_ack_tag,
+  f_service_key, f_service_descriptor, f_service_token, f_service_port,
+  f_service_kind, f_service_data,
   f_onion_epk, f_onion_wrapped_keys, f_onion_wk_nonce, f_onion_wk_cipher,
   f_onion_flags, f_onion_payload_nonce, f_onion_ct_len_xor,
-  f_onion_ciphertext
+  f_onion_ciphertext,
+  f_hybrid_envelope, f_hybrid_kem_ciphertext, f_hybrid_sealed_secret,
+  f_sphinx_alpha, f_sphinx_beta, f_sphinx_gamma, f_sphinx_payload
 }
 
 -- Helpers
 local function is_valid_msg_type(t)
   return t == TYPE_GET_IDENTITY_REQUEST or
          t == TYPE_GET_IDENTITY_RESPONSE or
-         t == TYPE_ONION_PACKET
+         t == TYPE_HELLO or
+         t == TYPE_HELLO_ACK or
+         t == TYPE_GET_EXIT_POLICY_REQUEST or
+         t == TYPE_GET_EXIT_POLICY_RESPONSE or
+         t == TYPE_ONION_PACKET or
+         t == TYPE_DELIVERY_ACK or
+         t == TYPE_SPHINX_PACKET or
+         t == TYPE_HYBRID_ONION_PACKET or
+         t == TYPE_SERVICE_LOOKUP_REQUEST or
+         t == TYPE_SERVICE_LOOKUP_RESPONSE or
+         t == TYPE_GUARD_REGISTER or
+         t == TYPE_SERVICE_DATA
 end
 
 -- Dissect GetIdentityRequest (0x00)
@@ -69,19 +154,177 @@ end
 local function dissect_msg_getidentityres(tvb, pinfo, tree, plen)
   tree:set_text("GetIdentityResponse")
 
-  if plen ~= 48 then
+  if plen ~= 48 and plen ~= 48 + KEM_KEY_SIZE then
     tree:add_expert_info(PI_MALFORMED, PI_ERROR,
-      string.format("GetIdentityResponse payload length must be 48, got %d", plen))
+      string.format("GetIdentityResponse payload length must be 48 or %d, got %d", 48 + KEM_KEY_SIZE, plen))
     return false
   end
 
   tree:add(f_ruuid, tvb(0, 16))
   tree:add(f_pubkey, tvb(16, 32))
+  if plen > 48 then
+    tree:add(f_kem_key, tvb(48, KEM_KEY_SIZE))
+  end
 
   pinfo.cols.info = "DOR GetIdentityResponse"
   return true
 end
 
+-- Dissect Hello (0x02)
+local function dissect_msg_hello(tvb, pinfo, tree, plen)
+  tree:set_text("Hello")
+
+  if plen ~= 6 then
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR,
+      string.format("Hello payload length must be 6, got %d", plen))
+    return false
+  end
+
+  tree:add(f_hello_min_version, tvb(0, 1))
+  tree:add(f_hello_max_version, tvb(1, 1))
+  tree:add(f_hello_caps, tvb(2, 4))
+
+  pinfo.cols.info = string.format("DOR Hello (v%d-v%d)", tvb(0, 1):uint(), tvb(1, 1):uint())
+  return true
+end
+
+-- Dissect HelloAck (0x03)
+local function dissect_msg_helloack(tvb, pinfo, tree, plen)
+  tree:set_text("HelloAck")
+
+  if plen ~= 5 then
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR,
+      string.format("HelloAck payload length must be 5, got %d", plen))
+    return false
+  end
+
+  tree:add(f_hello_version, tvb(0, 1))
+  tree:add(f_hello_caps, tvb(1, 4))
+
+  local version = tvb(0, 1):uint()
+  if version == 0 then
+    pinfo.cols.info = "DOR HelloAck (rejected)"
+  else
+    pinfo.cols.info = string.format("DOR HelloAck (v%d)", version)
+  end
+  return true
+end
+
+-- Dissect GetExitPolicyResponse (0x07)
+local function dissect_msg_getexitpolicyres(tvb, pinfo, tree, plen)
+  tree:set_text("GetExitPolicyResponse")
+
+  local flags = tree:add(f_exit_flags, tvb(0, 1))
+  flags:add(f_exit_reject_private, tvb(0, 1))
+
+  local offset = 1
+  for _, family in ipairs({ { "IPv4", f_exit_ipv4_count }, { "IPv6", f_exit_ipv6_count } }) do
+    if plen < offset + 2 then
+      tree:add_expert_info(PI_MALFORMED, PI_ERROR, "GetExitPolicyResponse truncated")
+      return false
+    end
+    local count = tvb(offset, 2):uint()
+    if plen < offset + 2 + 4 * count then
+      tree:add_expert_info(PI_MALFORMED, PI_ERROR,
+        string.format("GetExitPolicyResponse truncated: %d %s ranges announced", count, family[1]))
+      return false
+    end
+
+    local ftree = tree:add(family[2], tvb(offset, 2 + 4 * count))
+    offset = offset + 2
+    for i = 1, count do
+      local lo, hi = tvb(offset, 2):uint(), tvb(offset + 2, 2):uint()
+      local rtree = ftree:add(tvb(offset, 4), string.format("Ports %d-%d", lo, hi))
+      rtree:add(f_exit_port_min, tvb(offset, 2))
+      rtree:add(f_exit_port_max, tvb(offset + 2, 2))
+      offset = offset + 4
+    end
+  end
+
+  if offset ~= plen then
+    tree:add_expert_info(PI_MALFORMED, PI_WARN,
+      string.format("%d trailing bytes after exit policy summary", plen - offset))
+  end
+
+  pinfo.cols.info = "DOR GetExitPolicyResponse"
+  return true
+end
+
+-- Dissect DeliveryAck (0x11)
+local function dissect_msg_deliveryack(tvb, pinfo, tree, plen)
+  tree:set_text("DeliveryAck")
+
+  if plen ~= 32 then
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR,
+      string.format("DeliveryAck payload length must be 32, got %d", plen))
+    return false
+  end
+
+  tree:add(f_ack_id, tvb(0, 16))
+  tree:add(f_ack_tag, tvb(16, 16))
+
+  pinfo.cols.info = string.format("DOR DeliveryAck (%s...)", tvb(0, 4):bytes():tohex())
+  return true
+end
+
+-- Dissect ServiceLookupRequest (0x20)
+local function dissect_msg_servicelookupreq(tvb, pinfo, tree, plen)
+  tree:set_text("ServiceLookupRequest")
+
+  if plen ~= 32 then
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR,
+      string.format("ServiceLookupRequest payload length must be 32, got %d", plen))
+    return false
+  end
+
+  tree:add(f_service_key, tvb(0, 32))
+  pinfo.cols.info = "DOR ServiceLookupRequest"
+  return true
+end
+
+-- Dissect ServiceLookupResponse (0x21)
+local function dissect_msg_servicelookupres(tvb, pinfo, tree, plen)
+  tree:set_text("ServiceLookupResponse")
+  tree:add(f_service_descriptor, tvb(0, plen))
+  pinfo.cols.info = string.format("DOR ServiceLookupResponse (%d bytes)", plen)
+  return true
+end
+
+-- Dissect GuardRegister (0x22)
+local function dissect_msg_guardregister(tvb, pinfo, tree, plen)
+  tree:set_text("GuardRegister")
+
+  if plen ~= 18 then
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR,
+      string.format("GuardRegister payload length must be 18, got %d", plen))
+    return false
+  end
+
+  tree:add(f_service_token, tvb(0, 16))
+  tree:add(f_service_port, tvb(16, 2))
+  pinfo.cols.info = "DOR GuardRegister"
+  return true
+end
+
+-- Dissect ServiceData (0x23)
+local function dissect_msg_servicedata(tvb, pinfo, tree, plen)
+  tree:set_text("ServiceData")
+
+  if plen < 17 then
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR,
+      string.format("ServiceData payload length must be at least 17, got %d", plen))
+    return false
+  end
+
+  tree:add(f_service_token, tvb(0, 16))
+  tree:add(f_service_kind, tvb(16, 1))
+  if plen > 17 then
+    tree:add(f_service_data, tvb(17, plen - 17))
+  end
+  pinfo.cols.info = string.format("DOR ServiceData (%d bytes)", plen - 17)
+  return true
+end
+
 -- Dissect OnionPacket (0x10)
 local function dissect_msg_onionpacket(tvb, pinfo, tree, plen)
   tree:set_text(string.format("OnionPacket (%d bytes)", plen))
@@ -158,6 +401,54 @@ local function dissect_msg_onionpacket(tvb, pinfo, tree, plen)
   return true
 end
 
+-- Dissect HybridOnionPacket (0x13): a hybrid envelope followed by an onion
+-- layer
+local function dissect_msg_hybridonionpacket(tvb, pinfo, tree, plen)
+  if plen < HYBRID_ENVELOPE_SIZE then
+    tree:set_text(string.format("HybridOnionPacket (%d bytes)", plen))
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR, "Truncated: missing Hybrid Envelope")
+    return false
+  end
+
+  local env_tree = tree:add(f_hybrid_envelope, tvb(0, HYBRID_ENVELOPE_SIZE))
+  env_tree:add(f_hybrid_kem_ciphertext, tvb(0, KEM_CIPHERTEXT_SIZE))
+  env_tree:add(f_hybrid_sealed_secret, tvb(KEM_CIPHERTEXT_SIZE, 32 + 16))
+
+  local olen = plen - HYBRID_ENVELOPE_SIZE
+  local otree = tree:add(dor_proto, tvb(HYBRID_ENVELOPE_SIZE, olen), "Onion Layer")
+  local ok = dissect_msg_onionpacket(tvb(HYBRID_ENVELOPE_SIZE, olen):tvb(), pinfo, otree, olen)
+
+  tree:set_text(string.format("HybridOnionPacket (%d bytes)", plen))
+  pinfo.cols.info = string.format("DOR HybridOnionPacket (%d bytes)", plen)
+  return ok
+end
+
+-- Dissect SphinxPacket (0x12)
+local SPHINX_BETA_SIZE = 5 * 52
+local SPHINX_HEADER_SIZE = 32 + SPHINX_BETA_SIZE + 32
+local function dissect_msg_sphinxpacket(tvb, pinfo, tree, plen)
+  tree:set_text(string.format("SphinxPacket (%d bytes)", plen))
+
+  if plen ~= PACKET_SIZE then
+    tree:add_expert_info(PI_MALFORMED, PI_WARN,
+      string.format("SphinxPacket payload length should be %d, got %d", PACKET_SIZE, plen))
+  end
+  if plen < SPHINX_HEADER_SIZE then
+    tree:add_expert_info(PI_MALFORMED, PI_ERROR, "Truncated: missing Sphinx header")
+    return false
+  end
+
+  tree:add(f_sphinx_alpha, tvb(0, 32))
+  tree:add(f_sphinx_beta, tvb(32, SPHINX_BETA_SIZE))
+  tree:add(f_sphinx_gamma, tvb(32 + SPHINX_BETA_SIZE, 32))
+  if plen > SPHINX_HEADER_SIZE then
+    tree:add(f_sphinx_payload, tvb(SPHINX_HEADER_SIZE, plen - SPHINX_HEADER_SIZE))
+  end
+
+  pinfo.cols.info = string.format("DOR SphinxPacket (%d bytes)", plen)
+  return true
+end
+
 local MIN_HDR = 3
 local function dor_get_pdu_len(tvb, pinfo, offset)
   local tvb_len = tvb:len()
@@ -195,8 +486,28 @@ local function dor_dissect_one_pdu(tvb, pinfo, tree)
       dissect_msg_getidentityreq(payload, pinfo, paytree, plen)
     elseif msg_type == TYPE_GET_IDENTITY_RESPONSE then
       dissect_msg_getidentityres(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_HELLO then
+      dissect_msg_hello(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_HELLO_ACK then
+      dissect_msg_helloack(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_GET_EXIT_POLICY_RESPONSE then
+      dissect_msg_getexitpolicyres(payload, pinfo, paytree, plen)
     elseif msg_type == TYPE_ONION_PACKET then
       dissect_msg_onionpacket(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_DELIVERY_ACK then
+      dissect_msg_deliveryack(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_SPHINX_PACKET then
+      dissect_msg_sphinxpacket(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_HYBRID_ONION_PACKET then
+      dissect_msg_hybridonionpacket(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_SERVICE_LOOKUP_REQUEST then
+      dissect_msg_servicelookupreq(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_SERVICE_LOOKUP_RESPONSE then
+      dissect_msg_servicelookupres(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_GUARD_REGISTER then
+      dissect_msg_guardregister(payload, pinfo, paytree, plen)
+    elseif msg_type == TYPE_SERVICE_DATA then
+      dissect_msg_servicedata(payload, pinfo, paytree, plen)
     else
       paytree:set_text(string.format("Unknown packet type 0x%02X", msg_type))
       pinfo.cols.info = string.format("DOR Unknown (0x%02X)", msg_type)
@@ -204,6 +515,10 @@ local function dor_dissect_one_pdu(tvb, pinfo, tree)
   else
     if msg_type == TYPE_GET_IDENTITY_REQUEST then
       dissect_msg_getidentityreq(tvb(3, 0):tvb(), pinfo, subtree, 0)
+    elseif msg_type == TYPE_GET_EXIT_POLICY_REQUEST then
+      pinfo.cols.info = "DOR GetExitPolicyRequest"
+    elseif msg_type == TYPE_SERVICE_LOOKUP_RESPONSE then
+      pinfo.cols.info = "DOR ServiceLookupResponse (not found)"
     else
       pinfo.cols.info = string.format("DOR type 0x%02X (empty)", msg_type)
     end